@@ -3,13 +3,18 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"wanderwell/backend/db"
 	"wanderwell/backend/strava"
+	"wanderwell/backend/tiles"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
@@ -21,6 +26,7 @@ import (
 )
 
 type Server struct {
+	pool         *pgxpool.Pool
 	queries      *db.Queries
 	cacheUpdater *strava.CacheUpdater
 	router       chi.Router
@@ -28,17 +34,40 @@ type Server struct {
 	verifyToken  string
 	tileCacheURL string
 	adminUserID  int64
+	// optional key of the signed tile URLs, see tileQuery
+	tileSigningKey []byte
+	// optional in-process tile cache of GET /tiles, nil if the backend doesn't
+	// serve tiles
+	tileCache *tiles.Cache
+	// background jobs started by handlers, drained on shutdown. Long jobs
+	// run with jobsCtx, which is cancelled on shutdown so that they stop at
+	// the next safe point, e.g. between two activities of a sync.
+	jobs       sync.WaitGroup
+	jobsCtx    context.Context
+	cancelJobs context.CancelFunc
+	// optional Bearer token of the metrics scraper, see getMetrics
+	metricsToken string
+	// result of the last probeStrava check, reported by /readyz
+	stravaReachable atomic.Bool
 }
 
-func NewServer(pool *pgxpool.Pool, cacheUpdater *strava.CacheUpdater, frontendURL string, verifyToken string, tileCacheURL string, adminUserID int64) *Server {
+func NewServer(pool *pgxpool.Pool, cacheUpdater *strava.CacheUpdater, frontendURL string, verifyToken string, tileCacheURL string, adminUserID int64, tileSigningKey string, tileCache *tiles.Cache, metricsToken string) *Server {
 	s := &Server{
-		queries:      db.New(pool),
-		cacheUpdater: cacheUpdater,
-		router:       chi.NewRouter(),
-		frontendURL:  frontendURL,
-		verifyToken:  verifyToken,
-		tileCacheURL: tileCacheURL,
-		adminUserID:  adminUserID,
+		pool:           pool,
+		queries:        db.New(pool),
+		cacheUpdater:   cacheUpdater,
+		router:         chi.NewRouter(),
+		frontendURL:    frontendURL,
+		verifyToken:    verifyToken,
+		tileCacheURL:   tileCacheURL,
+		adminUserID:    adminUserID,
+		tileSigningKey: []byte(tileSigningKey),
+		tileCache:      tileCache,
+		metricsToken:   metricsToken,
+	}
+	s.jobsCtx, s.cancelJobs = context.WithCancel(context.Background())
+	if pool != nil {
+		s.registerPoolMetrics()
 	}
 	s.setupRoutes()
 	return s
@@ -49,27 +78,33 @@ type contextKey string
 
 const userIDKey contextKey = "userID"
 
-// RequireAuth is a middleware that checks for a valid user session
+// RequireAuth is a middleware that checks for a valid user session, or an API
+// token in the Authorization header (see authenticateAPIToken)
 func (s *Server) RequireAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			s.authenticateAPIToken(next, w, r)
+			return
+		}
+
 		session, err := gothic.Store.Get(r, "user-session")
 		if err != nil {
 			slog.Error("Failed to get session", "error", err)
-			http.Error(w, "Invalid session", http.StatusUnauthorized)
+			writeError(w, r, "Invalid session", http.StatusUnauthorized)
 			return
 		}
 
 		userIDRaw, ok := session.Values["user_id"]
 		if !ok {
 			slog.Error("user_id not found in session")
-			http.Error(w, "user_id not found in session", http.StatusUnauthorized)
+			writeError(w, r, "user_id not found in session", http.StatusUnauthorized)
 			return
 		}
 
 		userID, ok := userIDRaw.(int64)
 		if !ok {
 			slog.Error("user_id is not int64", "type", fmt.Sprintf("%T", userIDRaw))
-			http.Error(w, "Invalid user_id type", http.StatusInternalServerError)
+			writeError(w, r, "Invalid user_id type", http.StatusInternalServerError)
 			return
 		}
 
@@ -85,19 +120,19 @@ func (s *Server) RequireAdmin(next http.Handler) http.Handler {
 		// If no admin user is configured, adminUserID will have the int64 default value 0
 		if s.adminUserID == 0 {
 			slog.Warn("Admin endpoint accessed but no admin user configured")
-			http.Error(w, "Forbidden", http.StatusForbidden)
+			writeError(w, r, "Forbidden", http.StatusForbidden)
 			return
 		}
 
 		userID, ok := r.Context().Value(userIDKey).(int64)
 		if !ok {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			writeError(w, r, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		if userID != s.adminUserID {
 			slog.Warn("Non-admin user attempted to access admin endpoint", "userID", userID)
-			http.Error(w, "Forbidden", http.StatusForbidden)
+			writeError(w, r, "Forbidden", http.StatusForbidden)
 			return
 		}
 
@@ -106,21 +141,27 @@ func (s *Server) RequireAdmin(next http.Handler) http.Handler {
 }
 
 func (s *Server) setupRoutes() {
+	// Request IDs for the logs and the error envelope (see writeError)
+	s.router.Use(requestID)
+	s.router.Use(observeRequests)
+
 	// CORS configuration
 	s.router.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{s.frontendURL},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
 	}))
 
-	// Request logging for all routes; skip the high-volume /auth/tiles ForwardAuth endpoint
-	// to avoid log noise and disk usage.
+	// Request logging for all routes; skip the high-volume /auth/tiles ForwardAuth endpoint,
+	// the tiles themselves, the health probes and the metrics scrapes to avoid log noise
+	// and disk usage.
 	s.router.Use(httplog.RequestLogger(slog.Default(), &httplog.Options{
 		Skip: func(req *http.Request, _ int) bool {
-			return req.URL.Path == "/auth/tiles"
+			return req.URL.Path == "/auth/tiles" || strings.HasPrefix(req.URL.Path, "/tiles/") ||
+				req.URL.Path == "/healthz" || req.URL.Path == "/readyz" || req.URL.Path == "/metrics"
 		},
 	}))
 
@@ -131,11 +172,42 @@ func (s *Server) setupRoutes() {
 		r.Get("/preferences", s.getUserPreferences)
 		r.Put("/preferences", s.updateUserPreferences)
 		r.Get("/route_details", s.listRoutesWithoutRouteData)
-		// Dummy endpoint to allow Traefik to verify authentication for tile
-		// requests without needing to duplicate auth logic in the tile service.
-		r.Get("/auth/tiles", func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusOK)
-		})
+		r.Get("/routes", s.listRoutes)
+		r.Get("/routes/search", s.searchRoutes)
+		r.Get("/routes/endpoints", s.getRouteEndpoints)
+		r.Get("/routes/export", s.exportRoutes)
+		r.Get("/routes/{id}", s.getRoute)
+		r.Patch("/routes/{id}", s.updateRoute)
+		r.Get("/routes/{id}/new_ground", s.getRouteNewGround)
+		r.Get("/routes/{id}/export", s.exportRoute)
+		r.Get("/tags", s.listTags)
+		r.Post("/tags", s.createTag)
+		r.Get("/tags/{tag}", s.getTag)
+		r.Patch("/tags/{tag}", s.updateTag)
+		r.Delete("/tags/{tag}", s.deleteTag)
+		r.Post("/tags/{tag}/routes", s.tagRoutes)
+		r.Delete("/tags/{tag}/routes", s.untagRoutes)
+		r.Get("/tags/{tag}/rules", s.listTagRules)
+		r.Post("/tags/{tag}/rules", s.createTagRule)
+		r.Delete("/tags/{tag}/rules/{ruleID}", s.deleteTagRule)
+		r.Get("/shares", s.listShares)
+		r.Post("/shares", s.createShare)
+		r.Delete("/shares/{id}", s.revokeShare)
+		r.Get("/privacy_zones", s.listPrivacyZones)
+		r.Post("/privacy_zones", s.createPrivacyZone)
+		r.Delete("/privacy_zones/{id}", s.deletePrivacyZone)
+		r.Get("/explorer/stats", s.getExplorerStats)
+		r.Get("/explorer/timeline", s.getExplorerTimeline)
+		r.Get("/auth/tile_query", s.getTileQuery)
+	})
+
+	// API token management - require a session, not an API token
+	s.router.Group(func(r chi.Router) {
+		r.Use(s.RequireAuth)
+		r.Use(s.RequireSession)
+		r.Get("/api_tokens", s.listAPITokens)
+		r.Post("/api_tokens", s.createAPIToken)
+		r.Delete("/api_tokens/{id}", s.revokeAPIToken)
 	})
 
 	// Admin-only routes - require authentication and admin privileges
@@ -146,21 +218,104 @@ func (s *Server) setupRoutes() {
 	})
 
 	// Public routes
+	// Allows Traefik to verify tile requests, from a session, a share link or
+	// a signed URL, without needing to duplicate auth logic in the tile service.
+	s.router.Get("/auth/tiles", s.authorizeTiles)
+	// Tiles served by the backend itself instead of Martin, if enabled.
+	if s.tileCache != nil {
+		s.router.Get("/tiles/{layer}", s.getTileJSON)
+		s.router.Get("/tiles/{layer}/{z}/{x}/{y}.mvt", s.getTile)
+	}
+	s.router.Get("/shared/{token}", s.getSharedMap)
+	s.router.Get("/shared/{token}/routes", s.listSharedRoutes)
+	s.router.Get("/profiles/{userID}", s.getPublicProfile)
 	s.router.Get("/start", s.initiateAuthentication)
 	s.router.Get("/user_token_exchange", s.tokenExchange)
 	s.router.Get("/webhook", s.webhookCallbackChallenge)
 	s.router.Post("/webhook", s.webhookCallbackUpdate)
 	s.router.Get("/logout", s.logout)
+	s.router.Get("/openapi.json", s.getOpenAPI)
+	s.router.Get("/healthz", s.getHealth)
+	s.router.Get("/readyz", s.getReadiness)
+	s.router.Get("/metrics", s.getMetrics)
+
+	s.router.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, "Not found", http.StatusNotFound)
+	})
+	s.router.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+	})
 }
 
-func (s *Server) Start(addr string) error {
-	slog.Info("Starting server", "addr", addr)
-	return http.ListenAndServe(addr, s.router)
+// Timeouts of the HTTP server. Exports lift the write timeout, as they can
+// take longer to stream.
+const (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 60 * time.Second
+	idleTimeout       = 120 * time.Second
+	// How long shutdown waits for in-flight requests and then background jobs
+	// like syncs, within the stop_grace_period of docker-compose.yml.
+	shutdownTimeout = 50 * time.Second
+)
+
+// Start serves the API on addr until ctx is cancelled, e.g. on SIGTERM. It then
+// stops accepting connections, waits for the in-flight requests, and cancels
+// the background jobs they started and waits for them to stop, up to
+// shutdownTimeout in total.
+func (s *Server) Start(ctx context.Context, addr string) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           s.router,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+
+	s.jobs.Go(func() { s.probeStrava(s.jobsCtx) })
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Starting server", "addr", addr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down server: %w", err)
+	}
+
+	s.cancelJobs()
+	drained := make(chan struct{})
+	go func() {
+		s.jobs.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		slog.Info("Background jobs drained")
+		return nil
+	case <-shutdownCtx.Done():
+		return errors.New("timed out waiting for background jobs")
+	}
 }
 
-// purgeTileCache sends a BAN request to Vinyl Cache to invalidate all cached tiles for a user.
-// It is a no-op when no tile cache URL is configured.
+// purgeTileCache drops all in-process cached tiles of a user and sends a BAN
+// request to Vinyl Cache to invalidate them there. The BAN is skipped when no
+// tile cache URL is configured.
 func (s *Server) purgeTileCache(userID int64) {
+	if s.tileCache != nil {
+		s.tileCache.InvalidateUser(userID)
+	}
 	if s.tileCacheURL == "" {
 		return
 	}
@@ -171,26 +326,34 @@ func (s *Server) purgeTileCache(userID int64) {
 	}
 	req.Header.Set("X-User-Id", strconv.FormatInt(userID, 10))
 	client := &http.Client{Timeout: 5 * time.Second}
+	start := time.Now()
 	resp, err := client.Do(req)
+	tilePurgeDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		tilePurges.Inc("error")
 		slog.Error("Failed to send tile cache BAN request", "userID", userID, "error", err)
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		tilePurges.Inc("rejected")
+	} else {
+		tilePurges.Inc("ok")
+	}
 	slog.Info("Tile cache ban sent", "userID", userID, "status", resp.Status)
 }
 
 func (s *Server) getCurrentUser(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(userIDKey).(int64)
 	if !ok {
-		http.Error(w, "user_id not found in context", http.StatusUnauthorized)
+		writeError(w, r, "user_id not found in context", http.StatusUnauthorized)
 		return
 	}
 
 	athlete, err := s.queries.GetAthlete(r.Context(), userID)
 	if err != nil {
 		slog.Error("Failed to fetch user", "error", err)
-		http.Error(w, "Failed to fetch user", http.StatusInternalServerError)
+		writeError(w, r, "Failed to fetch user", http.StatusInternalServerError)
 		return
 	}
 
@@ -201,7 +364,7 @@ func (s *Server) getCurrentUser(w http.ResponseWriter, r *http.Request) {
 func (s *Server) listRoutesWithoutRouteData(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(userIDKey).(int64)
 	if !ok {
-		http.Error(w, "user_id not found in context", http.StatusBadRequest)
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
 		return
 	}
 	listRoutesByUser(s.queries, userID)(w, r)
@@ -210,14 +373,14 @@ func (s *Server) listRoutesWithoutRouteData(w http.ResponseWriter, r *http.Reque
 func (s *Server) getUserPreferences(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(userIDKey).(int64)
 	if !ok {
-		http.Error(w, "user_id not found in context", http.StatusBadRequest)
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
 		return
 	}
 
 	preferences, err := s.queries.GetUserPreferences(r.Context(), userID)
 	if err != nil {
 		slog.Error("Failed to fetch user preferences", "userID", userID, "error", err)
-		http.Error(w, "Failed to fetch user preferences", http.StatusInternalServerError)
+		writeError(w, r, "Failed to fetch user preferences", http.StatusInternalServerError)
 		return
 	}
 
@@ -228,64 +391,150 @@ func (s *Server) getUserPreferences(w http.ResponseWriter, r *http.Request) {
 func (s *Server) updateUserPreferences(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(userIDKey).(int64)
 	if !ok {
-		http.Error(w, "user_id not found in context", http.StatusBadRequest)
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
 		return
 	}
 
 	var request struct {
-		WriteUniqueDistance *bool `json:"write_unique_distance"`
+		WriteUniqueDistance      *bool    `json:"write_unique_distance"`
+		NewGroundWindow          *string  `json:"new_ground_window"`
+		NewGroundDays            *int32   `json:"new_ground_days"`
+		NewGroundToleranceMeters *float64 `json:"new_ground_tolerance_meters"`
+		NewGroundSampleMeters    *float64 `json:"new_ground_sample_meters"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	decoder.DisallowUnknownFields()
 	if err := decoder.Decode(&request); err != nil {
 		slog.Error("Failed to decode user preferences update", "userID", userID, "error", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, r, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	if request.WriteUniqueDistance == nil {
-		http.Error(w, "write_unique_distance is required", http.StatusBadRequest)
+
+	current, err := s.queries.GetUserPreferences(r.Context(), userID)
+	if err != nil {
+		slog.Error("Failed to fetch user preferences", "userID", userID, "error", err)
+		writeError(w, r, "Failed to fetch user preferences", http.StatusInternalServerError)
 		return
 	}
 
-	preferences, err := s.queries.UpsertUserPreferences(r.Context(), db.UpsertUserPreferencesParams{
-		UserID:              userID,
-		WriteUniqueDistance: *request.WriteUniqueDistance,
-	})
+	// Fields missing from the request keep their current value.
+	params := db.UpsertUserPreferencesParams{
+		UserID:                   userID,
+		WriteUniqueDistance:      current.WriteUniqueDistance,
+		NewGroundWindow:          current.NewGroundWindow,
+		NewGroundDays:            current.NewGroundDays,
+		NewGroundToleranceMeters: current.NewGroundToleranceMeters,
+		NewGroundSampleMeters:    current.NewGroundSampleMeters,
+	}
+	if request.WriteUniqueDistance != nil {
+		params.WriteUniqueDistance = *request.WriteUniqueDistance
+	}
+	if request.NewGroundWindow != nil {
+		params.NewGroundWindow = *request.NewGroundWindow
+	}
+	if request.NewGroundDays != nil {
+		params.NewGroundDays = *request.NewGroundDays
+	}
+	if request.NewGroundToleranceMeters != nil {
+		params.NewGroundToleranceMeters = *request.NewGroundToleranceMeters
+	}
+	if request.NewGroundSampleMeters != nil {
+		params.NewGroundSampleMeters = *request.NewGroundSampleMeters
+	}
+	if err := validateNewGroundSettings(params); err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	preferences, err := s.queries.UpsertUserPreferences(r.Context(), params)
 	if err != nil {
 		slog.Error("Failed to update user preferences", "userID", userID, "error", err)
-		http.Error(w, "Failed to update user preferences", http.StatusInternalServerError)
+		writeError(w, r, "Failed to update user preferences", http.StatusInternalServerError)
 		return
 	}
 
+	// The stored new ground of every route depends on the settings, so
+	// recompute it in the background when they change.
+	if preferences.NewGroundWindow != current.NewGroundWindow ||
+		preferences.NewGroundDays != current.NewGroundDays ||
+		preferences.NewGroundToleranceMeters != current.NewGroundToleranceMeters ||
+		preferences.NewGroundSampleMeters != current.NewGroundSampleMeters {
+		s.jobs.Go(func() { s.recomputeNewGround(s.jobsCtx, userID) })
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(preferences)
 }
 
+// validateNewGroundSettings checks the new ground settings against the ranges
+// allowed by the user_preferences table.
+func validateNewGroundSettings(p db.UpsertUserPreferencesParams) error {
+	switch p.NewGroundWindow {
+	case "before", "year", "days":
+	default:
+		return fmt.Errorf("invalid new_ground_window: %q, must be one of before, year, days", p.NewGroundWindow)
+	}
+	if p.NewGroundDays < 1 || p.NewGroundDays > 3650 {
+		return fmt.Errorf("invalid new_ground_days: %d, must be between 1 and 3650", p.NewGroundDays)
+	}
+	if p.NewGroundToleranceMeters < 1 || p.NewGroundToleranceMeters > 100 {
+		return fmt.Errorf("invalid new_ground_tolerance_meters: %g, must be between 1 and 100", p.NewGroundToleranceMeters)
+	}
+	if p.NewGroundSampleMeters < 5 || p.NewGroundSampleMeters > 100 {
+		return fmt.Errorf("invalid new_ground_sample_meters: %g, must be between 5 and 100", p.NewGroundSampleMeters)
+	}
+	return nil
+}
+
+// recomputeNewGround recomputes the stored new ground of all routes of a user
+// with their current settings and purges the tile cache. Errors are logged only.
+func (s *Server) recomputeNewGround(ctx context.Context, userID int64) {
+	start := time.Now()
+	err := s.queries.UpsertRouteNewGroundSince(ctx, db.UpsertRouteNewGroundSinceParams{
+		UserID: userID,
+	})
+	observeSync("new_ground", start, err)
+	if err != nil {
+		slog.Error("Failed to recompute new ground", "userID", userID, "error", err)
+		return
+	}
+	s.purgeTileCache(userID)
+}
+
 func (s *Server) updateCacheForUser(w http.ResponseWriter, r *http.Request) {
 	userIDParam := r.URL.Query().Get("user_id")
 	userID, err := strconv.ParseInt(userIDParam, 10, 64)
 	if err != nil {
 		errorMsg := fmt.Sprintf("invalid user_id: %q", userIDParam)
-		http.Error(w, errorMsg, http.StatusBadRequest)
+		writeError(w, r, errorMsg, http.StatusBadRequest)
 		return
 	}
 
 	// start background task to fetch and cache user activities
-	go func() {
-		if err := s.cacheUpdater.UpdateActivityCache(userID); err != nil {
-			slog.Error("Failed to fetch initial activities for user", "userID", userID, "error", err)
-			return
-		}
-		s.purgeTileCache(userID)
-	}()
+	s.jobs.Go(func() { s.syncActivities(s.jobsCtx, userID) })
 	w.WriteHeader(http.StatusOK)
 }
 
+// syncActivities fetches all activities of a user from Strava (see
+// UpdateActivityCache), then refreshes the explorer stats and purges the tile
+// cache. Errors are logged only.
+func (s *Server) syncActivities(ctx context.Context, userID int64) {
+	start := time.Now()
+	err := s.cacheUpdater.UpdateActivityCache(ctx, userID)
+	observeSync("activity_cache", start, err)
+	if err != nil {
+		slog.Error("Failed to fetch initial activities for user", "userID", userID, "error", err)
+		return
+	}
+	s.refreshExplorerStats(ctx, userID)
+	s.purgeTileCache(userID)
+}
+
 func (s *Server) initiateAuthentication(w http.ResponseWriter, r *http.Request) {
 	redirectURL := r.URL.Query().Get("redirect_url")
 	if redirectURL == "" {
-		http.Error(w, "Missing redirect_url parameter", http.StatusBadRequest)
+		writeError(w, r, "Missing redirect_url parameter", http.StatusBadRequest)
 		return
 	}
 
@@ -301,7 +550,7 @@ func (s *Server) tokenExchange(w http.ResponseWriter, r *http.Request) {
 	user, err := gothic.CompleteUserAuth(w, r)
 	if err != nil {
 		slog.Error("Failed to complete user authentication", "error", err)
-		http.Error(w, "Failed to complete user authentication", http.StatusInternalServerError)
+		writeError(w, r, "Failed to complete user authentication", http.StatusInternalServerError)
 		return
 	}
 	slog.Info("User authenticated", "user", user.UserID)
@@ -314,7 +563,7 @@ func (s *Server) tokenExchange(w http.ResponseWriter, r *http.Request) {
 	_, err = s.queries.GetAthlete(r.Context(), userID)
 	if err != nil && err != pgx.ErrNoRows {
 		slog.Error("Failed to look up athlete", "userID", userID, "error", err)
-		http.Error(w, "Failed to load user", http.StatusInternalServerError)
+		writeError(w, r, "Failed to load user", http.StatusInternalServerError)
 		return
 	}
 	isNewUser := err == pgx.ErrNoRows
@@ -330,7 +579,7 @@ func (s *Server) tokenExchange(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if err != nil {
-		http.Error(w, "Failed to save user", http.StatusInternalServerError)
+		writeError(w, r, "Failed to save user", http.StatusInternalServerError)
 		return
 	}
 
@@ -341,7 +590,7 @@ func (s *Server) tokenExchange(w http.ResponseWriter, r *http.Request) {
 	// Get the redirect URL from session
 	redirectURL, ok := session.Values["redirect_url"].(string)
 	if !ok || redirectURL == "" {
-		http.Error(w, "No redirect URL found", http.StatusInternalServerError)
+		writeError(w, r, "No redirect URL found", http.StatusInternalServerError)
 		return
 	}
 
@@ -355,13 +604,7 @@ func (s *Server) tokenExchange(w http.ResponseWriter, r *http.Request) {
 	// Start background task to fetch and cache activities for first-time users only.
 	// Existing users are kept up to date via Strava webhooks.
 	if isNewUser {
-		go func() {
-			if err := s.cacheUpdater.UpdateActivityCache(userID); err != nil {
-				slog.Error("Failed to fetch initial activities for user", "userID", userID, "error", err)
-				return
-			}
-			s.purgeTileCache(userID)
-		}()
+		s.jobs.Go(func() { s.syncActivities(s.jobsCtx, userID) })
 	}
 }
 
@@ -382,7 +625,7 @@ func (s *Server) webhookCallbackChallenge(w http.ResponseWriter, r *http.Request
 			"hub.challenge": challenge,
 		})
 	} else {
-		http.Error(w, "Verification failed", http.StatusForbidden)
+		writeError(w, r, "Verification failed", http.StatusForbidden)
 	}
 }
 
@@ -399,14 +642,16 @@ func (s *Server) webhookCallbackUpdate(w http.ResponseWriter, r *http.Request) {
 
 	// Read the request body
 	if err := json.NewDecoder(r.Body).Decode(&stravaEvent); err != nil {
+		webhookEvents.Inc("", "invalid")
 		slog.Error("Failed to decode webhook event", "error", err)
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, r, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
 	slog.Info("Received Strava webhook event", "object_type", stravaEvent.ObjectType, "aspect_type", stravaEvent.AspectType, "owner_id", stravaEvent.OwnerID, "object_id", stravaEvent.ObjectID)
 	if stravaEvent.ObjectType != "activity" {
 		// We only care about activity events for now
+		webhookEvents.Inc(stravaEvent.AspectType, "ignored")
 		w.WriteHeader(http.StatusOK)
 		return
 	}
@@ -418,26 +663,51 @@ func (s *Server) webhookCallbackUpdate(w http.ResponseWriter, r *http.Request) {
 		// description-only change has nothing meaningful to re-sync.
 		if stravaEvent.AspectType == "update" && len(stravaEvent.Updates) == 1 {
 			if _, onlyDescription := stravaEvent.Updates["description"]; onlyDescription {
+				webhookEvents.Inc(stravaEvent.AspectType, "ignored")
 				slog.Info("Skipping description-only webhook update", "activityID", stravaEvent.ObjectID)
 				w.WriteHeader(http.StatusOK)
 				return
 			}
 		}
 
-		if err := s.cacheUpdater.AddDetailedActivity(stravaEvent.ObjectID, stravaEvent.OwnerID); err != nil {
+		start := time.Now()
+		recomputeSince, err := s.cacheUpdater.AddDetailedActivity(stravaEvent.ObjectID, stravaEvent.OwnerID)
+		observeSync("activity", start, err)
+		if err != nil {
+			webhookEvents.Inc(stravaEvent.AspectType, "failed")
 			slog.Error("Failed to process activity update/create", "activity_id", stravaEvent.ObjectID, "owner_id", stravaEvent.OwnerID, "error", err)
-			http.Error(w, "Failed to process activity", http.StatusInternalServerError)
+			writeError(w, r, "Failed to process activity", http.StatusInternalServerError)
 			return
 		}
 
-		if stravaEvent.AspectType == "create" {
-			go s.cacheUpdater.WriteUniqueDistanceDescription(stravaEvent.ObjectID, stravaEvent.OwnerID)
-		}
-		// Respond to Strava first to avoid webhook retries, then purge cache asynchronously.
+		webhookEvents.Inc(stravaEvent.AspectType, "processed")
+		// Respond to Strava first to avoid webhook retries, then compute the new
+		// ground of the route, write it to the description of new activities and
+		// recompute the new ground of later routes, refresh the explorer stats
+		// and purge the cache asynchronously. Renames and other metadata-only
+		// updates only need the purge.
 		w.WriteHeader(http.StatusOK)
-		go s.purgeTileCache(stravaEvent.OwnerID)
+		s.jobs.Go(func() {
+			if recomputeSince.Valid {
+				start := time.Now()
+				err := s.cacheUpdater.ComputeNewGround(stravaEvent.ObjectID)
+				observeSync("new_ground", start, err)
+				if err != nil {
+					slog.Error("Failed to compute new ground", "activityID", stravaEvent.ObjectID, "error", err)
+				}
+			}
+			if stravaEvent.AspectType == "create" {
+				s.cacheUpdater.WriteUniqueDistanceDescription(stravaEvent.ObjectID, stravaEvent.OwnerID)
+			}
+			if recomputeSince.Valid {
+				s.refreshRoutesSince(s.jobsCtx, stravaEvent.OwnerID, recomputeSince)
+			} else {
+				s.purgeTileCache(stravaEvent.OwnerID)
+			}
+		})
 		return
 	} else {
+		webhookEvents.Inc(stravaEvent.AspectType, "ignored")
 		slog.Info("Unhandled aspect type in webhook event", "aspect_type", stravaEvent.AspectType)
 		w.WriteHeader(http.StatusOK)
 	}
@@ -447,14 +717,15 @@ func (s *Server) webhookCallbackUpdate(w http.ResponseWriter, r *http.Request) {
 func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
 	session, err := gothic.Store.Get(r, "user-session")
 	if err != nil {
-		fmt.Fprintf(w, "Error getting session: %v\n", err)
+		slog.Warn("Failed to get session on logout", "error", err)
 	}
 
 	session.Options.MaxAge = -1
 	// Save the session (this sends the delete instruction to the browser)
 	err = session.Save(r, w)
 	if err != nil {
-		fmt.Fprintf(w, "Error deleting session: %v", err)
+		slog.Error("Failed to delete session", "error", err)
+		writeError(w, r, fmt.Sprintf("Error deleting session: %v", err), http.StatusInternalServerError)
 		return
 	}
 	gothic.Logout(w, r)
@@ -463,9 +734,17 @@ func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
 
 func listRoutesByUser(q *db.Queries, userID int64) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		routes, err := q.ListRoutesByUser(r.Context(), userID)
+		includeHidden, err := parseIncludeHidden(r.URL.Query())
+		if err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		routes, err := q.ListRoutesByUser(r.Context(), db.ListRoutesByUserParams{
+			UserID:        userID,
+			IncludeHidden: includeHidden,
+		})
 		if err != nil {
-			http.Error(w, "Failed to query routes", http.StatusInternalServerError)
+			writeError(w, r, "Failed to query routes", http.StatusInternalServerError)
 			return
 		}
 
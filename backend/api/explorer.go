@@ -0,0 +1,258 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+	"wanderwell/backend/db"
+	"wanderwell/backend/explorer"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// parseGridZoom reads the optional grid_z query parameter, defaulting to the
+// classic zoom-14 grid.
+func parseGridZoom(r *http.Request) (int, error) {
+	gridZParam := r.URL.Query().Get("grid_z")
+	if gridZParam == "" {
+		return explorer.DefaultGridZoom, nil
+	}
+	gridZ, err := strconv.Atoi(gridZParam)
+	if err != nil || !explorer.IsGridZoom(gridZ) {
+		return 0, fmt.Errorf("invalid grid_z: %q, must be one of %v", gridZParam, explorer.GridZooms)
+	}
+	return gridZ, nil
+}
+
+// explorerStats computes the explorer statistics of a user at grid zoom gridZ
+// from their explored cells.
+func (s *Server) explorerStats(ctx context.Context, userID int64, gridZ int) (explorer.Stats, error) {
+	rows, err := s.queries.ListExploredCells(ctx, db.ListExploredCellsParams{
+		UserID: userID,
+		Z:      int32(gridZ),
+	})
+	if err != nil {
+		return explorer.Stats{}, err
+	}
+
+	cells := make([]explorer.Cell, len(rows))
+	for i, row := range rows {
+		cells[i] = explorer.Cell{X: int(row.X), Y: int(row.Y)}
+	}
+	return explorer.ComputeStats(gridZ, cells), nil
+}
+
+// computeExplorerStats computes the explorer statistics of a user at grid zoom
+// gridZ and stores them, so the explorer tiles can highlight the max cluster
+// and max square.
+func (s *Server) computeExplorerStats(ctx context.Context, userID int64, gridZ int) (explorer.Stats, error) {
+	stats, err := s.explorerStats(ctx, userID, gridZ)
+	if err != nil {
+		return explorer.Stats{}, err
+	}
+
+	clusterX := make([]int32, len(stats.MaxCluster.Cells))
+	clusterY := make([]int32, len(stats.MaxCluster.Cells))
+	for i, c := range stats.MaxCluster.Cells {
+		clusterX[i], clusterY[i] = int32(c.X), int32(c.Y)
+	}
+
+	err = s.queries.UpsertExplorerStats(ctx, db.UpsertExplorerStatsParams{
+		UserID:     userID,
+		Z:          int32(gridZ),
+		TotalTiles: int32(stats.TotalTiles),
+		MaxCluster: int32(stats.MaxCluster.Size),
+		MaxSquare:  int32(stats.MaxSquare.Size),
+		ClusterX:   clusterX,
+		ClusterY:   clusterY,
+		SquareX:    int32(stats.MaxSquare.X),
+		SquareY:    int32(stats.MaxSquare.Y),
+	})
+	if err != nil {
+		return explorer.Stats{}, err
+	}
+	return stats, nil
+}
+
+// refreshExplorerStats recomputes the stored explorer statistics of every grid
+// zoom in the background after a user's routes changed. It stops between grid
+// zooms once ctx is cancelled. Errors are logged only.
+func (s *Server) refreshExplorerStats(ctx context.Context, userID int64) {
+	start := time.Now()
+	var failed error
+	for _, gridZ := range explorer.GridZooms {
+		if err := ctx.Err(); err != nil {
+			failed = err
+			break
+		}
+		if _, err := s.computeExplorerStats(ctx, userID, gridZ); err != nil {
+			slog.Error("Failed to refresh explorer stats", "userID", userID, "gridZ", gridZ, "error", err)
+			failed = err
+		}
+	}
+	observeSync("explorer_stats", start, failed)
+}
+
+// storedExplorerStats reads the explorer statistics stored by
+// computeExplorerStats. It returns pgx.ErrNoRows if there are none, or only
+// ones stored without the location of the max square.
+func (s *Server) storedExplorerStats(ctx context.Context, userID int64, gridZ int) (explorer.Stats, error) {
+	row, err := s.queries.GetExplorerStats(ctx, db.GetExplorerStatsParams{
+		UserID: userID,
+		Z:      int32(gridZ),
+	})
+	if err != nil {
+		return explorer.Stats{}, err
+	}
+	if !row.SquareX.Valid || !row.SquareY.Valid {
+		return explorer.Stats{}, pgx.ErrNoRows
+	}
+
+	stats := explorer.Stats{
+		GridZoom:   gridZ,
+		TotalTiles: int(row.TotalTiles),
+		MaxCluster: explorer.Cluster{Size: int(row.MaxCluster)},
+		MaxSquare: explorer.Square{
+			Size: int(row.MaxSquare),
+			X:    int(row.SquareX.Int32),
+			Y:    int(row.SquareY.Int32),
+		},
+	}
+	if row.ClusterMinLat.Valid {
+		stats.MaxCluster.Bounds = fmt.Sprintf("%f,%f,%f,%f",
+			row.ClusterMinLat.Float64, row.ClusterMinLng.Float64, row.ClusterMaxLat.Float64, row.ClusterMaxLng.Float64)
+	}
+	if stats.MaxSquare.Size > 0 {
+		sq := stats.MaxSquare
+		stats.MaxSquare.Bounds = explorer.CellRangeBounds(gridZ, sq.X, sq.Y, sq.X+sq.Size-1, sq.Y+sq.Size-1)
+	}
+	return stats, nil
+}
+
+// getExplorerStats serves the stored explorer statistics, which are refreshed
+// in the background whenever the user's routes change. Like every GET it
+// doesn't write, so that read-only API tokens can call it: stats that weren't
+// stored yet are computed for the response only.
+func (s *Server) getExplorerStats(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	gridZ, err := parseGridZoom(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats, err := s.storedExplorerStats(r.Context(), userID, gridZ)
+	if err == pgx.ErrNoRows {
+		// Not refreshed yet since the user's routes were synced.
+		stats, err = s.explorerStats(r.Context(), userID, gridZ)
+	}
+	if err != nil {
+		slog.Error("Failed to get explorer stats", "userID", userID, "gridZ", gridZ, "error", err)
+		writeError(w, r, "Failed to get explorer stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// routeProgress is the explorer progress contributed by a single route.
+type routeProgress struct {
+	RouteID        int64              `json:"route_id"`
+	Name           string             `json:"name"`
+	StartDate      pgtype.Timestamptz `json:"start_date"`
+	NewCells       int32              `json:"new_cells"`
+	RevisitedCells int32              `json:"revisited_cells"`
+	CellsBefore    int32              `json:"cells_before"`
+	TotalCells     int32              `json:"total_cells"`
+}
+
+// periodProgress is the explorer progress aggregated over a week, month or year.
+type periodProgress struct {
+	PeriodStart pgtype.Timestamptz `json:"period_start"`
+	NewCells    int32              `json:"new_cells"`
+	CellsBefore int32              `json:"cells_before"`
+	TotalCells  int32              `json:"total_cells"`
+}
+
+// getExplorerTimeline returns how the explored cells grew over time, either per
+// activity (group=activity, the default) or per week, month or year.
+func (s *Server) getExplorerTimeline(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	gridZ, err := parseGridZoom(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	group := r.URL.Query().Get("group")
+	switch group {
+	case "", "activity":
+		rows, err := s.queries.ListExplorerProgressByRoute(r.Context(), db.ListExplorerProgressByRouteParams{
+			UserID: userID,
+			Z:      int32(gridZ),
+		})
+		if err != nil {
+			slog.Error("Failed to query explorer progress by route", "userID", userID, "gridZ", gridZ, "error", err)
+			writeError(w, r, "Failed to query explorer timeline", http.StatusInternalServerError)
+			return
+		}
+
+		timeline := make([]routeProgress, len(rows))
+		for i, row := range rows {
+			timeline[i] = routeProgress{
+				RouteID:        row.ID,
+				Name:           row.Name,
+				StartDate:      row.StartDate,
+				NewCells:       row.NewCells,
+				RevisitedCells: row.Cells - row.NewCells,
+				CellsBefore:    row.TotalCells - row.NewCells,
+				TotalCells:     row.TotalCells,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(timeline)
+
+	case "week", "month", "year":
+		rows, err := s.queries.ListExplorerProgressByPeriod(r.Context(), db.ListExplorerProgressByPeriodParams{
+			Period: group,
+			UserID: userID,
+			Z:      int32(gridZ),
+		})
+		if err != nil {
+			slog.Error("Failed to query explorer progress by period", "userID", userID, "gridZ", gridZ, "period", group, "error", err)
+			writeError(w, r, "Failed to query explorer timeline", http.StatusInternalServerError)
+			return
+		}
+
+		timeline := make([]periodProgress, len(rows))
+		for i, row := range rows {
+			timeline[i] = periodProgress{
+				PeriodStart: row.PeriodStart,
+				NewCells:    row.NewCells,
+				CellsBefore: row.TotalCells - row.NewCells,
+				TotalCells:  row.TotalCells,
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(timeline)
+
+	default:
+		writeError(w, r, fmt.Sprintf("invalid group: %q, must be one of activity, week, month, year", group), http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"wanderwell/backend/db"
+	"wanderwell/backend/export"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// exportFormat reads the ?format param of the export endpoints.
+func exportFormat(r *http.Request) (string, export.Format, error) {
+	name := r.URL.Query().Get("format")
+	format, ok := export.Formats[name]
+	if !ok {
+		return "", export.Format{}, fmt.Errorf("invalid format: %q, must be one of gpx, kml, geojson, fgb, gpkg", name)
+	}
+	return name, format, nil
+}
+
+// writeExport streams the matching routes of the user as a file download.
+// Once the response has started, errors can only be logged.
+func (s *Server) writeExport(w http.ResponseWriter, r *http.Request, userID int64, routeID pgtype.Int8, filters []byte, search pgtype.Text, name string, format export.Format, filename string) {
+	writer, err := export.NewWriter(name, w)
+	if err != nil {
+		slog.Error("Failed to create export writer", "format", name, "error", err)
+		writeError(w, r, "Failed to export routes", http.StatusInternalServerError)
+		return
+	}
+
+	// Large exports can take longer than the server's write timeout.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.Warn("Failed to lift the write deadline of the export", "error", err)
+	}
+
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename+"."+format.Extension))
+
+	count, err := export.WriteRoutes(r.Context(), s.queries, writer, userID, routeID, filters, search)
+	if err != nil {
+		slog.Error("Failed to export routes", "userID", userID, "format", name, "exported", count, "error", err)
+	}
+	if err := writer.Close(); err != nil {
+		slog.Error("Failed to complete export", "userID", userID, "format", name, "error", err)
+	}
+}
+
+// exportRoutes exports all routes of the user matching the tile filter params
+// and the optional ?q full-text search in the ?format given.
+func (s *Server) exportRoutes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	name, format, err := exportFormat(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filters, err := routeFilters(r.URL.Query(), "format", "q")
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var search pgtype.Text
+	if v := r.URL.Query().Get("q"); v != "" {
+		search = pgtype.Text{String: v, Valid: true}
+	}
+
+	s.writeExport(w, r, userID, pgtype.Int8{}, filters, search, name, format, "routes")
+}
+
+// exportRoute exports a single route of the user in the ?format given. The
+// route's streams are fetched first if possible, so that the export includes
+// time and elevation.
+func (s *Server) exportRoute(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	routeID, err := parseRouteID(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name, format, err := exportFormat(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	routeName, err := s.queries.GetRouteName(r.Context(), db.GetRouteNameParams{
+		ID:     routeID,
+		UserID: userID,
+	})
+	if err == pgx.ErrNoRows {
+		writeError(w, r, "Route not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to fetch route", "routeID", routeID, "userID", userID, "error", err)
+		writeError(w, r, "Failed to fetch route", http.StatusInternalServerError)
+		return
+	}
+
+	// Without streams the route is exported from its geometry only.
+	if _, _, err := s.cacheUpdater.GetRouteStream(r.Context(), routeID, userID); err != nil {
+		slog.Error("Failed to get route streams", "routeID", routeID, "error", err)
+	}
+
+	s.writeExport(w, r, userID, pgtype.Int8{Int64: routeID, Valid: true}, []byte(`{"include_hidden":"true"}`), pgtype.Text{}, name, format, exportFilename(routeName, routeID))
+}
+
+// exportFilename turns a route name into a safe download filename.
+func exportFilename(name string, routeID int64) string {
+	filename := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r == ' ':
+			return '_'
+		default:
+			return -1
+		}
+	}, name)
+	if filename == "" {
+		return fmt.Sprintf("route_%d", routeID)
+	}
+	return filename
+}
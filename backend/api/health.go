@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+	"wanderwell/backend/db"
+	"wanderwell/backend/strava"
+)
+
+// readinessTimeout bounds the checks of /readyz and each Strava probe, so that
+// a hanging database or Strava doesn't hang them.
+const readinessTimeout = 3 * time.Second
+
+// stravaProbeInterval is how often probeStrava checks the Strava token
+// endpoint for /readyz.
+const stravaProbeInterval = time.Minute
+
+// getHealth is the liveness probe: the process serves requests.
+func (s *Server) getHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// probeStrava checks whether the Strava token endpoint is reachable every
+// stravaProbeInterval until ctx is cancelled, so that /readyz reports the last
+// result instead of calling Strava on every probe.
+func (s *Server) probeStrava(ctx context.Context) {
+	ticker := time.NewTicker(stravaProbeInterval)
+	defer ticker.Stop()
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, readinessTimeout)
+		reachable := strava.TokenEndpointReachable(probeCtx)
+		cancel()
+		if reachable != s.stravaReachable.Swap(reachable) {
+			slog.Info("Strava token endpoint reachability changed", "reachable", reachable)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// getReadiness is the readiness probe. It is ready (200, else 503) when the
+// database answers and runs the schema of this build. Whether the Strava token
+// endpoint was reachable at the last probeStrava check is reported as well,
+// but doesn't affect readiness, as everything but syncing works without Strava.
+func (s *Server) getReadiness(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	response := struct {
+		Status                string `json:"status"`
+		Database              bool   `json:"database"`
+		SchemaVersion         string `json:"schema_version"`
+		ExpectedSchemaVersion string `json:"expected_schema_version"`
+		StravaReachable       bool   `json:"strava_reachable"`
+	}{
+		Status:                "ready",
+		ExpectedSchemaVersion: db.SchemaVersion(),
+	}
+
+	if err := s.pool.Ping(ctx); err != nil {
+		slog.Error("Readiness check: database ping failed", "error", err)
+	} else {
+		response.Database = true
+		version, err := s.queries.GetSchemaVersion(ctx)
+		if err != nil {
+			slog.Error("Readiness check: failed to fetch schema version", "error", err)
+		}
+		response.SchemaVersion = version
+	}
+	response.StravaReachable = s.stravaReachable.Load()
+
+	status := http.StatusOK
+	if !response.Database || response.SchemaVersion != response.ExpectedSchemaVersion {
+		response.Status = "not_ready"
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+	"wanderwell/backend/metrics"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+var (
+	httpRequestDuration = metrics.NewHistogram("wanderwell_http_request_duration_seconds",
+		"Duration of HTTP requests by method, chi route pattern and status.", metrics.DefaultBuckets, "method", "route", "status")
+	webhookEvents = metrics.NewCounter("wanderwell_webhook_events_total",
+		"Strava webhook events by aspect type and outcome (processed, ignored, invalid or failed).", "aspect", "outcome")
+	syncDuration = metrics.NewHistogram("wanderwell_sync_duration_seconds",
+		"Duration of sync jobs by job and outcome (ok or error).",
+		[]float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600, 21600}, "job", "outcome")
+	tilePurges = metrics.NewCounter("wanderwell_tile_purges_total",
+		"Tile cache BAN requests by outcome (ok, rejected or error).", "outcome")
+	tilePurgeDuration = metrics.NewHistogram("wanderwell_tile_purge_duration_seconds",
+		"Duration of tile cache BAN requests.", metrics.DefaultBuckets)
+)
+
+// observeSync records the duration of a sync job started at start, and whether
+// it failed.
+func observeSync(job string, start time.Time, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	syncDuration.Observe(time.Since(start).Seconds(), job, outcome)
+}
+
+// observeRequests is a middleware that records the duration of the requests by
+// their chi route pattern, e.g. /routes/{id}, so that the label values stay few.
+func observeRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := chi.RouteContext(r.Context()).RoutePattern()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpRequestDuration.Observe(time.Since(start).Seconds(), r.Method, route, strconv.Itoa(status))
+	})
+}
+
+// registerPoolMetrics exposes the statistics of the database connection pool.
+func (s *Server) registerPoolMetrics() {
+	metrics.NewGaugeFunc("wanderwell_db_pool_connections",
+		"Database pool connections by state.", []string{"state"}, func(set metrics.SetFunc) {
+			stat := s.pool.Stat()
+			set(float64(stat.AcquiredConns()), "acquired")
+			set(float64(stat.IdleConns()), "idle")
+			set(float64(stat.ConstructingConns()), "constructing")
+		})
+	metrics.NewGaugeFunc("wanderwell_db_pool_max_connections",
+		"Maximum size of the database pool.", nil, func(set metrics.SetFunc) {
+			set(float64(s.pool.Stat().MaxConns()))
+		})
+	metrics.NewCounterFunc("wanderwell_db_pool_acquires_total",
+		"Connections acquired from the database pool, by whether the pool had to wait for one (empty) or the acquire was canceled.",
+		[]string{"result"}, func(set metrics.SetFunc) {
+			stat := s.pool.Stat()
+			set(float64(stat.AcquireCount()-stat.EmptyAcquireCount()), "immediate")
+			set(float64(stat.EmptyAcquireCount()), "empty")
+			set(float64(stat.CanceledAcquireCount()), "canceled")
+		})
+	metrics.NewCounterFunc("wanderwell_db_pool_acquire_seconds_total",
+		"Total time spent acquiring connections from the database pool.", nil, func(set metrics.SetFunc) {
+			set(s.pool.Stat().AcquireDuration().Seconds())
+		})
+}
+
+// getMetrics serves the metrics in the Prometheus text format. It is restricted
+// to scrapers with METRICS_TOKEN as Bearer token, and to the admin user.
+func (s *Server) getMetrics(w http.ResponseWriter, r *http.Request) {
+	writeMetrics := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.Write(w)
+	}
+
+	if s.metricsToken != "" {
+		expected := "Bearer " + s.metricsToken
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(expected)) == 1 {
+			writeMetrics(w, r)
+			return
+		}
+	}
+	s.RequireAuth(s.RequireAdmin(http.HandlerFunc(writeMetrics))).ServeHTTP(w, r)
+}
@@ -0,0 +1,17 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec is the OpenAPI document of all routes, served at /openapi.json.
+// TestOpenAPIMatchesRoutes keeps it in sync with the router.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func (s *Server) getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"wanderwell/backend/tiles"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// TestOpenAPIMatchesRoutes compares the operations of openapi.json with the
+// routes of the router, with all optional routes (like the tiles) enabled, and
+// lists the routes that are missing from either. It needs no database.
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("invalid openapi.json: %v", err)
+	}
+	documented := make(map[string]bool)
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			documented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+
+	server := NewServer(nil, nil, "", "", "", 0, "", tiles.NewCache(0), "")
+	var problems []string
+	err := chi.Walk(server.router, func(method string, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		operation := method + " " + route
+		if !documented[operation] {
+			problems = append(problems, "undocumented route: "+operation)
+		}
+		delete(documented, operation)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for operation := range documented {
+		problems = append(problems, "documented route not served: "+operation)
+	}
+
+	if len(problems) > 0 {
+		slices.Sort(problems)
+		t.Errorf("openapi.json is out of sync with the routes:\n%s", strings.Join(problems, "\n"))
+	}
+}
@@ -0,0 +1,787 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"wanderwell/backend/db"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// parseRouteID reads the {id} URL parameter of the route endpoints.
+func parseRouteID(r *http.Request) (int64, error) {
+	idParam := chi.URLParam(r, "id")
+	routeID, err := strconv.ParseInt(idParam, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid route id: %q", idParam)
+	}
+	return routeID, nil
+}
+
+// getRouteNewGround returns the stored "new ground" of a route: its length, the
+// unique sub-segments as a GeoJSON geometry and the settings it was computed with.
+func (s *Server) getRouteNewGround(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	routeID, err := parseRouteID(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	newGround, err := s.queries.GetRouteNewGround(r.Context(), db.GetRouteNewGroundParams{
+		RouteID: routeID,
+		UserID:  userID,
+	})
+	if err == pgx.ErrNoRows {
+		writeError(w, r, "Route not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to fetch route new ground", "routeID", routeID, "userID", userID, "error", err)
+		writeError(w, r, "Failed to fetch route new ground", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		RouteID         int64              `json:"route_id"`
+		DistanceMeters  float64            `json:"distance_meters"`
+		Geometry        json.RawMessage    `json:"geometry"`
+		ComputedAt      pgtype.Timestamptz `json:"computed_at"`
+		TimeWindow      string             `json:"time_window"`
+		WindowDays      int32              `json:"window_days"`
+		ToleranceMeters float64            `json:"tolerance_meters"`
+		SampleMeters    float64            `json:"sample_meters"`
+	}{
+		RouteID:         newGround.RouteID,
+		DistanceMeters:  newGround.DistanceMeters,
+		Geometry:        json.RawMessage(newGround.Geometry),
+		ComputedAt:      newGround.ComputedAt,
+		TimeWindow:      newGround.TimeWindow,
+		WindowDays:      newGround.WindowDays,
+		ToleranceMeters: newGround.ToleranceMeters,
+		SampleMeters:    newGround.SampleMeters,
+	})
+}
+
+// endpointRoute is a route listed for a start/end point cluster.
+type endpointRoute struct {
+	ID        int64              `json:"id"`
+	Name      string             `json:"name"`
+	SportType pgtype.Text        `json:"sport_type"`
+	StartDate pgtype.Timestamptz `json:"start_date"`
+	Distance  float64            `json:"distance"`
+}
+
+// routeFilters converts the query params, except the excluded ones, into the
+// filters JSON the tiles accept (see route_filter_params in db/schema.sql).
+// It returns an error for a filter value the tiles can't parse.
+func routeFilters(query url.Values, exclude ...string) ([]byte, error) {
+	filters := make(map[string]string)
+	for name := range query {
+		if !slices.Contains(exclude, name) {
+			filters[name] = query.Get(name)
+		}
+	}
+	if err := validateRouteFilters(filters); err != nil {
+		return nil, err
+	}
+	return json.Marshal(filters)
+}
+
+// validateRouteFilters checks the values of the route filters, which
+// route_matches_filters casts in SQL, so that a bad value is a 400 rather than
+// a cast error. Other params are left to the caller.
+func validateRouteFilters(filters map[string]string) error {
+	for name, value := range filters {
+		var err error
+		switch name {
+		case "start_date", "end_date":
+			if _, err = time.Parse(time.DateOnly, value); err != nil {
+				return fmt.Errorf("invalid %s: %q, must be a date like 2024-12-31", name, value)
+			}
+		case "min_distance", "max_distance", "min_elevation", "max_elevation":
+			var v float64
+			if v, err = strconv.ParseFloat(value, 64); err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return fmt.Errorf("invalid %s: %q, must be a number", name, value)
+			}
+		case "min_duration", "max_duration":
+			if _, err = strconv.ParseInt(value, 10, 32); err != nil {
+				return fmt.Errorf("invalid %s: %q, must be a number of seconds", name, value)
+			}
+		case "commute", "trainer", "include_hidden":
+			if _, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("invalid %s: %q, must be true or false", name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// parseIncludeHidden reads the optional ?include_hidden param of the route
+// lists that don't take the tile filters. Hidden routes are left out unless it
+// is true.
+func parseIncludeHidden(query url.Values) (bool, error) {
+	if !query.Has("include_hidden") {
+		return false, nil
+	}
+	includeHidden, err := strconv.ParseBool(query.Get("include_hidden"))
+	if err != nil {
+		return false, fmt.Errorf("invalid include_hidden: %q, must be true or false", query.Get("include_hidden"))
+	}
+	return includeHidden, nil
+}
+
+// getRouteEndpoints returns the routes of a start/end point cluster of the
+// user_endpoints tiles, identified by its kind (start or end) and its cell
+// (cell_z, cell_x, cell_y). The tile filter params are applied as well.
+func (s *Server) getRouteEndpoints(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	kind := query.Get("kind")
+	if kind != "start" && kind != "end" {
+		writeError(w, r, fmt.Sprintf("invalid kind: %q, must be one of start, end", kind), http.StatusBadRequest)
+		return
+	}
+
+	var cell [3]int32
+	for i, name := range []string{"cell_z", "cell_x", "cell_y"} {
+		v, err := strconv.ParseInt(query.Get(name), 10, 32)
+		if err != nil || v < 0 {
+			writeError(w, r, fmt.Sprintf("invalid %s: %q", name, query.Get(name)), http.StatusBadRequest)
+			return
+		}
+		cell[i] = int32(v)
+	}
+
+	filtersJSON, err := routeFilters(query, "kind", "cell_z", "cell_x", "cell_y")
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.queries.ListRoutesByEndpointCell(r.Context(), db.ListRoutesByEndpointCellParams{
+		Kind:    kind,
+		UserID:  userID,
+		CellZ:   cell[0],
+		CellX:   cell[1],
+		CellY:   cell[2],
+		Filters: filtersJSON,
+	})
+	if err != nil {
+		slog.Error("Failed to list routes by endpoint", "userID", userID, "kind", kind, "cell", cell, "error", err)
+		writeError(w, r, "Failed to list routes", http.StatusInternalServerError)
+		return
+	}
+
+	routes := make([]endpointRoute, len(rows))
+	for i, row := range rows {
+		routes[i] = endpointRoute(row)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routes)
+}
+
+// searchArea converts the area query params of the route search into a GeoJSON
+// geometry and buffer radius. Exactly one of these must be given:
+//   - bbox=minLat,minLng,maxLat,maxLng (like route bounds)
+//   - polygon=<GeoJSON Polygon or MultiPolygon geometry>
+//   - lat, lng and radius (in metres)
+func searchArea(query url.Values) (string, float64, error) {
+	var areas int
+	for _, name := range []string{"bbox", "polygon", "lat"} {
+		if query.Has(name) {
+			areas++
+		}
+	}
+	if areas != 1 {
+		return "", 0, errors.New("exactly one of bbox, polygon or lat/lng/radius is required")
+	}
+
+	switch {
+	case query.Has("bbox"):
+		var minLat, minLng, maxLat, maxLng float64
+		if _, err := fmt.Sscanf(query.Get("bbox"), "%g,%g,%g,%g", &minLat, &minLng, &maxLat, &maxLng); err != nil ||
+			minLat >= maxLat || minLng >= maxLng {
+			return "", 0, fmt.Errorf("invalid bbox: %q, must be minLat,minLng,maxLat,maxLng", query.Get("bbox"))
+		}
+		polygon := fmt.Sprintf(`{"type":"Polygon","coordinates":[[[%[2]g,%[1]g],[%[4]g,%[1]g],[%[4]g,%[3]g],[%[2]g,%[3]g],[%[2]g,%[1]g]]]}`,
+			minLat, minLng, maxLat, maxLng)
+		return polygon, 0, nil
+
+	case query.Has("polygon"):
+		var geometry struct {
+			Type        string          `json:"type"`
+			Coordinates json.RawMessage `json:"coordinates"`
+		}
+		if err := json.Unmarshal([]byte(query.Get("polygon")), &geometry); err != nil ||
+			(geometry.Type != "Polygon" && geometry.Type != "MultiPolygon") || len(geometry.Coordinates) == 0 {
+			return "", 0, errors.New("invalid polygon: must be a GeoJSON Polygon or MultiPolygon geometry")
+		}
+		return query.Get("polygon"), 0, nil
+
+	default:
+		lat, latErr := strconv.ParseFloat(query.Get("lat"), 64)
+		lng, lngErr := strconv.ParseFloat(query.Get("lng"), 64)
+		if latErr != nil || lngErr != nil || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+			return "", 0, fmt.Errorf("invalid point: lat=%q, lng=%q", query.Get("lat"), query.Get("lng"))
+		}
+		radius, err := strconv.ParseFloat(query.Get("radius"), 64)
+		if err != nil || radius <= 0 || radius > 50000 {
+			return "", 0, fmt.Errorf("invalid radius: %q, must be between 0 and 50000 metres", query.Get("radius"))
+		}
+		return fmt.Sprintf(`{"type":"Point","coordinates":[%g,%g]}`, lng, lat), radius, nil
+	}
+}
+
+// searchRoutes returns the routes that pass through an area (see searchArea),
+// most recent first, with the length of the part inside the area. The optional
+// limit param caps the number of routes (default 100, at most 1000), and
+// hidden routes are only included with include_hidden=true.
+func (s *Server) searchRoutes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	area, radius, err := searchArea(query)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := 100
+	if query.Has("limit") {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit < 1 || limit > 1000 {
+			writeError(w, r, fmt.Sprintf("invalid limit: %q, must be between 1 and 1000", query.Get("limit")), http.StatusBadRequest)
+			return
+		}
+	}
+
+	includeHidden, err := parseIncludeHidden(query)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	routes, err := s.queries.SearchRoutesByArea(r.Context(), db.SearchRoutesByAreaParams{
+		RadiusMeters:  radius,
+		Area:          area,
+		UserID:        userID,
+		IncludeHidden: includeHidden,
+		MaxResults:    int32(limit),
+	})
+	if err != nil {
+		slog.Error("Failed to search routes", "userID", userID, "error", err)
+		writeError(w, r, "Failed to search routes", http.StatusInternalServerError)
+		return
+	}
+	if routes == nil {
+		routes = []db.SearchRoutesByAreaRow{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routes)
+}
+
+// maxProfilePoints caps the number of points of the elevation profile in the
+// route details; longer streams are downsampled.
+const maxProfilePoints = 500
+
+// profilePoint is a point of the elevation profile of a route.
+type profilePoint struct {
+	DistanceM float64 `json:"distance_m"`
+	AltitudeM float64 `json:"altitude_m"`
+}
+
+// routeDetail is a route with its full GeoJSON geometry and derived metrics.
+type routeDetail struct {
+	ID                    int64                         `json:"id"`
+	Name                  string                        `json:"name"`
+	SportType             pgtype.Text                   `json:"sport_type"`
+	StartDate             pgtype.Timestamptz            `json:"start_date"`
+	ElapsedTime           int32                         `json:"elapsed_time"`
+	MovingTime            int32                         `json:"moving_time"`
+	Distance              float64                       `json:"distance"`
+	AverageSpeed          float64                       `json:"average_speed"`
+	Elevation             float64                       `json:"elevation"`
+	Bounds                string                        `json:"bounds"`
+	Commute               bool                          `json:"commute"`
+	Trainer               bool                          `json:"trainer"`
+	Description           string                        `json:"description"`
+	Notes                 string                        `json:"notes"`
+	Hidden                bool                          `json:"hidden"`
+	ExcludeExplorer       bool                          `json:"exclude_explorer"`
+	ExcludeUniqueDistance bool                          `json:"exclude_unique_distance"`
+	Geometry              json.RawMessage               `json:"geometry"`
+	UniqueDistance        pgtype.Float8                 `json:"unique_distance"`
+	GridZoom              int                           `json:"grid_z"`
+	NewExplorerCells      int32                         `json:"new_explorer_cells"`
+	ElevationProfile      []profilePoint                `json:"elevation_profile"` // null without altitude stream
+	Regions               []db.ListRouteRegionsRow      `json:"regions"`
+	OverlappingRoutes     []db.ListOverlappingRoutesRow `json:"overlapping_routes"`
+}
+
+// getRoute returns a single route of the user with its GeoJSON geometry, unique
+// distance, the explorer cells it explored first (at ?grid_z, default 14), its
+// elevation profile if Strava has altitude data, the regions it crosses and the
+// other routes that overlap it most.
+func (s *Server) getRoute(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	routeID, err := parseRouteID(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gridZ, err := parseGridZoom(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Routes of other users are reported as missing, like unknown ones.
+	route, err := s.queries.GetRouteDetail(r.Context(), db.GetRouteDetailParams{
+		ID:     routeID,
+		UserID: userID,
+	})
+	if err == pgx.ErrNoRows {
+		writeError(w, r, "Route not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to fetch route", "routeID", routeID, "userID", userID, "error", err)
+		writeError(w, r, "Failed to fetch route", http.StatusInternalServerError)
+		return
+	}
+
+	detail := routeDetail{
+		ID:                    route.ID,
+		Name:                  route.Name,
+		SportType:             route.SportType,
+		StartDate:             route.StartDate,
+		ElapsedTime:           route.ElapsedTime,
+		MovingTime:            route.MovingTime,
+		Distance:              route.Distance,
+		AverageSpeed:          route.AverageSpeed,
+		Elevation:             route.Elevation,
+		Bounds:                route.Bounds,
+		Commute:               route.Commute,
+		Trainer:               route.Trainer,
+		Description:           route.Description,
+		Notes:                 route.Notes,
+		Hidden:                route.Hidden,
+		ExcludeExplorer:       route.ExcludeExplorer,
+		ExcludeUniqueDistance: route.ExcludeUniqueDistance,
+		Geometry:              json.RawMessage(route.Geometry),
+		UniqueDistance:        route.UniqueDistance,
+		GridZoom:              gridZ,
+	}
+
+	detail.NewExplorerCells, err = s.queries.CountRouteNewExplorerCells(r.Context(), db.CountRouteNewExplorerCellsParams{
+		UserID:       userID,
+		Z:            int32(gridZ),
+		FirstRouteID: routeID,
+	})
+	if err != nil {
+		slog.Error("Failed to count new explorer cells", "routeID", routeID, "error", err)
+		writeError(w, r, "Failed to fetch route", http.StatusInternalServerError)
+		return
+	}
+
+	detail.Regions, err = s.queries.ListRouteRegions(r.Context(), routeID)
+	if err != nil {
+		slog.Error("Failed to list route regions", "routeID", routeID, "error", err)
+		writeError(w, r, "Failed to fetch route", http.StatusInternalServerError)
+		return
+	}
+	if detail.Regions == nil {
+		detail.Regions = []db.ListRouteRegionsRow{}
+	}
+
+	detail.OverlappingRoutes, err = s.queries.ListOverlappingRoutes(r.Context(), db.ListOverlappingRoutesParams{
+		RouteID:    routeID,
+		UserID:     userID,
+		MaxResults: 20,
+	})
+	if err != nil {
+		slog.Error("Failed to list overlapping routes", "routeID", routeID, "error", err)
+		writeError(w, r, "Failed to fetch route", http.StatusInternalServerError)
+		return
+	}
+	if detail.OverlappingRoutes == nil {
+		detail.OverlappingRoutes = []db.ListOverlappingRoutesRow{}
+	}
+
+	// The elevation profile is optional, so failing to fetch the streams is
+	// only logged.
+	stream, ok, err := s.cacheUpdater.GetRouteStream(r.Context(), routeID, userID)
+	if err != nil {
+		slog.Error("Failed to get route streams", "routeID", routeID, "error", err)
+	}
+	if ok && len(stream.AltitudeM) > 0 {
+		step := (len(stream.AltitudeM) + maxProfilePoints - 1) / maxProfilePoints
+		for i := 0; i < len(stream.AltitudeM); i += step {
+			detail.ElevationProfile = append(detail.ElevationProfile, profilePoint{
+				DistanceM: stream.DistanceM[i],
+				AltitudeM: stream.AltitudeM[i],
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+// routeListSorts are the metrics the route list can be sorted by.
+var routeListSorts = []string{"start_date", "distance", "moving_time", "elapsed_time", "elevation", "average_speed", "unique_distance"}
+
+const (
+	defaultRouteListLimit = 50
+	maxRouteListLimit     = 500
+)
+
+// routeListItem is a route of the route list.
+type routeListItem struct {
+	ID                    int64              `json:"id"`
+	Name                  string             `json:"name"`
+	SportType             pgtype.Text        `json:"sport_type"`
+	StartDate             pgtype.Timestamptz `json:"start_date"`
+	ElapsedTime           int32              `json:"elapsed_time"`
+	MovingTime            int32              `json:"moving_time"`
+	Distance              float64            `json:"distance"`
+	AverageSpeed          float64            `json:"average_speed"`
+	Elevation             float64            `json:"elevation"`
+	Bounds                string             `json:"bounds"`
+	Commute               bool               `json:"commute"`
+	Trainer               bool               `json:"trainer"`
+	Description           string             `json:"description"`
+	Notes                 string             `json:"notes"`
+	Hidden                bool               `json:"hidden"`
+	ExcludeExplorer       bool               `json:"exclude_explorer"`
+	ExcludeUniqueDistance bool               `json:"exclude_unique_distance"`
+	UniqueDistance        pgtype.Float8      `json:"unique_distance"`
+	Tags                  []string           `json:"tags"`
+}
+
+// routeListCursor is the position after the last route of a page. It carries
+// the sort it was created for, so it can't be mixed up with another ordering.
+type routeListCursor struct {
+	Sort  string  `json:"s"`
+	Order string  `json:"o"`
+	Value float64 `json:"v"`
+	ID    int64   `json:"id"`
+}
+
+func (c routeListCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeRouteListCursor(s string) (routeListCursor, error) {
+	var c routeListCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
+
+// listRoutes returns a page of the user's routes. Params:
+//   - the tile filters (see route_filter_params in db/schema.sql); hidden
+//     routes are only listed with include_hidden=true
+//   - q: full-text search over the route names, descriptions and notes
+//   - sort: one of routeListSorts (default start_date), order: asc or desc (default)
+//   - limit: page size (default 50, max 500), cursor: next_cursor of the previous page
+//   - fields: comma-separated fields of routeListItem to return (default all)
+func (s *Server) listRoutes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	sort := query.Get("sort")
+	if sort == "" {
+		sort = "start_date"
+	}
+	if !slices.Contains(routeListSorts, sort) {
+		writeError(w, r, fmt.Sprintf("invalid sort: %q, must be one of %s", sort, strings.Join(routeListSorts, ", ")), http.StatusBadRequest)
+		return
+	}
+	order := query.Get("order")
+	if order == "" {
+		order = "desc"
+	}
+	var direction int32
+	switch order {
+	case "asc":
+		direction = 1
+	case "desc":
+		direction = -1
+	default:
+		writeError(w, r, fmt.Sprintf("invalid order: %q, must be one of asc, desc", order), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultRouteListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRouteListLimit {
+			writeError(w, r, fmt.Sprintf("invalid limit: %q, must be between 1 and %d", v, maxRouteListLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	var fields []string
+	if v := query.Get("fields"); v != "" {
+		fields = strings.Split(v, ",")
+		for _, field := range fields {
+			if !slices.Contains(routeListFields, field) {
+				writeError(w, r, fmt.Sprintf("invalid field: %q", field), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	params := db.ListRoutesPageParams{
+		Sort:       sort,
+		UserID:     userID,
+		Direction:  direction,
+		MaxResults: int32(limit) + 1, // one more to tell whether there is a next page
+	}
+	if v := query.Get("q"); v != "" {
+		params.Search = pgtype.Text{String: v, Valid: true}
+	}
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := decodeRouteListCursor(v)
+		if err != nil || cursor.Sort != sort || cursor.Order != order {
+			writeError(w, r, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		params.AfterValue = pgtype.Float8{Float64: cursor.Value, Valid: true}
+		params.AfterID = cursor.ID
+	}
+
+	var err error
+	params.Filters, err = routeFilters(query, "q", "sort", "order", "limit", "cursor", "fields")
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.queries.ListRoutesPage(r.Context(), params)
+	if err != nil {
+		slog.Error("Failed to list routes", "userID", userID, "error", err)
+		writeError(w, r, "Failed to list routes", http.StatusInternalServerError)
+		return
+	}
+
+	var nextCursor *string
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[len(rows)-1]
+		cursor := routeListCursor{Sort: sort, Order: order, Value: last.SortValue, ID: last.ID}.encode()
+		nextCursor = &cursor
+	}
+
+	routes := make([]any, len(rows))
+	for i, row := range rows {
+		item := routeListItem{
+			ID:                    row.ID,
+			Name:                  row.Name,
+			SportType:             row.SportType,
+			StartDate:             row.StartDate,
+			ElapsedTime:           row.ElapsedTime,
+			MovingTime:            row.MovingTime,
+			Distance:              row.Distance,
+			AverageSpeed:          row.AverageSpeed,
+			Elevation:             row.Elevation,
+			Bounds:                row.Bounds,
+			Commute:               row.Commute,
+			Trainer:               row.Trainer,
+			Description:           row.Description,
+			Notes:                 row.Notes,
+			Hidden:                row.Hidden,
+			ExcludeExplorer:       row.ExcludeExplorer,
+			ExcludeUniqueDistance: row.ExcludeUniqueDistance,
+			UniqueDistance:        row.UniqueDistance,
+			Tags:                  row.Tags,
+		}
+		if item.Tags == nil {
+			item.Tags = []string{}
+		}
+		routes[i] = item
+		if fields != nil {
+			routes[i], err = selectFields(item, fields)
+			if err != nil {
+				slog.Error("Failed to select route fields", "routeID", row.ID, "error", err)
+				writeError(w, r, "Failed to list routes", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Routes     []any   `json:"routes"`
+		NextCursor *string `json:"next_cursor"`
+	}{
+		Routes:     routes,
+		NextCursor: nextCursor,
+	})
+}
+
+// routeListFields are the JSON field names of routeListItem.
+var routeListFields = func() []string {
+	t := reflect.TypeFor[routeListItem]()
+	fields := make([]string, t.NumField())
+	for i := range fields {
+		fields[i] = t.Field(i).Tag.Get("json")
+	}
+	return fields
+}()
+
+// selectFields returns only the given JSON fields of v.
+func selectFields(v any, fields []string) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		selected[field] = all[field]
+	}
+	return selected, nil
+}
+
+// updateRoute updates the local overrides of a route: its display name (an
+// empty name restores the Strava name), whether it is hidden from the map,
+// excluded from the explorer or from the unique distance, and its notes.
+// Fields missing from the request keep their current value.
+func (s *Server) updateRoute(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	routeID, err := parseRouteID(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Name                  *string `json:"name"`
+		Hidden                *bool   `json:"hidden"`
+		ExcludeExplorer       *bool   `json:"exclude_explorer"`
+		ExcludeUniqueDistance *bool   `json:"exclude_unique_distance"`
+		Notes                 *string `json:"notes"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		slog.Error("Failed to decode route update", "routeID", routeID, "userID", userID, "error", err)
+		writeError(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	params := db.UpsertRouteOverrideParams{
+		RouteID: routeID,
+		UserID:  userID,
+	}
+	if request.Name != nil {
+		params.Name = pgtype.Text{String: strings.TrimSpace(*request.Name), Valid: true}
+	}
+	if request.Hidden != nil {
+		params.Hidden = pgtype.Bool{Bool: *request.Hidden, Valid: true}
+	}
+	if request.ExcludeExplorer != nil {
+		params.ExcludeExplorer = pgtype.Bool{Bool: *request.ExcludeExplorer, Valid: true}
+	}
+	if request.ExcludeUniqueDistance != nil {
+		params.ExcludeUniqueDistance = pgtype.Bool{Bool: *request.ExcludeUniqueDistance, Valid: true}
+	}
+	if request.Notes != nil {
+		params.Notes = pgtype.Text{String: *request.Notes, Valid: true}
+	}
+
+	// The cells of the route are re-synced by the route_override triggers.
+	override, err := s.queries.UpsertRouteOverride(r.Context(), params)
+	if err == pgx.ErrNoRows {
+		writeError(w, r, "Route not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to update route", "routeID", routeID, "userID", userID, "error", err)
+		writeError(w, r, "Failed to update route", http.StatusInternalServerError)
+		return
+	}
+
+	if request.ExcludeExplorer != nil || request.ExcludeUniqueDistance != nil {
+		s.jobs.Go(func() { s.refreshRoutesSince(s.jobsCtx, userID, override.StartDate) })
+	} else if request.Name != nil || request.Hidden != nil {
+		s.jobs.Go(func() { s.purgeTileCache(userID) })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(override)
+}
+
+// refreshRoutesSince recomputes what depends on a route's contribution to the
+// explorer and the unique distance after it was added, moved or excluded: the
+// new ground of every route from since on, the explorer stats and the cached
+// tiles. Errors are logged only.
+func (s *Server) refreshRoutesSince(ctx context.Context, userID int64, since pgtype.Timestamptz) {
+	start := time.Now()
+	err := s.queries.UpsertRouteNewGroundSince(ctx, db.UpsertRouteNewGroundSinceParams{
+		UserID: userID,
+		Since:  since,
+	})
+	observeSync("new_ground", start, err)
+	if err != nil {
+		slog.Error("Failed to recompute new ground", "userID", userID, "error", err)
+	}
+	s.refreshExplorerStats(ctx, userID)
+	s.purgeTileCache(userID)
+}
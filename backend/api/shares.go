@@ -0,0 +1,556 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"wanderwell/backend/db"
+	"wanderwell/backend/tiles"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// shareResponse is a share as returned to its owner. Unlike db.Share it
+// returns the filters as a JSON object.
+type shareResponse struct {
+	ID            int32              `json:"id"`
+	UserID        int64              `json:"user_id"`
+	Token         string             `json:"token"`
+	Name          string             `json:"name"`
+	Filters       json.RawMessage    `json:"filters"`
+	Layers        []string           `json:"layers"`
+	PublicProfile bool               `json:"public_profile"`
+	ExpiresAt     pgtype.Timestamptz `json:"expires_at"`
+	CreatedAt     pgtype.Timestamptz `json:"created_at"`
+}
+
+func newShareResponse(share db.Share) shareResponse {
+	return shareResponse{
+		ID:            share.ID,
+		UserID:        share.UserID,
+		Token:         share.Token,
+		Name:          share.Name,
+		Filters:       share.Filters,
+		Layers:        share.Layers,
+		PublicProfile: share.PublicProfile,
+		ExpiresAt:     share.ExpiresAt,
+		CreatedAt:     share.CreatedAt,
+	}
+}
+
+// sharedFilters merges the filters of a share into the filter params of a
+// request, like resolve_tile_params does for tiles: the share's filters win
+// and shared=true leaves out private activities.
+func sharedFilters(share db.Share, query url.Values, exclude ...string) ([]byte, error) {
+	filters := make(map[string]string)
+	for name := range query {
+		if !slices.Contains(exclude, name) && name != "include_hidden" {
+			filters[name] = query.Get(name)
+		}
+	}
+	var shareFilters map[string]string
+	if err := json.Unmarshal(share.Filters, &shareFilters); err != nil {
+		return nil, err
+	}
+	for name, value := range shareFilters {
+		filters[name] = value
+	}
+	filters["shared"] = "true"
+	return json.Marshal(filters)
+}
+
+// listShares returns the share links of the user that were not revoked.
+func (s *Server) listShares(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	shares, err := s.queries.ListShares(r.Context(), userID)
+	if err != nil {
+		slog.Error("Failed to list shares", "userID", userID, "error", err)
+		writeError(w, r, "Failed to list shares", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]shareResponse, len(shares))
+	for i, share := range shares {
+		response[i] = newShareResponse(share)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// createShare creates a share link, optionally limited to routes matching
+// filters (the tile filter params, e.g. a tag or start_date and end_date), to
+// some of the tile layers and until expires_at. With public_profile it becomes
+// the user's public profile, of which there is one at a time.
+func (s *Server) createShare(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Name          string            `json:"name"`
+		Filters       map[string]string `json:"filters"`
+		Layers        []string          `json:"layers"`
+		PublicProfile bool              `json:"public_profile"`
+		ExpiresAt     *time.Time        `json:"expires_at"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		slog.Error("Failed to decode share", "userID", userID, "error", err)
+		writeError(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	for _, layer := range request.Layers {
+		if !slices.Contains(tiles.Layers, layer) {
+			writeError(w, r, fmt.Sprintf("invalid layer: %q, must be one of %s", layer, strings.Join(tiles.Layers, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+	var expiresAt pgtype.Timestamptz
+	if request.ExpiresAt != nil {
+		if request.PublicProfile {
+			writeError(w, r, "a public profile can't expire", http.StatusBadRequest)
+			return
+		}
+		if !request.ExpiresAt.After(time.Now()) {
+			writeError(w, r, "invalid expires_at: must be in the future", http.StatusBadRequest)
+			return
+		}
+		expiresAt = pgtype.Timestamptz{Time: *request.ExpiresAt, Valid: true}
+	}
+	if request.Filters == nil {
+		request.Filters = map[string]string{}
+	}
+	// Filter values are only parsed when the routes are matched, so check them
+	// before they can break the shared tiles.
+	if err := validateRouteFilters(request.Filters); err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filters, err := json.Marshal(request.Filters)
+	if err != nil {
+		writeError(w, r, "Invalid filters", http.StatusBadRequest)
+		return
+	}
+
+	// Routes stored before the private flag was synced aren't known to be
+	// private until all activities are synced again.
+	syncedAt, err := s.queries.GetActivitiesSyncedAt(r.Context(), userID)
+	if err != nil {
+		slog.Error("Failed to check activity sync", "userID", userID, "error", err)
+		writeError(w, r, "Failed to create share", http.StatusInternalServerError)
+		return
+	}
+	if !syncedAt.Valid {
+		writeError(w, r, "Activities are still syncing, share links can be created once they are synced", http.StatusConflict)
+		return
+	}
+
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		slog.Error("Failed to generate share token", "error", err)
+		writeError(w, r, "Failed to create share", http.StatusInternalServerError)
+		return
+	}
+
+	share, err := s.queries.CreateShare(r.Context(), db.CreateShareParams{
+		UserID:        userID,
+		Token:         base64.RawURLEncoding.EncodeToString(token),
+		Name:          strings.TrimSpace(request.Name),
+		Filters:       filters,
+		Layers:        request.Layers,
+		PublicProfile: request.PublicProfile,
+		ExpiresAt:     expiresAt,
+	})
+	if isPgError(err, "23514") {
+		writeError(w, r, "Invalid filters, must be tile filter params other than include_hidden", http.StatusBadRequest)
+		return
+	}
+	if isPgError(err, "23505") {
+		writeError(w, r, "Public profile already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to create share", "userID", userID, "error", err)
+		writeError(w, r, "Failed to create share", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newShareResponse(share))
+}
+
+// revokeShare revokes a share link. Its tiles are rejected by the tile auth
+// endpoint right away; the cached tiles are purged as well.
+func (s *Server) revokeShare(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	shareID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		writeError(w, r, fmt.Sprintf("invalid share id: %q", chi.URLParam(r, "id")), http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := s.queries.RevokeShare(r.Context(), db.RevokeShareParams{
+		ID:     int32(shareID),
+		UserID: userID,
+	})
+	if err != nil {
+		slog.Error("Failed to revoke share", "shareID", shareID, "userID", userID, "error", err)
+		writeError(w, r, "Failed to revoke share", http.StatusInternalServerError)
+		return
+	}
+	if revoked == 0 {
+		writeError(w, r, "Share not found", http.StatusNotFound)
+		return
+	}
+
+	s.jobs.Go(func() { s.purgeTileCache(userID) })
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sharedMap is what anonymous viewers get to see of a share: enough to request
+// its tiles (with the tile_query params) and the totals and bounds of the
+// shared routes.
+type sharedMap struct {
+	UserID     int64              `json:"user_id"`
+	Token      string             `json:"token"`
+	TileQuery  string             `json:"tile_query"`
+	Name       string             `json:"name"`
+	Filters    json.RawMessage    `json:"filters"`
+	Layers     []string           `json:"layers"`
+	ExpiresAt  pgtype.Timestamptz `json:"expires_at"`
+	RouteCount int32              `json:"route_count"`
+	Distance   float64            `json:"distance"`
+	MovingTime int64              `json:"moving_time"`
+	Elevation  float64            `json:"elevation"`
+	FirstDate  pgtype.Timestamptz `json:"first_date"`
+	LastDate   pgtype.Timestamptz `json:"last_date"`
+	Bounds     string             `json:"bounds"`
+}
+
+// writeSharedMap responds with the sharedMap of a share.
+func (s *Server) writeSharedMap(w http.ResponseWriter, r *http.Request, share db.Share) {
+	filters, err := sharedFilters(share, nil)
+	if err != nil {
+		slog.Error("Invalid share filters", "shareID", share.ID, "error", err)
+		writeError(w, r, "Failed to fetch share", http.StatusInternalServerError)
+		return
+	}
+	totals, err := s.queries.GetSharedRouteTotals(r.Context(), db.GetSharedRouteTotalsParams{
+		UserID:  share.UserID,
+		Filters: filters,
+	})
+	if err != nil {
+		slog.Error("Failed to fetch shared route totals", "shareID", share.ID, "error", err)
+		writeError(w, r, "Failed to fetch share", http.StatusInternalServerError)
+		return
+	}
+
+	response := sharedMap{
+		UserID:     share.UserID,
+		Token:      share.Token,
+		TileQuery:  s.tileQuery(share.UserID, share.Token, shareTileSignatureTTL).Encode(),
+		Name:       share.Name,
+		Filters:    share.Filters,
+		Layers:     share.Layers,
+		ExpiresAt:  share.ExpiresAt,
+		RouteCount: totals.RouteCount,
+		Distance:   totals.Distance,
+		MovingTime: totals.MovingTime,
+		Elevation:  totals.Elevation,
+		FirstDate:  totals.FirstDate,
+		LastDate:   totals.LastDate,
+	}
+	if totals.MinLat.Valid {
+		response.Bounds = fmt.Sprintf("%f,%f,%f,%f", totals.MinLat.Float64, totals.MinLng.Float64, totals.MaxLat.Float64, totals.MaxLng.Float64)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// activeShare looks up the share of the {token} URL param, responding with
+// 404 if it doesn't exist, expired or was revoked.
+func (s *Server) activeShare(w http.ResponseWriter, r *http.Request) (db.Share, bool) {
+	share, err := s.queries.GetActiveShare(r.Context(), chi.URLParam(r, "token"))
+	if err == pgx.ErrNoRows {
+		writeError(w, r, "Share not found", http.StatusNotFound)
+		return share, false
+	}
+	if err != nil {
+		slog.Error("Failed to fetch share", "error", err)
+		writeError(w, r, "Failed to fetch share", http.StatusInternalServerError)
+		return share, false
+	}
+	return share, true
+}
+
+// getSharedMap returns the sharedMap of a share link. It needs no session.
+func (s *Server) getSharedMap(w http.ResponseWriter, r *http.Request) {
+	share, ok := s.activeShare(w, r)
+	if !ok {
+		return
+	}
+	s.writeSharedMap(w, r, share)
+}
+
+// getPublicProfile returns the sharedMap of a user's public profile, if they
+// opted in. It needs no session.
+func (s *Server) getPublicProfile(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		writeError(w, r, fmt.Sprintf("invalid user id: %q", chi.URLParam(r, "userID")), http.StatusBadRequest)
+		return
+	}
+
+	share, err := s.queries.GetPublicProfileShare(r.Context(), userID)
+	if err == pgx.ErrNoRows {
+		writeError(w, r, "Profile not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to fetch public profile", "userID", userID, "error", err)
+		writeError(w, r, "Failed to fetch profile", http.StatusInternalServerError)
+		return
+	}
+	s.writeSharedMap(w, r, share)
+}
+
+// sharedRoute is the summary of a route shown through a share link. It leaves
+// out the route's bounds, description and local notes.
+type sharedRoute struct {
+	ID             int64              `json:"id"`
+	Name           string             `json:"name"`
+	SportType      pgtype.Text        `json:"sport_type"`
+	StartDate      pgtype.Timestamptz `json:"start_date"`
+	ElapsedTime    int32              `json:"elapsed_time"`
+	MovingTime     int32              `json:"moving_time"`
+	Distance       float64            `json:"distance"`
+	AverageSpeed   float64            `json:"average_speed"`
+	Elevation      float64            `json:"elevation"`
+	UniqueDistance pgtype.Float8      `json:"unique_distance"`
+}
+
+// listSharedRoutes returns a page of the routes of a share link, most recent
+// first. Like the route list it takes further tile filters, q, limit and
+// cursor. It needs no session.
+func (s *Server) listSharedRoutes(w http.ResponseWriter, r *http.Request) {
+	share, ok := s.activeShare(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultRouteListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRouteListLimit {
+			writeError(w, r, fmt.Sprintf("invalid limit: %q, must be between 1 and %d", v, maxRouteListLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	params := db.ListRoutesPageParams{
+		Sort:       "start_date",
+		UserID:     share.UserID,
+		Direction:  -1,
+		MaxResults: int32(limit) + 1, // one more to tell whether there is a next page
+	}
+	if v := query.Get("q"); v != "" {
+		params.Search = pgtype.Text{String: v, Valid: true}
+	}
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := decodeRouteListCursor(v)
+		if err != nil || cursor.Sort != params.Sort || cursor.Order != "desc" {
+			writeError(w, r, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+		params.AfterValue = pgtype.Float8{Float64: cursor.Value, Valid: true}
+		params.AfterID = cursor.ID
+	}
+
+	if _, err := routeFilters(query, "q", "limit", "cursor"); err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var err error
+	params.Filters, err = sharedFilters(share, query, "q", "limit", "cursor")
+	if err != nil {
+		slog.Error("Invalid share filters", "shareID", share.ID, "error", err)
+		writeError(w, r, "Failed to list routes", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := s.queries.ListRoutesPage(r.Context(), params)
+	if err != nil {
+		slog.Error("Failed to list shared routes", "shareID", share.ID, "error", err)
+		writeError(w, r, "Failed to list routes", http.StatusInternalServerError)
+		return
+	}
+
+	var nextCursor *string
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[len(rows)-1]
+		cursor := routeListCursor{Sort: params.Sort, Order: "desc", Value: last.SortValue, ID: last.ID}.encode()
+		nextCursor = &cursor
+	}
+
+	routes := make([]sharedRoute, len(rows))
+	for i, row := range rows {
+		routes[i] = sharedRoute{
+			ID:             row.ID,
+			Name:           row.Name,
+			SportType:      row.SportType,
+			StartDate:      row.StartDate,
+			ElapsedTime:    row.ElapsedTime,
+			MovingTime:     row.MovingTime,
+			Distance:       row.Distance,
+			AverageSpeed:   row.AverageSpeed,
+			Elevation:      row.Elevation,
+			UniqueDistance: row.UniqueDistance,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Routes     []sharedRoute `json:"routes"`
+		NextCursor *string       `json:"next_cursor"`
+	}{
+		Routes:     routes,
+		NextCursor: nextCursor,
+	})
+}
+
+// listPrivacyZones returns the privacy zones of the user.
+func (s *Server) listPrivacyZones(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	zones, err := s.queries.ListPrivacyZones(r.Context(), userID)
+	if err != nil {
+		slog.Error("Failed to list privacy zones", "userID", userID, "error", err)
+		writeError(w, r, "Failed to list privacy zones", http.StatusInternalServerError)
+		return
+	}
+	if zones == nil {
+		zones = []db.PrivacyZone{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zones)
+}
+
+// createPrivacyZone adds a privacy zone of radius_meters around lat, lng.
+func (s *Server) createPrivacyZone(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Name         string   `json:"name"`
+		Lat          *float64 `json:"lat"`
+		Lng          *float64 `json:"lng"`
+		RadiusMeters *float64 `json:"radius_meters"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		slog.Error("Failed to decode privacy zone", "userID", userID, "error", err)
+		writeError(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if request.Lat == nil || request.Lng == nil ||
+		*request.Lat < -90 || *request.Lat > 90 || *request.Lng < -180 || *request.Lng > 180 {
+		writeError(w, r, "invalid point: lat and lng are required", http.StatusBadRequest)
+		return
+	}
+	if request.RadiusMeters == nil || *request.RadiusMeters <= 0 || *request.RadiusMeters > 50000 {
+		writeError(w, r, "invalid radius_meters: must be between 0 and 50000 metres", http.StatusBadRequest)
+		return
+	}
+
+	zone, err := s.queries.CreatePrivacyZone(r.Context(), db.CreatePrivacyZoneParams{
+		UserID:       userID,
+		Name:         strings.TrimSpace(request.Name),
+		Lat:          *request.Lat,
+		Lng:          *request.Lng,
+		RadiusMeters: *request.RadiusMeters,
+	})
+	if err != nil {
+		slog.Error("Failed to create privacy zone", "userID", userID, "error", err)
+		writeError(w, r, "Failed to create privacy zone", http.StatusInternalServerError)
+		return
+	}
+
+	s.jobs.Go(func() { s.purgeTileCache(userID) })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(zone)
+}
+
+// deletePrivacyZone deletes a privacy zone.
+func (s *Server) deletePrivacyZone(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	zoneID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		writeError(w, r, fmt.Sprintf("invalid privacy zone id: %q", chi.URLParam(r, "id")), http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := s.queries.DeletePrivacyZone(r.Context(), db.DeletePrivacyZoneParams{
+		ID:     int32(zoneID),
+		UserID: userID,
+	})
+	if err != nil {
+		slog.Error("Failed to delete privacy zone", "zoneID", zoneID, "userID", userID, "error", err)
+		writeError(w, r, "Failed to delete privacy zone", http.StatusInternalServerError)
+		return
+	}
+	if deleted == 0 {
+		writeError(w, r, "Privacy zone not found", http.StatusNotFound)
+		return
+	}
+
+	s.jobs.Go(func() { s.purgeTileCache(userID) })
+	w.WriteHeader(http.StatusNoContent)
+}
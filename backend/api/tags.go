@@ -0,0 +1,625 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+	"wanderwell/backend/db"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// maxTagNameLength caps the length of tag names, in characters.
+const maxTagNameLength = 64
+
+// validateTagName trims a tag name and checks that it can be used in the
+// comma-separated tag filter of the tiles and in URL paths.
+func validateTagName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxTagNameLength {
+		return "", fmt.Errorf("invalid tag name: must be between 1 and %d characters", maxTagNameLength)
+	}
+	if strings.ContainsAny(name, ",/") {
+		return "", errors.New("invalid tag name: must not contain ',' or '/'")
+	}
+	return name, nil
+}
+
+// parseTagName reads the tag name from the URL path. chi routes on the raw
+// path when the request has one, so the name may still be escaped.
+func parseTagName(r *http.Request) (string, error) {
+	name := chi.URLParam(r, "tag")
+	if r.URL.RawPath == "" {
+		return name, nil
+	}
+	unescaped, err := url.PathUnescape(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid tag: %q", name)
+	}
+	return unescaped, nil
+}
+
+// isPgError returns whether err is a PostgreSQL error with the given code,
+// e.g. 23505 for a unique violation.
+func isPgError(err error, code string) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == code
+}
+
+// tagExplorer is the contribution of a tag's routes to the explorer at a grid
+// zoom: the cells they touch and the cells one of them explored first.
+type tagExplorer struct {
+	GridZ    int   `json:"grid_z"`
+	Cells    int32 `json:"cells"`
+	NewCells int32 `json:"new_cells"`
+}
+
+// tagSummary is a tag with the totals and bounds of its routes.
+type tagSummary struct {
+	Name                 string             `json:"name"`
+	Description          string             `json:"description"`
+	CreatedAt            pgtype.Timestamptz `json:"created_at"`
+	RouteCount           int32              `json:"route_count"`
+	Distance             float64            `json:"distance"`
+	MovingTime           int64              `json:"moving_time"`
+	Elevation            float64            `json:"elevation"`
+	UniqueDistanceMeters float64            `json:"unique_distance_meters"`
+	FirstDate            pgtype.Timestamptz `json:"first_date"`
+	LastDate             pgtype.Timestamptz `json:"last_date"`
+	Bounds               string             `json:"bounds"`
+	Explorer             *tagExplorer       `json:"explorer,omitempty"`
+}
+
+func newTagSummary(row db.ListTagsRow) tagSummary {
+	summary := tagSummary{
+		Name:                 row.Name,
+		Description:          row.Description,
+		CreatedAt:            row.CreatedAt,
+		RouteCount:           row.RouteCount,
+		Distance:             row.Distance,
+		MovingTime:           row.MovingTime,
+		Elevation:            row.Elevation,
+		UniqueDistanceMeters: row.UniqueDistanceMeters,
+		FirstDate:            row.FirstDate,
+		LastDate:             row.LastDate,
+	}
+	// Same format as the bounds of a route; empty for tags without routes.
+	if row.MinLat.Valid {
+		summary.Bounds = fmt.Sprintf("%f,%f,%f,%f", row.MinLat.Float64, row.MinLng.Float64, row.MaxLat.Float64, row.MaxLng.Float64)
+	}
+	return summary
+}
+
+// listTags returns the tags of the user with the totals and bounds of their
+// routes.
+func (s *Server) listTags(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.queries.ListTags(r.Context(), db.ListTagsParams{UserID: userID})
+	if err != nil {
+		slog.Error("Failed to list tags", "userID", userID, "error", err)
+		writeError(w, r, "Failed to list tags", http.StatusInternalServerError)
+		return
+	}
+
+	tags := make([]tagSummary, len(rows))
+	for i, row := range rows {
+		tags[i] = newTagSummary(row)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+// createTag creates an empty tag of the user from a name and an optional
+// description.
+func (s *Server) createTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		slog.Error("Failed to decode tag", "userID", userID, "error", err)
+		writeError(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	name, err := validateTagName(request.Name)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tag, err := s.queries.CreateTag(r.Context(), db.CreateTagParams{
+		UserID:      userID,
+		Name:        name,
+		Description: request.Description,
+	})
+	if err == pgx.ErrNoRows {
+		writeError(w, r, "Tag already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to create tag", "userID", userID, "tag", name, "error", err)
+		writeError(w, r, "Failed to create tag", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tag)
+}
+
+// getTag returns a tag with the totals and bounds of its routes and their
+// explorer contribution at the optional grid_z.
+func (s *Server) getTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	name, err := parseTagName(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gridZ, err := parseGridZoom(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := s.queries.ListTags(r.Context(), db.ListTagsParams{
+		UserID: userID,
+		Name:   pgtype.Text{String: name, Valid: true},
+	})
+	if err != nil {
+		slog.Error("Failed to fetch tag", "userID", userID, "tag", name, "error", err)
+		writeError(w, r, "Failed to fetch tag", http.StatusInternalServerError)
+		return
+	}
+	if len(rows) == 0 {
+		writeError(w, r, "Tag not found", http.StatusNotFound)
+		return
+	}
+	summary := newTagSummary(rows[0])
+
+	contribution, err := s.queries.GetTagExplorerContribution(r.Context(), db.GetTagExplorerContributionParams{
+		Z:      int32(gridZ),
+		UserID: userID,
+		Tag:    name,
+	})
+	if err != nil {
+		slog.Error("Failed to fetch tag explorer contribution", "userID", userID, "tag", name, "error", err)
+		writeError(w, r, "Failed to fetch tag", http.StatusInternalServerError)
+		return
+	}
+	summary.Explorer = &tagExplorer{
+		GridZ:    gridZ,
+		Cells:    contribution.Cells,
+		NewCells: contribution.NewCells,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// updateTag renames a tag and/or changes its description. Fields missing from
+// the request keep their current value.
+func (s *Server) updateTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	name, err := parseTagName(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		slog.Error("Failed to decode tag update", "userID", userID, "tag", name, "error", err)
+		writeError(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	params := db.UpdateTagParams{
+		UserID: userID,
+		Name:   name,
+	}
+	if request.Name != nil {
+		newName, err := validateTagName(*request.Name)
+		if err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		params.NewName = pgtype.Text{String: newName, Valid: true}
+	}
+	if request.Description != nil {
+		params.Description = pgtype.Text{String: *request.Description, Valid: true}
+	}
+
+	tag, err := s.queries.UpdateTag(r.Context(), params)
+	if err == pgx.ErrNoRows {
+		writeError(w, r, "Tag not found", http.StatusNotFound)
+		return
+	}
+	if isPgError(err, "23505") {
+		writeError(w, r, "Tag already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to update tag", "userID", userID, "tag", name, "error", err)
+		writeError(w, r, "Failed to update tag", http.StatusInternalServerError)
+		return
+	}
+
+	if tag.Name != name {
+		s.jobs.Go(func() { s.purgeTileCache(userID) })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tag)
+}
+
+// deleteTag deletes a tag with its rules and removes it from its routes. The
+// routes themselves are kept.
+func (s *Server) deleteTag(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	name, err := parseTagName(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := s.queries.DeleteTag(r.Context(), db.DeleteTagParams{
+		UserID: userID,
+		Name:   name,
+	})
+	if err != nil {
+		slog.Error("Failed to delete tag", "userID", userID, "tag", name, "error", err)
+		writeError(w, r, "Failed to delete tag", http.StatusInternalServerError)
+		return
+	}
+	if deleted == 0 {
+		writeError(w, r, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	s.jobs.Go(func() { s.purgeTileCache(userID) })
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tagRoutes adds a tag to routes of the user, selected in one of these ways:
+//   - an area, given with the query params of the route search (see searchArea)
+//   - a full-text search q and/or the tile filter params, like the route list
+//   - a JSON body with the route_ids
+//
+// It returns the number of routes that were newly tagged.
+func (s *Server) tagRoutes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	name, err := parseTagName(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = s.queries.GetTag(r.Context(), db.GetTagParams{
+		UserID: userID,
+		Name:   name,
+	})
+	if err == pgx.ErrNoRows {
+		writeError(w, r, "Tag not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to fetch tag", "userID", userID, "tag", name, "error", err)
+		writeError(w, r, "Failed to tag routes", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	var tagged int64
+	switch {
+	case query.Has("bbox") || query.Has("polygon") || query.Has("lat"):
+		area, radius, areaErr := searchArea(query)
+		if areaErr != nil {
+			writeError(w, r, areaErr.Error(), http.StatusBadRequest)
+			return
+		}
+		tagged, err = s.queries.TagRoutesByArea(r.Context(), db.TagRoutesByAreaParams{
+			RadiusMeters: radius,
+			Area:         area,
+			UserID:       userID,
+			Tag:          name,
+		})
+
+	case len(query) > 0:
+		filters, filtersErr := routeFilters(query, "q")
+		if filtersErr != nil {
+			writeError(w, r, filtersErr.Error(), http.StatusBadRequest)
+			return
+		}
+		params := db.TagRoutesBySearchParams{
+			UserID:  userID,
+			Tag:     name,
+			Filters: filters,
+		}
+		if v := query.Get("q"); v != "" {
+			params.Search = pgtype.Text{String: v, Valid: true}
+		}
+		tagged, err = s.queries.TagRoutesBySearch(r.Context(), params)
+
+	default:
+		var request struct {
+			RouteIDs []int64 `json:"route_ids"`
+		}
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&request); err != nil || len(request.RouteIDs) == 0 {
+			writeError(w, r, "Invalid request body, route_ids or an area or search query is required", http.StatusBadRequest)
+			return
+		}
+		tagged, err = s.queries.TagRoutesByID(r.Context(), db.TagRoutesByIDParams{
+			UserID:   userID,
+			Tag:      name,
+			RouteIds: request.RouteIDs,
+		})
+	}
+	if err != nil {
+		slog.Error("Failed to tag routes", "userID", userID, "tag", name, "error", err)
+		writeError(w, r, "Failed to tag routes", http.StatusInternalServerError)
+		return
+	}
+
+	if tagged > 0 {
+		s.jobs.Go(func() { s.purgeTileCache(userID) })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"tagged": tagged})
+}
+
+// untagRoutes removes a tag from the route_ids in the JSON body. It returns
+// the number of routes that were untagged.
+func (s *Server) untagRoutes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	name, err := parseTagName(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		RouteIDs []int64 `json:"route_ids"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil || len(request.RouteIDs) == 0 {
+		writeError(w, r, "Invalid request body, route_ids is required", http.StatusBadRequest)
+		return
+	}
+
+	untagged, err := s.queries.UntagRoutes(r.Context(), db.UntagRoutesParams{
+		UserID:   userID,
+		Tag:      name,
+		RouteIds: request.RouteIDs,
+	})
+	if err != nil {
+		slog.Error("Failed to untag routes", "userID", userID, "tag", name, "error", err)
+		writeError(w, r, "Failed to untag routes", http.StatusInternalServerError)
+		return
+	}
+
+	if untagged > 0 {
+		s.jobs.Go(func() { s.purgeTileCache(userID) })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"untagged": untagged})
+}
+
+// listTagRules returns the auto-tag rules of a tag.
+func (s *Server) listTagRules(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	name, err := parseTagName(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rules, err := s.queries.ListTagRules(r.Context(), db.ListTagRulesParams{
+		UserID: userID,
+		Tag:    name,
+	})
+	if err != nil {
+		slog.Error("Failed to list tag rules", "userID", userID, "tag", name, "error", err)
+		writeError(w, r, "Failed to list tag rules", http.StatusInternalServerError)
+		return
+	}
+	if rules == nil {
+		rules = []db.TagRule{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// createTagRule adds an auto-tag rule to a tag and applies it to the existing
+// routes of the user; new and changed routes are tagged on ingest. A rule
+// matches routes whose name matches name_pattern (a case-insensitive POSIX
+// regular expression) and/or that start within radius_meters of lat, lng.
+func (s *Server) createTagRule(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	name, err := parseTagName(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		NamePattern  *string  `json:"name_pattern"`
+		Lat          *float64 `json:"lat"`
+		Lng          *float64 `json:"lng"`
+		RadiusMeters *float64 `json:"radius_meters"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		slog.Error("Failed to decode tag rule", "userID", userID, "tag", name, "error", err)
+		writeError(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	params := db.CreateTagRuleParams{
+		UserID: userID,
+		Tag:    name,
+	}
+	if request.NamePattern != nil && *request.NamePattern != "" {
+		params.NamePattern = pgtype.Text{String: *request.NamePattern, Valid: true}
+	}
+	hasPoint := request.Lat != nil || request.Lng != nil || request.RadiusMeters != nil
+	if hasPoint {
+		if request.Lat == nil || request.Lng == nil || request.RadiusMeters == nil ||
+			*request.Lat < -90 || *request.Lat > 90 || *request.Lng < -180 || *request.Lng > 180 {
+			writeError(w, r, "invalid point: lat, lng and radius_meters are required together", http.StatusBadRequest)
+			return
+		}
+		if *request.RadiusMeters <= 0 || *request.RadiusMeters > 50000 {
+			writeError(w, r, "invalid radius_meters: must be between 0 and 50000 metres", http.StatusBadRequest)
+			return
+		}
+		params.Lat = pgtype.Float8{Float64: *request.Lat, Valid: true}
+		params.Lng = pgtype.Float8{Float64: *request.Lng, Valid: true}
+		params.RadiusMeters = pgtype.Float8{Float64: *request.RadiusMeters, Valid: true}
+	}
+	if !params.NamePattern.Valid && !hasPoint {
+		writeError(w, r, "name_pattern or lat, lng and radius_meters is required", http.StatusBadRequest)
+		return
+	}
+
+	rule, err := s.queries.CreateTagRule(r.Context(), params)
+	if isPgError(err, "23503") {
+		writeError(w, r, "Tag not found", http.StatusNotFound)
+		return
+	}
+	if isPgError(err, "23514") || isPgError(err, "2201B") {
+		writeError(w, r, "invalid name_pattern: must be a POSIX regular expression", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to create tag rule", "userID", userID, "tag", name, "error", err)
+		writeError(w, r, "Failed to create tag rule", http.StatusInternalServerError)
+		return
+	}
+
+	tagged, err := s.queries.ApplyTagRule(r.Context(), rule.ID)
+	if err != nil {
+		slog.Error("Failed to apply tag rule", "ruleID", rule.ID, "userID", userID, "error", err)
+	}
+	if tagged > 0 {
+		s.jobs.Go(func() { s.purgeTileCache(userID) })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		db.TagRule
+		Tagged int64 `json:"tagged"`
+	}{rule, tagged})
+}
+
+// deleteTagRule deletes an auto-tag rule. Routes it already tagged keep the
+// tag.
+func (s *Server) deleteTagRule(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	name, err := parseTagName(r)
+	if err != nil {
+		writeError(w, r, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ruleID, err := strconv.ParseInt(chi.URLParam(r, "ruleID"), 10, 32)
+	if err != nil {
+		writeError(w, r, fmt.Sprintf("invalid rule id: %q", chi.URLParam(r, "ruleID")), http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := s.queries.DeleteTagRule(r.Context(), db.DeleteTagRuleParams{
+		ID:     int32(ruleID),
+		UserID: userID,
+		Tag:    name,
+	})
+	if err != nil {
+		slog.Error("Failed to delete tag rule", "ruleID", ruleID, "userID", userID, "error", err)
+		writeError(w, r, "Failed to delete tag rule", http.StatusInternalServerError)
+		return
+	}
+	if deleted == 0 {
+		writeError(w, r, "Tag rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
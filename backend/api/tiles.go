@@ -0,0 +1,281 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"wanderwell/backend/tiles"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+)
+
+// Lifetimes of signed tile URLs. The frontend renews the user's own with
+// GET /auth/tile_query, and those of a share link with GET /shared/{token}.
+const (
+	ownerTileSignatureTTL = 12 * time.Hour
+	shareTileSignatureTTL = time.Hour
+)
+
+// tileSignature returns the hex HMAC-SHA256 of the params a signed tile URL
+// vouches for. varnish/signed.vcl computes the same.
+func (s *Server) tileSignature(userID, share, expires string) string {
+	mac := hmac.New(sha256.New, s.tileSigningKey)
+	mac.Write([]byte(userID + ":" + share + ":" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// tileQuery returns the query params for the tile URLs of a user, through a
+// share link if share is set. With a signing key configured they are signed
+// (expires and sig) for ttl from now.
+func (s *Server) tileQuery(userID int64, share string, ttl time.Duration) url.Values {
+	query := url.Values{}
+	query.Set("user_id", strconv.FormatInt(userID, 10))
+	if share != "" {
+		query.Set("share", share)
+	}
+	if len(s.tileSigningKey) > 0 {
+		expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+		query.Set("expires", expires)
+		query.Set("sig", s.tileSignature(query.Get("user_id"), share, expires))
+	}
+	return query
+}
+
+// verifyTileSignature returns whether the tile params carry a valid signature
+// that hasn't expired.
+func (s *Server) verifyTileSignature(query url.Values) bool {
+	if len(s.tileSigningKey) == 0 {
+		return false
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := s.tileSignature(query.Get("user_id"), query.Get("share"), query.Get("expires"))
+	return hmac.Equal([]byte(expected), []byte(query.Get("sig")))
+}
+
+// getTileQuery returns the query params the frontend adds to the user's own
+// tile URLs.
+func (s *Server) getTileQuery(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"tile_query": s.tileQuery(userID, "", ownerTileSignatureTTL).Encode(),
+	})
+}
+
+// tileSources returns the Martin sources of a tile request path, e.g.
+// /user_routes/12/2148/1423 or a composite source like /user_routes,user_endpoints.
+func tileSources(path string) []string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if n := len(segments); n >= 4 {
+		_, zErr := strconv.Atoi(segments[n-3])
+		_, xErr := strconv.Atoi(segments[n-2])
+		_, yErr := strconv.Atoi(segments[n-1])
+		if zErr == nil && xErr == nil && yErr == nil {
+			segments = segments[:n-3]
+		}
+	}
+	return strings.Split(segments[len(segments)-1], ",")
+}
+
+// authorizeTiles is the ForwardAuth endpoint that Traefik calls for tile
+// requests, with the original request in X-Forwarded-Uri. See
+// authorizeTileRequest for the tiles that are allowed.
+func (s *Server) authorizeTiles(w http.ResponseWriter, r *http.Request) {
+	uri, err := url.ParseRequestURI(r.Header.Get("X-Forwarded-Uri"))
+	if err != nil {
+		writeError(w, r, "X-Forwarded-Uri required", http.StatusBadRequest)
+		return
+	}
+
+	s.authorizeTileRequest(w, r, tileSources(uri.Path), uri.Query(), func(w http.ResponseWriter, r *http.Request, userID int64) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// authorizeTileRequest calls next for a request of the tiles of some sources
+// with the given query params if they are allowed. The tiles of the requested
+// user_id are allowed:
+//   - with a valid signature (see tileQuery), which is all varnish/signed.vcl
+//     checks as well
+//   - through a share link (?share=<token>) of that user while it is active
+//     and includes the requested layers
+//   - for the user's own session
+func (s *Server) authorizeTileRequest(w http.ResponseWriter, r *http.Request, sources []string, query url.Values, next func(w http.ResponseWriter, r *http.Request, userID int64)) {
+	// Repeated params could be checked here and then read differently by
+	// the tile server.
+	for _, name := range []string{"user_id", "share", "expires", "sig"} {
+		if len(query[name]) > 1 {
+			writeError(w, r, "Repeated "+name, http.StatusForbidden)
+			return
+		}
+	}
+	userID, err := strconv.ParseInt(query.Get("user_id"), 10, 64)
+	if err != nil {
+		writeError(w, r, "user_id required", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case query.Has("sig"):
+		if !s.verifyTileSignature(query) {
+			writeError(w, r, "Invalid tile signature", http.StatusForbidden)
+			return
+		}
+
+	case query.Has("share"):
+		share, err := s.queries.GetActiveShare(r.Context(), query.Get("share"))
+		if err == pgx.ErrNoRows {
+			writeError(w, r, "Invalid share", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to fetch share", "error", err)
+			writeError(w, r, "Failed to fetch share", http.StatusInternalServerError)
+			return
+		}
+		if share.UserID != userID {
+			writeError(w, r, "Invalid share", http.StatusForbidden)
+			return
+		}
+		if share.Layers != nil {
+			for _, source := range sources {
+				if !slices.Contains(share.Layers, source) {
+					writeError(w, r, "Layer not shared", http.StatusForbidden)
+					return
+				}
+			}
+		}
+
+	default:
+		s.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sessionUserID, _ := r.Context().Value(userIDKey).(int64); sessionUserID != userID {
+				slog.Warn("Tile request for another user", "userID", sessionUserID, "requestedUserID", userID)
+				writeError(w, r, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next(w, r, userID)
+		})).ServeHTTP(w, r)
+		return
+	}
+
+	next(w, r, userID)
+}
+
+// getTileJSON returns the TileJSON of a layer served by getTile, like the
+// Martin source URLs the map style points at, e.g. /tiles/user_routes?user_id=1.
+// The tile URLs keep the query params.
+func (s *Server) getTileJSON(w http.ResponseWriter, r *http.Request) {
+	layer := chi.URLParam(r, "layer")
+	if !slices.Contains(tiles.Layers, layer) {
+		writeError(w, r, fmt.Sprintf("invalid layer: %q, must be one of %s", layer, strings.Join(tiles.Layers, ", ")), http.StatusNotFound)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	tileURL := fmt.Sprintf("%s://%s/tiles/%s/{z}/{x}/{y}.mvt", scheme, r.Host, layer)
+	if r.URL.RawQuery != "" {
+		tileURL += "?" + r.URL.RawQuery
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"tilejson": "3.0.0",
+		"name":     layer,
+		"tiles":    []string{tileURL},
+		"minzoom":  0,
+		"maxzoom":  tiles.MaxZoom,
+	})
+}
+
+// getTile serves a vector tile of a layer straight from the MVT functions, for
+// running without Martin and Varnish. It takes the same query params as the
+// Martin tile URLs and is authorized like them. Rendered tiles are kept in
+// s.tileCache until purgeTileCache drops the user's tiles.
+func (s *Server) getTile(w http.ResponseWriter, r *http.Request) {
+	layer := chi.URLParam(r, "layer")
+	if !slices.Contains(tiles.Layers, layer) {
+		writeError(w, r, fmt.Sprintf("invalid layer: %q, must be one of %s", layer, strings.Join(tiles.Layers, ", ")), http.StatusNotFound)
+		return
+	}
+	var coords [3]int
+	for i, name := range []string{"z", "x", "y"} {
+		value, err := strconv.Atoi(chi.URLParam(r, name))
+		if err != nil {
+			writeError(w, r, fmt.Sprintf("invalid %s: %q", name, chi.URLParam(r, name)), http.StatusBadRequest)
+			return
+		}
+		coords[i] = value
+	}
+	z, x, y := coords[0], coords[1], coords[2]
+	if !tiles.ValidTile(z, x, y) {
+		writeError(w, r, fmt.Sprintf("invalid tile: %d/%d/%d", z, x, y), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	s.authorizeTileRequest(w, r, []string{layer}, query, func(w http.ResponseWriter, r *http.Request, userID int64) {
+		if _, err := routeFilters(query); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The explorer layer casts grid_z in SQL like the route filters.
+		if _, err := parseGridZoom(r); err != nil {
+			writeError(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Like varnish/signed.vcl, cache the tiles once for all signatures.
+		query.Del("expires")
+		query.Del("sig")
+		key := fmt.Sprintf("%s/%d/%d/%d?%s", layer, z, x, y, query.Encode())
+
+		tile, ok := s.tileCache.Get(userID, key)
+		if !ok {
+			// The MVT functions read the query params as a JSON object of
+			// strings, as passed by Martin.
+			params := make(map[string]string, len(query))
+			for name := range query {
+				params[name] = query.Get(name)
+			}
+			var err error
+			tile, err = tiles.Render(r.Context(), s.queries, layer, z, x, y, params)
+			if err != nil {
+				slog.Error("Failed to render tile", "userID", userID, "layer", layer, "z", z, "x", x, "y", y, "error", err)
+				writeError(w, r, "Failed to render tile", http.StatusInternalServerError)
+				return
+			}
+			s.tileCache.Add(userID, key, tile)
+		}
+
+		if len(tile) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(tile)
+	})
+}
@@ -0,0 +1,267 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"wanderwell/backend/db"
+	"wanderwell/backend/tiles"
+
+	"github.com/gorilla/sessions"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/markbates/goth/gothic"
+)
+
+// shareDB serves GetActiveShare from a map of active shares by token. Any
+// other query fails.
+type shareDB map[string]db.Share
+
+func (d shareDB) Exec(context.Context, string, ...interface{}) (pgconn.CommandTag, error) {
+	return pgconn.CommandTag{}, errors.New("unexpected Exec")
+}
+
+func (d shareDB) Query(context.Context, string, ...interface{}) (pgx.Rows, error) {
+	return nil, errors.New("unexpected Query")
+}
+
+func (d shareDB) QueryRow(_ context.Context, sql string, args ...interface{}) pgx.Row {
+	if !strings.Contains(sql, "name: GetActiveShare ") {
+		return shareRow{err: errors.New("unexpected QueryRow")}
+	}
+	share, ok := d[args[0].(string)]
+	if !ok {
+		return shareRow{err: pgx.ErrNoRows}
+	}
+	return shareRow{share: share}
+}
+
+type shareRow struct {
+	share db.Share
+	err   error
+}
+
+func (r shareRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	*dest[0].(*int32) = r.share.ID
+	*dest[1].(*int64) = r.share.UserID
+	*dest[2].(*string) = r.share.Token
+	*dest[3].(*string) = r.share.Name
+	*dest[4].(*[]byte) = r.share.Filters
+	*dest[5].(*[]string) = r.share.Layers
+	*dest[6].(*bool) = r.share.PublicProfile
+	return nil
+}
+
+func newTileTestServer(signingKey string, shares shareDB) *Server {
+	s := &Server{tileSigningKey: []byte(signingKey)}
+	if shares != nil {
+		s.queries = db.New(shares)
+	}
+	return s
+}
+
+// signedTileQuery returns the signed tile params of a user and share that
+// expire at expires.
+func signedTileQuery(s *Server, userID, share string, expires time.Time) url.Values {
+	query := url.Values{}
+	query.Set("user_id", userID)
+	if share != "" {
+		query.Set("share", share)
+	}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("sig", s.tileSignature(userID, share, query.Get("expires")))
+	return query
+}
+
+// TestTileSignature pins the signature to the HMAC-SHA256 that
+// varnish/signed.vcl computes, e.g. with
+// printf '1::1700000000' | openssl dgst -sha256 -hmac test-key.
+func TestTileSignature(t *testing.T) {
+	s := newTileTestServer("test-key", nil)
+	tests := []struct {
+		userID, share, expires string
+		want                   string
+	}{
+		{"1", "", "1700000000", "b9eab421c3627ba0b7fee00d7198eb3bce7c70a616c3c9330af8f8dcf358609c"},
+		{"1", "abc", "1700000000", "8461d32d0dbf952e243035413882645d49c71a81c505ed73bc9c8a0190fea671"},
+	}
+	for _, tt := range tests {
+		if got := s.tileSignature(tt.userID, tt.share, tt.expires); got != tt.want {
+			t.Errorf("tileSignature(%q, %q, %q) = %s, want %s", tt.userID, tt.share, tt.expires, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTileSignature(t *testing.T) {
+	s := newTileTestServer("test-key", nil)
+	valid := time.Now().Add(time.Hour)
+	tests := []struct {
+		name  string
+		query url.Values
+		want  bool
+	}{
+		{"valid", signedTileQuery(s, "1", "", valid), true},
+		{"valid with share", signedTileQuery(s, "1", "abc", valid), true},
+		{"from tileQuery", s.tileQuery(1, "abc", time.Minute), true},
+		{"expired", signedTileQuery(s, "1", "", time.Now().Add(-time.Second)), false},
+		{"tampered user_id", with(signedTileQuery(s, "1", "", valid), "user_id", "2"), false},
+		{"tampered share", with(signedTileQuery(s, "1", "abc", valid), "share", "abd"), false},
+		{"share added", with(signedTileQuery(s, "1", "", valid), "share", "abc"), false},
+		{"share removed", without(signedTileQuery(s, "1", "abc", valid), "share"), false},
+		{"tampered expires", with(signedTileQuery(s, "1", "", valid), "expires", strconv.FormatInt(valid.Unix()+1, 10)), false},
+		{"invalid expires", with(signedTileQuery(s, "1", "", valid), "expires", "soon"), false},
+		{"uppercase sig", with(signedTileQuery(s, "1", "", valid), "sig", strings.ToUpper(signedTileQuery(s, "1", "", valid).Get("sig"))), false},
+		{"no sig", without(signedTileQuery(s, "1", "", valid), "sig"), false},
+		{"other key", signedTileQuery(newTileTestServer("other-key", nil), "1", "", valid), false},
+	}
+	for _, tt := range tests {
+		if got := s.verifyTileSignature(tt.query); got != tt.want {
+			t.Errorf("%s: verifyTileSignature(%s) = %v, want %v", tt.name, tt.query.Encode(), got, tt.want)
+		}
+	}
+
+	// Without a signing key, nothing is signed.
+	unsigned := newTileTestServer("", nil)
+	if unsigned.verifyTileSignature(signedTileQuery(unsigned, "1", "", valid)) {
+		t.Error("verifyTileSignature without a signing key = true, want false")
+	}
+}
+
+func with(query url.Values, name, value string) url.Values {
+	query.Set(name, value)
+	return query
+}
+
+func without(query url.Values, name string) url.Values {
+	query.Del(name)
+	return query
+}
+
+// useTestSessionStore replaces the session store, whose key is otherwise only
+// set from SESSION_SECRET, for the test.
+func useTestSessionStore(t *testing.T) {
+	t.Helper()
+	saved := gothic.Store
+	gothic.Store = sessions.NewCookieStore([]byte("test-session-key"))
+	t.Cleanup(func() { gothic.Store = saved })
+}
+
+// sessionCookies returns the cookies of a session of the user.
+func sessionCookies(t *testing.T, userID int64) []*http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := gothic.Store.New(r, "user-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["user_id"] = userID
+	w := httptest.NewRecorder()
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()
+}
+
+func TestAuthorizeTileRequest(t *testing.T) {
+	useTestSessionStore(t)
+	shares := shareDB{
+		"all-layers": {UserID: 1, Token: "all-layers"},
+		"routes":     {UserID: 1, Token: "routes", Layers: []string{"user_routes"}},
+		"other-user": {UserID: 2, Token: "other-user"},
+	}
+	s := newTileTestServer("test-key", shares)
+	valid := time.Now().Add(time.Hour)
+	repeated := signedTileQuery(s, "1", "", valid)
+	repeated.Add("user_id", "2")
+	repeatedShare := url.Values{"user_id": {"1"}, "share": {"routes", "all-layers"}}
+
+	tests := []struct {
+		name    string
+		sources []string
+		query   url.Values
+		session int64 // user of the session, 0 for none
+		want    int
+	}{
+		{"valid signature", []string{"user_routes"}, signedTileQuery(s, "1", "", valid), 0, http.StatusOK},
+		{"valid signature of a share", []string{"user_routes"}, signedTileQuery(s, "1", "abc", valid), 0, http.StatusOK},
+		{"expired signature", []string{"user_routes"}, signedTileQuery(s, "1", "", time.Now().Add(-time.Minute)), 0, http.StatusForbidden},
+		{"tampered user_id", []string{"user_routes"}, with(signedTileQuery(s, "2", "", valid), "user_id", "1"), 0, http.StatusForbidden},
+		{"tampered share", []string{"user_routes"}, with(signedTileQuery(s, "1", "abc", valid), "share", "routes"), 0, http.StatusForbidden},
+		{"repeated user_id", []string{"user_routes"}, repeated, 0, http.StatusForbidden},
+		{"repeated share", []string{"user_routes"}, repeatedShare, 0, http.StatusForbidden},
+		{"missing user_id", []string{"user_routes"}, url.Values{"share": {"all-layers"}}, 0, http.StatusForbidden},
+		{"share", []string{"user_routes", "user_endpoints"}, url.Values{"user_id": {"1"}, "share": {"all-layers"}}, 0, http.StatusOK},
+		{"share of the layer", []string{"user_routes"}, url.Values{"user_id": {"1"}, "share": {"routes"}}, 0, http.StatusOK},
+		{"share of other layers", []string{"user_routes", "user_endpoints"}, url.Values{"user_id": {"1"}, "share": {"routes"}}, 0, http.StatusForbidden},
+		{"share of another user", []string{"user_routes"}, url.Values{"user_id": {"1"}, "share": {"other-user"}}, 0, http.StatusForbidden},
+		{"inactive share", []string{"user_routes"}, url.Values{"user_id": {"1"}, "share": {"revoked"}}, 0, http.StatusForbidden},
+		{"session", []string{"user_routes"}, url.Values{"user_id": {"1"}}, 1, http.StatusOK},
+		{"session of another user", []string{"user_routes"}, url.Values{"user_id": {"1"}}, 2, http.StatusForbidden},
+		{"no session", []string{"user_routes"}, url.Values{"user_id": {"1"}}, 0, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/tiles/auth", nil)
+			if tt.session != 0 {
+				for _, cookie := range sessionCookies(t, tt.session) {
+					r.AddCookie(cookie)
+				}
+			}
+			w := httptest.NewRecorder()
+			var authorized int64
+			s.authorizeTileRequest(w, r, tt.sources, tt.query, func(w http.ResponseWriter, r *http.Request, userID int64) {
+				authorized = userID
+				w.WriteHeader(http.StatusOK)
+			})
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d (%s)", w.Code, tt.want, strings.TrimSpace(w.Body.String()))
+			}
+			if tt.want == http.StatusOK && authorized != 1 {
+				t.Errorf("authorized user %d, want 1", authorized)
+			}
+			if tt.want != http.StatusOK && authorized != 0 {
+				t.Errorf("authorized user %d, want none", authorized)
+			}
+		})
+	}
+}
+
+// TestAuthorizeTilesEncodedParams checks that percent-encoded param names,
+// which the tile server decodes, count as repeated params too.
+func TestAuthorizeTilesEncodedParams(t *testing.T) {
+	s := newTileTestServer("test-key", nil)
+	signed := signedTileQuery(s, "1", "", time.Now().Add(time.Hour)).Encode()
+	for _, extra := range []string{"user%5Fid=2", "%75ser_id=2", "sh%61re=abc"} {
+		r := httptest.NewRequest(http.MethodGet, "/tiles/auth", nil)
+		r.Header.Set("X-Forwarded-Uri", "/user_routes/1/0/0?"+signed+"&"+extra)
+		w := httptest.NewRecorder()
+		s.authorizeTiles(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("with %s: status = %d, want %d", extra, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestGetTileInvalidGridZoom(t *testing.T) {
+	server := NewServer(nil, nil, "", "", "", 0, "test-key", tiles.NewCache(0), "")
+	signed := signedTileQuery(server, "1", "", time.Now().Add(time.Hour)).Encode()
+	for _, gridZ := range []string{"13", "abc", "14.0"} {
+		r := httptest.NewRequest(http.MethodGet, "/tiles/user_explorer_tiles/14/8800/5370.mvt?"+signed+"&grid_z="+gridZ, nil)
+		w := httptest.NewRecorder()
+		server.router.ServeHTTP(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("grid_z=%s: status = %d, want %d", gridZ, w.Code, http.StatusBadRequest)
+		}
+	}
+}
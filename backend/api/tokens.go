@@ -0,0 +1,221 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"wanderwell/backend/db"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// apiTokenPrefix starts every API token, so that they are recognizable e.g.
+// by secret scanners.
+const apiTokenPrefix = "ww_"
+
+// apiTokenIDKey holds the ID of the API token a request was authenticated
+// with; it is missing for session requests.
+const apiTokenIDKey contextKey = "apiTokenID"
+
+// apiTokenResponse is an API token as returned to its owner, without the hash.
+// Token is only set when it is created.
+type apiTokenResponse struct {
+	ID         int32              `json:"id"`
+	Name       string             `json:"name"`
+	Scope      string             `json:"scope"`
+	Token      string             `json:"token,omitempty"`
+	LastUsedAt pgtype.Timestamptz `json:"last_used_at"`
+	CreatedAt  pgtype.Timestamptz `json:"created_at"`
+}
+
+func newAPITokenResponse(token db.ApiToken) apiTokenResponse {
+	return apiTokenResponse{
+		ID:         token.ID,
+		Name:       token.Name,
+		Scope:      token.Scope,
+		LastUsedAt: token.LastUsedAt,
+		CreatedAt:  token.CreatedAt,
+	}
+}
+
+func hashAPIToken(token string) []byte {
+	hash := sha256.Sum256([]byte(token))
+	return hash[:]
+}
+
+// writeGETPaths are the GET routes that change data, which read tokens are
+// refused like any other method. GET /update predates the tokens and is kept
+// for the scripts that call it.
+var writeGETPaths = []string{"/update"}
+
+// authenticateAPIToken is the part of RequireAuth for requests with an
+// "Authorization: Bearer <token>" header. read tokens are limited to GET and
+// HEAD requests outside writeGETPaths, so no other GET handler may change the
+// user's data.
+func (s *Server) authenticateAPIToken(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !strings.HasPrefix(token, apiTokenPrefix) {
+		writeError(w, r, "Invalid Authorization header, must be a Bearer API token", http.StatusUnauthorized)
+		return
+	}
+
+	apiToken, err := s.queries.GetActiveApiToken(r.Context(), hashAPIToken(token))
+	if err == pgx.ErrNoRows {
+		writeError(w, r, "Invalid API token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to fetch API token", "error", err)
+		writeError(w, r, "Failed to fetch API token", http.StatusInternalServerError)
+		return
+	}
+	readOnly := (r.Method == http.MethodGet || r.Method == http.MethodHead) && !slices.Contains(writeGETPaths, r.URL.Path)
+	if apiToken.Scope == "read" && !readOnly {
+		writeError(w, r, "API token is read-only", http.StatusForbidden)
+		return
+	}
+
+	if err := s.queries.TouchApiToken(r.Context(), apiToken.ID); err != nil {
+		slog.Error("Failed to update API token last use", "tokenID", apiToken.ID, "error", err)
+	}
+
+	ctx := context.WithValue(r.Context(), userIDKey, apiToken.UserID)
+	ctx = context.WithValue(ctx, apiTokenIDKey, apiToken.ID)
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// RequireSession is a middleware, after RequireAuth, that rejects requests
+// authenticated with an API token, so that a token can't mint or revoke
+// tokens.
+func (s *Server) RequireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(apiTokenIDKey).(int32); ok {
+			writeError(w, r, "API tokens can't manage API tokens", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) listAPITokens(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := s.queries.ListApiTokens(r.Context(), userID)
+	if err != nil {
+		slog.Error("Failed to list API tokens", "userID", userID, "error", err)
+		writeError(w, r, "Failed to list API tokens", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]apiTokenResponse, len(tokens))
+	for i, token := range tokens {
+		response[i] = newAPITokenResponse(token)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// createAPIToken mints a named API token with the read or read_write scope.
+// The token itself is only returned here; only its hash is stored.
+func (s *Server) createAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Name  string `json:"name"`
+		Scope string `json:"scope"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		slog.Error("Failed to decode API token", "userID", userID, "error", err)
+		writeError(w, r, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(request.Name)
+	if name == "" || len(name) > 100 {
+		writeError(w, r, "invalid name: must be 1 to 100 characters", http.StatusBadRequest)
+		return
+	}
+	if request.Scope != "read" && request.Scope != "read_write" {
+		writeError(w, r, fmt.Sprintf("invalid scope: %q, must be one of read, read_write", request.Scope), http.StatusBadRequest)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		slog.Error("Failed to generate API token", "error", err)
+		writeError(w, r, "Failed to create API token", http.StatusInternalServerError)
+		return
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	apiToken, err := s.queries.CreateApiToken(r.Context(), db.CreateApiTokenParams{
+		UserID:    userID,
+		Name:      name,
+		TokenHash: hashAPIToken(token),
+		Scope:     request.Scope,
+	})
+	if err != nil {
+		slog.Error("Failed to create API token", "userID", userID, "error", err)
+		writeError(w, r, "Failed to create API token", http.StatusInternalServerError)
+		return
+	}
+
+	response := newAPITokenResponse(apiToken)
+	response.Token = token
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) revokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(userIDKey).(int64)
+	if !ok {
+		writeError(w, r, "user_id not found in context", http.StatusBadRequest)
+		return
+	}
+
+	tokenID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 32)
+	if err != nil {
+		writeError(w, r, fmt.Sprintf("invalid API token id: %q", chi.URLParam(r, "id")), http.StatusBadRequest)
+		return
+	}
+
+	revoked, err := s.queries.RevokeApiToken(r.Context(), db.RevokeApiTokenParams{
+		ID:     int32(tokenID),
+		UserID: userID,
+	})
+	if err != nil {
+		slog.Error("Failed to revoke API token", "tokenID", tokenID, "userID", userID, "error", err)
+		writeError(w, r, "Failed to revoke API token", http.StatusInternalServerError)
+		return
+	}
+	if revoked == 0 {
+		writeError(w, r, "API token not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
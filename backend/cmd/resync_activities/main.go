@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"wanderwell/backend/config"
+	"wanderwell/backend/db"
+	"wanderwell/backend/strava"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/joho/godotenv"
+)
+
+// Syncs the activities of users from Strava like on their first login: missing
+// activities are added, and the name, sport type, flags and privacy of the
+// stored routes are updated from the activity summaries. Share links can only
+// be created once a user's activities are synced this way. Webhooks keep
+// routes up to date afterwards, so this is only needed once after upgrading to
+// fill in fields that routes synced before did not store. The descriptions
+// are not in the summaries: with -descriptions, the detailed activity of every
+// route without one is fetched as well, which takes one Strava request per
+// route. It reads the same environment (or .env file) as the server and waits
+// for the Strava rate limit when it is exhausted.
+func main() {
+	userID := flag.Int64("user", 0, "Only sync the activities of this user (default: all users)")
+	descriptions := flag.Bool("descriptions", false, "Also fetch the descriptions of routes that have none")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Printf("No .env file found, proceeding with environment variables")
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	// Stop at the next activity on Ctrl-C; running again picks up the rest.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	pool, err := pgxpool.New(ctx, cfg.DatabasePath)
+	if err != nil {
+		log.Fatalf("Failed to connect to PostGIS: %v", err)
+	}
+	defer pool.Close()
+
+	userIDs := []int64{*userID}
+	if *userID == 0 {
+		userIDs, err = db.New(pool).ListAthleteIDs(ctx)
+		if err != nil {
+			log.Fatalf("Failed to list users: %v", err)
+		}
+	}
+
+	cacheUpdater := strava.NewCacheUpdater(pool, cfg, strava.NewStravaAPI(pool, cfg))
+	// A user who revoked the app's access fails; carry on with the others.
+	failed := 0
+	for i, id := range userIDs {
+		if ctx.Err() != nil {
+			log.Fatalf("Interrupted after %d of %d users, run again to sync the rest", i, len(userIDs))
+		}
+		if err := cacheUpdater.UpdateActivityCache(ctx, id); err != nil {
+			log.Printf("Failed to sync activities of user %d: %v", id, err)
+			failed++
+			continue
+		}
+		if *descriptions {
+			filled, err := cacheUpdater.BackfillDescriptions(ctx, id)
+			if err != nil {
+				log.Printf("Failed to fetch descriptions of user %d: %v", id, err)
+				failed++
+			}
+			log.Printf("Filled in %d route descriptions of user %d", filled, id)
+		}
+		log.Printf("Synced activities of user %d", id)
+	}
+
+	if failed > 0 {
+		log.Fatalf("Failed to sync activities of %d of %d users", failed, len(userIDs))
+	}
+	log.Printf("Synced activities of %d users", len(userIDs))
+}
@@ -22,6 +22,16 @@ type Config struct {
 	TileCacheURL string
 	// optional: Strava user ID of the admin user (for restricted endpoints)
 	AdminUserID int64
+	// optional: secret key for signed tile URLs that the tile cache can
+	// validate without asking the backend
+	TileSigningKey string
+	// optional: serve tiles from the backend at /tiles, with an in-memory
+	// cache of TileMemoryCacheMB megabytes
+	ServeTiles        bool
+	TileMemoryCacheMB int
+	// optional: Bearer token of the Prometheus scraper for /metrics, which
+	// is otherwise only open to the admin user
+	MetricsToken string
 }
 
 func validateRequired(name, value string) error {
@@ -44,6 +54,8 @@ func Load() (*Config, error) {
 		SESSION_SECRET:     os.Getenv("SESSION_SECRET"),
 		SESSION_KEY:        os.Getenv("SESSION_KEY"),
 		TileCacheURL:       os.Getenv("TILE_CACHE_URL"),
+		TileSigningKey:     os.Getenv("TILE_SIGNING_KEY"),
+		MetricsToken:       os.Getenv("METRICS_TOKEN"),
 	}
 
 	// Parse optional AdminUserID
@@ -55,6 +67,23 @@ func Load() (*Config, error) {
 		cfg.AdminUserID = adminID
 	}
 
+	// Parse optional in-process tile serving
+	if serveTilesStr := os.Getenv("SERVE_TILES"); serveTilesStr != "" {
+		serveTiles, err := strconv.ParseBool(serveTilesStr)
+		if err != nil {
+			return nil, fmt.Errorf("SERVE_TILES must be a boolean: %w", err)
+		}
+		cfg.ServeTiles = serveTiles
+	}
+	cfg.TileMemoryCacheMB = 256
+	if cacheMBStr := os.Getenv("TILE_MEMORY_CACHE_MB"); cacheMBStr != "" {
+		cacheMB, err := strconv.Atoi(cacheMBStr)
+		if err != nil || cacheMB < 0 {
+			return nil, fmt.Errorf("TILE_MEMORY_CACHE_MB must be a non-negative integer: %q", cacheMBStr)
+		}
+		cfg.TileMemoryCacheMB = cacheMB
+	}
+
 	// Validate required fields
 	requiredFields := map[string]string{
 		"STRAVA_CLIENT_ID":     cfg.StravaClientID,
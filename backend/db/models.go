@@ -8,31 +8,178 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+type ApiToken struct {
+	ID         int32              `json:"id"`
+	UserID     int64              `json:"user_id"`
+	Name       string             `json:"name"`
+	TokenHash  []byte             `json:"token_hash"`
+	Scope      string             `json:"scope"`
+	LastUsedAt pgtype.Timestamptz `json:"last_used_at"`
+	RevokedAt  pgtype.Timestamptz `json:"revoked_at"`
+	CreatedAt  pgtype.Timestamptz `json:"created_at"`
+}
+
 type Athlete struct {
-	ID           int64       `json:"id"`
-	Firstname    pgtype.Text `json:"firstname"`
-	Lastname     pgtype.Text `json:"lastname"`
-	ExpiresAt    pgtype.Int8 `json:"expires_at"`
-	RefreshToken pgtype.Text `json:"refresh_token"`
-	AccessToken  pgtype.Text `json:"access_token"`
+	ID                 int64              `json:"id"`
+	Firstname          pgtype.Text        `json:"firstname"`
+	Lastname           pgtype.Text        `json:"lastname"`
+	ExpiresAt          pgtype.Int8        `json:"expires_at"`
+	RefreshToken       pgtype.Text        `json:"refresh_token"`
+	AccessToken        pgtype.Text        `json:"access_token"`
+	ActivitiesSyncedAt pgtype.Timestamptz `json:"activities_synced_at"`
 }
 
-type Route struct {
-	ID           int64              `json:"id"`
+type ExploredCell struct {
+	UserID       int64              `json:"user_id"`
+	Z            int32              `json:"z"`
+	X            int32              `json:"x"`
+	Y            int32              `json:"y"`
+	FirstVisit   pgtype.Timestamptz `json:"first_visit"`
+	LastVisit    pgtype.Timestamptz `json:"last_visit"`
+	VisitCount   int32              `json:"visit_count"`
+	FirstRouteID int64              `json:"first_route_id"`
+}
+
+type ExplorerStat struct {
+	UserID      int64              `json:"user_id"`
+	Z           int32              `json:"z"`
+	TotalTiles  int32              `json:"total_tiles"`
+	MaxCluster  int32              `json:"max_cluster"`
+	MaxSquare   int32              `json:"max_square"`
+	ClusterGeom string             `json:"cluster_geom"`
+	SquareGeom  string             `json:"square_geom"`
+	UpdatedAt   pgtype.Timestamptz `json:"updated_at"`
+	SquareX     pgtype.Int4        `json:"square_x"`
+	SquareY     pgtype.Int4        `json:"square_y"`
+}
+
+type PrivacyZone struct {
+	ID           int32              `json:"id"`
 	UserID       int64              `json:"user_id"`
-	StartDate    pgtype.Timestamptz `json:"start_date"`
 	Name         string             `json:"name"`
-	ElapsedTime  int32              `json:"elapsed_time"`
-	MovingTime   int32              `json:"moving_time"`
-	Distance     float64            `json:"distance"`
-	AverageSpeed float64            `json:"average_speed"`
-	Elevation    float64            `json:"elevation"`
-	Bounds       string             `json:"bounds"`
-	SportType    pgtype.Text        `json:"sport_type"`
-	Geom         string             `json:"geom"`
+	Lat          float64            `json:"lat"`
+	Lng          float64            `json:"lng"`
+	RadiusMeters float64            `json:"radius_meters"`
+	CreatedAt    pgtype.Timestamptz `json:"created_at"`
+}
+
+type Region struct {
+	ID   int32  `json:"id"`
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	Geom string `json:"geom"`
+}
+
+type Route struct {
+	ID             int64              `json:"id"`
+	UserID         int64              `json:"user_id"`
+	StartDate      pgtype.Timestamptz `json:"start_date"`
+	Name           string             `json:"name"`
+	ElapsedTime    int32              `json:"elapsed_time"`
+	MovingTime     int32              `json:"moving_time"`
+	Distance       float64            `json:"distance"`
+	AverageSpeed   float64            `json:"average_speed"`
+	Elevation      float64            `json:"elevation"`
+	Bounds         string             `json:"bounds"`
+	SportType      pgtype.Text        `json:"sport_type"`
+	Geom           string             `json:"geom"`
+	Commute        bool               `json:"commute"`
+	Trainer        bool               `json:"trainer"`
+	Geom3857       string             `json:"geom_3857"`
+	Geom3857Z7     string             `json:"geom_3857_z7"`
+	Geom3857Z10    string             `json:"geom_3857_z10"`
+	Geom3857Z13    string             `json:"geom_3857_z13"`
+	StartDateLocal pgtype.Timestamp   `json:"start_date_local"`
+	Description    string             `json:"description"`
+	SearchVector   interface{}        `json:"search_vector"`
+	Private        bool               `json:"private"`
+}
+
+type RouteCell struct {
+	RouteID int64 `json:"route_id"`
+	UserID  int64 `json:"user_id"`
+	Z       int32 `json:"z"`
+	X       int32 `json:"x"`
+	Y       int32 `json:"y"`
+}
+
+type RouteNewGround struct {
+	RouteID         int64              `json:"route_id"`
+	UserID          int64              `json:"user_id"`
+	DistanceMeters  float64            `json:"distance_meters"`
+	Geom            string             `json:"geom"`
+	ComputedAt      pgtype.Timestamptz `json:"computed_at"`
+	TimeWindow      string             `json:"time_window"`
+	WindowDays      int32              `json:"window_days"`
+	ToleranceMeters float64            `json:"tolerance_meters"`
+	SampleMeters    float64            `json:"sample_meters"`
+}
+
+type RouteOverride struct {
+	RouteID               int64              `json:"route_id"`
+	UserID                int64              `json:"user_id"`
+	Name                  pgtype.Text        `json:"name"`
+	Hidden                bool               `json:"hidden"`
+	ExcludeExplorer       bool               `json:"exclude_explorer"`
+	ExcludeUniqueDistance bool               `json:"exclude_unique_distance"`
+	Notes                 string             `json:"notes"`
+	SearchVector          interface{}        `json:"search_vector"`
+	UpdatedAt             pgtype.Timestamptz `json:"updated_at"`
+}
+
+type RouteStream struct {
+	RouteID   int64              `json:"route_id"`
+	UserID    int64              `json:"user_id"`
+	TimeS     []int32            `json:"time_s"`
+	DistanceM []float64          `json:"distance_m"`
+	AltitudeM []float64          `json:"altitude_m"`
+	Lat       []float64          `json:"lat"`
+	Lng       []float64          `json:"lng"`
+	FetchedAt pgtype.Timestamptz `json:"fetched_at"`
+}
+
+type RouteTag struct {
+	RouteID int64  `json:"route_id"`
+	UserID  int64  `json:"user_id"`
+	Tag     string `json:"tag"`
+}
+
+type Share struct {
+	ID            int32              `json:"id"`
+	UserID        int64              `json:"user_id"`
+	Token         string             `json:"token"`
+	Name          string             `json:"name"`
+	Filters       []byte             `json:"filters"`
+	Layers        []string           `json:"layers"`
+	PublicProfile bool               `json:"public_profile"`
+	ExpiresAt     pgtype.Timestamptz `json:"expires_at"`
+	RevokedAt     pgtype.Timestamptz `json:"revoked_at"`
+	CreatedAt     pgtype.Timestamptz `json:"created_at"`
+}
+
+type Tag struct {
+	UserID      int64              `json:"user_id"`
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	CreatedAt   pgtype.Timestamptz `json:"created_at"`
+}
+
+type TagRule struct {
+	ID           int32              `json:"id"`
+	UserID       int64              `json:"user_id"`
+	Tag          string             `json:"tag"`
+	NamePattern  pgtype.Text        `json:"name_pattern"`
+	Lat          pgtype.Float8      `json:"lat"`
+	Lng          pgtype.Float8      `json:"lng"`
+	RadiusMeters pgtype.Float8      `json:"radius_meters"`
+	CreatedAt    pgtype.Timestamptz `json:"created_at"`
 }
 
 type UserPreference struct {
-	UserID              int64 `json:"user_id"`
-	WriteUniqueDistance bool  `json:"write_unique_distance"`
+	UserID                   int64   `json:"user_id"`
+	WriteUniqueDistance      bool    `json:"write_unique_distance"`
+	NewGroundWindow          string  `json:"new_ground_window"`
+	NewGroundDays            int32   `json:"new_ground_days"`
+	NewGroundToleranceMeters float64 `json:"new_ground_tolerance_meters"`
+	NewGroundSampleMeters    float64 `json:"new_ground_sample_meters"`
 }
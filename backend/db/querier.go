@@ -6,28 +6,188 @@ package db
 
 import (
 	"context"
+
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
 type Querier interface {
+	// Updates the planner statistics of the route table, e.g. after bulk inserts.
+	AnalyzeRoutes(ctx context.Context) error
+	// Tags every existing route of the user that matches the rule. New and
+	// changed routes are tagged by the route_tag_rules triggers.
+	ApplyTagRule(ctx context.Context, id int32) (int64, error)
+	// Counts the explorer cells at grid zoom z that the route explored first.
+	CountRouteNewExplorerCells(ctx context.Context, arg CountRouteNewExplorerCellsParams) (int32, error)
+	CreateApiToken(ctx context.Context, arg CreateApiTokenParams) (ApiToken, error)
+	CreatePrivacyZone(ctx context.Context, arg CreatePrivacyZoneParams) (PrivacyZone, error)
+	CreateShare(ctx context.Context, arg CreateShareParams) (Share, error)
+	// Creates a tag of the user. Returns no row if it already exists.
+	CreateTag(ctx context.Context, arg CreateTagParams) (Tag, error)
+	CreateTagRule(ctx context.Context, arg CreateTagRuleParams) (TagRule, error)
+	DeleteExploredCellsByUser(ctx context.Context, userID int64) error
+	DeletePrivacyZone(ctx context.Context, arg DeletePrivacyZoneParams) (int64, error)
+	DeleteRouteCellsByUser(ctx context.Context, userID int64) error
+	// Deletes a tag with its route assignments and rules.
+	DeleteTag(ctx context.Context, arg DeleteTagParams) (int64, error)
+	DeleteTagRule(ctx context.Context, arg DeleteTagRuleParams) (int64, error)
+	// Returns the API token of a hash unless it was revoked.
+	GetActiveApiToken(ctx context.Context, tokenHash []byte) (ApiToken, error)
+	// Returns the share of a token unless it expired or was revoked.
+	GetActiveShare(ctx context.Context, token string) (Share, error)
+	GetActivitiesSyncedAt(ctx context.Context, id int64) (pgtype.Timestamptz, error)
 	GetAthlete(ctx context.Context, id int64) (GetAthleteRow, error)
 	GetAthleteTokens(ctx context.Context, id int64) (GetAthleteTokensRow, error)
+	// Returns the stored explorer statistics of a user at one grid zoom, with the
+	// bounds of the max cluster in EPSG:4326.
+	GetExplorerStats(ctx context.Context, arg GetExplorerStatsParams) (GetExplorerStatsRow, error)
+	// The body of user_routes before the precomputed geometries, where every route
+	// is transformed and clipped at full resolution. It is only kept as the
+	// baseline of cmd/bench_route_tiles.
+	GetLegacyUserRoutesTile(ctx context.Context, arg GetLegacyUserRoutesTileParams) ([]byte, error)
+	GetPublicProfileShare(ctx context.Context, userID int64) (Share, error)
+	GetRouteDetail(ctx context.Context, arg GetRouteDetailParams) (GetRouteDetailRow, error)
+	// Returns the start date of a stored route and whether wkt differs from its
+	// geometry, to tell whether upserting the route changes the new ground of the
+	// routes after it.
+	GetRouteGeometryChange(ctx context.Context, arg GetRouteGeometryChangeParams) (GetRouteGeometryChangeRow, error)
+	// Returns the name of a route as shown, i.e. the one of its override if set.
 	GetRouteName(ctx context.Context, arg GetRouteNameParams) (string, error)
+	GetRouteNewGround(ctx context.Context, arg GetRouteNewGroundParams) (GetRouteNewGroundRow, error)
+	GetRouteNewGroundDistance(ctx context.Context, routeID int64) (float64, error)
+	GetRouteStream(ctx context.Context, routeID int64) (RouteStream, error)
+	// Returns the fields of a route that are in Strava's activity summaries, to
+	// tell whether the route is stale.
+	GetRouteSummary(ctx context.Context, arg GetRouteSummaryParams) (GetRouteSummaryRow, error)
+	// Unique distance from the coverage grid with the same semantics as
+	// GetRouteUniqueDistanceMeters: compared against all other routes with a 10m
+	// tolerance and 20m sampling.
+	GetRouteUniqueDistanceFromCoverage(ctx context.Context, id int64) (float64, error)
+	// Reference implementation of the unique distance that compares every sample
+	// point against the other routes' geometries directly. Its cost grows with the
+	// user's history; it is only kept to validate the coverage grid approach in
+	// cmd/bench_unique_distance.
 	// Computes the meters of the route that don't come within 10m of any other route
 	// from the same user. Uses a point-sampling approach (one point per 20m) with
 	// geometry ST_DWithin so the GIST spatial index is used for each lookup.
-	// The result is capped at the route's own Strava-reported distance (in metres)
-	// so that a fully-unique route can never return a value larger than the route
-	// itself (PostGIS measures the raw GPS polyline, which is slightly longer than
-	// Strava's smoothed distance).
 	GetRouteUniqueDistanceMeters(ctx context.Context, id int64) (float64, error)
+	// Returns the version of the schema applied last.
+	GetSchemaVersion(ctx context.Context) (string, error)
+	// Returns the totals and the bounds of the user's routes matching the filters,
+	// with the privacy zones left out of the bounds.
+	GetSharedRouteTotals(ctx context.Context, arg GetSharedRouteTotalsParams) (GetSharedRouteTotalsRow, error)
+	GetTag(ctx context.Context, arg GetTagParams) (Tag, error)
+	// Counts the explorer cells at grid zoom z touched by the tag's routes and the
+	// cells that one of them explored first.
+	GetTagExplorerContribution(ctx context.Context, arg GetTagExplorerContributionParams) (GetTagExplorerContributionRow, error)
+	GetUserEndpointsTile(ctx context.Context, arg GetUserEndpointsTileParams) ([]byte, error)
+	GetUserExplorerTile(ctx context.Context, arg GetUserExplorerTileParams) ([]byte, error)
+	GetUserHeatmapTile(ctx context.Context, arg GetUserHeatmapTileParams) ([]byte, error)
+	GetUserNewGroundTile(ctx context.Context, arg GetUserNewGroundTileParams) ([]byte, error)
 	GetUserPreferences(ctx context.Context, userID int64) (UserPreference, error)
+	// The tile functions as Martin calls them, for the tiles served by the backend.
+	GetUserRoutesTile(ctx context.Context, arg GetUserRoutesTileParams) ([]byte, error)
+	// Aggregates route_cell into explored_cell for every cell of a user.
+	InsertExploredCellsByUser(ctx context.Context, userID int64) error
+	// Recomputes the cells of every route of a user at every explorer grid zoom
+	// and at the coverage grid zoom. Used to rebuild the materialized cells;
+	// regular updates go through the route triggers.
+	InsertRouteCellsByUser(ctx context.Context, userID int64) error
+	// Returns the API tokens of the user that were not revoked, newest first.
+	ListApiTokens(ctx context.Context, userID int64) ([]ApiToken, error)
 	ListAthleteIDs(ctx context.Context) ([]int64, error)
-	ListRoutesByUser(ctx context.Context, userID int64) ([]ListRoutesByUserRow, error)
+	ListExploredCells(ctx context.Context, arg ListExploredCellsParams) ([]ListExploredCellsRow, error)
+	// Returns the number of newly explored grid cells per period ('week', 'month'
+	// or 'year'), based on the first visit of each cell, and the running total.
+	ListExplorerProgressByPeriod(ctx context.Context, arg ListExplorerProgressByPeriodParams) ([]ListExplorerProgressByPeriodRow, error)
+	// Returns, per route in chronological order, how many grid cells it touches,
+	// how many of those it explored first, and the running total of explored cells.
+	ListExplorerProgressByRoute(ctx context.Context, arg ListExplorerProgressByRouteParams) ([]ListExplorerProgressByRouteRow, error)
+	// Returns the other routes of the user that share coverage grid cells with the
+	// route, with the fraction of the route's cells they share, largest first.
+	ListOverlappingRoutes(ctx context.Context, arg ListOverlappingRoutesParams) ([]ListOverlappingRoutesRow, error)
+	ListPrivacyZones(ctx context.Context, userID int64) ([]PrivacyZone, error)
+	// Returns the ids of the user's routes with an empty description, oldest
+	// first. The description is only in Strava's detailed activities, so routes
+	// stored before it was synced have none until they are fetched again.
+	ListRouteIDsWithoutDescription(ctx context.Context, userID int64) ([]int64, error)
+	ListRouteRegions(ctx context.Context, id int64) ([]ListRouteRegionsRow, error)
+	// Returns the routes whose start (kind = 'start') or end point (kind = 'end')
+	// lies in a cluster cell of the user_endpoints tiles, matching the same
+	// route filters as the tiles.
+	ListRoutesByEndpointCell(ctx context.Context, arg ListRoutesByEndpointCellParams) ([]ListRoutesByEndpointCellRow, error)
+	// Returns all routes of the user, most recent first. Routes hidden by their
+	// overrides are left out unless include_hidden is true.
+	ListRoutesByUser(ctx context.Context, arg ListRoutesByUserParams) ([]ListRoutesByUserRow, error)
+	// Returns a page of the user's routes matching the tile route filters, oldest
+	// first, with their geometry and stored streams for the exports, optionally
+	// narrowed by the same full-text search as ListRoutesPage. Pages are
+	// continued after (after_start_date, after_id); route_id limits the export to
+	// a single route.
+	ListRoutesForExport(ctx context.Context, arg ListRoutesForExportParams) ([]ListRoutesForExportRow, error)
+	// Returns a page of the user's routes matching the tile route filters and the
+	// optional full-text search over the Strava name and description and the
+	// local name and notes. The routes are ordered by the sort metric (and id to
+	// break ties), ascending for direction 1 and descending for -1; pages are
+	// continued after (after_value, after_id) of the last route.
+	ListRoutesPage(ctx context.Context, arg ListRoutesPageParams) ([]ListRoutesPageRow, error)
+	// Returns the shares of the user that were not revoked, newest first.
+	ListShares(ctx context.Context, userID int64) ([]Share, error)
+	ListTagRules(ctx context.Context, arg ListTagRulesParams) ([]TagRule, error)
+	// Returns the tags of the user (or only the named one) with the totals and
+	// bounds of their routes. The bounds are NULL for tags without routes.
+	ListTags(ctx context.Context, arg ListTagsParams) ([]ListTagsRow, error)
+	MarkActivitiesSynced(ctx context.Context, id int64) error
+	RecordSchemaVersion(ctx context.Context, version string) error
+	RevokeApiToken(ctx context.Context, arg RevokeApiTokenParams) (int64, error)
+	RevokeShare(ctx context.Context, arg RevokeShareParams) (int64, error)
 	RouteExists(ctx context.Context, id int64) (bool, error)
+	// Returns the user's routes that pass through an area, most recent first, with
+	// the length of the part inside it. The area is a GeoJSON geometry (EPSG:4326),
+	// buffered by radius_meters if that is positive, e.g. for a point. Routes
+	// hidden by their overrides are left out unless include_hidden is true.
+	SearchRoutesByArea(ctx context.Context, arg SearchRoutesByAreaParams) ([]SearchRoutesByAreaRow, error)
+	// Tags the user's routes that pass through an area, given like for
+	// SearchRoutesByArea.
+	TagRoutesByArea(ctx context.Context, arg TagRoutesByAreaParams) (int64, error)
+	// Tags the given routes of the user. Returns the number of newly tagged routes.
+	TagRoutesByID(ctx context.Context, arg TagRoutesByIDParams) (int64, error)
+	// Tags the user's routes that the route list would return for the filters and
+	// full-text search (see ListRoutesPage).
+	TagRoutesBySearch(ctx context.Context, arg TagRoutesBySearchParams) (int64, error)
+	// Sets the last use of an API token, at most once a minute to spare the writes.
+	TouchApiToken(ctx context.Context, id int32) error
+	UntagRoutes(ctx context.Context, arg UntagRoutesParams) (int64, error)
 	UpdateAthleteTokens(ctx context.Context, arg UpdateAthleteTokensParams) error
-	UpdateRouteName(ctx context.Context, arg UpdateRouteNameParams) error
+	UpdateRouteDescription(ctx context.Context, arg UpdateRouteDescriptionParams) error
+	// Updates the fields of a route that are in Strava's activity summaries.
+	UpdateRouteSummary(ctx context.Context, arg UpdateRouteSummaryParams) error
+	// Renames a tag and/or changes its description; NULL params keep the current
+	// value. The tag's routes are moved along and its rules follow the foreign key.
+	UpdateTag(ctx context.Context, arg UpdateTagParams) (Tag, error)
 	UpsertAthlete(ctx context.Context, arg UpsertAthleteParams) error
+	// Stores the explorer statistics of a user at one grid zoom. The max cluster is
+	// passed as the coordinates of its cells and the max square as its top-left cell.
+	UpsertExplorerStats(ctx context.Context, arg UpsertExplorerStatsParams) error
 	UpsertRoute(ctx context.Context, arg UpsertRouteParams) error
+	// Computes the parts of the route that aren't covered by an earlier route of
+	// the same user within the user's new ground window (see
+	// route_unique_segments) and stores them with their length and the settings
+	// used in route_new_ground.
+	// The length is capped at the route's own Strava-reported distance (in metres)
+	// so that a fully-unique route can never return a value larger than the route
+	// itself (PostGIS measures the raw GPS polyline, which is slightly longer than
+	// Strava's smoothed distance).
+	UpsertRouteNewGround(ctx context.Context, id int64) error
+	// Same as UpsertRouteNewGround for every route of a user that started at or
+	// after since (or for all of them if since is NULL). Adding a route only
+	// changes the new ground of the routes after it, and changing the settings
+	// changes all of them.
+	UpsertRouteNewGroundSince(ctx context.Context, arg UpsertRouteNewGroundSinceParams) error
+	// Updates the local overrides of a route of the user. Params that are NULL keep
+	// their current value; an empty name restores the Strava name. Returns no row
+	// if the route isn't the user's.
+	UpsertRouteOverride(ctx context.Context, arg UpsertRouteOverrideParams) (UpsertRouteOverrideRow, error)
+	UpsertRouteStream(ctx context.Context, arg UpsertRouteStreamParams) error
 	UpsertUserPreferences(ctx context.Context, arg UpsertUserPreferencesParams) (UserPreference, error)
 }
 
@@ -28,63 +28,208 @@ WHERE id = $1;
 SELECT id
 FROM athlete;
 
+-- name: GetActivitiesSyncedAt :one
+SELECT activities_synced_at
+FROM athlete
+WHERE id = @id;
+
+-- name: MarkActivitiesSynced :exec
+UPDATE athlete
+SET activities_synced_at = now()
+WHERE id = @id;
+
 -- name: GetUserPreferences :one
-SELECT user_id, write_unique_distance
+SELECT user_id, write_unique_distance, new_ground_window, new_ground_days, new_ground_tolerance_meters, new_ground_sample_meters
 FROM user_preferences
 WHERE user_id = $1;
 
 -- name: UpsertUserPreferences :one
-INSERT INTO user_preferences (user_id, write_unique_distance)
-VALUES ($1, $2)
+INSERT INTO user_preferences (user_id, write_unique_distance, new_ground_window, new_ground_days, new_ground_tolerance_meters, new_ground_sample_meters)
+VALUES ($1, $2, $3, $4, $5, $6)
 ON CONFLICT (user_id) DO UPDATE SET
-    write_unique_distance = EXCLUDED.write_unique_distance
-RETURNING user_id, write_unique_distance;
+    write_unique_distance       = EXCLUDED.write_unique_distance,
+    new_ground_window           = EXCLUDED.new_ground_window,
+    new_ground_days             = EXCLUDED.new_ground_days,
+    new_ground_tolerance_meters = EXCLUDED.new_ground_tolerance_meters,
+    new_ground_sample_meters    = EXCLUDED.new_ground_sample_meters
+RETURNING user_id, write_unique_distance, new_ground_window, new_ground_days, new_ground_tolerance_meters, new_ground_sample_meters;
 
 -- name: RouteExists :one
 SELECT COUNT(*) > 0
 FROM route
 WHERE id = $1;
 
+-- name: GetRouteGeometryChange :one
+-- Returns the start date of a stored route and whether wkt differs from its
+-- geometry, to tell whether upserting the route changes the new ground of the
+-- routes after it.
+SELECT start_date, geom IS DISTINCT FROM ST_GeomFromText(sqlc.narg(wkt)::text, 4326) AS geom_changed
+FROM route
+WHERE id = @id;
+
 -- name: UpsertRoute :exec
-INSERT INTO route (id, user_id, start_date, name, elapsed_time, moving_time, distance, average_speed, elevation, bounds, geom)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, ST_GeomFromText($11, 4326))
+INSERT INTO route (id, user_id, start_date, name, elapsed_time, moving_time, distance, average_speed, elevation, bounds, sport_type, commute, trainer, start_date_local, description, private, geom)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, ST_GeomFromText($17, 4326))
 ON CONFLICT (id) DO UPDATE SET
-    user_id       = EXCLUDED.user_id,
-    start_date    = EXCLUDED.start_date,
-    name          = EXCLUDED.name,
-    elapsed_time  = EXCLUDED.elapsed_time,
-    moving_time   = EXCLUDED.moving_time,
-    distance      = EXCLUDED.distance,
-    average_speed = EXCLUDED.average_speed,
-    elevation     = EXCLUDED.elevation,
-    bounds        = EXCLUDED.bounds,
-    geom          = EXCLUDED.geom;
+    user_id          = EXCLUDED.user_id,
+    start_date       = EXCLUDED.start_date,
+    name             = EXCLUDED.name,
+    elapsed_time     = EXCLUDED.elapsed_time,
+    moving_time      = EXCLUDED.moving_time,
+    distance         = EXCLUDED.distance,
+    average_speed    = EXCLUDED.average_speed,
+    elevation        = EXCLUDED.elevation,
+    bounds           = EXCLUDED.bounds,
+    sport_type       = EXCLUDED.sport_type,
+    commute          = EXCLUDED.commute,
+    trainer          = EXCLUDED.trainer,
+    start_date_local = EXCLUDED.start_date_local,
+    description      = EXCLUDED.description,
+    private          = EXCLUDED.private,
+    geom             = EXCLUDED.geom;
 
 
 -- name: GetRouteName :one
-SELECT name
+-- Returns the name of a route as shown, i.e. the one of its override if set.
+SELECT COALESCE(o.name, r.name) AS name
+FROM route r
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE r.id = $1 AND r.user_id = $2;
+
+-- name: GetRouteSummary :one
+-- Returns the fields of a route that are in Strava's activity summaries, to
+-- tell whether the route is stale.
+SELECT name, sport_type, commute, trainer, private
 FROM route
-WHERE id = $1 AND user_id = $2;
+WHERE id = @id AND user_id = @user_id;
 
--- name: UpdateRouteName :exec
+-- name: UpdateRouteSummary :exec
+-- Updates the fields of a route that are in Strava's activity summaries.
 UPDATE route
-SET name = $1
-WHERE id = $2 AND user_id = $3;
+SET name = @name, sport_type = @sport_type, commute = @commute, trainer = @trainer, private = @private
+WHERE id = @id AND user_id = @user_id;
+
+-- name: ListRouteIDsWithoutDescription :many
+-- Returns the ids of the user's routes with an empty description, oldest
+-- first. The description is only in Strava's detailed activities, so routes
+-- stored before it was synced have none until they are fetched again.
+SELECT id FROM route
+WHERE user_id = @user_id AND description = ''
+ORDER BY start_date, id;
+
+-- name: UpdateRouteDescription :exec
+UPDATE route SET description = @description
+WHERE id = @id AND user_id = @user_id;
 
 -- name: ListRoutesByUser :many
-SELECT id, user_id, start_date, name, elapsed_time, moving_time, distance, average_speed, elevation, bounds
-FROM route
-WHERE user_id = $1
-ORDER BY start_date DESC;
+-- Returns all routes of the user, most recent first. Routes hidden by their
+-- overrides are left out unless include_hidden is true.
+SELECT r.id, r.user_id, r.start_date, COALESCE(o.name, r.name) AS name, r.elapsed_time, r.moving_time, r.distance, r.average_speed, r.elevation, r.bounds,
+       ng.distance_meters AS unique_distance
+FROM route r
+LEFT JOIN route_new_ground ng ON ng.route_id = r.id
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE r.user_id = @user_id
+  AND (@include_hidden::boolean OR NOT COALESCE(o.hidden, FALSE))
+ORDER BY r.start_date DESC;
+
+-- name: UpsertRouteNewGround :exec
+-- Computes the parts of the route that aren't covered by an earlier route of
+-- the same user within the user's new ground window (see
+-- route_unique_segments) and stores them with their length and the settings
+-- used in route_new_ground.
+-- The length is capped at the route's own Strava-reported distance (in metres)
+-- so that a fully-unique route can never return a value larger than the route
+-- itself (PostGIS measures the raw GPS polyline, which is slightly longer than
+-- Strava's smoothed distance).
+INSERT INTO route_new_ground (route_id, user_id, distance_meters, geom, computed_at,
+                              time_window, window_days, tolerance_meters, sample_meters)
+SELECT
+    r.id,
+    r.user_id,
+    LEAST(
+        COALESCE(SUM(ST_Length(s.seg::geography)) FILTER (WHERE s.is_unique), 0),
+        r.distance * 1000
+    )::double precision,
+    ST_Multi(ST_LineMerge(ST_Collect(s.seg) FILTER (WHERE s.is_unique))),
+    now(),
+    p.new_ground_window,
+    p.new_ground_days,
+    p.new_ground_tolerance_meters,
+    p.new_ground_sample_meters
+FROM route r
+JOIN user_preferences p ON p.user_id = r.user_id
+CROSS JOIN LATERAL route_unique_segments(r.id, p.new_ground_window, p.new_ground_days,
+                                         p.new_ground_tolerance_meters, p.new_ground_sample_meters) s
+WHERE r.id = $1
+  AND r.geom IS NOT NULL
+GROUP BY r.id, p.user_id
+ON CONFLICT (route_id) DO UPDATE SET
+    user_id          = EXCLUDED.user_id,
+    distance_meters  = EXCLUDED.distance_meters,
+    geom             = EXCLUDED.geom,
+    computed_at      = EXCLUDED.computed_at,
+    time_window      = EXCLUDED.time_window,
+    window_days      = EXCLUDED.window_days,
+    tolerance_meters = EXCLUDED.tolerance_meters,
+    sample_meters    = EXCLUDED.sample_meters;
+
+-- name: UpsertRouteNewGroundSince :exec
+-- Same as UpsertRouteNewGround for every route of a user that started at or
+-- after since (or for all of them if since is NULL). Adding a route only
+-- changes the new ground of the routes after it, and changing the settings
+-- changes all of them.
+INSERT INTO route_new_ground (route_id, user_id, distance_meters, geom, computed_at,
+                              time_window, window_days, tolerance_meters, sample_meters)
+SELECT
+    r.id,
+    r.user_id,
+    LEAST(
+        COALESCE(SUM(ST_Length(s.seg::geography)) FILTER (WHERE s.is_unique), 0),
+        r.distance * 1000
+    )::double precision,
+    ST_Multi(ST_LineMerge(ST_Collect(s.seg) FILTER (WHERE s.is_unique))),
+    now(),
+    p.new_ground_window,
+    p.new_ground_days,
+    p.new_ground_tolerance_meters,
+    p.new_ground_sample_meters
+FROM route r
+JOIN user_preferences p ON p.user_id = r.user_id
+CROSS JOIN LATERAL route_unique_segments(r.id, p.new_ground_window, p.new_ground_days,
+                                         p.new_ground_tolerance_meters, p.new_ground_sample_meters) s
+WHERE r.user_id = @user_id
+  AND (sqlc.narg(since)::timestamptz IS NULL OR r.start_date >= sqlc.narg(since))
+  AND r.geom IS NOT NULL
+GROUP BY r.id, p.user_id
+ON CONFLICT (route_id) DO UPDATE SET
+    user_id          = EXCLUDED.user_id,
+    distance_meters  = EXCLUDED.distance_meters,
+    geom             = EXCLUDED.geom,
+    computed_at      = EXCLUDED.computed_at,
+    time_window      = EXCLUDED.time_window,
+    window_days      = EXCLUDED.window_days,
+    tolerance_meters = EXCLUDED.tolerance_meters,
+    sample_meters    = EXCLUDED.sample_meters;
+
+-- name: GetRouteUniqueDistanceFromCoverage :one
+-- Unique distance from the coverage grid with the same semantics as
+-- GetRouteUniqueDistanceMeters: compared against all other routes with a 10m
+-- tolerance and 20m sampling.
+SELECT LEAST(
+    COALESCE(SUM(ST_Length(s.seg::geography)) FILTER (WHERE s.is_unique), 0),
+    (SELECT distance * 1000 FROM route WHERE route.id = $1)
+)::double precision AS unique_distance_meters
+FROM route_unique_segments($1, 'all', 0, 10, 20) s;
 
 -- name: GetRouteUniqueDistanceMeters :one
+-- Reference implementation of the unique distance that compares every sample
+-- point against the other routes' geometries directly. Its cost grows with the
+-- user's history; it is only kept to validate the coverage grid approach in
+-- cmd/bench_unique_distance.
 -- Computes the meters of the route that don't come within 10m of any other route
 -- from the same user. Uses a point-sampling approach (one point per 20m) with
 -- geometry ST_DWithin so the GIST spatial index is used for each lookup.
--- The result is capped at the route's own Strava-reported distance (in metres)
--- so that a fully-unique route can never return a value larger than the route
--- itself (PostGIS measures the raw GPS polyline, which is slightly longer than
--- Strava's smoothed distance).
 WITH target AS (
     SELECT geom, user_id
     FROM route
@@ -127,3 +272,618 @@ SELECT LEAST(
     (SELECT distance * 1000 FROM route WHERE route.id = $1)
 )::double precision AS unique_distance_meters
 FROM segs;
+
+-- name: GetRouteNewGroundDistance :one
+SELECT distance_meters
+FROM route_new_ground
+WHERE route_id = $1;
+
+-- name: GetRouteNewGround :one
+SELECT route_id, distance_meters, COALESCE(ST_AsGeoJSON(geom), 'null')::text AS geometry, computed_at,
+       time_window, window_days, tolerance_meters, sample_meters
+FROM route_new_ground
+WHERE route_id = $1 AND user_id = $2;
+
+-- name: ListExploredCells :many
+SELECT x, y
+FROM explored_cell
+WHERE user_id = $1 AND z = $2;
+
+-- name: DeleteRouteCellsByUser :exec
+DELETE FROM route_cell
+WHERE user_id = $1;
+
+-- name: DeleteExploredCellsByUser :exec
+DELETE FROM explored_cell
+WHERE user_id = $1;
+
+-- name: InsertRouteCellsByUser :exec
+-- Recomputes the cells of every route of a user at every explorer grid zoom
+-- and at the coverage grid zoom. Used to rebuild the materialized cells;
+-- regular updates go through the route triggers.
+INSERT INTO route_cell (route_id, user_id, z, x, y)
+SELECT r.id, r.user_id, g.z, c.x, c.y
+FROM route r
+CROSS JOIN unnest(explorer_grid_zooms() || coverage_grid_zoom()) AS g(z)
+CROSS JOIN LATERAL route_cells(r.geom, g.z) c
+WHERE r.user_id = $1
+  AND r.geom IS NOT NULL
+  AND NOT route_cells_excluded(r.id, g.z);
+
+-- name: InsertExploredCellsByUser :exec
+-- Aggregates route_cell into explored_cell for every cell of a user.
+INSERT INTO explored_cell (user_id, z, x, y, first_visit, last_visit, visit_count, first_route_id)
+SELECT rc.user_id, rc.z, rc.x, rc.y,
+       min(r.start_date), max(r.start_date), count(*),
+       (array_agg(r.id ORDER BY r.start_date, r.id))[1]
+FROM route_cell rc
+JOIN route r ON r.id = rc.route_id
+WHERE rc.user_id = $1
+  AND rc.z = ANY (explorer_grid_zooms())
+GROUP BY rc.user_id, rc.z, rc.x, rc.y;
+
+-- name: UpsertExplorerStats :exec
+-- Stores the explorer statistics of a user at one grid zoom. The max cluster is
+-- passed as the coordinates of its cells and the max square as its top-left cell.
+INSERT INTO explorer_stats (user_id, z, total_tiles, max_cluster, max_square, cluster_geom, square_geom, square_x, square_y, updated_at)
+SELECT
+    @user_id::bigint,
+    @z::int,
+    @total_tiles::int,
+    @max_cluster::int,
+    @max_square::int,
+    (SELECT ST_Multi(ST_Union(ST_TileEnvelope(@z::int, c.x, c.y)))
+     FROM unnest(@cluster_x::int[], @cluster_y::int[]) AS c(x, y)),
+    CASE WHEN @max_square::int > 0 THEN
+        ST_Envelope(ST_Collect(
+            ST_TileEnvelope(@z::int, @square_x::int, @square_y::int),
+            ST_TileEnvelope(@z::int, @square_x::int + @max_square::int - 1, @square_y::int + @max_square::int - 1)
+        ))
+    END,
+    @square_x::int,
+    @square_y::int,
+    now()
+ON CONFLICT (user_id, z) DO UPDATE SET
+    total_tiles  = EXCLUDED.total_tiles,
+    max_cluster  = EXCLUDED.max_cluster,
+    max_square   = EXCLUDED.max_square,
+    cluster_geom = EXCLUDED.cluster_geom,
+    square_geom  = EXCLUDED.square_geom,
+    square_x     = EXCLUDED.square_x,
+    square_y     = EXCLUDED.square_y,
+    updated_at   = EXCLUDED.updated_at;
+
+-- name: GetExplorerStats :one
+-- Returns the stored explorer statistics of a user at one grid zoom, with the
+-- bounds of the max cluster in EPSG:4326.
+SELECT s.total_tiles, s.max_cluster, s.max_square, s.square_x, s.square_y,
+       ST_YMin(c.box)::float AS cluster_min_lat, ST_XMin(c.box)::float AS cluster_min_lng,
+       ST_YMax(c.box)::float AS cluster_max_lat, ST_XMax(c.box)::float AS cluster_max_lng
+FROM explorer_stats s
+LEFT JOIN LATERAL (SELECT ST_Transform(ST_Envelope(s.cluster_geom), 4326) AS box) c ON TRUE
+WHERE s.user_id = @user_id AND s.z = @z;
+
+-- name: ListExplorerProgressByRoute :many
+-- Returns, per route in chronological order, how many grid cells it touches,
+-- how many of those it explored first, and the running total of explored cells.
+SELECT r.id, COALESCE(o.name, r.name) AS name, r.start_date,
+       COUNT(*)::int AS cells,
+       (COUNT(*) FILTER (WHERE e.first_route_id = r.id))::int AS new_cells,
+       (SUM(COUNT(*) FILTER (WHERE e.first_route_id = r.id)) OVER (ORDER BY r.start_date, r.id))::int AS total_cells
+FROM route r
+JOIN route_cell rc ON rc.route_id = r.id AND rc.z = $2
+JOIN explored_cell e ON e.user_id = rc.user_id AND e.z = rc.z AND e.x = rc.x AND e.y = rc.y
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE r.user_id = $1
+GROUP BY r.id, o.name
+ORDER BY r.start_date, r.id;
+
+-- name: ListExplorerProgressByPeriod :many
+-- Returns the number of newly explored grid cells per period ('week', 'month'
+-- or 'year'), based on the first visit of each cell, and the running total.
+SELECT date_trunc(@period::text, first_visit)::timestamptz AS period_start,
+       COUNT(*)::int AS new_cells,
+       (SUM(COUNT(*)) OVER (ORDER BY date_trunc(@period::text, first_visit)))::int AS total_cells
+FROM explored_cell
+WHERE user_id = @user_id AND z = @z
+GROUP BY date_trunc(@period::text, first_visit)
+ORDER BY period_start;
+
+-- name: ListRoutesByEndpointCell :many
+-- Returns the routes whose start (kind = 'start') or end point (kind = 'end')
+-- lies in a cluster cell of the user_endpoints tiles, matching the same
+-- route filters as the tiles.
+SELECT r.id, COALESCE(o.name, r.name) AS name, r.sport_type, r.start_date, r.distance
+FROM route r
+LEFT JOIN route_override o ON o.route_id = r.id
+CROSS JOIN LATERAL (
+    SELECT CASE WHEN @kind::text = 'end' THEN ST_EndPoint(r.geom_3857) ELSE ST_StartPoint(r.geom_3857) END AS pt
+) e
+WHERE r.user_id = @user_id
+  AND r.geom_3857 && ST_TileEnvelope(@cell_z::int, @cell_x::int, @cell_y::int)
+  AND floor((ST_X(e.pt) + 20037508.342789244) / (2 * 20037508.342789244) * power(2, @cell_z::int))::int = @cell_x::int
+  AND floor((20037508.342789244 - ST_Y(e.pt)) / (2 * 20037508.342789244) * power(2, @cell_z::int))::int = @cell_y::int
+  AND route_matches_filters(r, @filters::json)
+ORDER BY r.start_date DESC;
+
+-- name: SearchRoutesByArea :many
+-- Returns the user's routes that pass through an area, most recent first, with
+-- the length of the part inside it. The area is a GeoJSON geometry (EPSG:4326),
+-- buffered by radius_meters if that is positive, e.g. for a point. Routes
+-- hidden by their overrides are left out unless include_hidden is true.
+WITH area AS (
+    SELECT CASE
+        WHEN @radius_meters::float > 0 THEN
+            ST_Buffer(ST_SetSRID(ST_GeomFromGeoJSON(@area::text), 4326)::geography, @radius_meters::float)::geometry
+        ELSE ST_SetSRID(ST_GeomFromGeoJSON(@area::text), 4326)
+    END AS geom
+)
+SELECT r.id, COALESCE(o.name, r.name) AS name, r.sport_type, r.start_date, r.distance,
+       ST_Length(ST_Intersection(r.geom, area.geom)::geography)::double precision AS distance_inside_meters
+FROM route r
+CROSS JOIN area
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE r.user_id = @user_id
+  AND (@include_hidden::boolean OR NOT COALESCE(o.hidden, FALSE))
+  AND r.geom && area.geom
+  AND ST_Intersects(r.geom, area.geom)
+ORDER BY r.start_date DESC
+LIMIT @max_results::int;
+
+-- name: GetRouteDetail :one
+SELECT r.id, COALESCE(o.name, r.name) AS name, r.sport_type, r.start_date, r.elapsed_time, r.moving_time, r.distance, r.average_speed, r.elevation, r.bounds,
+       r.commute, r.trainer,
+       COALESCE(ST_AsGeoJSON(r.geom), 'null')::text AS geometry,
+       ng.distance_meters AS unique_distance,
+       r.description,
+       COALESCE(o.notes, '')::text AS notes,
+       COALESCE(o.hidden, FALSE)::boolean AS hidden,
+       COALESCE(o.exclude_explorer, FALSE)::boolean AS exclude_explorer,
+       COALESCE(o.exclude_unique_distance, FALSE)::boolean AS exclude_unique_distance
+FROM route r
+LEFT JOIN route_new_ground ng ON ng.route_id = r.id
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE r.id = $1 AND r.user_id = $2;
+
+-- name: CountRouteNewExplorerCells :one
+-- Counts the explorer cells at grid zoom z that the route explored first.
+SELECT COUNT(*)::int
+FROM explored_cell
+WHERE user_id = $1 AND z = $2 AND first_route_id = $3;
+
+-- name: ListRouteRegions :many
+SELECT g.name, g.kind
+FROM region g
+JOIN route r ON r.geom && g.geom AND ST_Intersects(r.geom, g.geom)
+WHERE r.id = $1
+ORDER BY g.kind, g.name;
+
+-- name: ListOverlappingRoutes :many
+-- Returns the other routes of the user that share coverage grid cells with the
+-- route, with the fraction of the route's cells they share, largest first.
+WITH cells AS (
+    SELECT x, y
+    FROM route_cell
+    WHERE route_id = @route_id AND z = coverage_grid_zoom()
+)
+SELECT o.id, COALESCE(ov.name, o.name) AS name, o.start_date,
+       (COUNT(*)::float / (SELECT COUNT(*) FROM cells))::double precision AS overlap
+FROM cells c
+JOIN route_cell rc ON rc.user_id = @user_id AND rc.z = coverage_grid_zoom() AND rc.x = c.x AND rc.y = c.y
+JOIN route o ON o.id = rc.route_id
+LEFT JOIN route_override ov ON ov.route_id = o.id
+WHERE rc.route_id <> @route_id
+GROUP BY o.id, ov.name
+ORDER BY overlap DESC, o.start_date DESC
+LIMIT @max_results::int;
+
+-- name: GetRouteStream :one
+SELECT route_id, user_id, time_s, distance_m, altitude_m, lat, lng, fetched_at
+FROM route_stream
+WHERE route_id = $1;
+
+-- name: UpsertRouteStream :exec
+INSERT INTO route_stream (route_id, user_id, time_s, distance_m, altitude_m, lat, lng, fetched_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, now())
+ON CONFLICT (route_id) DO UPDATE SET
+    user_id    = EXCLUDED.user_id,
+    time_s     = EXCLUDED.time_s,
+    distance_m = EXCLUDED.distance_m,
+    altitude_m = EXCLUDED.altitude_m,
+    lat        = EXCLUDED.lat,
+    lng        = EXCLUDED.lng,
+    fetched_at = EXCLUDED.fetched_at;
+
+-- name: ListRoutesForExport :many
+-- Returns a page of the user's routes matching the tile route filters, oldest
+-- first, with their geometry and stored streams for the exports, optionally
+-- narrowed by the same full-text search as ListRoutesPage. Pages are
+-- continued after (after_start_date, after_id); route_id limits the export to
+-- a single route.
+SELECT r.id, COALESCE(o.name, r.name) AS name, r.sport_type, r.start_date, r.elapsed_time, r.moving_time, r.distance, r.elevation,
+       ST_AsGeoJSON(r.geom)::text AS geometry,
+       s.time_s, s.altitude_m, s.lat, s.lng
+FROM route r
+LEFT JOIN route_stream s ON s.route_id = r.id
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE r.user_id = @user_id
+  AND r.geom IS NOT NULL
+  AND (sqlc.narg(route_id)::bigint IS NULL OR r.id = sqlc.narg(route_id))
+  AND route_matches_filters(r, @filters::json)
+  AND (sqlc.narg(search)::text IS NULL
+       OR (r.search_vector || COALESCE(o.search_vector, ''::tsvector))
+          @@ websearch_to_tsquery('simple', sqlc.narg(search)))
+  AND (r.start_date, r.id) > (@after_start_date::timestamptz, @after_id::bigint)
+ORDER BY r.start_date, r.id
+LIMIT @max_results::int;
+
+-- name: ListRoutesPage :many
+-- Returns a page of the user's routes matching the tile route filters and the
+-- optional full-text search over the Strava name and description and the
+-- local name and notes. The routes are ordered by the sort metric (and id to
+-- break ties), ascending for direction 1 and descending for -1; pages are
+-- continued after (after_value, after_id) of the last route.
+WITH matching AS (
+    SELECT r.id, r.start_date, COALESCE(o.name, r.name) AS name, r.sport_type, r.elapsed_time, r.moving_time, r.distance,
+           r.average_speed, r.elevation, r.bounds, r.commute, r.trainer, r.description,
+           COALESCE(o.notes, '')::text AS notes,
+           COALESCE(o.hidden, FALSE)::boolean AS hidden,
+           COALESCE(o.exclude_explorer, FALSE)::boolean AS exclude_explorer,
+           COALESCE(o.exclude_unique_distance, FALSE)::boolean AS exclude_unique_distance,
+           ng.distance_meters AS unique_distance,
+           ARRAY(SELECT t.tag FROM route_tag t WHERE t.route_id = r.id ORDER BY t.tag)::text[] AS tags,
+           (CASE @sort::text
+                WHEN 'distance' THEN r.distance
+                WHEN 'moving_time' THEN r.moving_time
+                WHEN 'elapsed_time' THEN r.elapsed_time
+                WHEN 'elevation' THEN r.elevation
+                WHEN 'average_speed' THEN r.average_speed
+                WHEN 'unique_distance' THEN COALESCE(ng.distance_meters, 0)
+                ELSE extract(epoch FROM r.start_date)
+            END)::float AS sort_value
+    FROM route r
+    LEFT JOIN route_new_ground ng ON ng.route_id = r.id
+    LEFT JOIN route_override o ON o.route_id = r.id
+    WHERE r.user_id = @user_id
+      AND route_matches_filters(r, @filters::json)
+      AND (sqlc.narg(search)::text IS NULL
+           OR (r.search_vector || COALESCE(o.search_vector, ''::tsvector))
+              @@ websearch_to_tsquery('simple', sqlc.narg(search)))
+)
+SELECT id, start_date, name, sport_type, elapsed_time, moving_time, distance, average_speed, elevation,
+       bounds, commute, trainer, description, notes, hidden, exclude_explorer, exclude_unique_distance,
+       unique_distance, tags, sort_value
+FROM matching
+WHERE sqlc.narg(after_value)::float IS NULL
+   OR (sort_value * @direction::int, id * @direction::int)
+      > (sqlc.narg(after_value) * @direction::int, @after_id::bigint * @direction::int)
+ORDER BY sort_value * @direction::int, id * @direction::int
+LIMIT @max_results::int;
+
+-- name: UpsertRouteOverride :one
+-- Updates the local overrides of a route of the user. Params that are NULL keep
+-- their current value; an empty name restores the Strava name. Returns no row
+-- if the route isn't the user's.
+WITH upserted AS (
+    INSERT INTO route_override (route_id, user_id, name, hidden, exclude_explorer, exclude_unique_distance, notes)
+    SELECT r.id, r.user_id,
+           NULLIF(sqlc.narg(name)::text, ''),
+           COALESCE(sqlc.narg(hidden)::boolean, FALSE),
+           COALESCE(sqlc.narg(exclude_explorer)::boolean, FALSE),
+           COALESCE(sqlc.narg(exclude_unique_distance)::boolean, FALSE),
+           COALESCE(sqlc.narg(notes)::text, '')
+    FROM route r
+    WHERE r.id = @route_id AND r.user_id = @user_id
+    ON CONFLICT (route_id) DO UPDATE SET
+        name                    = CASE WHEN sqlc.narg(name)::text IS NULL THEN route_override.name
+                                       ELSE NULLIF(sqlc.narg(name)::text, '') END,
+        hidden                  = COALESCE(sqlc.narg(hidden)::boolean, route_override.hidden),
+        exclude_explorer        = COALESCE(sqlc.narg(exclude_explorer)::boolean, route_override.exclude_explorer),
+        exclude_unique_distance = COALESCE(sqlc.narg(exclude_unique_distance)::boolean, route_override.exclude_unique_distance),
+        notes                   = COALESCE(sqlc.narg(notes)::text, route_override.notes),
+        updated_at              = now()
+    RETURNING route_id, name, hidden, exclude_explorer, exclude_unique_distance, notes, updated_at
+)
+SELECT u.route_id, COALESCE(u.name, r.name) AS name, u.name IS NOT NULL AS renamed, u.hidden,
+       u.exclude_explorer, u.exclude_unique_distance, u.notes, u.updated_at, r.start_date
+FROM upserted u
+JOIN route r ON r.id = u.route_id;
+
+-- name: CreateTag :one
+-- Creates a tag of the user. Returns no row if it already exists.
+INSERT INTO tag (user_id, name, description)
+VALUES (@user_id, @name, @description)
+ON CONFLICT (user_id, name) DO NOTHING
+RETURNING user_id, name, description, created_at;
+
+-- name: GetTag :one
+SELECT user_id, name, description, created_at
+FROM tag
+WHERE user_id = @user_id AND name = @name;
+
+-- name: UpdateTag :one
+-- Renames a tag and/or changes its description; NULL params keep the current
+-- value. The tag's routes are moved along and its rules follow the foreign key.
+WITH updated AS (
+    UPDATE tag
+    SET name        = COALESCE(sqlc.narg(new_name)::text, name),
+        description = COALESCE(sqlc.narg(description)::text, description)
+    WHERE user_id = @user_id AND name = @name
+    RETURNING user_id, name, description, created_at
+), moved AS (
+    UPDATE route_tag t
+    SET tag = u.name
+    FROM updated u
+    WHERE t.user_id = u.user_id AND t.tag = @name AND u.name <> @name
+)
+SELECT user_id, name, description, created_at
+FROM updated;
+
+-- name: DeleteTag :execrows
+-- Deletes a tag with its route assignments and rules.
+WITH untagged AS (
+    DELETE FROM route_tag
+    WHERE user_id = @user_id AND tag = @name
+)
+DELETE FROM tag
+WHERE user_id = @user_id AND name = @name;
+
+-- name: ListTags :many
+-- Returns the tags of the user (or only the named one) with the totals and
+-- bounds of their routes. The bounds are NULL for tags without routes.
+SELECT g.name, g.description, g.created_at,
+       COUNT(r.id)::int AS route_count,
+       COALESCE(SUM(r.distance), 0)::float AS distance,
+       COALESCE(SUM(r.moving_time), 0)::bigint AS moving_time,
+       COALESCE(SUM(r.elevation), 0)::float AS elevation,
+       COALESCE(SUM(ng.distance_meters), 0)::float AS unique_distance_meters,
+       MIN(r.start_date)::timestamptz AS first_date,
+       MAX(r.start_date)::timestamptz AS last_date,
+       ST_YMin(ST_Extent(r.geom))::float AS min_lat,
+       ST_XMin(ST_Extent(r.geom))::float AS min_lng,
+       ST_YMax(ST_Extent(r.geom))::float AS max_lat,
+       ST_XMax(ST_Extent(r.geom))::float AS max_lng
+FROM tag g
+LEFT JOIN route_tag t ON t.user_id = g.user_id AND t.tag = g.name
+LEFT JOIN route r ON r.id = t.route_id
+LEFT JOIN route_new_ground ng ON ng.route_id = r.id
+WHERE g.user_id = @user_id
+  AND (sqlc.narg(name)::text IS NULL OR g.name = sqlc.narg(name))
+GROUP BY g.user_id, g.name
+ORDER BY g.name;
+
+-- name: GetTagExplorerContribution :one
+-- Counts the explorer cells at grid zoom z touched by the tag's routes and the
+-- cells that one of them explored first.
+SELECT
+    (SELECT COUNT(*)
+     FROM (SELECT DISTINCT rc.x, rc.y
+           FROM route_tag t
+           JOIN route_cell rc ON rc.route_id = t.route_id AND rc.z = @z::int
+           WHERE t.user_id = @user_id AND t.tag = @tag) c)::int AS cells,
+    (SELECT COUNT(*)
+     FROM route_tag t
+     JOIN explored_cell e ON e.user_id = t.user_id AND e.z = @z::int AND e.first_route_id = t.route_id
+     WHERE t.user_id = @user_id AND t.tag = @tag)::int AS new_cells;
+
+-- name: TagRoutesByID :execrows
+-- Tags the given routes of the user. Returns the number of newly tagged routes.
+INSERT INTO route_tag (route_id, user_id, tag)
+SELECT r.id, r.user_id, g.name
+FROM tag g
+JOIN route r ON r.user_id = g.user_id
+WHERE g.user_id = @user_id AND g.name = @tag
+  AND r.id = ANY (@route_ids::bigint[])
+ON CONFLICT (route_id, tag) DO NOTHING;
+
+-- name: TagRoutesBySearch :execrows
+-- Tags the user's routes that the route list would return for the filters and
+-- full-text search (see ListRoutesPage).
+INSERT INTO route_tag (route_id, user_id, tag)
+SELECT r.id, r.user_id, g.name
+FROM tag g
+JOIN route r ON r.user_id = g.user_id
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE g.user_id = @user_id AND g.name = @tag
+  AND route_matches_filters(r, @filters::json)
+  AND (sqlc.narg(search)::text IS NULL
+       OR (r.search_vector || COALESCE(o.search_vector, ''::tsvector))
+          @@ websearch_to_tsquery('simple', sqlc.narg(search)))
+ON CONFLICT (route_id, tag) DO NOTHING;
+
+-- name: TagRoutesByArea :execrows
+-- Tags the user's routes that pass through an area, given like for
+-- SearchRoutesByArea.
+WITH area AS (
+    SELECT CASE
+        WHEN @radius_meters::float > 0 THEN
+            ST_Buffer(ST_SetSRID(ST_GeomFromGeoJSON(@area::text), 4326)::geography, @radius_meters::float)::geometry
+        ELSE ST_SetSRID(ST_GeomFromGeoJSON(@area::text), 4326)
+    END AS geom
+)
+INSERT INTO route_tag (route_id, user_id, tag)
+SELECT r.id, r.user_id, g.name
+FROM tag g
+JOIN route r ON r.user_id = g.user_id
+CROSS JOIN area
+WHERE g.user_id = @user_id AND g.name = @tag
+  AND r.geom && area.geom
+  AND ST_Intersects(r.geom, area.geom)
+ON CONFLICT (route_id, tag) DO NOTHING;
+
+-- name: UntagRoutes :execrows
+DELETE FROM route_tag
+WHERE user_id = @user_id AND tag = @tag
+  AND route_id = ANY (@route_ids::bigint[]);
+
+-- name: CreateTagRule :one
+INSERT INTO tag_rule (user_id, tag, name_pattern, lat, lng, radius_meters)
+VALUES (@user_id, @tag, sqlc.narg(name_pattern), sqlc.narg(lat), sqlc.narg(lng), sqlc.narg(radius_meters))
+RETURNING id, user_id, tag, name_pattern, lat, lng, radius_meters, created_at;
+
+-- name: ListTagRules :many
+SELECT id, user_id, tag, name_pattern, lat, lng, radius_meters, created_at
+FROM tag_rule
+WHERE user_id = @user_id AND tag = @tag
+ORDER BY id;
+
+-- name: DeleteTagRule :execrows
+DELETE FROM tag_rule
+WHERE id = @id AND user_id = @user_id AND tag = @tag;
+
+-- name: ApplyTagRule :execrows
+-- Tags every existing route of the user that matches the rule. New and
+-- changed routes are tagged by the route_tag_rules triggers.
+INSERT INTO route_tag (route_id, user_id, tag)
+SELECT r.id, r.user_id, t.tag
+FROM tag_rule t
+JOIN route r ON r.user_id = t.user_id
+WHERE t.id = @id
+  AND tag_rule_matches(t, r)
+ON CONFLICT (route_id, tag) DO NOTHING;
+
+-- name: CreateShare :one
+INSERT INTO share (user_id, token, name, filters, layers, public_profile, expires_at)
+VALUES (@user_id, @token, @name, @filters, @layers, @public_profile, @expires_at)
+RETURNING id, user_id, token, name, filters, layers, public_profile, expires_at, revoked_at, created_at;
+
+-- name: ListShares :many
+-- Returns the shares of the user that were not revoked, newest first.
+SELECT id, user_id, token, name, filters, layers, public_profile, expires_at, revoked_at, created_at
+FROM share
+WHERE user_id = @user_id AND revoked_at IS NULL
+ORDER BY created_at DESC;
+
+-- name: RevokeShare :execrows
+UPDATE share
+SET revoked_at = now()
+WHERE id = @id AND user_id = @user_id AND revoked_at IS NULL;
+
+-- name: GetActiveShare :one
+-- Returns the share of a token unless it expired or was revoked.
+SELECT id, user_id, token, name, filters, layers, public_profile, expires_at, revoked_at, created_at
+FROM share
+WHERE token = @token
+  AND revoked_at IS NULL
+  AND (expires_at IS NULL OR expires_at > now());
+
+-- name: GetPublicProfileShare :one
+SELECT id, user_id, token, name, filters, layers, public_profile, expires_at, revoked_at, created_at
+FROM share
+WHERE user_id = @user_id AND public_profile AND revoked_at IS NULL;
+
+-- name: GetSharedRouteTotals :one
+-- Returns the totals and the bounds of the user's routes matching the filters,
+-- with the privacy zones left out of the bounds.
+SELECT COUNT(*)::int AS route_count,
+       COALESCE(SUM(r.distance), 0)::float AS distance,
+       COALESCE(SUM(r.moving_time), 0)::bigint AS moving_time,
+       COALESCE(SUM(r.elevation), 0)::float AS elevation,
+       MIN(r.start_date)::timestamptz AS first_date,
+       MAX(r.start_date)::timestamptz AS last_date,
+       ST_YMin(ST_Extent(privacy_clip(r.geom, z.geom)))::float AS min_lat,
+       ST_XMin(ST_Extent(privacy_clip(r.geom, z.geom)))::float AS min_lng,
+       ST_YMax(ST_Extent(privacy_clip(r.geom, z.geom)))::float AS max_lat,
+       ST_XMax(ST_Extent(privacy_clip(r.geom, z.geom)))::float AS max_lng
+FROM route r
+CROSS JOIN (SELECT privacy_zones(@user_id) AS geom) z
+WHERE r.user_id = @user_id
+  AND route_matches_filters(r, @filters::json);
+
+-- name: CreatePrivacyZone :one
+INSERT INTO privacy_zone (user_id, name, lat, lng, radius_meters)
+VALUES (@user_id, @name, @lat, @lng, @radius_meters)
+RETURNING id, user_id, name, lat, lng, radius_meters, created_at;
+
+-- name: ListPrivacyZones :many
+SELECT id, user_id, name, lat, lng, radius_meters, created_at
+FROM privacy_zone
+WHERE user_id = @user_id
+ORDER BY id;
+
+-- name: DeletePrivacyZone :execrows
+DELETE FROM privacy_zone
+WHERE id = @id AND user_id = @user_id;
+
+-- name: CreateApiToken :one
+INSERT INTO api_token (user_id, name, token_hash, scope)
+VALUES (@user_id, @name, @token_hash, @scope)
+RETURNING id, user_id, name, token_hash, scope, last_used_at, revoked_at, created_at;
+
+-- name: ListApiTokens :many
+-- Returns the API tokens of the user that were not revoked, newest first.
+SELECT id, user_id, name, token_hash, scope, last_used_at, revoked_at, created_at
+FROM api_token
+WHERE user_id = @user_id AND revoked_at IS NULL
+ORDER BY created_at DESC;
+
+-- name: RevokeApiToken :execrows
+UPDATE api_token
+SET revoked_at = now()
+WHERE id = @id AND user_id = @user_id AND revoked_at IS NULL;
+
+-- name: GetActiveApiToken :one
+-- Returns the API token of a hash unless it was revoked.
+SELECT id, user_id, name, token_hash, scope, last_used_at, revoked_at, created_at
+FROM api_token
+WHERE token_hash = @token_hash AND revoked_at IS NULL;
+
+-- name: TouchApiToken :exec
+-- Sets the last use of an API token, at most once a minute to spare the writes.
+UPDATE api_token
+SET last_used_at = now()
+WHERE id = @id
+  AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute');
+
+-- name: GetLegacyUserRoutesTile :one
+-- The body of user_routes before the precomputed geometries, where every route
+-- is transformed and clipped at full resolution. It is only kept as the
+-- baseline of cmd/bench_route_tiles.
+SELECT ST_AsMVT(tile, 'user_routes', 4096, 'geom')::bytea AS tile
+FROM (
+  SELECT
+    id,
+    name,
+    sport_type,
+    distance,
+    start_date,
+    ST_AsMVTGeom(
+      ST_Transform(geom, 3857),
+      ST_TileEnvelope(@z, @x, @y),
+      4096, 64, true
+    ) AS geom
+  FROM route
+  WHERE user_id = @user_id AND geom && ST_Transform(ST_TileEnvelope(@z, @x, @y), 4326)
+) tile;
+
+-- name: AnalyzeRoutes :exec
+-- Updates the planner statistics of the route table, e.g. after bulk inserts.
+ANALYZE route;
+
+-- name: GetUserRoutesTile :one
+-- The tile functions as Martin calls them, for the tiles served by the backend.
+SELECT user_routes(@z, @x, @y, @query_params::json)::bytea AS tile;
+
+-- name: GetUserExplorerTile :one
+SELECT user_explorer_tiles(@z, @x, @y, @query_params::json)::bytea AS tile;
+
+-- name: GetUserHeatmapTile :one
+SELECT user_heatmap(@z, @x, @y, @query_params::json)::bytea AS tile;
+
+-- name: GetUserNewGroundTile :one
+SELECT user_new_ground(@z, @x, @y, @query_params::json)::bytea AS tile;
+
+-- name: GetUserEndpointsTile :one
+SELECT user_endpoints(@z, @x, @y, @query_params::json)::bytea AS tile;
+
+-- name: RecordSchemaVersion :exec
+INSERT INTO schema_version (version)
+VALUES (@version)
+ON CONFLICT (version) DO UPDATE SET applied_at = now();
+
+-- name: GetSchemaVersion :one
+-- Returns the version of the schema applied last.
+SELECT version
+FROM schema_version
+ORDER BY applied_at DESC
+LIMIT 1;
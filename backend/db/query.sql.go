@@ -11,6 +11,374 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const analyzeRoutes = `-- name: AnalyzeRoutes :exec
+ANALYZE route
+`
+
+// Updates the planner statistics of the route table, e.g. after bulk inserts.
+func (q *Queries) AnalyzeRoutes(ctx context.Context) error {
+	_, err := q.db.Exec(ctx, analyzeRoutes)
+	return err
+}
+
+const applyTagRule = `-- name: ApplyTagRule :execrows
+INSERT INTO route_tag (route_id, user_id, tag)
+SELECT r.id, r.user_id, t.tag
+FROM tag_rule t
+JOIN route r ON r.user_id = t.user_id
+WHERE t.id = $1
+  AND tag_rule_matches(t, r)
+ON CONFLICT (route_id, tag) DO NOTHING
+`
+
+// Tags every existing route of the user that matches the rule. New and
+// changed routes are tagged by the route_tag_rules triggers.
+func (q *Queries) ApplyTagRule(ctx context.Context, id int32) (int64, error) {
+	result, err := q.db.Exec(ctx, applyTagRule, id)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const countRouteNewExplorerCells = `-- name: CountRouteNewExplorerCells :one
+SELECT COUNT(*)::int
+FROM explored_cell
+WHERE user_id = $1 AND z = $2 AND first_route_id = $3
+`
+
+type CountRouteNewExplorerCellsParams struct {
+	UserID       int64 `json:"user_id"`
+	Z            int32 `json:"z"`
+	FirstRouteID int64 `json:"first_route_id"`
+}
+
+// Counts the explorer cells at grid zoom z that the route explored first.
+func (q *Queries) CountRouteNewExplorerCells(ctx context.Context, arg CountRouteNewExplorerCellsParams) (int32, error) {
+	row := q.db.QueryRow(ctx, countRouteNewExplorerCells, arg.UserID, arg.Z, arg.FirstRouteID)
+	var column_1 int32
+	err := row.Scan(&column_1)
+	return column_1, err
+}
+
+const createApiToken = `-- name: CreateApiToken :one
+INSERT INTO api_token (user_id, name, token_hash, scope)
+VALUES ($1, $2, $3, $4)
+RETURNING id, user_id, name, token_hash, scope, last_used_at, revoked_at, created_at
+`
+
+type CreateApiTokenParams struct {
+	UserID    int64  `json:"user_id"`
+	Name      string `json:"name"`
+	TokenHash []byte `json:"token_hash"`
+	Scope     string `json:"scope"`
+}
+
+func (q *Queries) CreateApiToken(ctx context.Context, arg CreateApiTokenParams) (ApiToken, error) {
+	row := q.db.QueryRow(ctx, createApiToken,
+		arg.UserID,
+		arg.Name,
+		arg.TokenHash,
+		arg.Scope,
+	)
+	var i ApiToken
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Name,
+		&i.TokenHash,
+		&i.Scope,
+		&i.LastUsedAt,
+		&i.RevokedAt,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const createPrivacyZone = `-- name: CreatePrivacyZone :one
+INSERT INTO privacy_zone (user_id, name, lat, lng, radius_meters)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id, user_id, name, lat, lng, radius_meters, created_at
+`
+
+type CreatePrivacyZoneParams struct {
+	UserID       int64   `json:"user_id"`
+	Name         string  `json:"name"`
+	Lat          float64 `json:"lat"`
+	Lng          float64 `json:"lng"`
+	RadiusMeters float64 `json:"radius_meters"`
+}
+
+func (q *Queries) CreatePrivacyZone(ctx context.Context, arg CreatePrivacyZoneParams) (PrivacyZone, error) {
+	row := q.db.QueryRow(ctx, createPrivacyZone,
+		arg.UserID,
+		arg.Name,
+		arg.Lat,
+		arg.Lng,
+		arg.RadiusMeters,
+	)
+	var i PrivacyZone
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Name,
+		&i.Lat,
+		&i.Lng,
+		&i.RadiusMeters,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const createShare = `-- name: CreateShare :one
+INSERT INTO share (user_id, token, name, filters, layers, public_profile, expires_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+RETURNING id, user_id, token, name, filters, layers, public_profile, expires_at, revoked_at, created_at
+`
+
+type CreateShareParams struct {
+	UserID        int64              `json:"user_id"`
+	Token         string             `json:"token"`
+	Name          string             `json:"name"`
+	Filters       []byte             `json:"filters"`
+	Layers        []string           `json:"layers"`
+	PublicProfile bool               `json:"public_profile"`
+	ExpiresAt     pgtype.Timestamptz `json:"expires_at"`
+}
+
+func (q *Queries) CreateShare(ctx context.Context, arg CreateShareParams) (Share, error) {
+	row := q.db.QueryRow(ctx, createShare,
+		arg.UserID,
+		arg.Token,
+		arg.Name,
+		arg.Filters,
+		arg.Layers,
+		arg.PublicProfile,
+		arg.ExpiresAt,
+	)
+	var i Share
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Token,
+		&i.Name,
+		&i.Filters,
+		&i.Layers,
+		&i.PublicProfile,
+		&i.ExpiresAt,
+		&i.RevokedAt,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const createTag = `-- name: CreateTag :one
+INSERT INTO tag (user_id, name, description)
+VALUES ($1, $2, $3)
+ON CONFLICT (user_id, name) DO NOTHING
+RETURNING user_id, name, description, created_at
+`
+
+type CreateTagParams struct {
+	UserID      int64  `json:"user_id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Creates a tag of the user. Returns no row if it already exists.
+func (q *Queries) CreateTag(ctx context.Context, arg CreateTagParams) (Tag, error) {
+	row := q.db.QueryRow(ctx, createTag, arg.UserID, arg.Name, arg.Description)
+	var i Tag
+	err := row.Scan(
+		&i.UserID,
+		&i.Name,
+		&i.Description,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const createTagRule = `-- name: CreateTagRule :one
+INSERT INTO tag_rule (user_id, tag, name_pattern, lat, lng, radius_meters)
+VALUES ($1, $2, $3, $4, $5, $6)
+RETURNING id, user_id, tag, name_pattern, lat, lng, radius_meters, created_at
+`
+
+type CreateTagRuleParams struct {
+	UserID       int64         `json:"user_id"`
+	Tag          string        `json:"tag"`
+	NamePattern  pgtype.Text   `json:"name_pattern"`
+	Lat          pgtype.Float8 `json:"lat"`
+	Lng          pgtype.Float8 `json:"lng"`
+	RadiusMeters pgtype.Float8 `json:"radius_meters"`
+}
+
+func (q *Queries) CreateTagRule(ctx context.Context, arg CreateTagRuleParams) (TagRule, error) {
+	row := q.db.QueryRow(ctx, createTagRule,
+		arg.UserID,
+		arg.Tag,
+		arg.NamePattern,
+		arg.Lat,
+		arg.Lng,
+		arg.RadiusMeters,
+	)
+	var i TagRule
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Tag,
+		&i.NamePattern,
+		&i.Lat,
+		&i.Lng,
+		&i.RadiusMeters,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const deleteExploredCellsByUser = `-- name: DeleteExploredCellsByUser :exec
+DELETE FROM explored_cell
+WHERE user_id = $1
+`
+
+func (q *Queries) DeleteExploredCellsByUser(ctx context.Context, userID int64) error {
+	_, err := q.db.Exec(ctx, deleteExploredCellsByUser, userID)
+	return err
+}
+
+const deletePrivacyZone = `-- name: DeletePrivacyZone :execrows
+DELETE FROM privacy_zone
+WHERE id = $1 AND user_id = $2
+`
+
+type DeletePrivacyZoneParams struct {
+	ID     int32 `json:"id"`
+	UserID int64 `json:"user_id"`
+}
+
+func (q *Queries) DeletePrivacyZone(ctx context.Context, arg DeletePrivacyZoneParams) (int64, error) {
+	result, err := q.db.Exec(ctx, deletePrivacyZone, arg.ID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteRouteCellsByUser = `-- name: DeleteRouteCellsByUser :exec
+DELETE FROM route_cell
+WHERE user_id = $1
+`
+
+func (q *Queries) DeleteRouteCellsByUser(ctx context.Context, userID int64) error {
+	_, err := q.db.Exec(ctx, deleteRouteCellsByUser, userID)
+	return err
+}
+
+const deleteTag = `-- name: DeleteTag :execrows
+WITH untagged AS (
+    DELETE FROM route_tag
+    WHERE user_id = $1 AND tag = $2
+)
+DELETE FROM tag
+WHERE user_id = $1 AND name = $2
+`
+
+type DeleteTagParams struct {
+	UserID int64  `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+// Deletes a tag with its route assignments and rules.
+func (q *Queries) DeleteTag(ctx context.Context, arg DeleteTagParams) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteTag, arg.UserID, arg.Name)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const deleteTagRule = `-- name: DeleteTagRule :execrows
+DELETE FROM tag_rule
+WHERE id = $1 AND user_id = $2 AND tag = $3
+`
+
+type DeleteTagRuleParams struct {
+	ID     int32  `json:"id"`
+	UserID int64  `json:"user_id"`
+	Tag    string `json:"tag"`
+}
+
+func (q *Queries) DeleteTagRule(ctx context.Context, arg DeleteTagRuleParams) (int64, error) {
+	result, err := q.db.Exec(ctx, deleteTagRule, arg.ID, arg.UserID, arg.Tag)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const getActiveApiToken = `-- name: GetActiveApiToken :one
+SELECT id, user_id, name, token_hash, scope, last_used_at, revoked_at, created_at
+FROM api_token
+WHERE token_hash = $1 AND revoked_at IS NULL
+`
+
+// Returns the API token of a hash unless it was revoked.
+func (q *Queries) GetActiveApiToken(ctx context.Context, tokenHash []byte) (ApiToken, error) {
+	row := q.db.QueryRow(ctx, getActiveApiToken, tokenHash)
+	var i ApiToken
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Name,
+		&i.TokenHash,
+		&i.Scope,
+		&i.LastUsedAt,
+		&i.RevokedAt,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getActiveShare = `-- name: GetActiveShare :one
+SELECT id, user_id, token, name, filters, layers, public_profile, expires_at, revoked_at, created_at
+FROM share
+WHERE token = $1
+  AND revoked_at IS NULL
+  AND (expires_at IS NULL OR expires_at > now())
+`
+
+// Returns the share of a token unless it expired or was revoked.
+func (q *Queries) GetActiveShare(ctx context.Context, token string) (Share, error) {
+	row := q.db.QueryRow(ctx, getActiveShare, token)
+	var i Share
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Token,
+		&i.Name,
+		&i.Filters,
+		&i.Layers,
+		&i.PublicProfile,
+		&i.ExpiresAt,
+		&i.RevokedAt,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getActivitiesSyncedAt = `-- name: GetActivitiesSyncedAt :one
+SELECT activities_synced_at
+FROM athlete
+WHERE id = $1
+`
+
+func (q *Queries) GetActivitiesSyncedAt(ctx context.Context, id int64) (pgtype.Timestamptz, error) {
+	row := q.db.QueryRow(ctx, getActivitiesSyncedAt, id)
+	var activities_synced_at pgtype.Timestamptz
+	err := row.Scan(&activities_synced_at)
+	return activities_synced_at, err
+}
+
 const getAthlete = `-- name: GetAthlete :one
 SELECT id, firstname, lastname
 FROM athlete
@@ -55,10 +423,217 @@ func (q *Queries) GetAthleteTokens(ctx context.Context, id int64) (GetAthleteTok
 	return i, err
 }
 
-const getRouteName = `-- name: GetRouteName :one
-SELECT name
+const getExplorerStats = `-- name: GetExplorerStats :one
+SELECT s.total_tiles, s.max_cluster, s.max_square, s.square_x, s.square_y,
+       ST_YMin(c.box)::float AS cluster_min_lat, ST_XMin(c.box)::float AS cluster_min_lng,
+       ST_YMax(c.box)::float AS cluster_max_lat, ST_XMax(c.box)::float AS cluster_max_lng
+FROM explorer_stats s
+LEFT JOIN LATERAL (SELECT ST_Transform(ST_Envelope(s.cluster_geom), 4326) AS box) c ON TRUE
+WHERE s.user_id = $1 AND s.z = $2
+`
+
+type GetExplorerStatsParams struct {
+	UserID int64 `json:"user_id"`
+	Z      int32 `json:"z"`
+}
+
+type GetExplorerStatsRow struct {
+	TotalTiles    int32         `json:"total_tiles"`
+	MaxCluster    int32         `json:"max_cluster"`
+	MaxSquare     int32         `json:"max_square"`
+	SquareX       pgtype.Int4   `json:"square_x"`
+	SquareY       pgtype.Int4   `json:"square_y"`
+	ClusterMinLat pgtype.Float8 `json:"cluster_min_lat"`
+	ClusterMinLng pgtype.Float8 `json:"cluster_min_lng"`
+	ClusterMaxLat pgtype.Float8 `json:"cluster_max_lat"`
+	ClusterMaxLng pgtype.Float8 `json:"cluster_max_lng"`
+}
+
+// Returns the stored explorer statistics of a user at one grid zoom, with the
+// bounds of the max cluster in EPSG:4326.
+func (q *Queries) GetExplorerStats(ctx context.Context, arg GetExplorerStatsParams) (GetExplorerStatsRow, error) {
+	row := q.db.QueryRow(ctx, getExplorerStats, arg.UserID, arg.Z)
+	var i GetExplorerStatsRow
+	err := row.Scan(
+		&i.TotalTiles,
+		&i.MaxCluster,
+		&i.MaxSquare,
+		&i.SquareX,
+		&i.SquareY,
+		&i.ClusterMinLat,
+		&i.ClusterMinLng,
+		&i.ClusterMaxLat,
+		&i.ClusterMaxLng,
+	)
+	return i, err
+}
+
+const getLegacyUserRoutesTile = `-- name: GetLegacyUserRoutesTile :one
+SELECT ST_AsMVT(tile, 'user_routes', 4096, 'geom')::bytea AS tile
+FROM (
+  SELECT
+    id,
+    name,
+    sport_type,
+    distance,
+    start_date,
+    ST_AsMVTGeom(
+      ST_Transform(geom, 3857),
+      ST_TileEnvelope($1, $2, $3),
+      4096, 64, true
+    ) AS geom
+  FROM route
+  WHERE user_id = $4 AND geom && ST_Transform(ST_TileEnvelope($1, $2, $3), 4326)
+) tile
+`
+
+type GetLegacyUserRoutesTileParams struct {
+	Z      int32 `json:"z"`
+	X      int32 `json:"x"`
+	Y      int32 `json:"y"`
+	UserID int64 `json:"user_id"`
+}
+
+// The body of user_routes before the precomputed geometries, where every route
+// is transformed and clipped at full resolution. It is only kept as the
+// baseline of cmd/bench_route_tiles.
+func (q *Queries) GetLegacyUserRoutesTile(ctx context.Context, arg GetLegacyUserRoutesTileParams) ([]byte, error) {
+	row := q.db.QueryRow(ctx, getLegacyUserRoutesTile,
+		arg.Z,
+		arg.X,
+		arg.Y,
+		arg.UserID,
+	)
+	var tile []byte
+	err := row.Scan(&tile)
+	return tile, err
+}
+
+const getPublicProfileShare = `-- name: GetPublicProfileShare :one
+SELECT id, user_id, token, name, filters, layers, public_profile, expires_at, revoked_at, created_at
+FROM share
+WHERE user_id = $1 AND public_profile AND revoked_at IS NULL
+`
+
+func (q *Queries) GetPublicProfileShare(ctx context.Context, userID int64) (Share, error) {
+	row := q.db.QueryRow(ctx, getPublicProfileShare, userID)
+	var i Share
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Token,
+		&i.Name,
+		&i.Filters,
+		&i.Layers,
+		&i.PublicProfile,
+		&i.ExpiresAt,
+		&i.RevokedAt,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getRouteDetail = `-- name: GetRouteDetail :one
+SELECT r.id, COALESCE(o.name, r.name) AS name, r.sport_type, r.start_date, r.elapsed_time, r.moving_time, r.distance, r.average_speed, r.elevation, r.bounds,
+       r.commute, r.trainer,
+       COALESCE(ST_AsGeoJSON(r.geom), 'null')::text AS geometry,
+       ng.distance_meters AS unique_distance,
+       r.description,
+       COALESCE(o.notes, '')::text AS notes,
+       COALESCE(o.hidden, FALSE)::boolean AS hidden,
+       COALESCE(o.exclude_explorer, FALSE)::boolean AS exclude_explorer,
+       COALESCE(o.exclude_unique_distance, FALSE)::boolean AS exclude_unique_distance
+FROM route r
+LEFT JOIN route_new_ground ng ON ng.route_id = r.id
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE r.id = $1 AND r.user_id = $2
+`
+
+type GetRouteDetailParams struct {
+	ID     int64 `json:"id"`
+	UserID int64 `json:"user_id"`
+}
+
+type GetRouteDetailRow struct {
+	ID                    int64              `json:"id"`
+	Name                  string             `json:"name"`
+	SportType             pgtype.Text        `json:"sport_type"`
+	StartDate             pgtype.Timestamptz `json:"start_date"`
+	ElapsedTime           int32              `json:"elapsed_time"`
+	MovingTime            int32              `json:"moving_time"`
+	Distance              float64            `json:"distance"`
+	AverageSpeed          float64            `json:"average_speed"`
+	Elevation             float64            `json:"elevation"`
+	Bounds                string             `json:"bounds"`
+	Commute               bool               `json:"commute"`
+	Trainer               bool               `json:"trainer"`
+	Geometry              string             `json:"geometry"`
+	UniqueDistance        pgtype.Float8      `json:"unique_distance"`
+	Description           string             `json:"description"`
+	Notes                 string             `json:"notes"`
+	Hidden                bool               `json:"hidden"`
+	ExcludeExplorer       bool               `json:"exclude_explorer"`
+	ExcludeUniqueDistance bool               `json:"exclude_unique_distance"`
+}
+
+func (q *Queries) GetRouteDetail(ctx context.Context, arg GetRouteDetailParams) (GetRouteDetailRow, error) {
+	row := q.db.QueryRow(ctx, getRouteDetail, arg.ID, arg.UserID)
+	var i GetRouteDetailRow
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.SportType,
+		&i.StartDate,
+		&i.ElapsedTime,
+		&i.MovingTime,
+		&i.Distance,
+		&i.AverageSpeed,
+		&i.Elevation,
+		&i.Bounds,
+		&i.Commute,
+		&i.Trainer,
+		&i.Geometry,
+		&i.UniqueDistance,
+		&i.Description,
+		&i.Notes,
+		&i.Hidden,
+		&i.ExcludeExplorer,
+		&i.ExcludeUniqueDistance,
+	)
+	return i, err
+}
+
+const getRouteGeometryChange = `-- name: GetRouteGeometryChange :one
+SELECT start_date, geom IS DISTINCT FROM ST_GeomFromText($1::text, 4326) AS geom_changed
 FROM route
-WHERE id = $1 AND user_id = $2
+WHERE id = $2
+`
+
+type GetRouteGeometryChangeParams struct {
+	Wkt pgtype.Text `json:"wkt"`
+	ID  int64       `json:"id"`
+}
+
+type GetRouteGeometryChangeRow struct {
+	StartDate   pgtype.Timestamptz `json:"start_date"`
+	GeomChanged bool               `json:"geom_changed"`
+}
+
+// Returns the start date of a stored route and whether wkt differs from its
+// geometry, to tell whether upserting the route changes the new ground of the
+// routes after it.
+func (q *Queries) GetRouteGeometryChange(ctx context.Context, arg GetRouteGeometryChangeParams) (GetRouteGeometryChangeRow, error) {
+	row := q.db.QueryRow(ctx, getRouteGeometryChange, arg.Wkt, arg.ID)
+	var i GetRouteGeometryChangeRow
+	err := row.Scan(&i.StartDate, &i.GeomChanged)
+	return i, err
+}
+
+const getRouteName = `-- name: GetRouteName :one
+SELECT COALESCE(o.name, r.name) AS name
+FROM route r
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE r.id = $1 AND r.user_id = $2
 `
 
 type GetRouteNameParams struct {
@@ -66,6 +641,7 @@ type GetRouteNameParams struct {
 	UserID int64 `json:"user_id"`
 }
 
+// Returns the name of a route as shown, i.e. the one of its override if set.
 func (q *Queries) GetRouteName(ctx context.Context, arg GetRouteNameParams) (string, error) {
 	row := q.db.QueryRow(ctx, getRouteName, arg.ID, arg.UserID)
 	var name string
@@ -73,6 +649,132 @@ func (q *Queries) GetRouteName(ctx context.Context, arg GetRouteNameParams) (str
 	return name, err
 }
 
+const getRouteNewGround = `-- name: GetRouteNewGround :one
+SELECT route_id, distance_meters, COALESCE(ST_AsGeoJSON(geom), 'null')::text AS geometry, computed_at,
+       time_window, window_days, tolerance_meters, sample_meters
+FROM route_new_ground
+WHERE route_id = $1 AND user_id = $2
+`
+
+type GetRouteNewGroundParams struct {
+	RouteID int64 `json:"route_id"`
+	UserID  int64 `json:"user_id"`
+}
+
+type GetRouteNewGroundRow struct {
+	RouteID         int64              `json:"route_id"`
+	DistanceMeters  float64            `json:"distance_meters"`
+	Geometry        string             `json:"geometry"`
+	ComputedAt      pgtype.Timestamptz `json:"computed_at"`
+	TimeWindow      string             `json:"time_window"`
+	WindowDays      int32              `json:"window_days"`
+	ToleranceMeters float64            `json:"tolerance_meters"`
+	SampleMeters    float64            `json:"sample_meters"`
+}
+
+func (q *Queries) GetRouteNewGround(ctx context.Context, arg GetRouteNewGroundParams) (GetRouteNewGroundRow, error) {
+	row := q.db.QueryRow(ctx, getRouteNewGround, arg.RouteID, arg.UserID)
+	var i GetRouteNewGroundRow
+	err := row.Scan(
+		&i.RouteID,
+		&i.DistanceMeters,
+		&i.Geometry,
+		&i.ComputedAt,
+		&i.TimeWindow,
+		&i.WindowDays,
+		&i.ToleranceMeters,
+		&i.SampleMeters,
+	)
+	return i, err
+}
+
+const getRouteNewGroundDistance = `-- name: GetRouteNewGroundDistance :one
+SELECT distance_meters
+FROM route_new_ground
+WHERE route_id = $1
+`
+
+func (q *Queries) GetRouteNewGroundDistance(ctx context.Context, routeID int64) (float64, error) {
+	row := q.db.QueryRow(ctx, getRouteNewGroundDistance, routeID)
+	var distance_meters float64
+	err := row.Scan(&distance_meters)
+	return distance_meters, err
+}
+
+const getRouteStream = `-- name: GetRouteStream :one
+SELECT route_id, user_id, time_s, distance_m, altitude_m, lat, lng, fetched_at
+FROM route_stream
+WHERE route_id = $1
+`
+
+func (q *Queries) GetRouteStream(ctx context.Context, routeID int64) (RouteStream, error) {
+	row := q.db.QueryRow(ctx, getRouteStream, routeID)
+	var i RouteStream
+	err := row.Scan(
+		&i.RouteID,
+		&i.UserID,
+		&i.TimeS,
+		&i.DistanceM,
+		&i.AltitudeM,
+		&i.Lat,
+		&i.Lng,
+		&i.FetchedAt,
+	)
+	return i, err
+}
+
+const getRouteSummary = `-- name: GetRouteSummary :one
+SELECT name, sport_type, commute, trainer, private
+FROM route
+WHERE id = $1 AND user_id = $2
+`
+
+type GetRouteSummaryParams struct {
+	ID     int64 `json:"id"`
+	UserID int64 `json:"user_id"`
+}
+
+type GetRouteSummaryRow struct {
+	Name      string      `json:"name"`
+	SportType pgtype.Text `json:"sport_type"`
+	Commute   bool        `json:"commute"`
+	Trainer   bool        `json:"trainer"`
+	Private   bool        `json:"private"`
+}
+
+// Returns the fields of a route that are in Strava's activity summaries, to
+// tell whether the route is stale.
+func (q *Queries) GetRouteSummary(ctx context.Context, arg GetRouteSummaryParams) (GetRouteSummaryRow, error) {
+	row := q.db.QueryRow(ctx, getRouteSummary, arg.ID, arg.UserID)
+	var i GetRouteSummaryRow
+	err := row.Scan(
+		&i.Name,
+		&i.SportType,
+		&i.Commute,
+		&i.Trainer,
+		&i.Private,
+	)
+	return i, err
+}
+
+const getRouteUniqueDistanceFromCoverage = `-- name: GetRouteUniqueDistanceFromCoverage :one
+SELECT LEAST(
+    COALESCE(SUM(ST_Length(s.seg::geography)) FILTER (WHERE s.is_unique), 0),
+    (SELECT distance * 1000 FROM route WHERE route.id = $1)
+)::double precision AS unique_distance_meters
+FROM route_unique_segments($1, 'all', 0, 10, 20) s
+`
+
+// Unique distance from the coverage grid with the same semantics as
+// GetRouteUniqueDistanceMeters: compared against all other routes with a 10m
+// tolerance and 20m sampling.
+func (q *Queries) GetRouteUniqueDistanceFromCoverage(ctx context.Context, id int64) (float64, error) {
+	row := q.db.QueryRow(ctx, getRouteUniqueDistanceFromCoverage, id)
+	var unique_distance_meters float64
+	err := row.Scan(&unique_distance_meters)
+	return unique_distance_meters, err
+}
+
 const getRouteUniqueDistanceMeters = `-- name: GetRouteUniqueDistanceMeters :one
 WITH target AS (
     SELECT geom, user_id
@@ -118,13 +820,13 @@ SELECT LEAST(
 FROM segs
 `
 
+// Reference implementation of the unique distance that compares every sample
+// point against the other routes' geometries directly. Its cost grows with the
+// user's history; it is only kept to validate the coverage grid approach in
+// cmd/bench_unique_distance.
 // Computes the meters of the route that don't come within 10m of any other route
 // from the same user. Uses a point-sampling approach (one point per 20m) with
 // geometry ST_DWithin so the GIST spatial index is used for each lookup.
-// The result is capped at the route's own Strava-reported distance (in metres)
-// so that a fully-unique route can never return a value larger than the route
-// itself (PostGIS measures the raw GPS polyline, which is slightly longer than
-// Strava's smoothed distance).
 func (q *Queries) GetRouteUniqueDistanceMeters(ctx context.Context, id int64) (float64, error) {
 	row := q.db.QueryRow(ctx, getRouteUniqueDistanceMeters, id)
 	var unique_distance_meters float64
@@ -132,37 +834,1084 @@ func (q *Queries) GetRouteUniqueDistanceMeters(ctx context.Context, id int64) (f
 	return unique_distance_meters, err
 }
 
-const getUserPreferences = `-- name: GetUserPreferences :one
-SELECT user_id, write_unique_distance
-FROM user_preferences
-WHERE user_id = $1
+const getSchemaVersion = `-- name: GetSchemaVersion :one
+SELECT version
+FROM schema_version
+ORDER BY applied_at DESC
+LIMIT 1
+`
+
+// Returns the version of the schema applied last.
+func (q *Queries) GetSchemaVersion(ctx context.Context) (string, error) {
+	row := q.db.QueryRow(ctx, getSchemaVersion)
+	var version string
+	err := row.Scan(&version)
+	return version, err
+}
+
+const getSharedRouteTotals = `-- name: GetSharedRouteTotals :one
+SELECT COUNT(*)::int AS route_count,
+       COALESCE(SUM(r.distance), 0)::float AS distance,
+       COALESCE(SUM(r.moving_time), 0)::bigint AS moving_time,
+       COALESCE(SUM(r.elevation), 0)::float AS elevation,
+       MIN(r.start_date)::timestamptz AS first_date,
+       MAX(r.start_date)::timestamptz AS last_date,
+       ST_YMin(ST_Extent(privacy_clip(r.geom, z.geom)))::float AS min_lat,
+       ST_XMin(ST_Extent(privacy_clip(r.geom, z.geom)))::float AS min_lng,
+       ST_YMax(ST_Extent(privacy_clip(r.geom, z.geom)))::float AS max_lat,
+       ST_XMax(ST_Extent(privacy_clip(r.geom, z.geom)))::float AS max_lng
+FROM route r
+CROSS JOIN (SELECT privacy_zones($1) AS geom) z
+WHERE r.user_id = $1
+  AND route_matches_filters(r, $2::json)
+`
+
+type GetSharedRouteTotalsParams struct {
+	UserID  int64  `json:"user_id"`
+	Filters []byte `json:"filters"`
+}
+
+type GetSharedRouteTotalsRow struct {
+	RouteCount int32              `json:"route_count"`
+	Distance   float64            `json:"distance"`
+	MovingTime int64              `json:"moving_time"`
+	Elevation  float64            `json:"elevation"`
+	FirstDate  pgtype.Timestamptz `json:"first_date"`
+	LastDate   pgtype.Timestamptz `json:"last_date"`
+	MinLat     pgtype.Float8      `json:"min_lat"`
+	MinLng     pgtype.Float8      `json:"min_lng"`
+	MaxLat     pgtype.Float8      `json:"max_lat"`
+	MaxLng     pgtype.Float8      `json:"max_lng"`
+}
+
+// Returns the totals and the bounds of the user's routes matching the filters,
+// with the privacy zones left out of the bounds.
+func (q *Queries) GetSharedRouteTotals(ctx context.Context, arg GetSharedRouteTotalsParams) (GetSharedRouteTotalsRow, error) {
+	row := q.db.QueryRow(ctx, getSharedRouteTotals, arg.UserID, arg.Filters)
+	var i GetSharedRouteTotalsRow
+	err := row.Scan(
+		&i.RouteCount,
+		&i.Distance,
+		&i.MovingTime,
+		&i.Elevation,
+		&i.FirstDate,
+		&i.LastDate,
+		&i.MinLat,
+		&i.MinLng,
+		&i.MaxLat,
+		&i.MaxLng,
+	)
+	return i, err
+}
+
+const getTag = `-- name: GetTag :one
+SELECT user_id, name, description, created_at
+FROM tag
+WHERE user_id = $1 AND name = $2
+`
+
+type GetTagParams struct {
+	UserID int64  `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+func (q *Queries) GetTag(ctx context.Context, arg GetTagParams) (Tag, error) {
+	row := q.db.QueryRow(ctx, getTag, arg.UserID, arg.Name)
+	var i Tag
+	err := row.Scan(
+		&i.UserID,
+		&i.Name,
+		&i.Description,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getTagExplorerContribution = `-- name: GetTagExplorerContribution :one
+SELECT
+    (SELECT COUNT(*)
+     FROM (SELECT DISTINCT rc.x, rc.y
+           FROM route_tag t
+           JOIN route_cell rc ON rc.route_id = t.route_id AND rc.z = $1::int
+           WHERE t.user_id = $2 AND t.tag = $3) c)::int AS cells,
+    (SELECT COUNT(*)
+     FROM route_tag t
+     JOIN explored_cell e ON e.user_id = t.user_id AND e.z = $1::int AND e.first_route_id = t.route_id
+     WHERE t.user_id = $2 AND t.tag = $3)::int AS new_cells
+`
+
+type GetTagExplorerContributionParams struct {
+	Z      int32  `json:"z"`
+	UserID int64  `json:"user_id"`
+	Tag    string `json:"tag"`
+}
+
+type GetTagExplorerContributionRow struct {
+	Cells    int32 `json:"cells"`
+	NewCells int32 `json:"new_cells"`
+}
+
+// Counts the explorer cells at grid zoom z touched by the tag's routes and the
+// cells that one of them explored first.
+func (q *Queries) GetTagExplorerContribution(ctx context.Context, arg GetTagExplorerContributionParams) (GetTagExplorerContributionRow, error) {
+	row := q.db.QueryRow(ctx, getTagExplorerContribution, arg.Z, arg.UserID, arg.Tag)
+	var i GetTagExplorerContributionRow
+	err := row.Scan(&i.Cells, &i.NewCells)
+	return i, err
+}
+
+const getUserEndpointsTile = `-- name: GetUserEndpointsTile :one
+SELECT user_endpoints($1, $2, $3, $4::json)::bytea AS tile
+`
+
+type GetUserEndpointsTileParams struct {
+	Z           int32  `json:"z"`
+	X           int32  `json:"x"`
+	Y           int32  `json:"y"`
+	QueryParams []byte `json:"query_params"`
+}
+
+func (q *Queries) GetUserEndpointsTile(ctx context.Context, arg GetUserEndpointsTileParams) ([]byte, error) {
+	row := q.db.QueryRow(ctx, getUserEndpointsTile,
+		arg.Z,
+		arg.X,
+		arg.Y,
+		arg.QueryParams,
+	)
+	var tile []byte
+	err := row.Scan(&tile)
+	return tile, err
+}
+
+const getUserExplorerTile = `-- name: GetUserExplorerTile :one
+SELECT user_explorer_tiles($1, $2, $3, $4::json)::bytea AS tile
+`
+
+type GetUserExplorerTileParams struct {
+	Z           int32  `json:"z"`
+	X           int32  `json:"x"`
+	Y           int32  `json:"y"`
+	QueryParams []byte `json:"query_params"`
+}
+
+func (q *Queries) GetUserExplorerTile(ctx context.Context, arg GetUserExplorerTileParams) ([]byte, error) {
+	row := q.db.QueryRow(ctx, getUserExplorerTile,
+		arg.Z,
+		arg.X,
+		arg.Y,
+		arg.QueryParams,
+	)
+	var tile []byte
+	err := row.Scan(&tile)
+	return tile, err
+}
+
+const getUserHeatmapTile = `-- name: GetUserHeatmapTile :one
+SELECT user_heatmap($1, $2, $3, $4::json)::bytea AS tile
+`
+
+type GetUserHeatmapTileParams struct {
+	Z           int32  `json:"z"`
+	X           int32  `json:"x"`
+	Y           int32  `json:"y"`
+	QueryParams []byte `json:"query_params"`
+}
+
+func (q *Queries) GetUserHeatmapTile(ctx context.Context, arg GetUserHeatmapTileParams) ([]byte, error) {
+	row := q.db.QueryRow(ctx, getUserHeatmapTile,
+		arg.Z,
+		arg.X,
+		arg.Y,
+		arg.QueryParams,
+	)
+	var tile []byte
+	err := row.Scan(&tile)
+	return tile, err
+}
+
+const getUserNewGroundTile = `-- name: GetUserNewGroundTile :one
+SELECT user_new_ground($1, $2, $3, $4::json)::bytea AS tile
+`
+
+type GetUserNewGroundTileParams struct {
+	Z           int32  `json:"z"`
+	X           int32  `json:"x"`
+	Y           int32  `json:"y"`
+	QueryParams []byte `json:"query_params"`
+}
+
+func (q *Queries) GetUserNewGroundTile(ctx context.Context, arg GetUserNewGroundTileParams) ([]byte, error) {
+	row := q.db.QueryRow(ctx, getUserNewGroundTile,
+		arg.Z,
+		arg.X,
+		arg.Y,
+		arg.QueryParams,
+	)
+	var tile []byte
+	err := row.Scan(&tile)
+	return tile, err
+}
+
+const getUserPreferences = `-- name: GetUserPreferences :one
+SELECT user_id, write_unique_distance, new_ground_window, new_ground_days, new_ground_tolerance_meters, new_ground_sample_meters
+FROM user_preferences
+WHERE user_id = $1
+`
+
+func (q *Queries) GetUserPreferences(ctx context.Context, userID int64) (UserPreference, error) {
+	row := q.db.QueryRow(ctx, getUserPreferences, userID)
+	var i UserPreference
+	err := row.Scan(
+		&i.UserID,
+		&i.WriteUniqueDistance,
+		&i.NewGroundWindow,
+		&i.NewGroundDays,
+		&i.NewGroundToleranceMeters,
+		&i.NewGroundSampleMeters,
+	)
+	return i, err
+}
+
+const getUserRoutesTile = `-- name: GetUserRoutesTile :one
+SELECT user_routes($1, $2, $3, $4::json)::bytea AS tile
+`
+
+type GetUserRoutesTileParams struct {
+	Z           int32  `json:"z"`
+	X           int32  `json:"x"`
+	Y           int32  `json:"y"`
+	QueryParams []byte `json:"query_params"`
+}
+
+// The tile functions as Martin calls them, for the tiles served by the backend.
+func (q *Queries) GetUserRoutesTile(ctx context.Context, arg GetUserRoutesTileParams) ([]byte, error) {
+	row := q.db.QueryRow(ctx, getUserRoutesTile,
+		arg.Z,
+		arg.X,
+		arg.Y,
+		arg.QueryParams,
+	)
+	var tile []byte
+	err := row.Scan(&tile)
+	return tile, err
+}
+
+const insertExploredCellsByUser = `-- name: InsertExploredCellsByUser :exec
+INSERT INTO explored_cell (user_id, z, x, y, first_visit, last_visit, visit_count, first_route_id)
+SELECT rc.user_id, rc.z, rc.x, rc.y,
+       min(r.start_date), max(r.start_date), count(*),
+       (array_agg(r.id ORDER BY r.start_date, r.id))[1]
+FROM route_cell rc
+JOIN route r ON r.id = rc.route_id
+WHERE rc.user_id = $1
+  AND rc.z = ANY (explorer_grid_zooms())
+GROUP BY rc.user_id, rc.z, rc.x, rc.y
+`
+
+// Aggregates route_cell into explored_cell for every cell of a user.
+func (q *Queries) InsertExploredCellsByUser(ctx context.Context, userID int64) error {
+	_, err := q.db.Exec(ctx, insertExploredCellsByUser, userID)
+	return err
+}
+
+const insertRouteCellsByUser = `-- name: InsertRouteCellsByUser :exec
+INSERT INTO route_cell (route_id, user_id, z, x, y)
+SELECT r.id, r.user_id, g.z, c.x, c.y
+FROM route r
+CROSS JOIN unnest(explorer_grid_zooms() || coverage_grid_zoom()) AS g(z)
+CROSS JOIN LATERAL route_cells(r.geom, g.z) c
+WHERE r.user_id = $1
+  AND r.geom IS NOT NULL
+  AND NOT route_cells_excluded(r.id, g.z)
+`
+
+// Recomputes the cells of every route of a user at every explorer grid zoom
+// and at the coverage grid zoom. Used to rebuild the materialized cells;
+// regular updates go through the route triggers.
+func (q *Queries) InsertRouteCellsByUser(ctx context.Context, userID int64) error {
+	_, err := q.db.Exec(ctx, insertRouteCellsByUser, userID)
+	return err
+}
+
+const listApiTokens = `-- name: ListApiTokens :many
+SELECT id, user_id, name, token_hash, scope, last_used_at, revoked_at, created_at
+FROM api_token
+WHERE user_id = $1 AND revoked_at IS NULL
+ORDER BY created_at DESC
+`
+
+// Returns the API tokens of the user that were not revoked, newest first.
+func (q *Queries) ListApiTokens(ctx context.Context, userID int64) ([]ApiToken, error) {
+	rows, err := q.db.Query(ctx, listApiTokens, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ApiToken
+	for rows.Next() {
+		var i ApiToken
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Name,
+			&i.TokenHash,
+			&i.Scope,
+			&i.LastUsedAt,
+			&i.RevokedAt,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listAthleteIDs = `-- name: ListAthleteIDs :many
+SELECT id
+FROM athlete
+`
+
+func (q *Queries) ListAthleteIDs(ctx context.Context) ([]int64, error) {
+	rows, err := q.db.Query(ctx, listAthleteIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		items = append(items, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listExploredCells = `-- name: ListExploredCells :many
+SELECT x, y
+FROM explored_cell
+WHERE user_id = $1 AND z = $2
+`
+
+type ListExploredCellsParams struct {
+	UserID int64 `json:"user_id"`
+	Z      int32 `json:"z"`
+}
+
+type ListExploredCellsRow struct {
+	X int32 `json:"x"`
+	Y int32 `json:"y"`
+}
+
+func (q *Queries) ListExploredCells(ctx context.Context, arg ListExploredCellsParams) ([]ListExploredCellsRow, error) {
+	rows, err := q.db.Query(ctx, listExploredCells, arg.UserID, arg.Z)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListExploredCellsRow
+	for rows.Next() {
+		var i ListExploredCellsRow
+		if err := rows.Scan(&i.X, &i.Y); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listExplorerProgressByPeriod = `-- name: ListExplorerProgressByPeriod :many
+SELECT date_trunc($1::text, first_visit)::timestamptz AS period_start,
+       COUNT(*)::int AS new_cells,
+       (SUM(COUNT(*)) OVER (ORDER BY date_trunc($1::text, first_visit)))::int AS total_cells
+FROM explored_cell
+WHERE user_id = $2 AND z = $3
+GROUP BY date_trunc($1::text, first_visit)
+ORDER BY period_start
+`
+
+type ListExplorerProgressByPeriodParams struct {
+	Period string `json:"period"`
+	UserID int64  `json:"user_id"`
+	Z      int32  `json:"z"`
+}
+
+type ListExplorerProgressByPeriodRow struct {
+	PeriodStart pgtype.Timestamptz `json:"period_start"`
+	NewCells    int32              `json:"new_cells"`
+	TotalCells  int32              `json:"total_cells"`
+}
+
+// Returns the number of newly explored grid cells per period ('week', 'month'
+// or 'year'), based on the first visit of each cell, and the running total.
+func (q *Queries) ListExplorerProgressByPeriod(ctx context.Context, arg ListExplorerProgressByPeriodParams) ([]ListExplorerProgressByPeriodRow, error) {
+	rows, err := q.db.Query(ctx, listExplorerProgressByPeriod, arg.Period, arg.UserID, arg.Z)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListExplorerProgressByPeriodRow
+	for rows.Next() {
+		var i ListExplorerProgressByPeriodRow
+		if err := rows.Scan(&i.PeriodStart, &i.NewCells, &i.TotalCells); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listExplorerProgressByRoute = `-- name: ListExplorerProgressByRoute :many
+SELECT r.id, COALESCE(o.name, r.name) AS name, r.start_date,
+       COUNT(*)::int AS cells,
+       (COUNT(*) FILTER (WHERE e.first_route_id = r.id))::int AS new_cells,
+       (SUM(COUNT(*) FILTER (WHERE e.first_route_id = r.id)) OVER (ORDER BY r.start_date, r.id))::int AS total_cells
+FROM route r
+JOIN route_cell rc ON rc.route_id = r.id AND rc.z = $2
+JOIN explored_cell e ON e.user_id = rc.user_id AND e.z = rc.z AND e.x = rc.x AND e.y = rc.y
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE r.user_id = $1
+GROUP BY r.id, o.name
+ORDER BY r.start_date, r.id
+`
+
+type ListExplorerProgressByRouteParams struct {
+	UserID int64 `json:"user_id"`
+	Z      int32 `json:"z"`
+}
+
+type ListExplorerProgressByRouteRow struct {
+	ID         int64              `json:"id"`
+	Name       string             `json:"name"`
+	StartDate  pgtype.Timestamptz `json:"start_date"`
+	Cells      int32              `json:"cells"`
+	NewCells   int32              `json:"new_cells"`
+	TotalCells int32              `json:"total_cells"`
+}
+
+// Returns, per route in chronological order, how many grid cells it touches,
+// how many of those it explored first, and the running total of explored cells.
+func (q *Queries) ListExplorerProgressByRoute(ctx context.Context, arg ListExplorerProgressByRouteParams) ([]ListExplorerProgressByRouteRow, error) {
+	rows, err := q.db.Query(ctx, listExplorerProgressByRoute, arg.UserID, arg.Z)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListExplorerProgressByRouteRow
+	for rows.Next() {
+		var i ListExplorerProgressByRouteRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.StartDate,
+			&i.Cells,
+			&i.NewCells,
+			&i.TotalCells,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listOverlappingRoutes = `-- name: ListOverlappingRoutes :many
+WITH cells AS (
+    SELECT x, y
+    FROM route_cell
+    WHERE route_id = $1 AND z = coverage_grid_zoom()
+)
+SELECT o.id, COALESCE(ov.name, o.name) AS name, o.start_date,
+       (COUNT(*)::float / (SELECT COUNT(*) FROM cells))::double precision AS overlap
+FROM cells c
+JOIN route_cell rc ON rc.user_id = $2 AND rc.z = coverage_grid_zoom() AND rc.x = c.x AND rc.y = c.y
+JOIN route o ON o.id = rc.route_id
+LEFT JOIN route_override ov ON ov.route_id = o.id
+WHERE rc.route_id <> $1
+GROUP BY o.id, ov.name
+ORDER BY overlap DESC, o.start_date DESC
+LIMIT $3::int
+`
+
+type ListOverlappingRoutesParams struct {
+	RouteID    int64 `json:"route_id"`
+	UserID     int64 `json:"user_id"`
+	MaxResults int32 `json:"max_results"`
+}
+
+type ListOverlappingRoutesRow struct {
+	ID        int64              `json:"id"`
+	Name      string             `json:"name"`
+	StartDate pgtype.Timestamptz `json:"start_date"`
+	Overlap   float64            `json:"overlap"`
+}
+
+// Returns the other routes of the user that share coverage grid cells with the
+// route, with the fraction of the route's cells they share, largest first.
+func (q *Queries) ListOverlappingRoutes(ctx context.Context, arg ListOverlappingRoutesParams) ([]ListOverlappingRoutesRow, error) {
+	rows, err := q.db.Query(ctx, listOverlappingRoutes, arg.RouteID, arg.UserID, arg.MaxResults)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListOverlappingRoutesRow
+	for rows.Next() {
+		var i ListOverlappingRoutesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.StartDate,
+			&i.Overlap,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listPrivacyZones = `-- name: ListPrivacyZones :many
+SELECT id, user_id, name, lat, lng, radius_meters, created_at
+FROM privacy_zone
+WHERE user_id = $1
+ORDER BY id
+`
+
+func (q *Queries) ListPrivacyZones(ctx context.Context, userID int64) ([]PrivacyZone, error) {
+	rows, err := q.db.Query(ctx, listPrivacyZones, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []PrivacyZone
+	for rows.Next() {
+		var i PrivacyZone
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Name,
+			&i.Lat,
+			&i.Lng,
+			&i.RadiusMeters,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listRouteIDsWithoutDescription = `-- name: ListRouteIDsWithoutDescription :many
+SELECT id FROM route
+WHERE user_id = $1 AND description = ''
+ORDER BY start_date, id
+`
+
+// Returns the ids of the user's routes with an empty description, oldest
+// first. The description is only in Strava's detailed activities, so routes
+// stored before it was synced have none until they are fetched again.
+func (q *Queries) ListRouteIDsWithoutDescription(ctx context.Context, userID int64) ([]int64, error) {
+	rows, err := q.db.Query(ctx, listRouteIDsWithoutDescription, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		items = append(items, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listRouteRegions = `-- name: ListRouteRegions :many
+SELECT g.name, g.kind
+FROM region g
+JOIN route r ON r.geom && g.geom AND ST_Intersects(r.geom, g.geom)
+WHERE r.id = $1
+ORDER BY g.kind, g.name
+`
+
+type ListRouteRegionsRow struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+}
+
+func (q *Queries) ListRouteRegions(ctx context.Context, id int64) ([]ListRouteRegionsRow, error) {
+	rows, err := q.db.Query(ctx, listRouteRegions, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListRouteRegionsRow
+	for rows.Next() {
+		var i ListRouteRegionsRow
+		if err := rows.Scan(&i.Name, &i.Kind); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listRoutesByEndpointCell = `-- name: ListRoutesByEndpointCell :many
+SELECT r.id, COALESCE(o.name, r.name) AS name, r.sport_type, r.start_date, r.distance
+FROM route r
+LEFT JOIN route_override o ON o.route_id = r.id
+CROSS JOIN LATERAL (
+    SELECT CASE WHEN $1::text = 'end' THEN ST_EndPoint(r.geom_3857) ELSE ST_StartPoint(r.geom_3857) END AS pt
+) e
+WHERE r.user_id = $2
+  AND r.geom_3857 && ST_TileEnvelope($3::int, $4::int, $5::int)
+  AND floor((ST_X(e.pt) + 20037508.342789244) / (2 * 20037508.342789244) * power(2, $3::int))::int = $4::int
+  AND floor((20037508.342789244 - ST_Y(e.pt)) / (2 * 20037508.342789244) * power(2, $3::int))::int = $5::int
+  AND route_matches_filters(r, $6::json)
+ORDER BY r.start_date DESC
+`
+
+type ListRoutesByEndpointCellParams struct {
+	Kind    string `json:"kind"`
+	UserID  int64  `json:"user_id"`
+	CellZ   int32  `json:"cell_z"`
+	CellX   int32  `json:"cell_x"`
+	CellY   int32  `json:"cell_y"`
+	Filters []byte `json:"filters"`
+}
+
+type ListRoutesByEndpointCellRow struct {
+	ID        int64              `json:"id"`
+	Name      string             `json:"name"`
+	SportType pgtype.Text        `json:"sport_type"`
+	StartDate pgtype.Timestamptz `json:"start_date"`
+	Distance  float64            `json:"distance"`
+}
+
+// Returns the routes whose start (kind = 'start') or end point (kind = 'end')
+// lies in a cluster cell of the user_endpoints tiles, matching the same
+// route filters as the tiles.
+func (q *Queries) ListRoutesByEndpointCell(ctx context.Context, arg ListRoutesByEndpointCellParams) ([]ListRoutesByEndpointCellRow, error) {
+	rows, err := q.db.Query(ctx, listRoutesByEndpointCell,
+		arg.Kind,
+		arg.UserID,
+		arg.CellZ,
+		arg.CellX,
+		arg.CellY,
+		arg.Filters,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListRoutesByEndpointCellRow
+	for rows.Next() {
+		var i ListRoutesByEndpointCellRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.SportType,
+			&i.StartDate,
+			&i.Distance,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listRoutesByUser = `-- name: ListRoutesByUser :many
+SELECT r.id, r.user_id, r.start_date, COALESCE(o.name, r.name) AS name, r.elapsed_time, r.moving_time, r.distance, r.average_speed, r.elevation, r.bounds,
+       ng.distance_meters AS unique_distance
+FROM route r
+LEFT JOIN route_new_ground ng ON ng.route_id = r.id
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE r.user_id = $1
+  AND ($2::boolean OR NOT COALESCE(o.hidden, FALSE))
+ORDER BY r.start_date DESC
+`
+
+type ListRoutesByUserParams struct {
+	UserID        int64 `json:"user_id"`
+	IncludeHidden bool  `json:"include_hidden"`
+}
+
+type ListRoutesByUserRow struct {
+	ID             int64              `json:"id"`
+	UserID         int64              `json:"user_id"`
+	StartDate      pgtype.Timestamptz `json:"start_date"`
+	Name           string             `json:"name"`
+	ElapsedTime    int32              `json:"elapsed_time"`
+	MovingTime     int32              `json:"moving_time"`
+	Distance       float64            `json:"distance"`
+	AverageSpeed   float64            `json:"average_speed"`
+	Elevation      float64            `json:"elevation"`
+	Bounds         string             `json:"bounds"`
+	UniqueDistance pgtype.Float8      `json:"unique_distance"`
+}
+
+// Returns all routes of the user, most recent first. Routes hidden by their
+// overrides are left out unless include_hidden is true.
+func (q *Queries) ListRoutesByUser(ctx context.Context, arg ListRoutesByUserParams) ([]ListRoutesByUserRow, error) {
+	rows, err := q.db.Query(ctx, listRoutesByUser, arg.UserID, arg.IncludeHidden)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListRoutesByUserRow
+	for rows.Next() {
+		var i ListRoutesByUserRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.StartDate,
+			&i.Name,
+			&i.ElapsedTime,
+			&i.MovingTime,
+			&i.Distance,
+			&i.AverageSpeed,
+			&i.Elevation,
+			&i.Bounds,
+			&i.UniqueDistance,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listRoutesForExport = `-- name: ListRoutesForExport :many
+SELECT r.id, COALESCE(o.name, r.name) AS name, r.sport_type, r.start_date, r.elapsed_time, r.moving_time, r.distance, r.elevation,
+       ST_AsGeoJSON(r.geom)::text AS geometry,
+       s.time_s, s.altitude_m, s.lat, s.lng
+FROM route r
+LEFT JOIN route_stream s ON s.route_id = r.id
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE r.user_id = $1
+  AND r.geom IS NOT NULL
+  AND ($2::bigint IS NULL OR r.id = $2)
+  AND route_matches_filters(r, $3::json)
+  AND ($4::text IS NULL
+       OR (r.search_vector || COALESCE(o.search_vector, ''::tsvector))
+          @@ websearch_to_tsquery('simple', $4))
+  AND (r.start_date, r.id) > ($5::timestamptz, $6::bigint)
+ORDER BY r.start_date, r.id
+LIMIT $7::int
+`
+
+type ListRoutesForExportParams struct {
+	UserID         int64              `json:"user_id"`
+	RouteID        pgtype.Int8        `json:"route_id"`
+	Filters        []byte             `json:"filters"`
+	Search         pgtype.Text        `json:"search"`
+	AfterStartDate pgtype.Timestamptz `json:"after_start_date"`
+	AfterID        int64              `json:"after_id"`
+	MaxResults     int32              `json:"max_results"`
+}
+
+type ListRoutesForExportRow struct {
+	ID          int64              `json:"id"`
+	Name        string             `json:"name"`
+	SportType   pgtype.Text        `json:"sport_type"`
+	StartDate   pgtype.Timestamptz `json:"start_date"`
+	ElapsedTime int32              `json:"elapsed_time"`
+	MovingTime  int32              `json:"moving_time"`
+	Distance    float64            `json:"distance"`
+	Elevation   float64            `json:"elevation"`
+	Geometry    string             `json:"geometry"`
+	TimeS       []int32            `json:"time_s"`
+	AltitudeM   []float64          `json:"altitude_m"`
+	Lat         []float64          `json:"lat"`
+	Lng         []float64          `json:"lng"`
+}
+
+// Returns a page of the user's routes matching the tile route filters, oldest
+// first, with their geometry and stored streams for the exports, optionally
+// narrowed by the same full-text search as ListRoutesPage. Pages are
+// continued after (after_start_date, after_id); route_id limits the export to
+// a single route.
+func (q *Queries) ListRoutesForExport(ctx context.Context, arg ListRoutesForExportParams) ([]ListRoutesForExportRow, error) {
+	rows, err := q.db.Query(ctx, listRoutesForExport,
+		arg.UserID,
+		arg.RouteID,
+		arg.Filters,
+		arg.Search,
+		arg.AfterStartDate,
+		arg.AfterID,
+		arg.MaxResults,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListRoutesForExportRow
+	for rows.Next() {
+		var i ListRoutesForExportRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.SportType,
+			&i.StartDate,
+			&i.ElapsedTime,
+			&i.MovingTime,
+			&i.Distance,
+			&i.Elevation,
+			&i.Geometry,
+			&i.TimeS,
+			&i.AltitudeM,
+			&i.Lat,
+			&i.Lng,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listRoutesPage = `-- name: ListRoutesPage :many
+WITH matching AS (
+    SELECT r.id, r.start_date, COALESCE(o.name, r.name) AS name, r.sport_type, r.elapsed_time, r.moving_time, r.distance,
+           r.average_speed, r.elevation, r.bounds, r.commute, r.trainer, r.description,
+           COALESCE(o.notes, '')::text AS notes,
+           COALESCE(o.hidden, FALSE)::boolean AS hidden,
+           COALESCE(o.exclude_explorer, FALSE)::boolean AS exclude_explorer,
+           COALESCE(o.exclude_unique_distance, FALSE)::boolean AS exclude_unique_distance,
+           ng.distance_meters AS unique_distance,
+           ARRAY(SELECT t.tag FROM route_tag t WHERE t.route_id = r.id ORDER BY t.tag)::text[] AS tags,
+           (CASE $1::text
+                WHEN 'distance' THEN r.distance
+                WHEN 'moving_time' THEN r.moving_time
+                WHEN 'elapsed_time' THEN r.elapsed_time
+                WHEN 'elevation' THEN r.elevation
+                WHEN 'average_speed' THEN r.average_speed
+                WHEN 'unique_distance' THEN COALESCE(ng.distance_meters, 0)
+                ELSE extract(epoch FROM r.start_date)
+            END)::float AS sort_value
+    FROM route r
+    LEFT JOIN route_new_ground ng ON ng.route_id = r.id
+    LEFT JOIN route_override o ON o.route_id = r.id
+    WHERE r.user_id = $2
+      AND route_matches_filters(r, $3::json)
+      AND ($4::text IS NULL
+           OR (r.search_vector || COALESCE(o.search_vector, ''::tsvector))
+              @@ websearch_to_tsquery('simple', $4))
+)
+SELECT id, start_date, name, sport_type, elapsed_time, moving_time, distance, average_speed, elevation,
+       bounds, commute, trainer, description, notes, hidden, exclude_explorer, exclude_unique_distance,
+       unique_distance, tags, sort_value
+FROM matching
+WHERE $5::float IS NULL
+   OR (sort_value * $6::int, id * $6::int)
+      > ($5 * $6::int, $7::bigint * $6::int)
+ORDER BY sort_value * $6::int, id * $6::int
+LIMIT $8::int
+`
+
+type ListRoutesPageParams struct {
+	Sort       string        `json:"sort"`
+	UserID     int64         `json:"user_id"`
+	Filters    []byte        `json:"filters"`
+	Search     pgtype.Text   `json:"search"`
+	AfterValue pgtype.Float8 `json:"after_value"`
+	Direction  int32         `json:"direction"`
+	AfterID    int64         `json:"after_id"`
+	MaxResults int32         `json:"max_results"`
+}
+
+type ListRoutesPageRow struct {
+	ID                    int64              `json:"id"`
+	StartDate             pgtype.Timestamptz `json:"start_date"`
+	Name                  string             `json:"name"`
+	SportType             pgtype.Text        `json:"sport_type"`
+	ElapsedTime           int32              `json:"elapsed_time"`
+	MovingTime            int32              `json:"moving_time"`
+	Distance              float64            `json:"distance"`
+	AverageSpeed          float64            `json:"average_speed"`
+	Elevation             float64            `json:"elevation"`
+	Bounds                string             `json:"bounds"`
+	Commute               bool               `json:"commute"`
+	Trainer               bool               `json:"trainer"`
+	Description           string             `json:"description"`
+	Notes                 string             `json:"notes"`
+	Hidden                bool               `json:"hidden"`
+	ExcludeExplorer       bool               `json:"exclude_explorer"`
+	ExcludeUniqueDistance bool               `json:"exclude_unique_distance"`
+	UniqueDistance        pgtype.Float8      `json:"unique_distance"`
+	Tags                  []string           `json:"tags"`
+	SortValue             float64            `json:"sort_value"`
+}
+
+// Returns a page of the user's routes matching the tile route filters and the
+// optional full-text search over the Strava name and description and the
+// local name and notes. The routes are ordered by the sort metric (and id to
+// break ties), ascending for direction 1 and descending for -1; pages are
+// continued after (after_value, after_id) of the last route.
+func (q *Queries) ListRoutesPage(ctx context.Context, arg ListRoutesPageParams) ([]ListRoutesPageRow, error) {
+	rows, err := q.db.Query(ctx, listRoutesPage,
+		arg.Sort,
+		arg.UserID,
+		arg.Filters,
+		arg.Search,
+		arg.AfterValue,
+		arg.Direction,
+		arg.AfterID,
+		arg.MaxResults,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ListRoutesPageRow
+	for rows.Next() {
+		var i ListRoutesPageRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.StartDate,
+			&i.Name,
+			&i.SportType,
+			&i.ElapsedTime,
+			&i.MovingTime,
+			&i.Distance,
+			&i.AverageSpeed,
+			&i.Elevation,
+			&i.Bounds,
+			&i.Commute,
+			&i.Trainer,
+			&i.Description,
+			&i.Notes,
+			&i.Hidden,
+			&i.ExcludeExplorer,
+			&i.ExcludeUniqueDistance,
+			&i.UniqueDistance,
+			&i.Tags,
+			&i.SortValue,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listShares = `-- name: ListShares :many
+SELECT id, user_id, token, name, filters, layers, public_profile, expires_at, revoked_at, created_at
+FROM share
+WHERE user_id = $1 AND revoked_at IS NULL
+ORDER BY created_at DESC
 `
 
-func (q *Queries) GetUserPreferences(ctx context.Context, userID int64) (UserPreference, error) {
-	row := q.db.QueryRow(ctx, getUserPreferences, userID)
-	var i UserPreference
-	err := row.Scan(&i.UserID, &i.WriteUniqueDistance)
-	return i, err
+// Returns the shares of the user that were not revoked, newest first.
+func (q *Queries) ListShares(ctx context.Context, userID int64) ([]Share, error) {
+	rows, err := q.db.Query(ctx, listShares, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Share
+	for rows.Next() {
+		var i Share
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Token,
+			&i.Name,
+			&i.Filters,
+			&i.Layers,
+			&i.PublicProfile,
+			&i.ExpiresAt,
+			&i.RevokedAt,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
 }
 
-const listAthleteIDs = `-- name: ListAthleteIDs :many
-SELECT id
-FROM athlete
+const listTagRules = `-- name: ListTagRules :many
+SELECT id, user_id, tag, name_pattern, lat, lng, radius_meters, created_at
+FROM tag_rule
+WHERE user_id = $1 AND tag = $2
+ORDER BY id
 `
 
-func (q *Queries) ListAthleteIDs(ctx context.Context) ([]int64, error) {
-	rows, err := q.db.Query(ctx, listAthleteIDs)
+type ListTagRulesParams struct {
+	UserID int64  `json:"user_id"`
+	Tag    string `json:"tag"`
+}
+
+func (q *Queries) ListTagRules(ctx context.Context, arg ListTagRulesParams) ([]TagRule, error) {
+	rows, err := q.db.Query(ctx, listTagRules, arg.UserID, arg.Tag)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []int64
+	var items []TagRule
 	for rows.Next() {
-		var id int64
-		if err := rows.Scan(&id); err != nil {
+		var i TagRule
+		if err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.Tag,
+			&i.NamePattern,
+			&i.Lat,
+			&i.Lng,
+			&i.RadiusMeters,
+			&i.CreatedAt,
+		); err != nil {
 			return nil, err
 		}
-		items = append(items, id)
+		items = append(items, i)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -170,46 +1919,77 @@ func (q *Queries) ListAthleteIDs(ctx context.Context) ([]int64, error) {
 	return items, nil
 }
 
-const listRoutesByUser = `-- name: ListRoutesByUser :many
-SELECT id, user_id, start_date, name, elapsed_time, moving_time, distance, average_speed, elevation, bounds
-FROM route
-WHERE user_id = $1
-ORDER BY start_date DESC
+const listTags = `-- name: ListTags :many
+SELECT g.name, g.description, g.created_at,
+       COUNT(r.id)::int AS route_count,
+       COALESCE(SUM(r.distance), 0)::float AS distance,
+       COALESCE(SUM(r.moving_time), 0)::bigint AS moving_time,
+       COALESCE(SUM(r.elevation), 0)::float AS elevation,
+       COALESCE(SUM(ng.distance_meters), 0)::float AS unique_distance_meters,
+       MIN(r.start_date)::timestamptz AS first_date,
+       MAX(r.start_date)::timestamptz AS last_date,
+       ST_YMin(ST_Extent(r.geom))::float AS min_lat,
+       ST_XMin(ST_Extent(r.geom))::float AS min_lng,
+       ST_YMax(ST_Extent(r.geom))::float AS max_lat,
+       ST_XMax(ST_Extent(r.geom))::float AS max_lng
+FROM tag g
+LEFT JOIN route_tag t ON t.user_id = g.user_id AND t.tag = g.name
+LEFT JOIN route r ON r.id = t.route_id
+LEFT JOIN route_new_ground ng ON ng.route_id = r.id
+WHERE g.user_id = $1
+  AND ($2::text IS NULL OR g.name = $2)
+GROUP BY g.user_id, g.name
+ORDER BY g.name
 `
 
-type ListRoutesByUserRow struct {
-	ID           int64              `json:"id"`
-	UserID       int64              `json:"user_id"`
-	StartDate    pgtype.Timestamptz `json:"start_date"`
-	Name         string             `json:"name"`
-	ElapsedTime  int32              `json:"elapsed_time"`
-	MovingTime   int32              `json:"moving_time"`
-	Distance     float64            `json:"distance"`
-	AverageSpeed float64            `json:"average_speed"`
-	Elevation    float64            `json:"elevation"`
-	Bounds       string             `json:"bounds"`
-}
-
-func (q *Queries) ListRoutesByUser(ctx context.Context, userID int64) ([]ListRoutesByUserRow, error) {
-	rows, err := q.db.Query(ctx, listRoutesByUser, userID)
+type ListTagsParams struct {
+	UserID int64       `json:"user_id"`
+	Name   pgtype.Text `json:"name"`
+}
+
+type ListTagsRow struct {
+	Name                 string             `json:"name"`
+	Description          string             `json:"description"`
+	CreatedAt            pgtype.Timestamptz `json:"created_at"`
+	RouteCount           int32              `json:"route_count"`
+	Distance             float64            `json:"distance"`
+	MovingTime           int64              `json:"moving_time"`
+	Elevation            float64            `json:"elevation"`
+	UniqueDistanceMeters float64            `json:"unique_distance_meters"`
+	FirstDate            pgtype.Timestamptz `json:"first_date"`
+	LastDate             pgtype.Timestamptz `json:"last_date"`
+	MinLat               pgtype.Float8      `json:"min_lat"`
+	MinLng               pgtype.Float8      `json:"min_lng"`
+	MaxLat               pgtype.Float8      `json:"max_lat"`
+	MaxLng               pgtype.Float8      `json:"max_lng"`
+}
+
+// Returns the tags of the user (or only the named one) with the totals and
+// bounds of their routes. The bounds are NULL for tags without routes.
+func (q *Queries) ListTags(ctx context.Context, arg ListTagsParams) ([]ListTagsRow, error) {
+	rows, err := q.db.Query(ctx, listTags, arg.UserID, arg.Name)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var items []ListRoutesByUserRow
+	var items []ListTagsRow
 	for rows.Next() {
-		var i ListRoutesByUserRow
+		var i ListTagsRow
 		if err := rows.Scan(
-			&i.ID,
-			&i.UserID,
-			&i.StartDate,
 			&i.Name,
-			&i.ElapsedTime,
-			&i.MovingTime,
+			&i.Description,
+			&i.CreatedAt,
+			&i.RouteCount,
 			&i.Distance,
-			&i.AverageSpeed,
+			&i.MovingTime,
 			&i.Elevation,
-			&i.Bounds,
+			&i.UniqueDistanceMeters,
+			&i.FirstDate,
+			&i.LastDate,
+			&i.MinLat,
+			&i.MinLng,
+			&i.MaxLat,
+			&i.MaxLng,
 		); err != nil {
 			return nil, err
 		}
@@ -221,6 +2001,66 @@ func (q *Queries) ListRoutesByUser(ctx context.Context, userID int64) ([]ListRou
 	return items, nil
 }
 
+const markActivitiesSynced = `-- name: MarkActivitiesSynced :exec
+UPDATE athlete
+SET activities_synced_at = now()
+WHERE id = $1
+`
+
+func (q *Queries) MarkActivitiesSynced(ctx context.Context, id int64) error {
+	_, err := q.db.Exec(ctx, markActivitiesSynced, id)
+	return err
+}
+
+const recordSchemaVersion = `-- name: RecordSchemaVersion :exec
+INSERT INTO schema_version (version)
+VALUES ($1)
+ON CONFLICT (version) DO UPDATE SET applied_at = now()
+`
+
+func (q *Queries) RecordSchemaVersion(ctx context.Context, version string) error {
+	_, err := q.db.Exec(ctx, recordSchemaVersion, version)
+	return err
+}
+
+const revokeApiToken = `-- name: RevokeApiToken :execrows
+UPDATE api_token
+SET revoked_at = now()
+WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+`
+
+type RevokeApiTokenParams struct {
+	ID     int32 `json:"id"`
+	UserID int64 `json:"user_id"`
+}
+
+func (q *Queries) RevokeApiToken(ctx context.Context, arg RevokeApiTokenParams) (int64, error) {
+	result, err := q.db.Exec(ctx, revokeApiToken, arg.ID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const revokeShare = `-- name: RevokeShare :execrows
+UPDATE share
+SET revoked_at = now()
+WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+`
+
+type RevokeShareParams struct {
+	ID     int32 `json:"id"`
+	UserID int64 `json:"user_id"`
+}
+
+func (q *Queries) RevokeShare(ctx context.Context, arg RevokeShareParams) (int64, error) {
+	result, err := q.db.Exec(ctx, revokeShare, arg.ID, arg.UserID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const routeExists = `-- name: RouteExists :one
 SELECT COUNT(*) > 0
 FROM route
@@ -234,6 +2074,216 @@ func (q *Queries) RouteExists(ctx context.Context, id int64) (bool, error) {
 	return column_1, err
 }
 
+const searchRoutesByArea = `-- name: SearchRoutesByArea :many
+WITH area AS (
+    SELECT CASE
+        WHEN $1::float > 0 THEN
+            ST_Buffer(ST_SetSRID(ST_GeomFromGeoJSON($2::text), 4326)::geography, $1::float)::geometry
+        ELSE ST_SetSRID(ST_GeomFromGeoJSON($2::text), 4326)
+    END AS geom
+)
+SELECT r.id, COALESCE(o.name, r.name) AS name, r.sport_type, r.start_date, r.distance,
+       ST_Length(ST_Intersection(r.geom, area.geom)::geography)::double precision AS distance_inside_meters
+FROM route r
+CROSS JOIN area
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE r.user_id = $3
+  AND ($4::boolean OR NOT COALESCE(o.hidden, FALSE))
+  AND r.geom && area.geom
+  AND ST_Intersects(r.geom, area.geom)
+ORDER BY r.start_date DESC
+LIMIT $5::int
+`
+
+type SearchRoutesByAreaParams struct {
+	RadiusMeters  float64 `json:"radius_meters"`
+	Area          string  `json:"area"`
+	UserID        int64   `json:"user_id"`
+	IncludeHidden bool    `json:"include_hidden"`
+	MaxResults    int32   `json:"max_results"`
+}
+
+type SearchRoutesByAreaRow struct {
+	ID                   int64              `json:"id"`
+	Name                 string             `json:"name"`
+	SportType            pgtype.Text        `json:"sport_type"`
+	StartDate            pgtype.Timestamptz `json:"start_date"`
+	Distance             float64            `json:"distance"`
+	DistanceInsideMeters float64            `json:"distance_inside_meters"`
+}
+
+// Returns the user's routes that pass through an area, most recent first, with
+// the length of the part inside it. The area is a GeoJSON geometry (EPSG:4326),
+// buffered by radius_meters if that is positive, e.g. for a point. Routes
+// hidden by their overrides are left out unless include_hidden is true.
+func (q *Queries) SearchRoutesByArea(ctx context.Context, arg SearchRoutesByAreaParams) ([]SearchRoutesByAreaRow, error) {
+	rows, err := q.db.Query(ctx, searchRoutesByArea,
+		arg.RadiusMeters,
+		arg.Area,
+		arg.UserID,
+		arg.IncludeHidden,
+		arg.MaxResults,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []SearchRoutesByAreaRow
+	for rows.Next() {
+		var i SearchRoutesByAreaRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Name,
+			&i.SportType,
+			&i.StartDate,
+			&i.Distance,
+			&i.DistanceInsideMeters,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const tagRoutesByArea = `-- name: TagRoutesByArea :execrows
+WITH area AS (
+    SELECT CASE
+        WHEN $1::float > 0 THEN
+            ST_Buffer(ST_SetSRID(ST_GeomFromGeoJSON($2::text), 4326)::geography, $1::float)::geometry
+        ELSE ST_SetSRID(ST_GeomFromGeoJSON($2::text), 4326)
+    END AS geom
+)
+INSERT INTO route_tag (route_id, user_id, tag)
+SELECT r.id, r.user_id, g.name
+FROM tag g
+JOIN route r ON r.user_id = g.user_id
+CROSS JOIN area
+WHERE g.user_id = $3 AND g.name = $4
+  AND r.geom && area.geom
+  AND ST_Intersects(r.geom, area.geom)
+ON CONFLICT (route_id, tag) DO NOTHING
+`
+
+type TagRoutesByAreaParams struct {
+	RadiusMeters float64 `json:"radius_meters"`
+	Area         string  `json:"area"`
+	UserID       int64   `json:"user_id"`
+	Tag          string  `json:"tag"`
+}
+
+// Tags the user's routes that pass through an area, given like for
+// SearchRoutesByArea.
+func (q *Queries) TagRoutesByArea(ctx context.Context, arg TagRoutesByAreaParams) (int64, error) {
+	result, err := q.db.Exec(ctx, tagRoutesByArea,
+		arg.RadiusMeters,
+		arg.Area,
+		arg.UserID,
+		arg.Tag,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const tagRoutesByID = `-- name: TagRoutesByID :execrows
+INSERT INTO route_tag (route_id, user_id, tag)
+SELECT r.id, r.user_id, g.name
+FROM tag g
+JOIN route r ON r.user_id = g.user_id
+WHERE g.user_id = $1 AND g.name = $2
+  AND r.id = ANY ($3::bigint[])
+ON CONFLICT (route_id, tag) DO NOTHING
+`
+
+type TagRoutesByIDParams struct {
+	UserID   int64   `json:"user_id"`
+	Tag      string  `json:"tag"`
+	RouteIds []int64 `json:"route_ids"`
+}
+
+// Tags the given routes of the user. Returns the number of newly tagged routes.
+func (q *Queries) TagRoutesByID(ctx context.Context, arg TagRoutesByIDParams) (int64, error) {
+	result, err := q.db.Exec(ctx, tagRoutesByID, arg.UserID, arg.Tag, arg.RouteIds)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const tagRoutesBySearch = `-- name: TagRoutesBySearch :execrows
+INSERT INTO route_tag (route_id, user_id, tag)
+SELECT r.id, r.user_id, g.name
+FROM tag g
+JOIN route r ON r.user_id = g.user_id
+LEFT JOIN route_override o ON o.route_id = r.id
+WHERE g.user_id = $1 AND g.name = $2
+  AND route_matches_filters(r, $3::json)
+  AND ($4::text IS NULL
+       OR (r.search_vector || COALESCE(o.search_vector, ''::tsvector))
+          @@ websearch_to_tsquery('simple', $4))
+ON CONFLICT (route_id, tag) DO NOTHING
+`
+
+type TagRoutesBySearchParams struct {
+	UserID  int64       `json:"user_id"`
+	Tag     string      `json:"tag"`
+	Filters []byte      `json:"filters"`
+	Search  pgtype.Text `json:"search"`
+}
+
+// Tags the user's routes that the route list would return for the filters and
+// full-text search (see ListRoutesPage).
+func (q *Queries) TagRoutesBySearch(ctx context.Context, arg TagRoutesBySearchParams) (int64, error) {
+	result, err := q.db.Exec(ctx, tagRoutesBySearch,
+		arg.UserID,
+		arg.Tag,
+		arg.Filters,
+		arg.Search,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
+const touchApiToken = `-- name: TouchApiToken :exec
+UPDATE api_token
+SET last_used_at = now()
+WHERE id = $1
+  AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute')
+`
+
+// Sets the last use of an API token, at most once a minute to spare the writes.
+func (q *Queries) TouchApiToken(ctx context.Context, id int32) error {
+	_, err := q.db.Exec(ctx, touchApiToken, id)
+	return err
+}
+
+const untagRoutes = `-- name: UntagRoutes :execrows
+DELETE FROM route_tag
+WHERE user_id = $1 AND tag = $2
+  AND route_id = ANY ($3::bigint[])
+`
+
+type UntagRoutesParams struct {
+	UserID   int64   `json:"user_id"`
+	Tag      string  `json:"tag"`
+	RouteIds []int64 `json:"route_ids"`
+}
+
+func (q *Queries) UntagRoutes(ctx context.Context, arg UntagRoutesParams) (int64, error) {
+	result, err := q.db.Exec(ctx, untagRoutes, arg.UserID, arg.Tag, arg.RouteIds)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected(), nil
+}
+
 const updateAthleteTokens = `-- name: UpdateAthleteTokens :exec
 UPDATE athlete
 SET access_token = $1,
@@ -252,23 +2302,95 @@ func (q *Queries) UpdateAthleteTokens(ctx context.Context, arg UpdateAthleteToke
 	return err
 }
 
-const updateRouteName = `-- name: UpdateRouteName :exec
-UPDATE route
-SET name = $1
+const updateRouteDescription = `-- name: UpdateRouteDescription :exec
+UPDATE route SET description = $1
 WHERE id = $2 AND user_id = $3
 `
 
-type UpdateRouteNameParams struct {
-	Name   string `json:"name"`
-	ID     int64  `json:"id"`
-	UserID int64  `json:"user_id"`
+type UpdateRouteDescriptionParams struct {
+	Description string `json:"description"`
+	ID          int64  `json:"id"`
+	UserID      int64  `json:"user_id"`
+}
+
+func (q *Queries) UpdateRouteDescription(ctx context.Context, arg UpdateRouteDescriptionParams) error {
+	_, err := q.db.Exec(ctx, updateRouteDescription, arg.Description, arg.ID, arg.UserID)
+	return err
+}
+
+const updateRouteSummary = `-- name: UpdateRouteSummary :exec
+UPDATE route
+SET name = $1, sport_type = $2, commute = $3, trainer = $4, private = $5
+WHERE id = $6 AND user_id = $7
+`
+
+type UpdateRouteSummaryParams struct {
+	Name      string      `json:"name"`
+	SportType pgtype.Text `json:"sport_type"`
+	Commute   bool        `json:"commute"`
+	Trainer   bool        `json:"trainer"`
+	Private   bool        `json:"private"`
+	ID        int64       `json:"id"`
+	UserID    int64       `json:"user_id"`
 }
 
-func (q *Queries) UpdateRouteName(ctx context.Context, arg UpdateRouteNameParams) error {
-	_, err := q.db.Exec(ctx, updateRouteName, arg.Name, arg.ID, arg.UserID)
+// Updates the fields of a route that are in Strava's activity summaries.
+func (q *Queries) UpdateRouteSummary(ctx context.Context, arg UpdateRouteSummaryParams) error {
+	_, err := q.db.Exec(ctx, updateRouteSummary,
+		arg.Name,
+		arg.SportType,
+		arg.Commute,
+		arg.Trainer,
+		arg.Private,
+		arg.ID,
+		arg.UserID,
+	)
 	return err
 }
 
+const updateTag = `-- name: UpdateTag :one
+WITH updated AS (
+    UPDATE tag
+    SET name        = COALESCE($1::text, name),
+        description = COALESCE($2::text, description)
+    WHERE user_id = $3 AND name = $4
+    RETURNING user_id, name, description, created_at
+), moved AS (
+    UPDATE route_tag t
+    SET tag = u.name
+    FROM updated u
+    WHERE t.user_id = u.user_id AND t.tag = $4 AND u.name <> $4
+)
+SELECT user_id, name, description, created_at
+FROM updated
+`
+
+type UpdateTagParams struct {
+	NewName     pgtype.Text `json:"new_name"`
+	Description pgtype.Text `json:"description"`
+	UserID      int64       `json:"user_id"`
+	Name        string      `json:"name"`
+}
+
+// Renames a tag and/or changes its description; NULL params keep the current
+// value. The tag's routes are moved along and its rules follow the foreign key.
+func (q *Queries) UpdateTag(ctx context.Context, arg UpdateTagParams) (Tag, error) {
+	row := q.db.QueryRow(ctx, updateTag,
+		arg.NewName,
+		arg.Description,
+		arg.UserID,
+		arg.Name,
+	)
+	var i Tag
+	err := row.Scan(
+		&i.UserID,
+		&i.Name,
+		&i.Description,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
 const upsertAthlete = `-- name: UpsertAthlete :exec
 INSERT INTO athlete (id, firstname, lastname, access_token, refresh_token, expires_at)
 VALUES ($1, $2, $3, $4, $5, $6)
@@ -301,20 +2423,85 @@ func (q *Queries) UpsertAthlete(ctx context.Context, arg UpsertAthleteParams) er
 	return err
 }
 
+const upsertExplorerStats = `-- name: UpsertExplorerStats :exec
+INSERT INTO explorer_stats (user_id, z, total_tiles, max_cluster, max_square, cluster_geom, square_geom, square_x, square_y, updated_at)
+SELECT
+    $1::bigint,
+    $2::int,
+    $3::int,
+    $4::int,
+    $5::int,
+    (SELECT ST_Multi(ST_Union(ST_TileEnvelope($2::int, c.x, c.y)))
+     FROM unnest($6::int[], $7::int[]) AS c(x, y)),
+    CASE WHEN $5::int > 0 THEN
+        ST_Envelope(ST_Collect(
+            ST_TileEnvelope($2::int, $8::int, $9::int),
+            ST_TileEnvelope($2::int, $8::int + $5::int - 1, $9::int + $5::int - 1)
+        ))
+    END,
+    $8::int,
+    $9::int,
+    now()
+ON CONFLICT (user_id, z) DO UPDATE SET
+    total_tiles  = EXCLUDED.total_tiles,
+    max_cluster  = EXCLUDED.max_cluster,
+    max_square   = EXCLUDED.max_square,
+    cluster_geom = EXCLUDED.cluster_geom,
+    square_geom  = EXCLUDED.square_geom,
+    square_x     = EXCLUDED.square_x,
+    square_y     = EXCLUDED.square_y,
+    updated_at   = EXCLUDED.updated_at
+`
+
+type UpsertExplorerStatsParams struct {
+	UserID     int64   `json:"user_id"`
+	Z          int32   `json:"z"`
+	TotalTiles int32   `json:"total_tiles"`
+	MaxCluster int32   `json:"max_cluster"`
+	MaxSquare  int32   `json:"max_square"`
+	ClusterX   []int32 `json:"cluster_x"`
+	ClusterY   []int32 `json:"cluster_y"`
+	SquareX    int32   `json:"square_x"`
+	SquareY    int32   `json:"square_y"`
+}
+
+// Stores the explorer statistics of a user at one grid zoom. The max cluster is
+// passed as the coordinates of its cells and the max square as its top-left cell.
+func (q *Queries) UpsertExplorerStats(ctx context.Context, arg UpsertExplorerStatsParams) error {
+	_, err := q.db.Exec(ctx, upsertExplorerStats,
+		arg.UserID,
+		arg.Z,
+		arg.TotalTiles,
+		arg.MaxCluster,
+		arg.MaxSquare,
+		arg.ClusterX,
+		arg.ClusterY,
+		arg.SquareX,
+		arg.SquareY,
+	)
+	return err
+}
+
 const upsertRoute = `-- name: UpsertRoute :exec
-INSERT INTO route (id, user_id, start_date, name, elapsed_time, moving_time, distance, average_speed, elevation, bounds, geom)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, ST_GeomFromText($11, 4326))
+INSERT INTO route (id, user_id, start_date, name, elapsed_time, moving_time, distance, average_speed, elevation, bounds, sport_type, commute, trainer, start_date_local, description, private, geom)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, ST_GeomFromText($17, 4326))
 ON CONFLICT (id) DO UPDATE SET
-    user_id       = EXCLUDED.user_id,
-    start_date    = EXCLUDED.start_date,
-    name          = EXCLUDED.name,
-    elapsed_time  = EXCLUDED.elapsed_time,
-    moving_time   = EXCLUDED.moving_time,
-    distance      = EXCLUDED.distance,
-    average_speed = EXCLUDED.average_speed,
-    elevation     = EXCLUDED.elevation,
-    bounds        = EXCLUDED.bounds,
-    geom          = EXCLUDED.geom
+    user_id          = EXCLUDED.user_id,
+    start_date       = EXCLUDED.start_date,
+    name             = EXCLUDED.name,
+    elapsed_time     = EXCLUDED.elapsed_time,
+    moving_time      = EXCLUDED.moving_time,
+    distance         = EXCLUDED.distance,
+    average_speed    = EXCLUDED.average_speed,
+    elevation        = EXCLUDED.elevation,
+    bounds           = EXCLUDED.bounds,
+    sport_type       = EXCLUDED.sport_type,
+    commute          = EXCLUDED.commute,
+    trainer          = EXCLUDED.trainer,
+    start_date_local = EXCLUDED.start_date_local,
+    description      = EXCLUDED.description,
+    private          = EXCLUDED.private,
+    geom             = EXCLUDED.geom
 `
 
 type UpsertRouteParams struct {
@@ -328,6 +2515,12 @@ type UpsertRouteParams struct {
 	AverageSpeed   float64            `json:"average_speed"`
 	Elevation      float64            `json:"elevation"`
 	Bounds         string             `json:"bounds"`
+	SportType      pgtype.Text        `json:"sport_type"`
+	Commute        bool               `json:"commute"`
+	Trainer        bool               `json:"trainer"`
+	StartDateLocal pgtype.Timestamp   `json:"start_date_local"`
+	Description    string             `json:"description"`
+	Private        bool               `json:"private"`
 	StGeomfromtext interface{}        `json:"st_geomfromtext"`
 }
 
@@ -343,27 +2536,264 @@ func (q *Queries) UpsertRoute(ctx context.Context, arg UpsertRouteParams) error
 		arg.AverageSpeed,
 		arg.Elevation,
 		arg.Bounds,
+		arg.SportType,
+		arg.Commute,
+		arg.Trainer,
+		arg.StartDateLocal,
+		arg.Description,
+		arg.Private,
 		arg.StGeomfromtext,
 	)
 	return err
 }
 
+const upsertRouteNewGround = `-- name: UpsertRouteNewGround :exec
+INSERT INTO route_new_ground (route_id, user_id, distance_meters, geom, computed_at,
+                              time_window, window_days, tolerance_meters, sample_meters)
+SELECT
+    r.id,
+    r.user_id,
+    LEAST(
+        COALESCE(SUM(ST_Length(s.seg::geography)) FILTER (WHERE s.is_unique), 0),
+        r.distance * 1000
+    )::double precision,
+    ST_Multi(ST_LineMerge(ST_Collect(s.seg) FILTER (WHERE s.is_unique))),
+    now(),
+    p.new_ground_window,
+    p.new_ground_days,
+    p.new_ground_tolerance_meters,
+    p.new_ground_sample_meters
+FROM route r
+JOIN user_preferences p ON p.user_id = r.user_id
+CROSS JOIN LATERAL route_unique_segments(r.id, p.new_ground_window, p.new_ground_days,
+                                         p.new_ground_tolerance_meters, p.new_ground_sample_meters) s
+WHERE r.id = $1
+  AND r.geom IS NOT NULL
+GROUP BY r.id, p.user_id
+ON CONFLICT (route_id) DO UPDATE SET
+    user_id          = EXCLUDED.user_id,
+    distance_meters  = EXCLUDED.distance_meters,
+    geom             = EXCLUDED.geom,
+    computed_at      = EXCLUDED.computed_at,
+    time_window      = EXCLUDED.time_window,
+    window_days      = EXCLUDED.window_days,
+    tolerance_meters = EXCLUDED.tolerance_meters,
+    sample_meters    = EXCLUDED.sample_meters
+`
+
+// Computes the parts of the route that aren't covered by an earlier route of
+// the same user within the user's new ground window (see
+// route_unique_segments) and stores them with their length and the settings
+// used in route_new_ground.
+// The length is capped at the route's own Strava-reported distance (in metres)
+// so that a fully-unique route can never return a value larger than the route
+// itself (PostGIS measures the raw GPS polyline, which is slightly longer than
+// Strava's smoothed distance).
+func (q *Queries) UpsertRouteNewGround(ctx context.Context, id int64) error {
+	_, err := q.db.Exec(ctx, upsertRouteNewGround, id)
+	return err
+}
+
+const upsertRouteNewGroundSince = `-- name: UpsertRouteNewGroundSince :exec
+INSERT INTO route_new_ground (route_id, user_id, distance_meters, geom, computed_at,
+                              time_window, window_days, tolerance_meters, sample_meters)
+SELECT
+    r.id,
+    r.user_id,
+    LEAST(
+        COALESCE(SUM(ST_Length(s.seg::geography)) FILTER (WHERE s.is_unique), 0),
+        r.distance * 1000
+    )::double precision,
+    ST_Multi(ST_LineMerge(ST_Collect(s.seg) FILTER (WHERE s.is_unique))),
+    now(),
+    p.new_ground_window,
+    p.new_ground_days,
+    p.new_ground_tolerance_meters,
+    p.new_ground_sample_meters
+FROM route r
+JOIN user_preferences p ON p.user_id = r.user_id
+CROSS JOIN LATERAL route_unique_segments(r.id, p.new_ground_window, p.new_ground_days,
+                                         p.new_ground_tolerance_meters, p.new_ground_sample_meters) s
+WHERE r.user_id = $1
+  AND ($2::timestamptz IS NULL OR r.start_date >= $2)
+  AND r.geom IS NOT NULL
+GROUP BY r.id, p.user_id
+ON CONFLICT (route_id) DO UPDATE SET
+    user_id          = EXCLUDED.user_id,
+    distance_meters  = EXCLUDED.distance_meters,
+    geom             = EXCLUDED.geom,
+    computed_at      = EXCLUDED.computed_at,
+    time_window      = EXCLUDED.time_window,
+    window_days      = EXCLUDED.window_days,
+    tolerance_meters = EXCLUDED.tolerance_meters,
+    sample_meters    = EXCLUDED.sample_meters
+`
+
+type UpsertRouteNewGroundSinceParams struct {
+	UserID int64              `json:"user_id"`
+	Since  pgtype.Timestamptz `json:"since"`
+}
+
+// Same as UpsertRouteNewGround for every route of a user that started at or
+// after since (or for all of them if since is NULL). Adding a route only
+// changes the new ground of the routes after it, and changing the settings
+// changes all of them.
+func (q *Queries) UpsertRouteNewGroundSince(ctx context.Context, arg UpsertRouteNewGroundSinceParams) error {
+	_, err := q.db.Exec(ctx, upsertRouteNewGroundSince, arg.UserID, arg.Since)
+	return err
+}
+
+const upsertRouteOverride = `-- name: UpsertRouteOverride :one
+WITH upserted AS (
+    INSERT INTO route_override (route_id, user_id, name, hidden, exclude_explorer, exclude_unique_distance, notes)
+    SELECT r.id, r.user_id,
+           NULLIF($1::text, ''),
+           COALESCE($2::boolean, FALSE),
+           COALESCE($3::boolean, FALSE),
+           COALESCE($4::boolean, FALSE),
+           COALESCE($5::text, '')
+    FROM route r
+    WHERE r.id = $6 AND r.user_id = $7
+    ON CONFLICT (route_id) DO UPDATE SET
+        name                    = CASE WHEN $1::text IS NULL THEN route_override.name
+                                       ELSE NULLIF($1::text, '') END,
+        hidden                  = COALESCE($2::boolean, route_override.hidden),
+        exclude_explorer        = COALESCE($3::boolean, route_override.exclude_explorer),
+        exclude_unique_distance = COALESCE($4::boolean, route_override.exclude_unique_distance),
+        notes                   = COALESCE($5::text, route_override.notes),
+        updated_at              = now()
+    RETURNING route_id, name, hidden, exclude_explorer, exclude_unique_distance, notes, updated_at
+)
+SELECT u.route_id, COALESCE(u.name, r.name) AS name, u.name IS NOT NULL AS renamed, u.hidden,
+       u.exclude_explorer, u.exclude_unique_distance, u.notes, u.updated_at, r.start_date
+FROM upserted u
+JOIN route r ON r.id = u.route_id
+`
+
+type UpsertRouteOverrideParams struct {
+	Name                  pgtype.Text `json:"name"`
+	Hidden                pgtype.Bool `json:"hidden"`
+	ExcludeExplorer       pgtype.Bool `json:"exclude_explorer"`
+	ExcludeUniqueDistance pgtype.Bool `json:"exclude_unique_distance"`
+	Notes                 pgtype.Text `json:"notes"`
+	RouteID               int64       `json:"route_id"`
+	UserID                int64       `json:"user_id"`
+}
+
+type UpsertRouteOverrideRow struct {
+	RouteID               int64              `json:"route_id"`
+	Name                  string             `json:"name"`
+	Renamed               bool               `json:"renamed"`
+	Hidden                bool               `json:"hidden"`
+	ExcludeExplorer       bool               `json:"exclude_explorer"`
+	ExcludeUniqueDistance bool               `json:"exclude_unique_distance"`
+	Notes                 string             `json:"notes"`
+	UpdatedAt             pgtype.Timestamptz `json:"updated_at"`
+	StartDate             pgtype.Timestamptz `json:"start_date"`
+}
+
+// Updates the local overrides of a route of the user. Params that are NULL keep
+// their current value; an empty name restores the Strava name. Returns no row
+// if the route isn't the user's.
+func (q *Queries) UpsertRouteOverride(ctx context.Context, arg UpsertRouteOverrideParams) (UpsertRouteOverrideRow, error) {
+	row := q.db.QueryRow(ctx, upsertRouteOverride,
+		arg.Name,
+		arg.Hidden,
+		arg.ExcludeExplorer,
+		arg.ExcludeUniqueDistance,
+		arg.Notes,
+		arg.RouteID,
+		arg.UserID,
+	)
+	var i UpsertRouteOverrideRow
+	err := row.Scan(
+		&i.RouteID,
+		&i.Name,
+		&i.Renamed,
+		&i.Hidden,
+		&i.ExcludeExplorer,
+		&i.ExcludeUniqueDistance,
+		&i.Notes,
+		&i.UpdatedAt,
+		&i.StartDate,
+	)
+	return i, err
+}
+
+const upsertRouteStream = `-- name: UpsertRouteStream :exec
+INSERT INTO route_stream (route_id, user_id, time_s, distance_m, altitude_m, lat, lng, fetched_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, now())
+ON CONFLICT (route_id) DO UPDATE SET
+    user_id    = EXCLUDED.user_id,
+    time_s     = EXCLUDED.time_s,
+    distance_m = EXCLUDED.distance_m,
+    altitude_m = EXCLUDED.altitude_m,
+    lat        = EXCLUDED.lat,
+    lng        = EXCLUDED.lng,
+    fetched_at = EXCLUDED.fetched_at
+`
+
+type UpsertRouteStreamParams struct {
+	RouteID   int64     `json:"route_id"`
+	UserID    int64     `json:"user_id"`
+	TimeS     []int32   `json:"time_s"`
+	DistanceM []float64 `json:"distance_m"`
+	AltitudeM []float64 `json:"altitude_m"`
+	Lat       []float64 `json:"lat"`
+	Lng       []float64 `json:"lng"`
+}
+
+func (q *Queries) UpsertRouteStream(ctx context.Context, arg UpsertRouteStreamParams) error {
+	_, err := q.db.Exec(ctx, upsertRouteStream,
+		arg.RouteID,
+		arg.UserID,
+		arg.TimeS,
+		arg.DistanceM,
+		arg.AltitudeM,
+		arg.Lat,
+		arg.Lng,
+	)
+	return err
+}
+
 const upsertUserPreferences = `-- name: UpsertUserPreferences :one
-INSERT INTO user_preferences (user_id, write_unique_distance)
-VALUES ($1, $2)
+INSERT INTO user_preferences (user_id, write_unique_distance, new_ground_window, new_ground_days, new_ground_tolerance_meters, new_ground_sample_meters)
+VALUES ($1, $2, $3, $4, $5, $6)
 ON CONFLICT (user_id) DO UPDATE SET
-    write_unique_distance = EXCLUDED.write_unique_distance
-RETURNING user_id, write_unique_distance
+    write_unique_distance       = EXCLUDED.write_unique_distance,
+    new_ground_window           = EXCLUDED.new_ground_window,
+    new_ground_days             = EXCLUDED.new_ground_days,
+    new_ground_tolerance_meters = EXCLUDED.new_ground_tolerance_meters,
+    new_ground_sample_meters    = EXCLUDED.new_ground_sample_meters
+RETURNING user_id, write_unique_distance, new_ground_window, new_ground_days, new_ground_tolerance_meters, new_ground_sample_meters
 `
 
 type UpsertUserPreferencesParams struct {
-	UserID              int64 `json:"user_id"`
-	WriteUniqueDistance bool  `json:"write_unique_distance"`
+	UserID                   int64   `json:"user_id"`
+	WriteUniqueDistance      bool    `json:"write_unique_distance"`
+	NewGroundWindow          string  `json:"new_ground_window"`
+	NewGroundDays            int32   `json:"new_ground_days"`
+	NewGroundToleranceMeters float64 `json:"new_ground_tolerance_meters"`
+	NewGroundSampleMeters    float64 `json:"new_ground_sample_meters"`
 }
 
 func (q *Queries) UpsertUserPreferences(ctx context.Context, arg UpsertUserPreferencesParams) (UserPreference, error) {
-	row := q.db.QueryRow(ctx, upsertUserPreferences, arg.UserID, arg.WriteUniqueDistance)
+	row := q.db.QueryRow(ctx, upsertUserPreferences,
+		arg.UserID,
+		arg.WriteUniqueDistance,
+		arg.NewGroundWindow,
+		arg.NewGroundDays,
+		arg.NewGroundToleranceMeters,
+		arg.NewGroundSampleMeters,
+	)
 	var i UserPreference
-	err := row.Scan(&i.UserID, &i.WriteUniqueDistance)
+	err := row.Scan(
+		&i.UserID,
+		&i.WriteUniqueDistance,
+		&i.NewGroundWindow,
+		&i.NewGroundDays,
+		&i.NewGroundToleranceMeters,
+		&i.NewGroundSampleMeters,
+	)
 	return i, err
 }
@@ -0,0 +1,18 @@
+package db
+
+import (
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+)
+
+// Schema creates or updates the schema; it is applied at startup.
+//
+//go:embed schema.sql
+var Schema string
+
+// SchemaVersion identifies the Schema of this build by its checksum.
+func SchemaVersion() string {
+	sum := sha256.Sum256([]byte(Schema))
+	return hex.EncodeToString(sum[:8])
+}
@@ -25,12 +25,70 @@ CREATE TABLE IF NOT EXISTS route (
     FOREIGN KEY (user_id) REFERENCES athlete(id)
 );
 
+-- Strava flags used to filter the tiles.
+ALTER TABLE route
+    ADD COLUMN IF NOT EXISTS commute BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS trainer BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- Route geometry in EPSG:3857 for the route tiles, at full resolution and
+-- simplified for the zoom bands up to zoom 7, 10 and 13. The tolerance of each
+-- band is about two MVT units (a 4096th of the tile width) at its highest zoom,
+-- well below a screen pixel. Generated columns are recomputed on every upsert.
+ALTER TABLE route
+    ADD COLUMN IF NOT EXISTS geom_3857 geometry(LineString, 3857)
+        GENERATED ALWAYS AS (ST_Transform(geom, 3857)) STORED,
+    ADD COLUMN IF NOT EXISTS geom_3857_z7 geometry(LineString, 3857)
+        GENERATED ALWAYS AS (ST_SimplifyPreserveTopology(ST_Transform(geom, 3857), 150)) STORED,
+    ADD COLUMN IF NOT EXISTS geom_3857_z10 geometry(LineString, 3857)
+        GENERATED ALWAYS AS (ST_SimplifyPreserveTopology(ST_Transform(geom, 3857), 20)) STORED,
+    ADD COLUMN IF NOT EXISTS geom_3857_z13 geometry(LineString, 3857)
+        GENERATED ALWAYS AS (ST_SimplifyPreserveTopology(ST_Transform(geom, 3857), 2.5)) STORED;
+
+-- Wall-clock start time in the activity's time zone, as reported by Strava.
+ALTER TABLE route
+    ADD COLUMN IF NOT EXISTS start_date_local TIMESTAMP;
+
+-- The activity's notes (its Strava description) and the full-text search
+-- vector over name and notes for the route list. The 'simple' configuration
+-- doesn't stem, as activity names are in any language.
+ALTER TABLE route
+    ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE route
+    ADD COLUMN IF NOT EXISTS search_vector tsvector
+        GENERATED ALWAYS AS (to_tsvector('simple', name || ' ' || description)) STORED;
+CREATE INDEX IF NOT EXISTS route_search_vector_idx ON route USING GIN (search_vector);
+
+-- Whether the activity is private on Strava ("Only You"). Private routes are
+-- never shown through share links.
+ALTER TABLE route
+    ADD COLUMN IF NOT EXISTS private BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- When all activities of the athlete were last synced from their summaries.
+-- Routes stored before the private flag was synced default to not private, so
+-- share links are only created once this is set.
+ALTER TABLE athlete
+    ADD COLUMN IF NOT EXISTS activities_synced_at TIMESTAMPTZ;
+
 CREATE TABLE IF NOT EXISTS user_preferences (
     user_id BIGINT PRIMARY KEY,
     write_unique_distance BOOLEAN NOT NULL DEFAULT FALSE,
     FOREIGN KEY (user_id) REFERENCES athlete(id)
 );
 
+-- New ground settings: the window of earlier routes a route is compared
+-- against ('before' this activity, the same calendar 'year', or the last
+-- new_ground_days 'days'), how close another route must come to cover it and
+-- how densely the route is sampled.
+ALTER TABLE user_preferences
+    ADD COLUMN IF NOT EXISTS new_ground_window TEXT NOT NULL DEFAULT 'before'
+        CHECK (new_ground_window IN ('before', 'year', 'days')),
+    ADD COLUMN IF NOT EXISTS new_ground_days INTEGER NOT NULL DEFAULT 365
+        CHECK (new_ground_days BETWEEN 1 AND 3650),
+    ADD COLUMN IF NOT EXISTS new_ground_tolerance_meters FLOAT NOT NULL DEFAULT 10
+        CHECK (new_ground_tolerance_meters BETWEEN 1 AND 100),
+    ADD COLUMN IF NOT EXISTS new_ground_sample_meters FLOAT NOT NULL DEFAULT 20
+        CHECK (new_ground_sample_meters BETWEEN 5 AND 100);
+
 -- Backfill user_preferences for existing athletes
 INSERT INTO user_preferences (user_id)
 SELECT id
@@ -55,34 +113,789 @@ AFTER INSERT ON athlete
 FOR EACH ROW
 EXECUTE FUNCTION ensure_user_preferences();
 
+-- Free-form tags of routes, used to filter the tiles.
+CREATE TABLE IF NOT EXISTS route_tag (
+    route_id BIGINT NOT NULL,
+    user_id  BIGINT NOT NULL,
+    tag      TEXT NOT NULL,
+    PRIMARY KEY (route_id, tag),
+    FOREIGN KEY (route_id) REFERENCES route(id) ON DELETE CASCADE
+);
+
+-- Tags of a user, which double as named collections of routes ("Alps trip
+-- 2023"). A tag can exist without any routes.
+CREATE TABLE IF NOT EXISTS tag (
+    user_id     BIGINT NOT NULL,
+    name        TEXT NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, name),
+    FOREIGN KEY (user_id) REFERENCES athlete(id)
+);
+
+-- Backfill tags that were assigned before the tag table existed
+INSERT INTO tag (user_id, name)
+SELECT DISTINCT user_id, tag
+FROM route_tag
+ON CONFLICT (user_id, name) DO NOTHING;
+
+-- Rules that tag routes automatically, on ingest, on renames and when the
+-- rule is created: routes whose name (the one of their override if set)
+-- matches name_pattern (a case-insensitive POSIX regular expression) and/or
+-- that start within radius_meters of (lat, lng). Matching the pattern against the empty string rejects invalid
+-- patterns up front, as they would otherwise break every later route upsert.
+CREATE TABLE IF NOT EXISTS tag_rule (
+    id            SERIAL PRIMARY KEY,
+    user_id       BIGINT NOT NULL,
+    tag           TEXT NOT NULL,
+    name_pattern  TEXT CHECK (name_pattern IS NULL OR ('' ~* name_pattern) IS NOT NULL),
+    lat           FLOAT,
+    lng           FLOAT,
+    radius_meters FLOAT CHECK (radius_meters > 0),
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (name_pattern IS NOT NULL OR radius_meters IS NOT NULL),
+    CHECK ((lat IS NULL) = (radius_meters IS NULL) AND (lng IS NULL) = (radius_meters IS NULL)),
+    FOREIGN KEY (user_id, tag) REFERENCES tag(user_id, name) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+-- Local-only overrides of a route, kept apart from the route table so they
+-- survive resyncs from Strava: a display name (NULL keeps the Strava name),
+-- hiding it from the map, leaving it out of the explorer cells or of the
+-- unique distance (neither getting new ground nor covering other routes), and
+-- free-text notes that the route search covers as well.
+CREATE TABLE IF NOT EXISTS route_override (
+    route_id                BIGINT PRIMARY KEY,
+    user_id                 BIGINT NOT NULL,
+    name                    TEXT,
+    hidden                  BOOLEAN NOT NULL DEFAULT FALSE,
+    exclude_explorer        BOOLEAN NOT NULL DEFAULT FALSE,
+    exclude_unique_distance BOOLEAN NOT NULL DEFAULT FALSE,
+    notes                   TEXT NOT NULL DEFAULT '',
+    search_vector           tsvector
+        GENERATED ALWAYS AS (to_tsvector('simple', COALESCE(name, '') || ' ' || notes)) STORED,
+    updated_at              TIMESTAMPTZ NOT NULL DEFAULT now(),
+    FOREIGN KEY (route_id) REFERENCES route(id) ON DELETE CASCADE
+);
+
+-- Circles around places like home or work. Whenever the map is viewed through
+-- a share link, routes are cut off inside them and their start and end points
+-- and explorer cells are left out.
+CREATE TABLE IF NOT EXISTS privacy_zone (
+    id            SERIAL PRIMARY KEY,
+    user_id       BIGINT NOT NULL,
+    name          TEXT NOT NULL DEFAULT '',
+    lat           FLOAT NOT NULL CHECK (lat BETWEEN -90 AND 90),
+    lng           FLOAT NOT NULL CHECK (lng BETWEEN -180 AND 180),
+    radius_meters FLOAT NOT NULL CHECK (radius_meters > 0),
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now(),
+    FOREIGN KEY (user_id) REFERENCES athlete(id)
+);
+
+CREATE INDEX IF NOT EXISTS privacy_zone_user_id_idx ON privacy_zone (user_id);
+
+-- Personal API tokens for scripts and other clients that can't use the session
+-- cookie, sent as "Authorization: Bearer <token>". Only the SHA-256 hash of a
+-- token is stored. read tokens are limited to GET requests.
+CREATE TABLE IF NOT EXISTS api_token (
+    id           SERIAL PRIMARY KEY,
+    user_id      BIGINT NOT NULL,
+    name         TEXT NOT NULL,
+    token_hash   BYTEA NOT NULL UNIQUE,
+    scope        TEXT NOT NULL CHECK (scope IN ('read', 'read_write')),
+    last_used_at TIMESTAMPTZ,
+    revoked_at   TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    FOREIGN KEY (user_id) REFERENCES athlete(id)
+);
+
+CREATE INDEX IF NOT EXISTS api_token_user_id_idx ON api_token (user_id);
+
+-- Explorer statistics per user and grid zoom, refreshed whenever the user's
+-- routes change. The geometries (in EPSG:3857, like the tile envelopes they are
+-- built from) let the explorer tiles highlight the max cluster and max square.
+CREATE TABLE IF NOT EXISTS explorer_stats (
+    user_id      BIGINT NOT NULL,
+    z            INTEGER NOT NULL,
+    total_tiles  INTEGER NOT NULL,
+    max_cluster  INTEGER NOT NULL,
+    max_square   INTEGER NOT NULL,
+    cluster_geom geometry(MultiPolygon, 3857),
+    square_geom  geometry(Polygon, 3857),
+    updated_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, z),
+    FOREIGN KEY (user_id) REFERENCES athlete(id)
+);
+
+-- Top-left cell of the max square, so GET /explorer/stats can be served from
+-- the stored row. NULL for rows stored before, which are recomputed on read.
+ALTER TABLE explorer_stats
+    ADD COLUMN IF NOT EXISTS square_x INTEGER,
+    ADD COLUMN IF NOT EXISTS square_y INTEGER;
+
+-- Grid cells touched by each route, at every explorer grid zoom and at the
+-- fine coverage grid zoom. Maintained by the route_explored_cells triggers
+-- below; there is deliberately no foreign key to route so the delete trigger
+-- still sees the rows it has to remove.
+CREATE TABLE IF NOT EXISTS route_cell (
+    route_id BIGINT NOT NULL,
+    user_id  BIGINT NOT NULL,
+    z        INTEGER NOT NULL,
+    x        INTEGER NOT NULL,
+    y        INTEGER NOT NULL,
+    PRIMARY KEY (route_id, z, x, y)
+);
+
+-- Materialized explorer cells per user, aggregated from route_cell. This is
+-- what the user_explorer_tiles MVT function and the explorer stats read.
+CREATE TABLE IF NOT EXISTS explored_cell (
+    user_id        BIGINT NOT NULL,
+    z              INTEGER NOT NULL,
+    x              INTEGER NOT NULL,
+    y              INTEGER NOT NULL,
+    first_visit    TIMESTAMPTZ NOT NULL,
+    last_visit     TIMESTAMPTZ NOT NULL,
+    visit_count    INTEGER NOT NULL,
+    first_route_id BIGINT NOT NULL,
+    PRIMARY KEY (user_id, z, x, y),
+    FOREIGN KEY (user_id) REFERENCES athlete(id)
+);
+
+-- "New ground" of each route: the parts that aren't covered by an earlier
+-- route of the same user within the user's new ground window, computed when
+-- the route is ingested. The settings it was computed with are stored along.
+CREATE TABLE IF NOT EXISTS route_new_ground (
+    route_id        BIGINT PRIMARY KEY,
+    user_id         BIGINT NOT NULL,
+    distance_meters FLOAT NOT NULL,
+    geom            geometry(MultiLineString, 4326),
+    computed_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    FOREIGN KEY (route_id) REFERENCES route(id) ON DELETE CASCADE
+);
+
+-- Rows computed before the settings existed compared against all other routes
+-- with the fixed 10m tolerance and 20m sampling.
+ALTER TABLE route_new_ground
+    ADD COLUMN IF NOT EXISTS time_window      TEXT NOT NULL DEFAULT 'all',
+    ADD COLUMN IF NOT EXISTS window_days      INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS tolerance_meters FLOAT NOT NULL DEFAULT 10,
+    ADD COLUMN IF NOT EXISTS sample_meters    FLOAT NOT NULL DEFAULT 20;
+
+-- Strava streams of a route, fetched on demand for the route details and
+-- exports. All arrays have one entry per recorded point; altitude is empty if
+-- the activity has no elevation data.
+CREATE TABLE IF NOT EXISTS route_stream (
+    route_id   BIGINT PRIMARY KEY,
+    user_id    BIGINT NOT NULL,
+    time_s     INTEGER[] NOT NULL,
+    distance_m FLOAT[] NOT NULL,
+    altitude_m FLOAT[] NOT NULL,
+    lat        FLOAT[] NOT NULL,
+    lng        FLOAT[] NOT NULL,
+    fetched_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    FOREIGN KEY (route_id) REFERENCES route(id) ON DELETE CASCADE
+);
+
+-- Named regions (countries, states, national parks, ...) the route details list
+-- when a route crosses them. Empty by default; load any polygon dataset into
+-- it, see the README.
+CREATE TABLE IF NOT EXISTS region (
+    id   SERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    geom geometry(MultiPolygon, 4326) NOT NULL
+);
+
 -- Create spatial index
 CREATE INDEX IF NOT EXISTS route_geom_idx ON route USING GIST (geom);
+CREATE INDEX IF NOT EXISTS route_geom_3857_idx ON route USING GIST (geom_3857);
 CREATE INDEX IF NOT EXISTS route_user_id_id_idx ON route (user_id, id);
+CREATE INDEX IF NOT EXISTS route_cell_user_cell_idx ON route_cell (user_id, z, x, y);
+CREATE INDEX IF NOT EXISTS route_new_ground_geom_idx ON route_new_ground USING GIST (geom);
+CREATE INDEX IF NOT EXISTS route_tag_user_tag_idx ON route_tag (user_id, tag);
+CREATE INDEX IF NOT EXISTS tag_rule_user_id_idx ON tag_rule (user_id);
+CREATE INDEX IF NOT EXISTS region_geom_idx ON region USING GIST (geom);
+
+-- Grid zoom levels supported by the explorer: zoom 14 "squadrats", zoom 17
+-- "squadratinhos" and zoom 12 for travel. Cells are materialized for each.
+CREATE OR REPLACE FUNCTION explorer_grid_zooms()
+		RETURNS int[] AS $$
+		  SELECT ARRAY[12, 14, 17];
+		$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+-- Zoom of the fine coverage grid used to compute the new ground of a route.
+-- A zoom-21 cell is ~19m wide at the equator and ~12m at 50 degrees latitude.
+CREATE OR REPLACE FUNCTION coverage_grid_zoom()
+		RETURNS int AS $$
+		  SELECT 21;
+		$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+-- Returns the distinct slippy-map cells at grid_z that a route passes through.
+-- The route is densified to a fifth of the cell width (in EPSG:3857 units) so
+-- no cell is skipped between two vertices.
+CREATE OR REPLACE FUNCTION route_cells(geom geometry, grid_z int)
+		RETURNS TABLE (x int, y int) AS $$
+		  SELECT DISTINCT
+		    floor((ST_X(pt) + 20037508.342789244) / (2 * 20037508.342789244) * (1 << grid_z))::int,
+		    floor((20037508.342789244 - ST_Y(pt)) / (2 * 20037508.342789244) * (1 << grid_z))::int
+		  FROM (
+		    SELECT (ST_DumpPoints(
+		              ST_Segmentize(
+		                ST_Transform(geom, 3857),
+		                2 * 20037508.342789244 / (1 << grid_z) / 5))).geom AS pt
+		  ) p;
+		$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+-- Recomputes the explored_cell rows of a user for the given cells from
+-- route_cell. Cells no longer touched by any route are removed.
+CREATE OR REPLACE FUNCTION refresh_explored_cells(uid bigint, grid_z int, xs int[], ys int[])
+		RETURNS void AS $$
+		BEGIN
+		  DELETE FROM explored_cell e
+		  USING unnest(xs, ys) AS c(x, y)
+		  WHERE e.user_id = uid AND e.z = grid_z AND e.x = c.x AND e.y = c.y;
+
+		  INSERT INTO explored_cell (user_id, z, x, y, first_visit, last_visit, visit_count, first_route_id)
+		  SELECT rc.user_id, rc.z, rc.x, rc.y,
+		         min(r.start_date), max(r.start_date), count(*),
+		         (array_agg(r.id ORDER BY r.start_date, r.id))[1]
+		  FROM (SELECT DISTINCT u.x, u.y FROM unnest(xs, ys) AS u(x, y)) c
+		  JOIN route_cell rc ON rc.user_id = uid AND rc.z = grid_z AND rc.x = c.x AND rc.y = c.y
+		  JOIN route r ON r.id = rc.route_id
+		  GROUP BY rc.user_id, rc.z, rc.x, rc.y;
+		END;
+		$$ LANGUAGE plpgsql;
+
+-- Returns whether the cells of a route at grid_z are left out because of its
+-- overrides: the explorer grid cells of routes excluded from the explorer and
+-- the coverage grid cells of routes excluded from the unique distance.
+CREATE OR REPLACE FUNCTION route_cells_excluded(rid bigint, grid_z int)
+		RETURNS boolean AS $$
+		  SELECT EXISTS (
+		    SELECT 1
+		    FROM route_override o
+		    WHERE o.route_id = rid
+		      AND CASE WHEN grid_z = coverage_grid_zoom() THEN o.exclude_unique_distance
+		               ELSE o.exclude_explorer END
+		  );
+		$$ LANGUAGE sql STABLE PARALLEL SAFE;
+
+-- Removes the cells of a route at grid_z and, for the explorer grid zooms,
+-- recomputes the aggregates of every affected cell.
+CREATE OR REPLACE FUNCTION remove_route_cells(rid bigint, uid bigint, grid_z int)
+		RETURNS void AS $$
+		DECLARE
+		  old_x int[];
+		  old_y int[];
+		BEGIN
+		  WITH removed AS (
+		    DELETE FROM route_cell WHERE route_id = rid AND z = grid_z RETURNING x, y
+		  )
+		  SELECT COALESCE(array_agg(x), '{}'), COALESCE(array_agg(y), '{}')
+		  INTO old_x, old_y
+		  FROM removed;
+		  IF grid_z = ANY (explorer_grid_zooms()) THEN
+		    PERFORM refresh_explored_cells(uid, grid_z, old_x, old_y);
+		  END IF;
+		END;
+		$$ LANGUAGE plpgsql;
+
+-- Adds the cells of a route at grid_z unless its overrides exclude them and,
+-- for the explorer grid zooms, recomputes the aggregates of every affected cell.
+CREATE OR REPLACE FUNCTION add_route_cells(rid bigint, uid bigint, geom geometry, grid_z int)
+		RETURNS void AS $$
+		DECLARE
+		  new_x int[];
+		  new_y int[];
+		BEGIN
+		  IF route_cells_excluded(rid, grid_z) THEN
+		    RETURN;
+		  END IF;
+
+		  WITH added AS (
+		    INSERT INTO route_cell (route_id, user_id, z, x, y)
+		    SELECT rid, uid, grid_z, c.x, c.y
+		    FROM route_cells(geom, grid_z) c
+		    RETURNING x, y
+		  )
+		  SELECT COALESCE(array_agg(x), '{}'), COALESCE(array_agg(y), '{}')
+		  INTO new_x, new_y
+		  FROM added;
+		  IF grid_z = ANY (explorer_grid_zooms()) THEN
+		    PERFORM refresh_explored_cells(uid, grid_z, new_x, new_y);
+		  END IF;
+		END;
+		$$ LANGUAGE plpgsql;
+
+-- Keeps route_cell and explored_cell in sync with the route table: for every
+-- explorer grid zoom and the coverage grid zoom, the cells of the old version
+-- of a route are removed and the cells of the new version are added. For the
+-- explorer grid zooms, the aggregates of every affected cell are recomputed.
+CREATE OR REPLACE FUNCTION sync_explored_cells()
+		RETURNS trigger AS $$
+		DECLARE
+		  grid_z int;
+		BEGIN
+		  FOREACH grid_z IN ARRAY explorer_grid_zooms() || coverage_grid_zoom() LOOP
+		    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+		      PERFORM remove_route_cells(OLD.id, OLD.user_id, grid_z);
+		    END IF;
+
+		    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.geom IS NOT NULL THEN
+		      PERFORM add_route_cells(NEW.id, NEW.user_id, NEW.geom, grid_z);
+		    END IF;
+		  END LOOP;
+
+		  RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+
+-- Re-syncs the cells of a route when its overrides change what it contributes
+-- to the explorer or the unique distance. Overrides deleted along with their
+-- route find no route left to sync.
+CREATE OR REPLACE FUNCTION sync_route_override_cells()
+		RETURNS trigger AS $$
+		DECLARE
+		  grid_z int;
+		  r route;
+		BEGIN
+		  SELECT * INTO r FROM route WHERE id = COALESCE(NEW.route_id, OLD.route_id);
+		  IF r.geom IS NULL THEN
+		    RETURN NULL;
+		  END IF;
+
+		  FOREACH grid_z IN ARRAY explorer_grid_zooms() || coverage_grid_zoom() LOOP
+		    PERFORM remove_route_cells(r.id, r.user_id, grid_z);
+		    PERFORM add_route_cells(r.id, r.user_id, r.geom, grid_z);
+		  END LOOP;
+
+		  RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+
+-- Splits a route into segments of sample_meters and flags the ones that are
+-- not covered by another route of the same user within the time window:
+--   'all'    every other route (only used to validate against the reference),
+--   'before' every route that started before this one,
+--   'year'   routes that started before this one in the same calendar year,
+--   'days'   routes that started in the window_days before this one.
+-- Except for 'all', only earlier routes count, so the value of a route doesn't
+-- change when later routes repeat it.
+-- A sample point is covered when another route touches a coverage grid cell
+-- within tolerance_meters of the point's cell, rounded up to whole cells (at
+-- least the eight neighbouring cells). Each lookup is an index probe on
+-- route_cell, so the cost is proportional to the route length and independent
+-- of the size of the user's history.
+DROP FUNCTION IF EXISTS route_unique_segments(bigint);
+CREATE OR REPLACE FUNCTION route_unique_segments(rid bigint, time_window text, window_days int,
+                                                 tolerance_meters float, sample_meters float)
+		RETURNS TABLE (seg geometry, is_unique boolean) AS $$
+		  WITH target AS (
+		    SELECT geom, user_id, start_date, route_cells_excluded(rid, coverage_grid_zoom()) AS excluded
+		    FROM route
+		    WHERE id = rid
+		      AND geom IS NOT NULL
+		  ),
+		  pts AS (
+		    -- Resample the route to one vertex every sample_meters for uniform coverage
+		    SELECT (dp).path[1] AS n, (dp).geom AS pt, t.user_id, t.start_date, t.excluded,
+		           floor((ST_X(ST_Transform((dp).geom, 3857)) + 20037508.342789244)
+		                 / (2 * 20037508.342789244) * (1 << coverage_grid_zoom()))::int AS cx,
+		           floor((20037508.342789244 - ST_Y(ST_Transform((dp).geom, 3857)))
+		                 / (2 * 20037508.342789244) * (1 << coverage_grid_zoom()))::int AS cy,
+		           -- Cells are 2 * 20037508.342789244 / 2^z wide in EPSG:3857,
+		           -- which shrinks with cos(latitude) on the ground. The k cells
+		           -- around the point only narrow down the candidate routes, which
+		           -- are then checked against the exact tolerance.
+		           greatest(1, ceil(tolerance_meters
+		                            / (cos(radians(ST_Y((dp).geom))) * 2 * 20037508.342789244
+		                               / (1 << coverage_grid_zoom()))))::int AS k
+		    FROM target t
+		    CROSS JOIN LATERAL ST_DumpPoints(ST_Segmentize(t.geom::geography, sample_meters)::geometry) dp
+		  ),
+		  pt_covered AS (
+		    SELECT p.n, p.pt, p.excluded,
+		           EXISTS (
+		             SELECT 1
+		             FROM route_cell rc
+		             JOIN route o ON o.id = rc.route_id
+		             WHERE rc.user_id = p.user_id
+		               AND rc.z = coverage_grid_zoom()
+		               AND rc.x = ANY (ARRAY(SELECT generate_series(p.cx - p.k, p.cx + p.k)))
+		               AND rc.y BETWEEN p.cy - p.k AND p.cy + p.k
+		               AND rc.route_id <> rid
+		               AND (time_window = 'all' OR (o.start_date, o.id) < (p.start_date, rid))
+		               AND (time_window <> 'year' OR o.start_date >= date_trunc('year', p.start_date))
+		               AND (time_window <> 'days' OR o.start_date >= p.start_date - make_interval(days => window_days))
+		               AND ST_DWithin(p.pt::geography, o.geom::geography, tolerance_meters)
+		           ) AS covered
+		    FROM pts p
+		  )
+		  -- A segment is unique if at least one of its endpoints is not covered.
+		  -- Routes excluded from the unique distance have none.
+		  SELECT ST_MakeLine(a.pt, b.pt), NOT (a.covered AND b.covered) AND NOT a.excluded
+		  FROM pt_covered a
+		  JOIN pt_covered b ON b.n = a.n + 1;
+		$$ LANGUAGE sql STABLE PARALLEL SAFE;
+
+DROP TRIGGER IF EXISTS route_explored_cells_insert_delete ON route;
+CREATE TRIGGER route_explored_cells_insert_delete
+AFTER INSERT OR DELETE ON route
+FOR EACH ROW
+EXECUTE FUNCTION sync_explored_cells();
+
+-- Renames and other metadata-only updates do not change the explored cells.
+DROP TRIGGER IF EXISTS route_explored_cells_update ON route;
+CREATE TRIGGER route_explored_cells_update
+AFTER UPDATE ON route
+FOR EACH ROW
+WHEN (OLD.geom IS DISTINCT FROM NEW.geom
+      OR OLD.start_date IS DISTINCT FROM NEW.start_date
+      OR OLD.user_id IS DISTINCT FROM NEW.user_id)
+EXECUTE FUNCTION sync_explored_cells();
+
+-- Names, notes and hiding do not change the cells.
+DROP TRIGGER IF EXISTS route_override_cells_insert ON route_override;
+CREATE TRIGGER route_override_cells_insert
+AFTER INSERT ON route_override
+FOR EACH ROW
+WHEN (NEW.exclude_explorer OR NEW.exclude_unique_distance)
+EXECUTE FUNCTION sync_route_override_cells();
+
+DROP TRIGGER IF EXISTS route_override_cells_delete ON route_override;
+CREATE TRIGGER route_override_cells_delete
+AFTER DELETE ON route_override
+FOR EACH ROW
+WHEN (OLD.exclude_explorer OR OLD.exclude_unique_distance)
+EXECUTE FUNCTION sync_route_override_cells();
+
+DROP TRIGGER IF EXISTS route_override_cells_update ON route_override;
+CREATE TRIGGER route_override_cells_update
+AFTER UPDATE ON route_override
+FOR EACH ROW
+WHEN (OLD.exclude_explorer IS DISTINCT FROM NEW.exclude_explorer
+      OR OLD.exclude_unique_distance IS DISTINCT FROM NEW.exclude_unique_distance)
+EXECUTE FUNCTION sync_route_override_cells();
+
+-- Returns whether a route matches an auto-tag rule (see tag_rule). Names are
+-- matched as shown, i.e. the name of the route's override if set.
+CREATE OR REPLACE FUNCTION tag_rule_matches(rule tag_rule, r route)
+		RETURNS boolean AS $$
+		  SELECT rule.user_id = r.user_id
+		     AND (rule.name_pattern IS NULL
+		          OR COALESCE((SELECT o.name FROM route_override o WHERE o.route_id = r.id), r.name)
+		             ~* rule.name_pattern)
+		     AND (rule.radius_meters IS NULL
+		          OR (r.geom IS NOT NULL
+		              AND ST_DWithin(ST_StartPoint(r.geom)::geography,
+		                             ST_SetSRID(ST_MakePoint(rule.lng, rule.lat), 4326)::geography,
+		                             rule.radius_meters)));
+		$$ LANGUAGE sql STABLE PARALLEL SAFE;
+
+-- Tags a new or changed route with every auto-tag rule of its user it matches.
+-- Auto-tags are only ever added, so removing one by hand sticks until the
+-- route's name (or the name of its override) or geometry changes.
+CREATE OR REPLACE FUNCTION apply_tag_rules()
+		RETURNS trigger AS $$
+		BEGIN
+		  INSERT INTO route_tag (route_id, user_id, tag)
+		  SELECT NEW.id, NEW.user_id, t.tag
+		  FROM tag_rule t
+		  WHERE t.user_id = NEW.user_id
+		    AND tag_rule_matches(t, NEW)
+		  ON CONFLICT (route_id, tag) DO NOTHING;
+
+		  RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+
+-- Tags a route with every auto-tag rule of its user it matches once the name
+-- of its override is set or changed.
+CREATE OR REPLACE FUNCTION apply_override_tag_rules()
+		RETURNS trigger AS $$
+		BEGIN
+		  INSERT INTO route_tag (route_id, user_id, tag)
+		  SELECT r.id, r.user_id, t.tag
+		  FROM route r
+		  JOIN tag_rule t ON t.user_id = r.user_id
+		  WHERE r.id = NEW.route_id
+		    AND tag_rule_matches(t, r)
+		  ON CONFLICT (route_id, tag) DO NOTHING;
+
+		  RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS route_tag_rules_insert ON route;
+CREATE TRIGGER route_tag_rules_insert
+AFTER INSERT ON route
+FOR EACH ROW
+EXECUTE FUNCTION apply_tag_rules();
+
+DROP TRIGGER IF EXISTS route_tag_rules_update ON route;
+CREATE TRIGGER route_tag_rules_update
+AFTER UPDATE ON route
+FOR EACH ROW
+WHEN (OLD.name IS DISTINCT FROM NEW.name
+      OR OLD.geom IS DISTINCT FROM NEW.geom)
+EXECUTE FUNCTION apply_tag_rules();
+
+DROP TRIGGER IF EXISTS route_override_tag_rules_insert ON route_override;
+CREATE TRIGGER route_override_tag_rules_insert
+AFTER INSERT ON route_override
+FOR EACH ROW
+WHEN (NEW.name IS NOT NULL)
+EXECUTE FUNCTION apply_override_tag_rules();
+
+DROP TRIGGER IF EXISTS route_override_tag_rules_update ON route_override;
+CREATE TRIGGER route_override_tag_rules_update
+AFTER UPDATE ON route_override
+FOR EACH ROW
+WHEN (NEW.name IS NOT NULL AND OLD.name IS DISTINCT FROM NEW.name)
+EXECUTE FUNCTION apply_override_tag_rules();
+
+-- Query params the tile functions accept to filter the routes they show:
+--   start_date, end_date        dates (YYYY-MM-DD), both inclusive
+--   sport_type                  comma-separated sport types, e.g. Ride,GravelRide
+--   min_distance, max_distance  in km, like route.distance
+--   commute, trainer            true or false
+--   tag                         comma-separated tags, any of them matches
+--   include_hidden              true to include routes hidden by their overrides
+CREATE OR REPLACE FUNCTION route_filter_params()
+		RETURNS text[] AS $$
+		  SELECT ARRAY['start_date', 'end_date', 'sport_type', 'min_distance', 'max_distance',
+		               'min_duration', 'max_duration', 'min_elevation', 'max_elevation',
+		               'commute', 'trainer', 'tag', 'include_hidden'];
+		$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+-- Returns whether a route matches the filters in the query_params of a tile
+-- request (see route_filter_params). Params that are missing don't filter,
+-- except that hidden routes are left out unless include_hidden is true.
+-- Requests through a share link (shared = true, see resolve_tile_params)
+-- leave out private activities as well.
+CREATE OR REPLACE FUNCTION route_matches_filters(r route, query_params json)
+		RETURNS boolean AS $$
+		  SELECT (query_params->>'start_date' IS NULL
+		          OR r.start_date >= (query_params->>'start_date')::date)
+		     AND (query_params->>'end_date' IS NULL
+		          OR r.start_date < (query_params->>'end_date')::date + 1)
+		     AND (query_params->>'sport_type' IS NULL
+		          OR r.sport_type = ANY (string_to_array(query_params->>'sport_type', ',')))
+		     AND (query_params->>'min_distance' IS NULL
+		          OR r.distance >= (query_params->>'min_distance')::float)
+		     AND (query_params->>'max_distance' IS NULL
+		          OR r.distance <= (query_params->>'max_distance')::float)
+		     AND (query_params->>'min_duration' IS NULL
+		          OR r.moving_time >= (query_params->>'min_duration')::int)
+		     AND (query_params->>'max_duration' IS NULL
+		          OR r.moving_time <= (query_params->>'max_duration')::int)
+		     AND (query_params->>'min_elevation' IS NULL
+		          OR r.elevation >= (query_params->>'min_elevation')::float)
+		     AND (query_params->>'max_elevation' IS NULL
+		          OR r.elevation <= (query_params->>'max_elevation')::float)
+		     AND (query_params->>'commute' IS NULL
+		          OR r.commute = (query_params->>'commute')::boolean)
+		     AND (query_params->>'trainer' IS NULL
+		          OR r.trainer = (query_params->>'trainer')::boolean)
+		     AND (query_params->>'tag' IS NULL
+		          OR EXISTS (SELECT 1
+		                     FROM route_tag t
+		                     WHERE t.route_id = r.id
+		                       AND t.tag = ANY (string_to_array(query_params->>'tag', ','))))
+		     AND (COALESCE((query_params->>'include_hidden')::boolean, FALSE)
+		          OR NOT EXISTS (SELECT 1
+		                         FROM route_override o
+		                         WHERE o.route_id = r.id
+		                           AND o.hidden))
+		     AND (NOT COALESCE((query_params->>'shared')::boolean, FALSE)
+		          OR NOT r.private);
+		$$ LANGUAGE sql STABLE PARALLEL SAFE;
+
+-- Returns whether the filters of a share are string-valued route filter
+-- params. include_hidden is not allowed, as hidden routes are never shared.
+CREATE OR REPLACE FUNCTION share_filters_valid(filters jsonb)
+		RETURNS boolean AS $$
+		  SELECT CASE
+		    WHEN jsonb_typeof(filters) <> 'object' THEN FALSE
+		    ELSE NOT EXISTS (SELECT 1
+		                     FROM jsonb_each(filters) f
+		                     WHERE jsonb_typeof(f.value) <> 'string'
+		                        OR NOT f.key = ANY (array_remove(route_filter_params(), 'include_hidden')))
+		  END;
+		$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+-- Read-only links to a user's map. Anyone with the token can load the tiles of
+-- the share's layers (all of them if NULL) and the route summaries, limited to
+-- the routes matching its filters (route filter params, e.g. a tag or a date
+-- range), until it expires or is revoked. Private activities and hidden routes
+-- are always left out and the privacy zones applied. The public profile of a
+-- user is a share as well, found by the user's ID instead of the token.
+CREATE TABLE IF NOT EXISTS share (
+    id             SERIAL PRIMARY KEY,
+    user_id        BIGINT NOT NULL,
+    token          TEXT NOT NULL UNIQUE,
+    name           TEXT NOT NULL DEFAULT '',
+    filters        JSONB NOT NULL DEFAULT '{}' CHECK (share_filters_valid(filters)),
+    layers         TEXT[],
+    public_profile BOOLEAN NOT NULL DEFAULT FALSE,
+    expires_at     TIMESTAMPTZ,
+    revoked_at     TIMESTAMPTZ,
+    created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CHECK (NOT public_profile OR expires_at IS NULL),
+    FOREIGN KEY (user_id) REFERENCES athlete(id)
+);
+
+CREATE INDEX IF NOT EXISTS share_user_id_idx ON share (user_id);
+-- A user has at most one public profile at a time
+CREATE UNIQUE INDEX IF NOT EXISTS share_public_profile_idx ON share (user_id)
+    WHERE public_profile AND revoked_at IS NULL;
+
+-- Resolves the query params of a tile request through a share link
+-- (?share=<token>): the user and the filters of the share replace those of the
+-- request, which can only add filters the share doesn't set. shared = true
+-- makes route_matches_filters leave out private activities and the tile
+-- functions apply the privacy zones (see tile_privacy_zones). Unknown, expired
+-- or revoked shares, and layers the share doesn't include, give empty tiles.
+-- Requests without a share are returned unchanged.
+CREATE OR REPLACE FUNCTION resolve_tile_params(query_params json, layer text)
+		RETURNS json AS $$
+		  SELECT CASE
+		    WHEN query_params->>'share' IS NULL THEN query_params
+		    ELSE COALESCE(
+		      (SELECT ((query_params::jsonb - 'include_hidden') || s.filters
+		               || jsonb_build_object('user_id', s.user_id, 'shared', true))::json
+		       FROM share s
+		       WHERE s.token = query_params->>'share'
+		         AND s.revoked_at IS NULL
+		         AND (s.expires_at IS NULL OR s.expires_at > now())
+		         AND (s.layers IS NULL OR layer = ANY (s.layers))),
+		      json_build_object('user_id', NULL, 'shared', true))
+		  END;
+		$$ LANGUAGE sql STABLE PARALLEL SAFE;
+
+-- Returns the union of the user's privacy zones in EPSG:4326, or NULL if the
+-- user has none.
+CREATE OR REPLACE FUNCTION privacy_zones(uid bigint)
+		RETURNS geometry AS $$
+		  SELECT ST_Union(ST_Buffer(ST_SetSRID(ST_MakePoint(z.lng, z.lat), 4326)::geography,
+		                            z.radius_meters)::geometry)
+		  FROM privacy_zone z
+		  WHERE z.user_id = uid;
+		$$ LANGUAGE sql STABLE PARALLEL SAFE;
+
+-- Returns the privacy zones to apply to a tile request in the given SRID:
+-- those of the user for requests through a share link, NULL otherwise.
+CREATE OR REPLACE FUNCTION tile_privacy_zones(query_params json, srid int)
+		RETURNS geometry AS $$
+		  SELECT CASE
+		    WHEN COALESCE((query_params->>'shared')::boolean, FALSE)
+		      THEN ST_Transform(privacy_zones((query_params->>'user_id')::bigint), srid)
+		  END;
+		$$ LANGUAGE sql STABLE PARALLEL SAFE;
+
+-- Removes the privacy zones, if any, from a geometry in the same SRID.
+CREATE OR REPLACE FUNCTION privacy_clip(geom geometry, zones geometry)
+		RETURNS geometry AS $$
+		  SELECT CASE
+		    WHEN zones IS NULL OR NOT geom && zones THEN geom
+		    ELSE ST_Difference(geom, zones)
+		  END;
+		$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+-- Returns the elevation of the sun in degrees above the horizon at a time and
+-- place, using the low-precision formulas of the Astronomical Almanac (accurate
+-- to about a degree, plenty to tell day from night).
+CREATE OR REPLACE FUNCTION sun_elevation(ts timestamptz, lat float, lng float)
+		RETURNS float AS $$
+		  WITH t AS (
+		    -- Days since J2000.0
+		    SELECT extract(epoch FROM ts) / 86400.0 - 10957.5 AS d
+		  ),
+		  ecliptic AS (
+		    SELECT d,
+		           radians(280.460 + 0.9856474 * d
+		                   + 1.915 * sin(radians(357.528 + 0.9856003 * d))
+		                   + 0.020 * sin(radians(2 * (357.528 + 0.9856003 * d)))) AS lambda,
+		           radians(23.439 - 0.0000004 * d) AS eps
+		    FROM t
+		  ),
+		  equatorial AS (
+		    SELECT d,
+		           asin(sin(eps) * sin(lambda)) AS decl,
+		           atan2(cos(eps) * sin(lambda), cos(lambda)) AS ra
+		    FROM ecliptic
+		  )
+		  -- The hour angle is the local sidereal time minus the right ascension.
+		  SELECT degrees(asin(
+		           sin(radians(lat)) * sin(decl)
+		           + cos(radians(lat)) * cos(decl)
+		             * cos(radians(280.46061837 + 360.98564736629 * d + lng) - ra)))
+		  FROM equatorial;
+		$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
 
 -- Create MVT function for user routes
+-- Uses the precomputed EPSG:3857 geometry of the zoom band, so tiles neither
+-- transform nor clip full-resolution routes at low zooms.
+-- Routes can be filtered with the params of route_filter_params.
+-- Besides the route's metrics, each feature carries the local year, month,
+-- ISO weekday (1 = Monday) and hour of the start, whether the sun was up at
+-- the start point, and the start as seconds since 1970 (start_epoch) for
+-- data-driven styling by recency; a rank among the routes would need all of
+-- the user's routes for every tile, so clients derive it from start_epoch.
+-- Routes synced before the local start time was stored fall back to the
+-- solar time of the start point.
+-- Through a share link, routes are cut off at the privacy zones.
 CREATE OR REPLACE FUNCTION user_routes(z int, x int, y int, query_params json)
 		RETURNS bytea AS $$
 		DECLARE
 		  mvt bytea;
 		  uid bigint;
+		  zones geometry;
 		BEGIN
+		  query_params := resolve_tile_params(query_params, 'user_routes');
 		  uid := (query_params->>'user_id')::bigint;
+		  zones := tile_privacy_zones(query_params, 3857);
 
 		  SELECT INTO mvt ST_AsMVT(tile, 'user_routes', 4096, 'geom')
 		  FROM (
 		    SELECT
-		      id,
-		      name,
-		      sport_type,
-		      distance,
-		      start_date,
+		      r.id,
+		      COALESCE(ov.name, r.name) AS name,
+		      r.sport_type,
+		      r.distance,
+		      r.start_date,
+		      extract(year FROM l.start_local)::int AS year,
+		      extract(month FROM l.start_local)::int AS month,
+		      extract(isodow FROM l.start_local)::int AS weekday,
+		      extract(hour FROM l.start_local)::int AS hour,
+		      r.average_speed,
+		      r.elevation,
+		      r.moving_time,
+		      -- Sunrise and sunset are when the sun's upper limb touches the
+		      -- horizon, including refraction.
+		      sun_elevation(r.start_date, ST_Y(sp.pt), ST_X(sp.pt)) > -0.833 AS daylight,
+		      extract(epoch FROM r.start_date)::bigint AS start_epoch,
 		      ST_AsMVTGeom(
-		        ST_Transform(geom, 3857),
+		        privacy_clip(
+		          CASE
+		            WHEN z <= 7 THEN geom_3857_z7
+		            WHEN z <= 10 THEN geom_3857_z10
+		            WHEN z <= 13 THEN geom_3857_z13
+		            ELSE geom_3857
+		          END,
+		          zones),
 		        ST_TileEnvelope(z, x, y),
 		        4096, 64, true
 		      ) AS geom
-		    FROM route
-		    WHERE user_id = uid AND geom && ST_Transform(ST_TileEnvelope(z, x, y), 4326)
+		    FROM route r
+		    LEFT JOIN route_override ov ON ov.route_id = r.id
+		    CROSS JOIN LATERAL (SELECT ST_StartPoint(r.geom) AS pt) sp
+		    CROSS JOIN LATERAL (
+		      SELECT COALESCE(r.start_date_local,
+		                      (r.start_date AT TIME ZONE 'UTC') + make_interval(secs => ST_X(sp.pt) * 240)) AS start_local
+		    ) l
+		    WHERE r.user_id = uid
+		      AND r.geom_3857 && ST_TileEnvelope(z, x, y)
+		      AND route_matches_filters(r, query_params)
 		  ) tile;
 
 		  RETURN mvt;
@@ -95,53 +908,319 @@ CREATE OR REPLACE FUNCTION user_routes(z int, x int, y int, query_params json)
 -- zoom 14; a grid cell counts as "explored" once any of the user's routes
 -- passes through it. This function returns, for the requested (z, x, y) tile,
 -- the set of explored zoom-14 cells (as polygons) that fall within it.
+-- The optional grid_z query param selects another grid zoom out of
+-- explorer_grid_zooms(), e.g. 17 for "squadratinhos".
 --
--- The computation runs entirely in PostGIS and is bounded by the length of the
--- routes visible in the requested tile (not by zoom level): each visible route
--- is clipped to the tile, densified so no zoom-14 cell (~2.4 km wide) is
--- skipped, and every sample point is mapped to its zoom-14 cell coordinates.
--- Results are cached per user by Vinyl Cache (varnish) via the user_id param.
+-- Cells are read from the explored_cell table, which is maintained by the
+-- route triggers, so the cost only depends on the number of cells in the tile.
+-- The `cluster` attribute marks cells whose four neighbours are explored too;
+-- first_visit, last_visit and visit_count tell when and how often the cell was
+-- visited.
+--
+-- A second layer, user_explorer_highlights, carries the max cluster and max
+-- square stored in explorer_stats so the map can highlight them.
+--
+-- With any of the route_filter_params, e.g. "rides only in 2024", the cells are
+-- instead aggregated from the route_cell rows of the matching routes. The
+-- highlights are left out then, as the stored statistics cover all routes.
+-- Results are cached per user, grid zoom and filters by Vinyl Cache (varnish)
+-- via the query params.
+--
+-- Through a share link, the cells are always aggregated from the matching
+-- routes, so private activities don't count, and cells touching a privacy zone
+-- are left out.
 CREATE OR REPLACE FUNCTION user_explorer_tiles(z int, x int, y int, query_params json)
 		RETURNS bytea AS $$
 		DECLARE
 		  mvt bytea;
+		  highlights bytea;
 		  uid bigint;
-		  grid_z constant int := 14;
-		  world constant double precision := 20037508.342789244;
-		  n double precision := (1 << grid_z);
-		  step_m constant double precision := 500; -- densify step (< zoom-14 cell width) so cells are not skipped
+		  grid_z int;
 		  env geometry := ST_TileEnvelope(z, x, y);
-		  env4326 geometry := ST_Transform(env, 4326);
+		  min_x int;
+		  max_x int;
+		  min_y int;
+		  max_y int;
+		  filtered boolean;
+		  zones geometry;
 		BEGIN
+		  query_params := resolve_tile_params(query_params, 'user_explorer_tiles');
 		  uid := (query_params->>'user_id')::bigint;
+		  grid_z := COALESCE((query_params->>'grid_z')::int, 14);
+		  IF NOT grid_z = ANY (explorer_grid_zooms()) THEN
+		    RAISE EXCEPTION 'unsupported explorer grid zoom %', grid_z;
+		  END IF;
+		  zones := tile_privacy_zones(query_params, 3857);
+		  filtered := query_params::jsonb ?| route_filter_params()
+		              OR COALESCE((query_params->>'shared')::boolean, FALSE);
+
+		  -- Range of grid cells covered by the requested tile.
+		  IF z <= grid_z THEN
+		    min_x := x << (grid_z - z);
+		    max_x := ((x + 1) << (grid_z - z)) - 1;
+		    min_y := y << (grid_z - z);
+		    max_y := ((y + 1) << (grid_z - z)) - 1;
+		  ELSE
+		    min_x := x >> (z - grid_z);
+		    max_x := min_x;
+		    min_y := y >> (z - grid_z);
+		    max_y := min_y;
+		  END IF;
+
+		  IF filtered THEN
+		    -- Cells of the matching routes, including a one-cell border so the
+		    -- cluster flag of the cells at the tile edge is correct.
+		    WITH cells AS (
+		      SELECT rc.x, rc.y,
+		             min(r.start_date) AS first_visit,
+		             max(r.start_date) AS last_visit,
+		             count(*)::int AS visit_count
+		      FROM route_cell rc
+		      JOIN route r ON r.id = rc.route_id
+		      WHERE rc.user_id = uid
+		        AND rc.z = grid_z
+		        AND rc.x BETWEEN min_x - 1 AND max_x + 1
+		        AND rc.y BETWEEN min_y - 1 AND max_y + 1
+		        AND route_matches_filters(r, query_params)
+		        AND (zones IS NULL OR NOT ST_Intersects(ST_TileEnvelope(grid_z, rc.x, rc.y), zones))
+		      GROUP BY rc.x, rc.y
+		    )
+		    SELECT INTO mvt ST_AsMVT(tile, 'user_explorer_tiles', 4096, 'geom')
+		    FROM (
+		      SELECT
+		        c.x,
+		        c.y,
+		        EXISTS (SELECT 1 FROM cells o WHERE o.x = c.x - 1 AND o.y = c.y)
+		          AND EXISTS (SELECT 1 FROM cells o WHERE o.x = c.x + 1 AND o.y = c.y)
+		          AND EXISTS (SELECT 1 FROM cells o WHERE o.x = c.x AND o.y = c.y - 1)
+		          AND EXISTS (SELECT 1 FROM cells o WHERE o.x = c.x AND o.y = c.y + 1) AS cluster,
+		        c.first_visit,
+		        c.last_visit,
+		        c.visit_count,
+		        ST_AsMVTGeom(
+		          ST_TileEnvelope(grid_z, c.x, c.y),
+		          env, 4096, 0, true
+		        ) AS geom
+		      FROM cells c
+		      WHERE c.x BETWEEN min_x AND max_x
+		        AND c.y BETWEEN min_y AND max_y
+		    ) tile;
+
+		    RETURN COALESCE(mvt, ''::bytea);
+		  END IF;
 
 		  SELECT INTO mvt ST_AsMVT(tile, 'user_explorer_tiles', 4096, 'geom')
 		  FROM (
 		    SELECT
-		      tx AS x,
-		      ty AS y,
+		      c.x,
+		      c.y,
+		      EXISTS (SELECT 1 FROM explored_cell o WHERE o.user_id = uid AND o.z = grid_z AND o.x = c.x - 1 AND o.y = c.y)
+		        AND EXISTS (SELECT 1 FROM explored_cell o WHERE o.user_id = uid AND o.z = grid_z AND o.x = c.x + 1 AND o.y = c.y)
+		        AND EXISTS (SELECT 1 FROM explored_cell o WHERE o.user_id = uid AND o.z = grid_z AND o.x = c.x AND o.y = c.y - 1)
+		        AND EXISTS (SELECT 1 FROM explored_cell o WHERE o.user_id = uid AND o.z = grid_z AND o.x = c.x AND o.y = c.y + 1) AS cluster,
+		      c.first_visit,
+		      c.last_visit,
+		      c.visit_count,
+		      ST_AsMVTGeom(
+		        ST_TileEnvelope(grid_z, c.x, c.y),
+		        env, 4096, 0, true
+		      ) AS geom
+		    FROM explored_cell c
+		    WHERE c.user_id = uid
+		      AND c.z = grid_z
+		      AND c.x BETWEEN min_x AND max_x
+		      AND c.y BETWEEN min_y AND max_y
+		  ) tile;
+
+		  SELECT INTO highlights ST_AsMVT(h, 'user_explorer_highlights', 4096, 'geom')
+		  FROM (
+		    SELECT 'max_cluster' AS kind, s.max_cluster AS size,
+		           ST_AsMVTGeom(s.cluster_geom, env, 4096, 0, true) AS geom
+		    FROM explorer_stats s
+		    WHERE s.user_id = uid AND s.z = grid_z AND s.cluster_geom && env
+		    UNION ALL
+		    SELECT 'max_square' AS kind, s.max_square AS size,
+		           ST_AsMVTGeom(s.square_geom, env, 4096, 0, true) AS geom
+		    FROM explorer_stats s
+		    WHERE s.user_id = uid AND s.z = grid_z AND s.square_geom && env
+		  ) h;
+
+		  RETURN COALESCE(mvt, ''::bytea) || COALESCE(highlights, ''::bytea);
+		END;
+		$$ LANGUAGE plpgsql STABLE PARALLEL SAFE;
+
+-- Create MVT function for a traversal-frequency heatmap of the user's routes.
+--
+-- Each tile is divided into a 128x128 grid of bins (so the bins get finer as
+-- the zoom increases). Every route visible in the tile is clipped, densified to
+-- half a bin width and mapped to the bins it passes through. A bin's `count` is
+-- the number of distinct routes traversing it, so overlapping commutes add up
+-- instead of being drawn on top of each other.
+-- Routes can be filtered with the params of route_filter_params. Through a
+-- share link, routes are cut off at the privacy zones.
+-- Results are cached per user by Vinyl Cache (varnish) via the user_id param.
+CREATE OR REPLACE FUNCTION user_heatmap(z int, x int, y int, query_params json)
+		RETURNS bytea AS $$
+		DECLARE
+		  mvt bytea;
+		  uid bigint;
+		  bins constant int := 128;
+		  env geometry := ST_TileEnvelope(z, x, y);
+		  env4326 geometry := ST_Transform(env, 4326);
+		  min_x double precision := ST_XMin(env);
+		  max_y double precision := ST_YMax(env);
+		  bin_size double precision := (ST_XMax(env) - ST_XMin(env)) / bins;
+		  zones geometry;
+		BEGIN
+		  query_params := resolve_tile_params(query_params, 'user_heatmap');
+		  uid := (query_params->>'user_id')::bigint;
+		  zones := tile_privacy_zones(query_params, 4326);
+
+		  SELECT INTO mvt ST_AsMVT(tile, 'user_heatmap', 4096, 'geom')
+		  FROM (
+		    SELECT
+		      count(DISTINCT b.route_id) AS count,
 		      ST_AsMVTGeom(
-		        ST_TileEnvelope(grid_z, tx, ty),
+		        ST_MakeEnvelope(
+		          min_x + b.bin_x * bin_size, max_y - (b.bin_y + 1) * bin_size,
+		          min_x + (b.bin_x + 1) * bin_size, max_y - b.bin_y * bin_size,
+		          3857),
 		        env, 4096, 0, true
 		      ) AS geom
 		    FROM (
-		      -- Distinct zoom-14 cells touched by the user's routes within this tile.
-		      SELECT DISTINCT
-		        floor((ST_X(pt) + world) / (2 * world) * n)::int AS tx,
-		        floor((world - ST_Y(pt)) / (2 * world) * n)::int AS ty
+		      SELECT
+		        p.route_id,
+		        floor((ST_X(p.pt) - min_x) / bin_size)::int AS bin_x,
+		        floor((max_y - ST_Y(p.pt)) / bin_size)::int AS bin_y
 		      FROM (
-		        SELECT (ST_DumpPoints(
+		        SELECT r.id AS route_id,
+		               (ST_DumpPoints(
 		                  ST_Segmentize(
-		                    ST_Transform(ST_Intersection(r.geom, env4326), 3857),
-		                    step_m))).geom AS pt
+		                    ST_Transform(privacy_clip(ST_Intersection(r.geom, env4326), zones), 3857),
+		                    bin_size / 2))).geom AS pt
 		        FROM route r
 		        WHERE r.user_id = uid
 		          AND r.geom IS NOT NULL
 		          AND r.geom && env4326
+		          AND route_matches_filters(r, query_params)
 		      ) p
-		    ) tiles
+		    ) b
+		    WHERE b.bin_x BETWEEN 0 AND bins - 1
+		      AND b.bin_y BETWEEN 0 AND bins - 1
+		    GROUP BY b.bin_x, b.bin_y
 		  ) tile;
 
 		  RETURN mvt;
 		END;
 		$$ LANGUAGE plpgsql STABLE PARALLEL SAFE;
+
+-- Create MVT function for the "new ground" of the user's routes, i.e. the
+-- parts of each route that were not covered by an earlier route within the
+-- user's new ground window (see route_new_ground).
+-- Routes can be filtered with the params of route_filter_params. Through a
+-- share link, the new ground is cut off at the privacy zones.
+-- Results are cached per user by Vinyl Cache (varnish) via the user_id param.
+CREATE OR REPLACE FUNCTION user_new_ground(z int, x int, y int, query_params json)
+		RETURNS bytea AS $$
+		DECLARE
+		  mvt bytea;
+		  uid bigint;
+		  zones geometry;
+		BEGIN
+		  query_params := resolve_tile_params(query_params, 'user_new_ground');
+		  uid := (query_params->>'user_id')::bigint;
+		  zones := tile_privacy_zones(query_params, 4326);
+
+		  SELECT INTO mvt ST_AsMVT(tile, 'user_new_ground', 4096, 'geom')
+		  FROM (
+		    SELECT
+		      r.id,
+		      COALESCE(ov.name, r.name) AS name,
+		      r.sport_type,
+		      r.start_date,
+		      ng.distance_meters,
+		      ST_AsMVTGeom(
+		        ST_Transform(privacy_clip(ng.geom, zones), 3857),
+		        ST_TileEnvelope(z, x, y),
+		        4096, 64, true
+		      ) AS geom
+		    FROM route_new_ground ng
+		    JOIN route r ON r.id = ng.route_id
+		    LEFT JOIN route_override ov ON ov.route_id = r.id
+		    WHERE ng.user_id = uid
+		      AND ng.geom && ST_Transform(ST_TileEnvelope(z, x, y), 4326)
+		      AND route_matches_filters(r, query_params)
+		  ) tile;
+
+		  RETURN mvt;
+		END;
+		$$ LANGUAGE plpgsql STABLE PARALLEL SAFE;
+
+-- Create MVT function for the start and end points of the user's routes,
+-- clustered per zoom so home, work or trailheads show up as single points.
+--
+-- The tile is divided into a 32x32 grid, i.e. the cells of zoom z + 5, and the
+-- start (kind = 'start') and end points (kind = 'end') in each cell form one
+-- cluster, placed at their centroid. Each cluster carries its count, the most
+-- common sport type and the dates of the first and last route, plus the cell
+-- (cell_z, cell_x, cell_y) that lists its routes via GET /routes/endpoints.
+-- Routes can be filtered with the params of route_filter_params. Through a
+-- share link, points inside a privacy zone are left out.
+-- Results are cached per user by Vinyl Cache (varnish) via the user_id param.
+CREATE OR REPLACE FUNCTION user_endpoints(z int, x int, y int, query_params json)
+		RETURNS bytea AS $$
+		DECLARE
+		  mvt bytea;
+		  uid bigint;
+		  cell_z int := z + 5;
+		  env geometry := ST_TileEnvelope(z, x, y);
+		  zones geometry;
+		BEGIN
+		  query_params := resolve_tile_params(query_params, 'user_endpoints');
+		  uid := (query_params->>'user_id')::bigint;
+		  zones := tile_privacy_zones(query_params, 3857);
+
+		  SELECT INTO mvt ST_AsMVT(tile, 'user_endpoints', 4096, 'geom')
+		  FROM (
+		    SELECT
+		      p.kind,
+		      cell_z,
+		      p.cell_x,
+		      p.cell_y,
+		      count(*)::int AS count,
+		      mode() WITHIN GROUP (ORDER BY p.sport_type) AS sport_type,
+		      min(p.start_date) AS first_date,
+		      max(p.start_date) AS last_date,
+		      ST_AsMVTGeom(ST_Centroid(ST_Collect(p.pt)), env, 4096, 0, true) AS geom
+		    FROM (
+		      SELECT e.kind, e.pt, r.sport_type, r.start_date,
+		             floor((ST_X(e.pt) + 20037508.342789244)
+		                   / (2 * 20037508.342789244) * power(2, cell_z))::int AS cell_x,
+		             floor((20037508.342789244 - ST_Y(e.pt))
+		                   / (2 * 20037508.342789244) * power(2, cell_z))::int AS cell_y
+		      FROM route r
+		      CROSS JOIN LATERAL (
+		        VALUES ('start', ST_StartPoint(r.geom_3857)), ('end', ST_EndPoint(r.geom_3857))
+		      ) e(kind, pt)
+		      WHERE r.user_id = uid
+		        AND r.geom_3857 && env
+		        AND route_matches_filters(r, query_params)
+		    ) p
+		    -- Points on a tile edge belong to exactly one tile.
+		    WHERE p.cell_x BETWEEN x * 32 AND x * 32 + 31
+		      AND p.cell_y BETWEEN y * 32 AND y * 32 + 31
+		      AND (zones IS NULL OR NOT ST_Intersects(p.pt, zones))
+		    GROUP BY p.kind, p.cell_x, p.cell_y
+		  ) tile;
+
+		  RETURN mvt;
+		END;
+		$$ LANGUAGE plpgsql STABLE PARALLEL SAFE;
+
+-- The versions of this file applied to the database, by checksum (see
+-- db.SchemaVersion), so that /readyz can tell whether the database runs the
+-- schema of this build.
+CREATE TABLE IF NOT EXISTS schema_version (
+    version    TEXT PRIMARY KEY,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,187 @@
+package explorer
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// DefaultGridZoom is the slippy-map zoom level of the classic explorer grid. A
+// cell counts as "explored" once any route of the user passes through it.
+const DefaultGridZoom = 14
+
+// GridZooms are the grid zoom levels explored cells are materialized for. It
+// must match explorer_grid_zooms() in db/schema.sql.
+var GridZooms = []int{12, 14, 17}
+
+// IsGridZoom reports whether z is a supported explorer grid zoom.
+func IsGridZoom(z int) bool {
+	return slices.Contains(GridZooms, z)
+}
+
+// Cell is a single explorer grid cell in slippy-map tile coordinates.
+type Cell struct {
+	X int
+	Y int
+}
+
+// Cluster describes the largest connected group of cluster cells, i.e. cells
+// whose four direct neighbours are explored as well.
+type Cluster struct {
+	Size   int    `json:"size"`
+	Bounds string `json:"bounds,omitempty"` // "minLat,minLng,maxLat,maxLng"
+	Cells  []Cell `json:"-"`
+}
+
+// Square describes the largest square of explored cells. X and Y are the
+// coordinates of its top-left cell.
+type Square struct {
+	Size   int    `json:"size"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Bounds string `json:"bounds,omitempty"` // "minLat,minLng,maxLat,maxLng"
+}
+
+// Stats are the numbers explorer hunters usually track, for one grid zoom.
+type Stats struct {
+	GridZoom   int     `json:"grid_z"`
+	TotalTiles int     `json:"total_tiles"`
+	MaxCluster Cluster `json:"max_cluster"`
+	MaxSquare  Square  `json:"max_square"`
+}
+
+// ComputeStats derives the explorer statistics from a set of explored cells at
+// grid zoom z. Duplicate cells are ignored.
+func ComputeStats(z int, cells []Cell) Stats {
+	explored := make(map[Cell]bool, len(cells))
+	for _, c := range cells {
+		explored[c] = true
+	}
+
+	return Stats{
+		GridZoom:   z,
+		TotalTiles: len(explored),
+		MaxCluster: maxCluster(z, explored),
+		MaxSquare:  maxSquare(z, explored),
+	}
+}
+
+// maxCluster returns the largest 4-connected component of cells whose four
+// neighbours are all explored.
+func maxCluster(z int, explored map[Cell]bool) Cluster {
+	isCluster := func(c Cell) bool {
+		return explored[c] &&
+			explored[Cell{c.X - 1, c.Y}] && explored[Cell{c.X + 1, c.Y}] &&
+			explored[Cell{c.X, c.Y - 1}] && explored[Cell{c.X, c.Y + 1}]
+	}
+
+	visited := make(map[Cell]bool)
+	var best []Cell
+	for c := range explored {
+		if visited[c] || !isCluster(c) {
+			continue
+		}
+
+		// Flood fill the component containing c.
+		var component []Cell
+		stack := []Cell{c}
+		visited[c] = true
+		for len(stack) > 0 {
+			cur := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			component = append(component, cur)
+			for _, n := range []Cell{{cur.X - 1, cur.Y}, {cur.X + 1, cur.Y}, {cur.X, cur.Y - 1}, {cur.X, cur.Y + 1}} {
+				if !visited[n] && isCluster(n) {
+					visited[n] = true
+					stack = append(stack, n)
+				}
+			}
+		}
+
+		if len(component) > len(best) {
+			best = component
+		}
+	}
+
+	if len(best) == 0 {
+		return Cluster{}
+	}
+	minX, minY, maxX, maxY := best[0].X, best[0].Y, best[0].X, best[0].Y
+	for _, c := range best {
+		minX, maxX = min(minX, c.X), max(maxX, c.X)
+		minY, maxY = min(minY, c.Y), max(maxY, c.Y)
+	}
+	return Cluster{
+		Size:   len(best),
+		Bounds: CellRangeBounds(z, minX, minY, maxX, maxY),
+		Cells:  best,
+	}
+}
+
+// maxSquare finds the largest square of explored cells using the classic
+// dynamic programming approach: the square ending at (x, y) is one larger than
+// the smallest square ending at its left, top and top-left neighbours. The
+// cells are visited row by row in sorted order, so the work is proportional to
+// the number of explored cells rather than the area of their bounding box.
+func maxSquare(z int, explored map[Cell]bool) Square {
+	if len(explored) == 0 {
+		return Square{}
+	}
+
+	cells := make([]Cell, 0, len(explored))
+	for c := range explored {
+		cells = append(cells, c)
+	}
+	slices.SortFunc(cells, func(a, b Cell) int {
+		if a.Y != b.Y {
+			return a.Y - b.Y
+		}
+		return a.X - b.X
+	})
+
+	// Only the sizes of the previous row are needed to compute the current
+	// one; unexplored cells have size 0 and are simply missing.
+	prev := make(map[int]int)
+	cur := make(map[int]int)
+	var best Square
+	for i, c := range cells {
+		if i > 0 && c.Y != cells[i-1].Y {
+			if c.Y == cells[i-1].Y+1 {
+				prev, cur = cur, prev
+			} else {
+				clear(prev)
+			}
+			clear(cur)
+		}
+		size := 1 + min(cur[c.X-1], prev[c.X], prev[c.X-1])
+		cur[c.X] = size
+		if size > best.Size {
+			best = Square{Size: size, X: c.X - size + 1, Y: c.Y - size + 1}
+		}
+	}
+
+	best.Bounds = CellRangeBounds(z, best.X, best.Y, best.X+best.Size-1, best.Y+best.Size-1)
+	return best
+}
+
+// CellRangeBounds returns the bounds of the cells between (minX, minY) and
+// (maxX, maxY) inclusive, formatted like route bounds as
+// "minLat,minLng,maxLat,maxLng".
+func CellRangeBounds(z, minX, minY, maxX, maxY int) string {
+	minLng := tileLng(z, minX)
+	maxLng := tileLng(z, maxX+1)
+	maxLat := tileLat(z, minY)
+	minLat := tileLat(z, maxY+1)
+	return fmt.Sprintf("%f,%f,%f,%f", minLat, minLng, maxLat, maxLng)
+}
+
+// tileLng returns the longitude of the west edge of tile column x.
+func tileLng(z, x int) float64 {
+	return float64(x)/float64(int(1)<<z)*360.0 - 180.0
+}
+
+// tileLat returns the latitude of the north edge of tile row y.
+func tileLat(z, y int) float64 {
+	n := math.Pi - 2.0*math.Pi*float64(y)/float64(int(1)<<z)
+	return 180.0 / math.Pi * math.Atan(math.Sinh(n))
+}
@@ -0,0 +1,258 @@
+package explorer
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// parseCells returns the cells marked # in the rows of a drawing, with its
+// top-left corner at (x0, y0).
+func parseCells(x0, y0 int, rows ...string) []Cell {
+	var cells []Cell
+	for y, row := range rows {
+		for x, c := range row {
+			if c == '#' {
+				cells = append(cells, Cell{X: x0 + x, Y: y0 + y})
+			}
+		}
+	}
+	return cells
+}
+
+func sortCells(cells []Cell) []Cell {
+	cells = slices.Clone(cells)
+	slices.SortFunc(cells, func(a, b Cell) int {
+		if a.Y != b.Y {
+			return a.Y - b.Y
+		}
+		return a.X - b.X
+	})
+	return cells
+}
+
+func TestComputeStats(t *testing.T) {
+	tests := []struct {
+		name    string
+		cells   []Cell
+		total   int
+		square  Square // without bounds
+		cluster []Cell
+	}{
+		{
+			name: "no cells",
+		},
+		{
+			name:   "single cell",
+			cells:  []Cell{{X: 8800, Y: 5370}},
+			total:  1,
+			square: Square{Size: 1, X: 8800, Y: 5370},
+		},
+		{
+			name: "duplicates",
+			cells: append(parseCells(10, 20,
+				"##",
+				"##",
+			), Cell{X: 10, Y: 20}, Cell{X: 11, Y: 21}),
+			total:  4,
+			square: Square{Size: 2, X: 10, Y: 20},
+		},
+		{
+			// The row after the gap must not build on the rows before it.
+			name: "gap between rows",
+			cells: parseCells(100, 200,
+				"###",
+				"###",
+				"...",
+				"###",
+			),
+			total:  9,
+			square: Square{Size: 2, X: 100, Y: 200},
+		},
+		{
+			name: "gaps within rows",
+			cells: parseCells(0, 0,
+				"##.###",
+				"##.###",
+				"##.###",
+				"##.#.#",
+			),
+			total:   19,
+			square:  Square{Size: 3, X: 3, Y: 0},
+			cluster: []Cell{{X: 4, Y: 1}},
+		},
+		{
+			name: "square next to a longer run",
+			cells: parseCells(50, 60,
+				"###.......",
+				"##########",
+				"###.......",
+				"#.........",
+				"#.........",
+				"#.........",
+			),
+			total:   19,
+			square:  Square{Size: 3, X: 50, Y: 60},
+			cluster: []Cell{{X: 51, Y: 61}, {X: 52, Y: 61}},
+		},
+		{
+			// The cells next to the unexplored cell in the top edge aren't
+			// cluster cells, as one of their neighbours is missing.
+			name: "cluster touching an unexplored border",
+			cells: parseCells(30, 40,
+				"##.##",
+				"#####",
+				"#####",
+				"#####",
+				"#####",
+			),
+			total:  24,
+			square: Square{Size: 4, X: 30, Y: 41},
+			cluster: parseCells(30, 40,
+				".....",
+				".#.#.",
+				".###.",
+				".###.",
+				".....",
+			),
+		},
+		{
+			name: "largest of two clusters",
+			cells: parseCells(0, 0,
+				"###......",
+				"###.#####",
+				"###.#####",
+				"....#####",
+				"....#####",
+			),
+			total:  29,
+			square: Square{Size: 4, X: 4, Y: 1},
+			cluster: parseCells(0, 0,
+				".........",
+				".........",
+				".....###.",
+				".....###.",
+				".........",
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := ComputeStats(DefaultGridZoom, tt.cells)
+			if stats.GridZoom != DefaultGridZoom {
+				t.Errorf("GridZoom = %d, want %d", stats.GridZoom, DefaultGridZoom)
+			}
+			if stats.TotalTiles != tt.total {
+				t.Errorf("TotalTiles = %d, want %d", stats.TotalTiles, tt.total)
+			}
+
+			want := tt.square
+			if want.Size > 0 {
+				want.Bounds = CellRangeBounds(DefaultGridZoom, want.X, want.Y, want.X+want.Size-1, want.Y+want.Size-1)
+			}
+			if stats.MaxSquare != want {
+				t.Errorf("MaxSquare = %+v, want %+v", stats.MaxSquare, want)
+			}
+
+			cluster := stats.MaxCluster
+			if got, want := sortCells(cluster.Cells), sortCells(tt.cluster); !slices.Equal(got, want) {
+				t.Errorf("MaxCluster.Cells = %v, want %v", got, want)
+			}
+			if cluster.Size != len(tt.cluster) {
+				t.Errorf("MaxCluster.Size = %d, want %d", cluster.Size, len(tt.cluster))
+			}
+			wantBounds := ""
+			if len(tt.cluster) > 0 {
+				minX, minY, maxX, maxY := tt.cluster[0].X, tt.cluster[0].Y, tt.cluster[0].X, tt.cluster[0].Y
+				for _, c := range tt.cluster {
+					minX, maxX = min(minX, c.X), max(maxX, c.X)
+					minY, maxY = min(minY, c.Y), max(maxY, c.Y)
+				}
+				wantBounds = CellRangeBounds(DefaultGridZoom, minX, minY, maxX, maxY)
+			}
+			if cluster.Bounds != wantBounds {
+				t.Errorf("MaxCluster.Bounds = %q, want %q", cluster.Bounds, wantBounds)
+			}
+		})
+	}
+}
+
+// TestMaxSquareMatchesBruteForce compares the sparse row-by-row maxSquare with
+// checking every square of a dense grid.
+func TestMaxSquareMatchesBruteForce(t *testing.T) {
+	grids := [][]string{
+		{
+			"#.##.####",
+			"####.####",
+			".###.####",
+			"####.####",
+			"##...#.##",
+		},
+		{
+			"....#",
+			"...##",
+			"..###",
+			".####",
+			"#####",
+		},
+		{
+			"#########",
+			"#.......#",
+			"#.......#",
+			"#########",
+		},
+	}
+	for i, rows := range grids {
+		explored := make(map[Cell]bool)
+		for _, c := range parseCells(0, 0, rows...) {
+			explored[c] = true
+		}
+
+		var want Square
+		for y := range rows {
+			for x := range rows[y] {
+				for size := want.Size + 1; y+size <= len(rows) && x+size <= len(rows[y]); size++ {
+					full := true
+					for dy := range size {
+						if strings.Contains(rows[y+dy][x:x+size], ".") {
+							full = false
+							break
+						}
+					}
+					if full {
+						want = Square{Size: size, X: x, Y: y}
+					}
+				}
+			}
+		}
+
+		got := maxSquare(DefaultGridZoom, explored)
+		if got.Size != want.Size {
+			t.Errorf("grid %d: maxSquare size = %d, want %d", i, got.Size, want.Size)
+		}
+		for dy := range got.Size {
+			for dx := range got.Size {
+				if !explored[Cell{X: got.X + dx, Y: got.Y + dy}] {
+					t.Errorf("grid %d: square %+v includes unexplored cell (%d, %d)", i, got, got.X+dx, got.Y+dy)
+				}
+			}
+		}
+	}
+}
+
+func TestCellRangeBounds(t *testing.T) {
+	tests := []struct {
+		z, minX, minY, maxX, maxY int
+		want                      string
+	}{
+		{0, 0, 0, 0, 0, "-85.051129,-180.000000,85.051129,180.000000"},
+		{1, 1, 0, 1, 0, "0.000000,0.000000,85.051129,180.000000"},
+		{2, 0, 2, 1, 3, "-85.051129,-180.000000,0.000000,0.000000"},
+	}
+	for _, tt := range tests {
+		if got := CellRangeBounds(tt.z, tt.minX, tt.minY, tt.maxX, tt.maxY); got != tt.want {
+			t.Errorf("CellRangeBounds(%d, %d, %d, %d, %d) = %q, want %q", tt.z, tt.minX, tt.minY, tt.maxX, tt.maxY, got, tt.want)
+		}
+	}
+}
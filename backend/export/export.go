@@ -0,0 +1,180 @@
+package export
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"wanderwell/backend/db"
+
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// pageSize is the number of routes fetched from the database at once, so that
+// large exports never hold more than one page of routes in memory.
+const pageSize = 200
+
+// Format describes a supported export format.
+type Format struct {
+	ContentType string
+	Extension   string
+}
+
+// Formats are the supported export formats by name.
+var Formats = map[string]Format{
+	"gpx":     {ContentType: "application/gpx+xml", Extension: "gpx"},
+	"kml":     {ContentType: "application/vnd.google-earth.kml+xml", Extension: "kml"},
+	"geojson": {ContentType: "application/geo+json", Extension: "geojson"},
+	"fgb":     {ContentType: "application/octet-stream", Extension: "fgb"},
+	"gpkg":    {ContentType: "application/geopackage+sqlite3", Extension: "gpkg"},
+}
+
+// Point is a single point of an exported route. Elevation and time are only
+// known if the route's Strava streams are stored.
+type Point struct {
+	Lat       float64
+	Lng       float64
+	Elevation float64
+	HasEle    bool
+	Time      time.Time
+}
+
+// Route is a route with its track as it is exported.
+type Route struct {
+	ID          int64
+	Name        string
+	SportType   string
+	StartDate   time.Time
+	ElapsedTime int32
+	MovingTime  int32
+	Distance    float64
+	Elevation   float64
+	Points      []Point
+}
+
+// Writer writes routes in one of the export formats. Close must be called
+// after the last route to complete the output.
+type Writer interface {
+	Write(route Route) error
+	Close() error
+}
+
+// NewWriter returns a Writer for the named format that writes to w.
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case "gpx":
+		return newGPXWriter(w), nil
+	case "kml":
+		return newKMLWriter(w), nil
+	case "geojson":
+		return newGeoJSONWriter(w), nil
+	case "fgb":
+		return newFlatGeobufWriter(w), nil
+	case "gpkg":
+		return newGeoPackageWriter(w)
+	default:
+		return nil, fmt.Errorf("unsupported export format: %q", format)
+	}
+}
+
+// WriteRoutes writes the user's routes matching the tile route filters (see
+// route_filter_params in db/schema.sql) and, if valid, the full-text search
+// to w, oldest first. If routeID is valid only that route is written. It
+// returns the number of routes written.
+func WriteRoutes(ctx context.Context, queries *db.Queries, w Writer, userID int64, routeID pgtype.Int8, filters []byte, search pgtype.Text) (int, error) {
+	var count int
+	params := db.ListRoutesForExportParams{
+		UserID:         userID,
+		RouteID:        routeID,
+		Filters:        filters,
+		Search:         search,
+		AfterStartDate: pgtype.Timestamptz{Time: time.Time{}, InfinityModifier: pgtype.NegativeInfinity, Valid: true},
+		MaxResults:     pageSize,
+	}
+	for {
+		rows, err := queries.ListRoutesForExport(ctx, params)
+		if err != nil {
+			return count, fmt.Errorf("failed to list routes: %w", err)
+		}
+
+		for _, row := range rows {
+			route, err := routeFromRow(row)
+			if err != nil {
+				return count, fmt.Errorf("failed to convert route %d: %w", row.ID, err)
+			}
+			if err := w.Write(route); err != nil {
+				return count, fmt.Errorf("failed to write route %d: %w", row.ID, err)
+			}
+			count++
+		}
+
+		if len(rows) < pageSize {
+			return count, nil
+		}
+		last := rows[len(rows)-1]
+		params.AfterStartDate = last.StartDate
+		params.AfterID = last.ID
+	}
+}
+
+// routeFromRow converts an export row into a Route. The points are taken from
+// the stored streams if there are any, as they carry time and elevation, and
+// from the route geometry otherwise.
+func routeFromRow(row db.ListRoutesForExportRow) (Route, error) {
+	route := Route{
+		ID:          row.ID,
+		Name:        row.Name,
+		SportType:   row.SportType.String,
+		StartDate:   row.StartDate.Time,
+		ElapsedTime: row.ElapsedTime,
+		MovingTime:  row.MovingTime,
+		Distance:    row.Distance,
+		Elevation:   row.Elevation,
+	}
+
+	if len(row.Lat) > 0 && len(row.Lat) == len(row.Lng) {
+		route.Points = make([]Point, len(row.Lat))
+		for i := range row.Lat {
+			p := Point{Lat: row.Lat[i], Lng: row.Lng[i]}
+			if i < len(row.AltitudeM) {
+				p.Elevation = row.AltitudeM[i]
+				p.HasEle = true
+			}
+			if i < len(row.TimeS) && row.StartDate.Valid {
+				p.Time = row.StartDate.Time.Add(time.Duration(row.TimeS[i]) * time.Second)
+			}
+			route.Points[i] = p
+		}
+		return route, nil
+	}
+
+	var geometry struct {
+		Coordinates [][]float64 `json:"coordinates"`
+	}
+	if err := json.Unmarshal([]byte(row.Geometry), &geometry); err != nil {
+		return route, fmt.Errorf("failed to parse geometry: %w", err)
+	}
+	route.Points = make([]Point, 0, len(geometry.Coordinates))
+	for _, c := range geometry.Coordinates {
+		if len(c) < 2 {
+			continue
+		}
+		route.Points = append(route.Points, Point{Lat: c[1], Lng: c[0]})
+	}
+	return route, nil
+}
+
+// bounds returns the bounding box of the route's points.
+func (r Route) bounds() (minLng, minLat, maxLng, maxLat float64) {
+	for i, p := range r.Points {
+		if i == 0 {
+			minLng, minLat, maxLng, maxLat = p.Lng, p.Lat, p.Lng, p.Lat
+			continue
+		}
+		minLng, maxLng = min(minLng, p.Lng), max(maxLng, p.Lng)
+		minLat, maxLat = min(minLat, p.Lat), max(maxLat, p.Lat)
+	}
+	return minLng, minLat, maxLng, maxLat
+}
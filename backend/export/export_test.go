@@ -0,0 +1,38 @@
+package export
+
+import (
+	"time"
+)
+
+// testRoutes are the routes written by the format tests: one with a sport
+// type and one without, to cover the optional column.
+var testRoutes = []Route{
+	{
+		ID:          11,
+		Name:        "Morning Ride",
+		SportType:   "Ride",
+		StartDate:   time.Date(2024, 5, 1, 7, 30, 0, 0, time.UTC),
+		ElapsedTime: 3600,
+		MovingTime:  3300,
+		Distance:    25123.5,
+		Elevation:   310.25,
+		Points: []Point{
+			{Lat: 52.5, Lng: 13.4},
+			{Lat: 52.51, Lng: 13.42},
+			{Lat: 52.53, Lng: 13.41},
+		},
+	},
+	{
+		ID:          12,
+		Name:        "Über den Berg",
+		StartDate:   time.Date(2024, 6, 2, 18, 0, 0, 0, time.FixedZone("CEST", 2*60*60)),
+		ElapsedTime: 5400,
+		MovingTime:  5000,
+		Distance:    14000,
+		Elevation:   820,
+		Points: []Point{
+			{Lat: 47.1, Lng: 11.2},
+			{Lat: 47.2, Lng: 11.3},
+		},
+	},
+}
@@ -0,0 +1,199 @@
+package export
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// fbBuilder is a minimal FlatBuffers builder, just enough to encode the
+// FlatGeobuf header and features. Like the reference implementation it fills
+// the buffer back to front, so that every offset points forward and the
+// alignment of the scalars is relative to the end of the buffer.
+type fbBuilder struct {
+	buf       []byte
+	head      int
+	minAlign  int
+	vtable    []int
+	objectEnd int
+}
+
+func newFBBuilder() *fbBuilder {
+	return &fbBuilder{buf: make([]byte, 1024), head: 1024, minAlign: 1}
+}
+
+// offset returns the current offset from the end of the buffer.
+func (b *fbBuilder) offset() int {
+	return len(b.buf) - b.head
+}
+
+func (b *fbBuilder) grow() {
+	buf := make([]byte, 2*len(b.buf))
+	copy(buf[len(buf)-len(b.buf):], b.buf)
+	b.head += len(buf) - len(b.buf)
+	b.buf = buf
+}
+
+// prep aligns the buffer so that after writing additional bytes, a value of
+// size bytes can be written aligned to its size.
+func (b *fbBuilder) prep(size, additional int) {
+	if size > b.minAlign {
+		b.minAlign = size
+	}
+	pad := (-(b.offset() + additional)) & (size - 1)
+	for b.head < pad+size+additional {
+		b.grow()
+	}
+	for range pad {
+		b.head--
+		b.buf[b.head] = 0
+	}
+}
+
+func (b *fbBuilder) placeUint16(v uint16) {
+	b.head -= 2
+	binary.LittleEndian.PutUint16(b.buf[b.head:], v)
+}
+
+func (b *fbBuilder) placeUint32(v uint32) {
+	b.head -= 4
+	binary.LittleEndian.PutUint32(b.buf[b.head:], v)
+}
+
+func (b *fbBuilder) placeUint64(v uint64) {
+	b.head -= 8
+	binary.LittleEndian.PutUint64(b.buf[b.head:], v)
+}
+
+func (b *fbBuilder) prependUint8(v uint8) {
+	b.prep(1, 0)
+	b.head--
+	b.buf[b.head] = v
+}
+
+func (b *fbBuilder) prependUint16(v uint16) {
+	b.prep(2, 0)
+	b.placeUint16(v)
+}
+
+func (b *fbBuilder) prependUint32(v uint32) {
+	b.prep(4, 0)
+	b.placeUint32(v)
+}
+
+func (b *fbBuilder) prependUint64(v uint64) {
+	b.prep(8, 0)
+	b.placeUint64(v)
+}
+
+// prependOffset writes an offset to an object written earlier.
+func (b *fbBuilder) prependOffset(off int) {
+	b.prep(4, 0)
+	b.placeUint32(uint32(b.offset() - off + 4))
+}
+
+// endVector writes the length of a vector whose elements were just written.
+func (b *fbBuilder) endVector(n int) int {
+	b.placeUint32(uint32(n))
+	return b.offset()
+}
+
+func (b *fbBuilder) createString(s string) int {
+	b.prep(4, len(s)+1)
+	b.head--
+	b.buf[b.head] = 0
+	b.head -= len(s)
+	copy(b.buf[b.head:], s)
+	return b.endVector(len(s))
+}
+
+func (b *fbBuilder) createBytes(v []byte) int {
+	b.prep(4, len(v))
+	b.head -= len(v)
+	copy(b.buf[b.head:], v)
+	return b.endVector(len(v))
+}
+
+func (b *fbBuilder) createFloat64s(v []float64) int {
+	b.prep(4, 8*len(v))
+	b.prep(8, 8*len(v))
+	for i := len(v) - 1; i >= 0; i-- {
+		b.placeUint64(math.Float64bits(v[i]))
+	}
+	return b.endVector(len(v))
+}
+
+func (b *fbBuilder) createOffsets(offs []int) int {
+	b.prep(4, 4*len(offs))
+	for i := len(offs) - 1; i >= 0; i-- {
+		b.prependOffset(offs[i])
+	}
+	return b.endVector(len(offs))
+}
+
+func (b *fbBuilder) startTable(numFields int) {
+	b.vtable = make([]int, numFields)
+	b.objectEnd = b.offset()
+}
+
+// The add functions write a table field. Unlike the reference implementation
+// they never skip default values; the callers simply omit such fields.
+
+func (b *fbBuilder) addUint8(field int, v uint8) {
+	b.prependUint8(v)
+	b.vtable[field] = b.offset()
+}
+
+func (b *fbBuilder) addUint16(field int, v uint16) {
+	b.prependUint16(v)
+	b.vtable[field] = b.offset()
+}
+
+func (b *fbBuilder) addInt32(field int, v int32) {
+	b.prependUint32(uint32(v))
+	b.vtable[field] = b.offset()
+}
+
+func (b *fbBuilder) addUint64(field int, v uint64) {
+	b.prependUint64(v)
+	b.vtable[field] = b.offset()
+}
+
+func (b *fbBuilder) addOffset(field int, off int) {
+	b.prependOffset(off)
+	b.vtable[field] = b.offset()
+}
+
+// endTable writes the vtable of the current table and returns its offset.
+func (b *fbBuilder) endTable() int {
+	b.prependUint32(0) // replaced by the offset to the vtable below
+	objectOffset := b.offset()
+
+	n := len(b.vtable)
+	for n > 0 && b.vtable[n-1] == 0 {
+		n--
+	}
+	for i := n - 1; i >= 0; i-- {
+		var fieldOffset int
+		if b.vtable[i] != 0 {
+			fieldOffset = objectOffset - b.vtable[i]
+		}
+		b.prependUint16(uint16(fieldOffset))
+	}
+	b.prependUint16(uint16(objectOffset - b.objectEnd))
+	b.prependUint16(uint16((n + 2) * 2))
+
+	pos := len(b.buf) - objectOffset
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(int32(b.offset()-objectOffset)))
+	b.vtable = nil
+	return objectOffset
+}
+
+// finishSizePrefixed completes the buffer with root as its root table and
+// prefixes it with its size, as FlatGeobuf expects for the header and each
+// feature.
+func (b *fbBuilder) finishSizePrefixed(root int) []byte {
+	b.prep(b.minAlign, 8)
+	b.prependOffset(root)
+	b.prependUint32(uint32(b.offset()))
+	return b.buf[b.head:]
+}
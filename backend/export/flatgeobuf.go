@@ -0,0 +1,148 @@
+package export
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"time"
+)
+
+// fgbMagic starts every FlatGeobuf file (format version 3).
+var fgbMagic = []byte{0x66, 0x67, 0x62, 0x03, 0x66, 0x67, 0x62, 0x00}
+
+// FlatGeobuf geometry and column types, see header.fbs of the specification.
+const (
+	fgbLineString = 2
+
+	fgbColumnInt      = 5
+	fgbColumnLong     = 7
+	fgbColumnDouble   = 10
+	fgbColumnString   = 11
+	fgbColumnDateTime = 13
+)
+
+// fgbColumns are the attribute columns of the exported routes, in the order
+// they are written in each feature's properties.
+var fgbColumns = []struct {
+	name    string
+	colType uint8
+}{
+	{"id", fgbColumnLong},
+	{"name", fgbColumnString},
+	{"sport_type", fgbColumnString},
+	{"start_date", fgbColumnDateTime},
+	{"elapsed_time", fgbColumnInt},
+	{"moving_time", fgbColumnInt},
+	{"distance", fgbColumnDouble},
+	{"elevation", fgbColumnDouble},
+}
+
+// flatGeobufWriter writes the routes as FlatGeobuf LineStrings in EPSG:4326.
+// As the routes are streamed, the file has no spatial index and an unknown
+// feature count.
+type flatGeobufWriter struct {
+	w      *bufio.Writer
+	header bool
+}
+
+func newFlatGeobufWriter(w io.Writer) *flatGeobufWriter {
+	return &flatGeobufWriter{w: bufio.NewWriter(w)}
+}
+
+func (f *flatGeobufWriter) writeHeader() error {
+	if f.header {
+		return nil
+	}
+	f.header = true
+
+	b := newFBBuilder()
+	columns := make([]int, len(fgbColumns))
+	for i, c := range fgbColumns {
+		name := b.createString(c.name)
+		b.startTable(11)
+		b.addOffset(0, name)
+		b.addUint8(1, c.colType)
+		columns[i] = b.endTable()
+	}
+	columnsVector := b.createOffsets(columns)
+
+	org := b.createString("EPSG")
+	b.startTable(6)
+	b.addOffset(0, org)
+	b.addInt32(1, 4326)
+	crs := b.endTable()
+
+	name := b.createString("routes")
+	b.startTable(14)
+	b.addOffset(0, name)
+	b.addOffset(7, columnsVector)
+	b.addOffset(10, crs)
+	b.addUint64(8, 0) // features_count: unknown
+	b.addUint16(9, 0) // index_node_size: no spatial index
+	b.addUint8(2, fgbLineString)
+	header := b.endTable()
+
+	if _, err := f.w.Write(fgbMagic); err != nil {
+		return err
+	}
+	_, err := f.w.Write(b.finishSizePrefixed(header))
+	return err
+}
+
+func (f *flatGeobufWriter) Write(route Route) error {
+	if err := f.writeHeader(); err != nil {
+		return err
+	}
+
+	var props []byte
+	props = fgbAppendColumn(props, 0)
+	props = binary.LittleEndian.AppendUint64(props, uint64(route.ID))
+	props = fgbAppendString(fgbAppendColumn(props, 1), route.Name)
+	if route.SportType != "" {
+		props = fgbAppendString(fgbAppendColumn(props, 2), route.SportType)
+	}
+	props = fgbAppendString(fgbAppendColumn(props, 3), route.StartDate.UTC().Format(time.RFC3339))
+	props = binary.LittleEndian.AppendUint32(fgbAppendColumn(props, 4), uint32(route.ElapsedTime))
+	props = binary.LittleEndian.AppendUint32(fgbAppendColumn(props, 5), uint32(route.MovingTime))
+	props = binary.LittleEndian.AppendUint64(fgbAppendColumn(props, 6), math.Float64bits(route.Distance))
+	props = binary.LittleEndian.AppendUint64(fgbAppendColumn(props, 7), math.Float64bits(route.Elevation))
+
+	xy := make([]float64, 0, 2*len(route.Points))
+	for _, p := range route.Points {
+		xy = append(xy, p.Lng, p.Lat)
+	}
+
+	b := newFBBuilder()
+	xyVector := b.createFloat64s(xy)
+	b.startTable(8)
+	b.addOffset(1, xyVector)
+	geometry := b.endTable()
+
+	propsVector := b.createBytes(props)
+	b.startTable(3)
+	b.addOffset(0, geometry)
+	b.addOffset(1, propsVector)
+	feature := b.endTable()
+
+	_, err := f.w.Write(b.finishSizePrefixed(feature))
+	return err
+}
+
+func (f *flatGeobufWriter) Close() error {
+	if err := f.writeHeader(); err != nil {
+		return err
+	}
+	return f.w.Flush()
+}
+
+// fgbAppendColumn appends the column index that precedes each property value.
+func fgbAppendColumn(props []byte, column uint16) []byte {
+	return binary.LittleEndian.AppendUint16(props, column)
+}
+
+// fgbAppendString appends a length-prefixed string property value.
+func fgbAppendString(props []byte, s string) []byte {
+	props = binary.LittleEndian.AppendUint32(props, uint32(len(s)))
+	return append(props, s...)
+}
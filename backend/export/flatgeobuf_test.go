@@ -0,0 +1,267 @@
+package export
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// fbTable reads a table of a FlatBuffers buffer, just enough to decode what
+// the FlatGeobuf writer produces.
+type fbTable struct {
+	buf []byte
+	pos int
+}
+
+// fbRoot returns the root table of a size-prefixed buffer and the size of the
+// buffer including the prefix.
+func fbRoot(t *testing.T, buf []byte) (fbTable, int) {
+	t.Helper()
+	size := int(binary.LittleEndian.Uint32(buf)) + 4
+	if size > len(buf) {
+		t.Fatalf("buffer size %d exceeds the %d bytes left", size, len(buf))
+	}
+	buf = buf[4:size]
+	return fbTable{buf: buf, pos: int(binary.LittleEndian.Uint32(buf))}, size
+}
+
+// field returns the position of the field in the buffer, or 0 if it is not set.
+func (tb fbTable) field(slot int) int {
+	vtable := tb.pos - int(int32(binary.LittleEndian.Uint32(tb.buf[tb.pos:])))
+	entry := 4 + 2*slot
+	if entry >= int(binary.LittleEndian.Uint16(tb.buf[vtable:])) {
+		return 0
+	}
+	off := int(binary.LittleEndian.Uint16(tb.buf[vtable+entry:]))
+	if off == 0 {
+		return 0
+	}
+	return tb.pos + off
+}
+
+func (tb fbTable) uint8(slot int) uint8 {
+	if p := tb.field(slot); p != 0 {
+		return tb.buf[p]
+	}
+	return 0
+}
+
+func (tb fbTable) uint16(slot int) uint16 {
+	if p := tb.field(slot); p != 0 {
+		return binary.LittleEndian.Uint16(tb.buf[p:])
+	}
+	return 0
+}
+
+func (tb fbTable) int32(slot int) int32 {
+	if p := tb.field(slot); p != 0 {
+		return int32(binary.LittleEndian.Uint32(tb.buf[p:]))
+	}
+	return 0
+}
+
+// indirect follows the offset stored in the field.
+func (tb fbTable) indirect(slot int) int {
+	p := tb.field(slot)
+	if p == 0 {
+		return 0
+	}
+	return p + int(binary.LittleEndian.Uint32(tb.buf[p:]))
+}
+
+func (tb fbTable) table(slot int) fbTable {
+	return fbTable{buf: tb.buf, pos: tb.indirect(slot)}
+}
+
+// vector returns the length and position of the first element of a vector.
+func (tb fbTable) vector(slot int) (int, int) {
+	p := tb.indirect(slot)
+	if p == 0 {
+		return 0, 0
+	}
+	return int(binary.LittleEndian.Uint32(tb.buf[p:])), p + 4
+}
+
+func (tb fbTable) string(slot int) string {
+	n, p := tb.vector(slot)
+	return string(tb.buf[p : p+n])
+}
+
+func (tb fbTable) tables(slot int) []fbTable {
+	n, p := tb.vector(slot)
+	tables := make([]fbTable, n)
+	for i := range tables {
+		elem := p + 4*i
+		tables[i] = fbTable{buf: tb.buf, pos: elem + int(binary.LittleEndian.Uint32(tb.buf[elem:]))}
+	}
+	return tables
+}
+
+func TestFlatGeobufRoundTrip(t *testing.T) {
+	var out bytes.Buffer
+	w := newFlatGeobufWriter(&out)
+	for _, route := range testRoutes {
+		if err := w.Write(route); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	buf := out.Bytes()
+	if !bytes.HasPrefix(buf, fgbMagic) {
+		t.Fatalf("file starts with % x, want the FlatGeobuf magic bytes", buf[:min(len(buf), 8)])
+	}
+	buf = buf[len(fgbMagic):]
+
+	header, size := fbRoot(t, buf)
+	buf = buf[size:]
+	if got := header.string(0); got != "routes" {
+		t.Errorf("header name = %q, want routes", got)
+	}
+	if got := header.uint8(2); got != fgbLineString {
+		t.Errorf("geometry type = %d, want LineString", got)
+	}
+	if got := header.uint16(9); got != 0 {
+		t.Errorf("index_node_size = %d, want 0 (no spatial index)", got)
+	}
+	crs := header.table(10)
+	if org, code := crs.string(0), crs.int32(1); org != "EPSG" || code != 4326 {
+		t.Errorf("crs = %s:%d, want EPSG:4326", org, code)
+	}
+	columns := header.tables(7)
+	if len(columns) != len(fgbColumns) {
+		t.Fatalf("header has %d columns, want %d", len(columns), len(fgbColumns))
+	}
+	for i, c := range columns {
+		if name, colType := c.string(0), c.uint8(1); name != fgbColumns[i].name || colType != fgbColumns[i].colType {
+			t.Errorf("column %d = %s (type %d), want %s (type %d)", i, name, colType, fgbColumns[i].name, fgbColumns[i].colType)
+		}
+	}
+
+	for i, want := range testRoutes {
+		if len(buf) == 0 {
+			t.Fatalf("file ends after %d features, want %d", i, len(testRoutes))
+		}
+		feature, size := fbRoot(t, buf)
+		buf = buf[size:]
+
+		geometry := feature.table(0)
+		n, p := geometry.vector(1)
+		if n != 2*len(want.Points) {
+			t.Fatalf("feature %d has %d coordinates, want %d", i, n, 2*len(want.Points))
+		}
+		for j, point := range want.Points {
+			x := math.Float64frombits(binary.LittleEndian.Uint64(geometry.buf[p+16*j:]))
+			y := math.Float64frombits(binary.LittleEndian.Uint64(geometry.buf[p+16*j+8:]))
+			if x != point.Lng || y != point.Lat {
+				t.Errorf("feature %d point %d = (%v, %v), want (%v, %v)", i, j, x, y, point.Lng, point.Lat)
+			}
+		}
+
+		n, p = feature.vector(1)
+		got := fgbReadProperties(t, feature.buf[p:p+n])
+		if got != fgbTestProperties(want) {
+			t.Errorf("feature %d properties = %+v, want %+v", i, got, fgbTestProperties(want))
+		}
+	}
+	if len(buf) != 0 {
+		t.Errorf("%d bytes left after the features", len(buf))
+	}
+}
+
+// fgbProperties are the decoded property values of a feature.
+type fgbProperties struct {
+	ID          int64
+	Name        string
+	SportType   string
+	StartDate   string
+	ElapsedTime int32
+	MovingTime  int32
+	Distance    float64
+	Elevation   float64
+}
+
+func fgbTestProperties(route Route) fgbProperties {
+	return fgbProperties{
+		ID:          route.ID,
+		Name:        route.Name,
+		SportType:   route.SportType,
+		StartDate:   route.StartDate.UTC().Format(time.RFC3339),
+		ElapsedTime: route.ElapsedTime,
+		MovingTime:  route.MovingTime,
+		Distance:    route.Distance,
+		Elevation:   route.Elevation,
+	}
+}
+
+// fgbReadProperties decodes the properties by the column types of the header.
+func fgbReadProperties(t *testing.T, props []byte) fgbProperties {
+	t.Helper()
+	var p fgbProperties
+	for len(props) > 0 {
+		column := int(binary.LittleEndian.Uint16(props))
+		props = props[2:]
+		if column >= len(fgbColumns) {
+			t.Fatalf("property of unknown column %d", column)
+		}
+		var value any
+		switch fgbColumns[column].colType {
+		case fgbColumnInt:
+			value = int32(binary.LittleEndian.Uint32(props))
+			props = props[4:]
+		case fgbColumnLong:
+			value = int64(binary.LittleEndian.Uint64(props))
+			props = props[8:]
+		case fgbColumnDouble:
+			value = math.Float64frombits(binary.LittleEndian.Uint64(props))
+			props = props[8:]
+		case fgbColumnString, fgbColumnDateTime:
+			n := int(binary.LittleEndian.Uint32(props))
+			value = string(props[4 : 4+n])
+			props = props[4+n:]
+		}
+		switch fgbColumns[column].name {
+		case "id":
+			p.ID = value.(int64)
+		case "name":
+			p.Name = value.(string)
+		case "sport_type":
+			p.SportType = value.(string)
+		case "start_date":
+			p.StartDate = value.(string)
+		case "elapsed_time":
+			p.ElapsedTime = value.(int32)
+		case "moving_time":
+			p.MovingTime = value.(int32)
+		case "distance":
+			p.Distance = value.(float64)
+		case "elevation":
+			p.Elevation = value.(float64)
+		}
+	}
+	return p
+}
+
+func TestFlatGeobufEmpty(t *testing.T) {
+	var out bytes.Buffer
+	w := newFlatGeobufWriter(&out)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	buf := out.Bytes()
+	if !bytes.HasPrefix(buf, fgbMagic) {
+		t.Fatalf("file starts with % x, want the FlatGeobuf magic bytes", buf[:min(len(buf), 8)])
+	}
+	header, size := fbRoot(t, buf[len(fgbMagic):])
+	if len(fgbMagic)+size != len(buf) {
+		t.Errorf("file has %d bytes after the header, want none", len(buf)-len(fgbMagic)-size)
+	}
+	if got := len(header.tables(7)); got != len(fgbColumns) {
+		t.Errorf("header has %d columns, want %d", got, len(fgbColumns))
+	}
+}
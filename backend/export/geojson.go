@@ -0,0 +1,86 @@
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// geoJSONWriter writes the routes as a GeoJSON FeatureCollection of
+// LineStrings, one feature per route.
+type geoJSONWriter struct {
+	w        *bufio.Writer
+	features int
+}
+
+func newGeoJSONWriter(w io.Writer) *geoJSONWriter {
+	return &geoJSONWriter{w: bufio.NewWriter(w)}
+}
+
+type geoJSONFeature struct {
+	Type       string            `json:"type"`
+	ID         int64             `json:"id"`
+	Geometry   geoJSONLineString `json:"geometry"`
+	Properties geoJSONProperties `json:"properties"`
+}
+
+type geoJSONLineString struct {
+	Type        string      `json:"type"`
+	Coordinates [][]float64 `json:"coordinates"`
+}
+
+type geoJSONProperties struct {
+	Name        string    `json:"name"`
+	SportType   string    `json:"sport_type"`
+	StartDate   time.Time `json:"start_date"`
+	ElapsedTime int32     `json:"elapsed_time"`
+	MovingTime  int32     `json:"moving_time"`
+	Distance    float64   `json:"distance"`
+	Elevation   float64   `json:"elevation"`
+}
+
+func (g *geoJSONWriter) Write(route Route) error {
+	if g.features == 0 {
+		g.w.WriteString(`{"type":"FeatureCollection","features":[` + "\n")
+	} else {
+		g.w.WriteString(",\n")
+	}
+	g.features++
+
+	coords := make([][]float64, len(route.Points))
+	for i, p := range route.Points {
+		if p.HasEle {
+			coords[i] = []float64{p.Lng, p.Lat, p.Elevation}
+		} else {
+			coords[i] = []float64{p.Lng, p.Lat}
+		}
+	}
+	feature, err := json.Marshal(geoJSONFeature{
+		Type:     "Feature",
+		ID:       route.ID,
+		Geometry: geoJSONLineString{Type: "LineString", Coordinates: coords},
+		Properties: geoJSONProperties{
+			Name:        route.Name,
+			SportType:   route.SportType,
+			StartDate:   route.StartDate,
+			ElapsedTime: route.ElapsedTime,
+			MovingTime:  route.MovingTime,
+			Distance:    route.Distance,
+			Elevation:   route.Elevation,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = g.w.Write(feature)
+	return err
+}
+
+func (g *geoJSONWriter) Close() error {
+	if g.features == 0 {
+		g.w.WriteString(`{"type":"FeatureCollection","features":[`)
+	}
+	g.w.WriteString("\n]}\n")
+	return g.w.Flush()
+}
@@ -0,0 +1,190 @@
+package export
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	_ "modernc.org/sqlite" // SQLite driver
+)
+
+// geoPackageSchema creates the minimal GeoPackage 1.3 tables and the routes
+// feature table.
+const geoPackageSchema = `
+PRAGMA application_id = 1196444487;
+PRAGMA user_version = 10300;
+
+CREATE TABLE gpkg_spatial_ref_sys (
+    srs_name                 TEXT NOT NULL,
+    srs_id                   INTEGER PRIMARY KEY,
+    organization             TEXT NOT NULL,
+    organization_coordsys_id INTEGER NOT NULL,
+    definition               TEXT NOT NULL,
+    description              TEXT
+);
+
+INSERT INTO gpkg_spatial_ref_sys VALUES
+    ('Undefined cartesian SRS', -1, 'NONE', -1, 'undefined', 'undefined cartesian coordinate reference system'),
+    ('Undefined geographic SRS', 0, 'NONE', 0, 'undefined', 'undefined geographic coordinate reference system'),
+    ('WGS 84 geodetic', 4326, 'EPSG', 4326, 'GEOGCS["WGS 84",DATUM["WGS_1984",SPHEROID["WGS 84",6378137,298.257223563,AUTHORITY["EPSG","7030"]],AUTHORITY["EPSG","6326"]],PRIMEM["Greenwich",0,AUTHORITY["EPSG","8901"]],UNIT["degree",0.0174532925199433,AUTHORITY["EPSG","9122"]],AUTHORITY["EPSG","4326"]]', 'longitude/latitude coordinates in decimal degrees on the WGS 84 spheroid');
+
+CREATE TABLE gpkg_contents (
+    table_name  TEXT NOT NULL PRIMARY KEY,
+    data_type   TEXT NOT NULL,
+    identifier  TEXT UNIQUE,
+    description TEXT DEFAULT '',
+    last_change DATETIME NOT NULL DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+    min_x       DOUBLE,
+    min_y       DOUBLE,
+    max_x       DOUBLE,
+    max_y       DOUBLE,
+    srs_id      INTEGER,
+    CONSTRAINT fk_gc_r_srs_id FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys(srs_id)
+);
+
+CREATE TABLE gpkg_geometry_columns (
+    table_name         TEXT NOT NULL,
+    column_name        TEXT NOT NULL,
+    geometry_type_name TEXT NOT NULL,
+    srs_id             INTEGER NOT NULL,
+    z                  TINYINT NOT NULL,
+    m                  TINYINT NOT NULL,
+    CONSTRAINT pk_geom_cols PRIMARY KEY (table_name, column_name),
+    CONSTRAINT fk_gc_tn FOREIGN KEY (table_name) REFERENCES gpkg_contents(table_name),
+    CONSTRAINT fk_gc_srs FOREIGN KEY (srs_id) REFERENCES gpkg_spatial_ref_sys (srs_id)
+);
+
+CREATE TABLE routes (
+    fid          INTEGER PRIMARY KEY AUTOINCREMENT,
+    geom         LINESTRING,
+    id           INTEGER NOT NULL,
+    name         TEXT NOT NULL,
+    sport_type   TEXT,
+    start_date   DATETIME NOT NULL,
+    elapsed_time INTEGER NOT NULL,
+    moving_time  INTEGER NOT NULL,
+    distance     DOUBLE NOT NULL,
+    elevation    DOUBLE NOT NULL
+);
+
+INSERT INTO gpkg_contents (table_name, data_type, identifier, srs_id) VALUES ('routes', 'features', 'routes', 4326);
+INSERT INTO gpkg_geometry_columns VALUES ('routes', 'geom', 'LINESTRING', 4326, 0, 0);
+`
+
+// geoPackageWriter writes the routes into a GeoPackage. SQLite needs a file to
+// work on, so the routes are written to a temporary file that is copied to the
+// output on Close.
+type geoPackageWriter struct {
+	w    io.Writer
+	file string
+	db   *sql.DB
+	tx   *sql.Tx
+
+	// The extent of all routes, stored in gpkg_contents.
+	empty                  bool
+	minX, minY, maxX, maxY float64
+}
+
+func newGeoPackageWriter(w io.Writer) (*geoPackageWriter, error) {
+	f, err := os.CreateTemp("", "wanderwell-*.gpkg")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	f.Close()
+
+	g := &geoPackageWriter{w: w, file: f.Name(), empty: true}
+	g.db, err = sql.Open("sqlite", g.file)
+	if err != nil {
+		os.Remove(g.file)
+		return nil, fmt.Errorf("failed to open GeoPackage: %w", err)
+	}
+	if _, err := g.db.Exec(geoPackageSchema); err != nil {
+		g.cleanup()
+		return nil, fmt.Errorf("failed to create GeoPackage tables: %w", err)
+	}
+	g.tx, err = g.db.Begin()
+	if err != nil {
+		g.cleanup()
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	return g, nil
+}
+
+func (g *geoPackageWriter) Write(route Route) error {
+	minX, minY, maxX, maxY := route.bounds()
+	if g.empty {
+		g.minX, g.minY, g.maxX, g.maxY = minX, minY, maxX, maxY
+		g.empty = false
+	} else {
+		g.minX, g.minY = min(g.minX, minX), min(g.minY, minY)
+		g.maxX, g.maxY = max(g.maxX, maxX), max(g.maxY, maxY)
+	}
+
+	var sportType sql.NullString
+	if route.SportType != "" {
+		sportType = sql.NullString{String: route.SportType, Valid: true}
+	}
+	_, err := g.tx.Exec(`INSERT INTO routes (geom, id, name, sport_type, start_date, elapsed_time, moving_time, distance, elevation)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		geoPackageLineString(route, minX, minY, maxX, maxY), route.ID, route.Name, sportType,
+		route.StartDate.UTC().Format(time.RFC3339), route.ElapsedTime, route.MovingTime, route.Distance, route.Elevation,
+	)
+	return err
+}
+
+func (g *geoPackageWriter) Close() error {
+	defer g.cleanup()
+
+	if !g.empty {
+		_, err := g.tx.Exec("UPDATE gpkg_contents SET min_x = ?, min_y = ?, max_x = ?, max_y = ? WHERE table_name = 'routes'",
+			g.minX, g.minY, g.maxX, g.maxY)
+		if err != nil {
+			return fmt.Errorf("failed to update extent: %w", err)
+		}
+	}
+	if err := g.tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit GeoPackage: %w", err)
+	}
+	if err := g.db.Close(); err != nil {
+		return fmt.Errorf("failed to close GeoPackage: %w", err)
+	}
+
+	f, err := os.Open(g.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(g.w, f)
+	return err
+}
+
+// cleanup closes the database and removes the temporary file.
+func (g *geoPackageWriter) cleanup() {
+	g.db.Close()
+	os.Remove(g.file)
+}
+
+// geoPackageLineString encodes the route as a GeoPackage geometry blob: the
+// "GP" header with the SRS and envelope, followed by a little-endian WKB
+// LineString.
+func geoPackageLineString(route Route, minX, minY, maxX, maxY float64) []byte {
+	blob := make([]byte, 0, 8+32+9+16*len(route.Points))
+	blob = append(blob, 'G', 'P', 0, 0x03) // version 1, little endian, XY envelope
+	blob = binary.LittleEndian.AppendUint32(blob, 4326)
+	for _, v := range []float64{minX, maxX, minY, maxY} {
+		blob = binary.LittleEndian.AppendUint64(blob, math.Float64bits(v))
+	}
+
+	blob = append(blob, 1) // little endian
+	blob = binary.LittleEndian.AppendUint32(blob, 2)
+	blob = binary.LittleEndian.AppendUint32(blob, uint32(len(route.Points)))
+	for _, p := range route.Points {
+		blob = binary.LittleEndian.AppendUint64(blob, math.Float64bits(p.Lng))
+		blob = binary.LittleEndian.AppendUint64(blob, math.Float64bits(p.Lat))
+	}
+	return blob
+}
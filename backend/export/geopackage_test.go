@@ -0,0 +1,177 @@
+package export
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readGeoPackage writes the GeoPackage to a file and opens it.
+func readGeoPackage(t *testing.T, data []byte) *sql.DB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "routes.gpkg")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestGeoPackageRoundTrip(t *testing.T) {
+	var out bytes.Buffer
+	w, err := newGeoPackageWriter(&out)
+	if err != nil {
+		t.Fatalf("newGeoPackageWriter: %v", err)
+	}
+	for _, route := range testRoutes {
+		if err := w.Write(route); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if !bytes.HasPrefix(out.Bytes(), []byte("SQLite format 3\x00")) {
+		t.Fatal("output is not an SQLite database")
+	}
+	db := readGeoPackage(t, out.Bytes())
+
+	var applicationID, userVersion int
+	if err := db.QueryRow("PRAGMA application_id").Scan(&applicationID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow("PRAGMA user_version").Scan(&userVersion); err != nil {
+		t.Fatal(err)
+	}
+	if applicationID != 0x47504B47 || userVersion != 10300 {
+		t.Errorf("application_id = %#x, user_version = %d, want GPKG 1.3", applicationID, userVersion)
+	}
+	var check string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&check); err != nil || check != "ok" {
+		t.Errorf("integrity_check = %q, %v", check, err)
+	}
+
+	var minX, minY, maxX, maxY float64
+	err = db.QueryRow("SELECT min_x, min_y, max_x, max_y FROM gpkg_contents WHERE table_name = 'routes' AND srs_id = 4326").
+		Scan(&minX, &minY, &maxX, &maxY)
+	if err != nil {
+		t.Fatalf("failed to read the routes contents: %v", err)
+	}
+	if minX != 11.2 || minY != 47.1 || maxX != 13.42 || maxY != 52.53 {
+		t.Errorf("extent = (%v, %v, %v, %v), want (11.2, 47.1, 13.42, 52.53)", minX, minY, maxX, maxY)
+	}
+
+	rows, err := db.Query(`SELECT geom, id, name, sport_type, start_date, elapsed_time, moving_time, distance, elevation
+		FROM routes ORDER BY fid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var i int
+	for ; rows.Next(); i++ {
+		var (
+			geom      []byte
+			got       Route
+			sportType sql.NullString
+			startDate string
+		)
+		err := rows.Scan(&geom, &got.ID, &got.Name, &sportType, &startDate, &got.ElapsedTime, &got.MovingTime, &got.Distance, &got.Elevation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(testRoutes) {
+			t.Fatalf("GeoPackage has more than %d routes", len(testRoutes))
+		}
+		want := testRoutes[i]
+		got.SportType = sportType.String
+		if sportType.Valid != (want.SportType != "") {
+			t.Errorf("route %d sport_type = %v, want %q", i, sportType, want.SportType)
+		}
+		got.StartDate, err = time.Parse(time.RFC3339, startDate)
+		if err != nil {
+			t.Errorf("route %d start_date %q: %v", i, startDate, err)
+		}
+		got.Points = geoPackageTestPoints(t, geom, want)
+		if got.ID != want.ID || got.Name != want.Name || got.SportType != want.SportType || !got.StartDate.Equal(want.StartDate) ||
+			got.ElapsedTime != want.ElapsedTime || got.MovingTime != want.MovingTime ||
+			got.Distance != want.Distance || got.Elevation != want.Elevation {
+			t.Errorf("route %d = %+v, want %+v", i, got, want)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(testRoutes) {
+		t.Errorf("GeoPackage has %d routes, want %d", i, len(testRoutes))
+	}
+}
+
+// geoPackageTestPoints decodes the geometry blob and checks its header and
+// points against the route.
+func geoPackageTestPoints(t *testing.T, geom []byte, want Route) []Point {
+	t.Helper()
+	if len(geom) < 8+32+9 || string(geom[:2]) != "GP" || geom[2] != 0 || geom[3] != 0x03 {
+		t.Fatalf("route %d geometry has an invalid header: % x", want.ID, geom[:min(len(geom), 8)])
+	}
+	if srs := binary.LittleEndian.Uint32(geom[4:]); srs != 4326 {
+		t.Errorf("route %d geometry srs_id = %d, want 4326", want.ID, srs)
+	}
+	float := func(p int) float64 { return math.Float64frombits(binary.LittleEndian.Uint64(geom[p:])) }
+	minX, minY, maxX, maxY := want.bounds()
+	if float(8) != minX || float(16) != maxX || float(24) != minY || float(32) != maxY {
+		t.Errorf("route %d envelope = (%v, %v, %v, %v), want (%v, %v, %v, %v)",
+			want.ID, float(8), float(16), float(24), float(32), minX, maxX, minY, maxY)
+	}
+
+	wkb := geom[40:]
+	if wkb[0] != 1 || binary.LittleEndian.Uint32(wkb[1:]) != 2 {
+		t.Fatalf("route %d geometry is not a little-endian WKB LineString: % x", want.ID, wkb[:5])
+	}
+	n := int(binary.LittleEndian.Uint32(wkb[5:]))
+	if len(wkb) != 9+16*n {
+		t.Fatalf("route %d geometry has %d bytes for %d points", want.ID, len(wkb), n)
+	}
+	points := make([]Point, n)
+	for i := range points {
+		points[i] = Point{Lng: float(40 + 9 + 16*i), Lat: float(40 + 9 + 16*i + 8)}
+	}
+	if len(points) != len(want.Points) {
+		t.Errorf("route %d has %d points, want %d", want.ID, len(points), len(want.Points))
+	}
+	for i := range min(len(points), len(want.Points)) {
+		if points[i] != want.Points[i] {
+			t.Errorf("route %d point %d = %+v, want %+v", want.ID, i, points[i], want.Points[i])
+		}
+	}
+	return points
+}
+
+func TestGeoPackageEmpty(t *testing.T) {
+	var out bytes.Buffer
+	w, err := newGeoPackageWriter(&out)
+	if err != nil {
+		t.Fatalf("newGeoPackageWriter: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	db := readGeoPackage(t, out.Bytes())
+	var count int
+	if err := db.QueryRow("SELECT count(*) FROM routes").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("empty GeoPackage has %d routes", count)
+	}
+}
@@ -0,0 +1,67 @@
+package export
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// gpxWriter writes each route as a GPX 1.1 track. The track points carry
+// elevation and time when the route's streams are stored.
+type gpxWriter struct {
+	w      *bufio.Writer
+	header bool
+}
+
+func newGPXWriter(w io.Writer) *gpxWriter {
+	return &gpxWriter{w: bufio.NewWriter(w)}
+}
+
+func (g *gpxWriter) writeHeader() {
+	if g.header {
+		return
+	}
+	g.header = true
+	g.w.WriteString(xml.Header)
+	g.w.WriteString(`<gpx version="1.1" creator="Wanderwell" xmlns="http://www.topografix.com/GPX/1/1">` + "\n")
+}
+
+func (g *gpxWriter) Write(route Route) error {
+	g.writeHeader()
+
+	g.w.WriteString("<trk>\n<name>")
+	xml.EscapeText(g.w, []byte(route.Name))
+	g.w.WriteString("</name>\n")
+	if route.SportType != "" {
+		g.w.WriteString("<type>")
+		xml.EscapeText(g.w, []byte(route.SportType))
+		g.w.WriteString("</type>\n")
+	}
+	g.w.WriteString("<trkseg>\n")
+	for _, p := range route.Points {
+		fmt.Fprintf(g.w, `<trkpt lat="%s" lon="%s">`, formatCoord(p.Lat), formatCoord(p.Lng))
+		if p.HasEle {
+			fmt.Fprintf(g.w, "<ele>%s</ele>", strconv.FormatFloat(p.Elevation, 'f', 1, 64))
+		}
+		if !p.Time.IsZero() {
+			fmt.Fprintf(g.w, "<time>%s</time>", p.Time.UTC().Format(time.RFC3339))
+		}
+		g.w.WriteString("</trkpt>\n")
+	}
+	_, err := g.w.WriteString("</trkseg>\n</trk>\n")
+	return err
+}
+
+func (g *gpxWriter) Close() error {
+	g.writeHeader()
+	g.w.WriteString("</gpx>\n")
+	return g.w.Flush()
+}
+
+// formatCoord formats a latitude or longitude with ~1cm precision.
+func formatCoord(v float64) string {
+	return strconv.FormatFloat(v, 'f', 7, 64)
+}
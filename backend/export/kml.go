@@ -0,0 +1,78 @@
+package export
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// kmlWriter writes each route as a KML placemark with a LineString. The
+// coordinates include the altitude when the route's streams are stored.
+type kmlWriter struct {
+	w      *bufio.Writer
+	header bool
+}
+
+func newKMLWriter(w io.Writer) *kmlWriter {
+	return &kmlWriter{w: bufio.NewWriter(w)}
+}
+
+func (k *kmlWriter) writeHeader() {
+	if k.header {
+		return
+	}
+	k.header = true
+	k.w.WriteString(xml.Header)
+	k.w.WriteString(`<kml xmlns="http://www.opengis.net/kml/2.2">` + "\n<Document>\n<name>Wanderwell routes</name>\n")
+}
+
+func (k *kmlWriter) Write(route Route) error {
+	k.writeHeader()
+
+	k.w.WriteString("<Placemark>\n<name>")
+	xml.EscapeText(k.w, []byte(route.Name))
+	k.w.WriteString("</name>\n")
+	fmt.Fprintf(k.w, "<TimeStamp><when>%s</when></TimeStamp>\n", route.StartDate.UTC().Format(time.RFC3339))
+
+	k.w.WriteString("<ExtendedData>\n")
+	k.writeData("id", strconv.FormatInt(route.ID, 10))
+	k.writeData("sport_type", route.SportType)
+	k.writeData("distance", strconv.FormatFloat(route.Distance, 'f', -1, 64))
+	k.writeData("elevation", strconv.FormatFloat(route.Elevation, 'f', -1, 64))
+	k.writeData("moving_time", strconv.Itoa(int(route.MovingTime)))
+	k.w.WriteString("</ExtendedData>\n")
+
+	hasEle := len(route.Points) > 0 && route.Points[0].HasEle
+	if hasEle {
+		k.w.WriteString("<LineString>\n<altitudeMode>absolute</altitudeMode>\n<coordinates>\n")
+	} else {
+		k.w.WriteString("<LineString>\n<coordinates>\n")
+	}
+	for _, p := range route.Points {
+		k.w.WriteString(formatCoord(p.Lng))
+		k.w.WriteByte(',')
+		k.w.WriteString(formatCoord(p.Lat))
+		if hasEle {
+			k.w.WriteByte(',')
+			k.w.WriteString(strconv.FormatFloat(p.Elevation, 'f', 1, 64))
+		}
+		k.w.WriteByte('\n')
+	}
+	_, err := k.w.WriteString("</coordinates>\n</LineString>\n</Placemark>\n")
+	return err
+}
+
+func (k *kmlWriter) writeData(name, value string) {
+	fmt.Fprintf(k.w, `<Data name="%s"><value>`, name)
+	xml.EscapeText(k.w, []byte(value))
+	k.w.WriteString("</value></Data>\n")
+}
+
+func (k *kmlWriter) Close() error {
+	k.writeHeader()
+	k.w.WriteString("</Document>\n</kml>\n")
+	return k.w.Flush()
+}
@@ -2,14 +2,20 @@ package main
 
 import (
 	"context"
-	_ "embed"
 	"fmt"
 	"io"
 	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 	"wanderwell/backend/api"
 	"wanderwell/backend/config"
+	"wanderwell/backend/db"
 	"wanderwell/backend/strava"
+	"wanderwell/backend/tiles"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/markbates/goth"
@@ -32,19 +38,43 @@ func initDB(databasePath string) (*pgxpool.Pool, error) {
 	return pool, nil
 }
 
-//go:embed db/schema.sql
-var schemaSQL string
-
 func ensureSchema(pool *pgxpool.Pool) error {
-	_, err := pool.Exec(context.Background(), schemaSQL)
+	_, err := pool.Exec(context.Background(), db.Schema)
 	if err != nil {
 		return fmt.Errorf("failed to create schema: %w", err)
 	}
-	slog.Info("DB schema ensured")
+	if err := db.New(pool).RecordSchemaVersion(context.Background(), db.SchemaVersion()); err != nil {
+		return fmt.Errorf("failed to record schema version: %w", err)
+	}
+	slog.Info("DB schema ensured", "version", db.SchemaVersion())
 	return nil
 }
 
+// healthcheck probes the /healthz endpoint of the server listening on addr and
+// returns the exit code for the Docker healthcheck, as the distroless image
+// has no curl.
+func healthcheck(addr string) int {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	client := &http.Client{Timeout: 3 * time.Second}
+	resp, err := client.Get("http://" + addr + "/healthz")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, resp.Status)
+		return 1
+	}
+	return 0
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "healthcheck" {
+		os.Exit(healthcheck(os.Getenv("SERVER_PORT")))
+	}
 
 	file, err := os.OpenFile("app.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
@@ -84,7 +114,16 @@ func main() {
 		gothstrava.New(cfg.StravaClientID, cfg.StravaClientSecret, cfg.RedirectURI, scope),
 	)
 
-	if err := api.NewServer(db, cacheUpdater, cfg.FrontendURL, cfg.VerifyToken, cfg.TileCacheURL, cfg.AdminUserID).Start(cfg.ServerPort); err != nil {
-		slog.Error("Error starting server", "err", err)
+	var tileCache *tiles.Cache
+	if cfg.ServeTiles {
+		tileCache = tiles.NewCache(cfg.TileMemoryCacheMB << 20)
+	}
+
+	// Shut down gracefully on docker stop (SIGTERM) or Ctrl-C.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := api.NewServer(db, cacheUpdater, cfg.FrontendURL, cfg.VerifyToken, cfg.TileCacheURL, cfg.AdminUserID, cfg.TileSigningKey, tileCache, cfg.MetricsToken).Start(ctx, cfg.ServerPort); err != nil {
+		slog.Error("Error running server", "err", err)
 	}
 }
@@ -0,0 +1,279 @@
+// Package metrics keeps counters, histograms and gauges and writes them in the
+// Prometheus text exposition format. Metrics register themselves in a single
+// registry when they are created, usually as package variables next to the
+// code that updates them.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is a metric family that can write its samples.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	// by name
+	registry = make(map[string]metric)
+)
+
+// register adds a metric to the registry. It panics if the name is already
+// registered, as two families of the same name can't be exposed.
+func register(name string, m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("metrics: %s is already registered", name))
+	}
+	registry[name] = m
+}
+
+// Write writes all metrics in the Prometheus text format, sorted by name.
+func Write(w io.Writer) error {
+	registryMu.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	metrics := make([]metric, len(names))
+	sort.Strings(names)
+	for i, name := range names {
+		metrics[i] = registry[name]
+	}
+	registryMu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help), name, kind)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats label pairs like {method="GET",route="/me"}, with
+// extra pairs (name, value, ...) appended.
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	pair := func(name, value string) {
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelValueEscaper.Replace(value))
+		b.WriteByte('"')
+	}
+	for i, name := range names {
+		pair(name, values[i])
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pair(extra[i], extra[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// labelKey joins label values into a map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func checkLabels(name string, labels, values []string) {
+	if len(values) != len(labels) {
+		panic(fmt.Sprintf("metrics: %s takes labels %v, got values %v", name, labels, values))
+	}
+}
+
+// Counter is a counter with labels, e.g. requests by status.
+type Counter struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+// NewCounter creates and registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]*counterValue)}
+	register(name, c)
+	return c
+}
+
+// Inc adds one to the counter of the label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds a non-negative delta to the counter of the label values.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	checkLabels(c.name, c.labels, labelValues)
+	key := labelKey(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labelValues: slices.Clone(labelValues)}
+		c.values[key] = v
+	}
+	v.value += delta
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, v.labelValues), formatValue(v.value))
+	}
+}
+
+// Histogram counts observations, e.g. durations in seconds, in buckets, with
+// labels.
+type Histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	// per bucket, not cumulative; the last one is +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// DefaultBuckets suit request durations in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// NewHistogram creates and registers a histogram with the given upper bounds
+// of the buckets (in increasing order) and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+	register(name, h)
+	return h
+}
+
+// Observe adds an observation to the histogram of the label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	checkLabels(h.name, h.labels, labelValues)
+	key := labelKey(labelValues)
+	bucket, _ := slices.BinarySearch(h.buckets, value)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{labelValues: slices.Clone(labelValues), counts: make([]uint64, len(h.buckets)+1)}
+		h.values[key] = v
+	}
+	v.counts[bucket]++
+	v.sum += value
+	v.count++
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		var cumulative uint64
+		for i, count := range v.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, v.labelValues, "le", formatValue(le)), cumulative)
+		}
+		labels := formatLabels(h.labels, v.labelValues)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatValue(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, v.count)
+	}
+}
+
+// SetFunc sets the value of a sample of a Func metric.
+type SetFunc func(value float64, labelValues ...string)
+
+// Func is a gauge or counter whose samples are read when the metrics are
+// written, e.g. from the state of a connection pool.
+type Func struct {
+	name, help, kind string
+	labels           []string
+	collect          func(set SetFunc)
+}
+
+// NewGaugeFunc creates and registers a gauge whose samples collect sets.
+func NewGaugeFunc(name, help string, labels []string, collect func(set SetFunc)) *Func {
+	f := &Func{name: name, help: help, kind: "gauge", labels: labels, collect: collect}
+	register(name, f)
+	return f
+}
+
+// NewCounterFunc creates and registers a counter whose samples collect sets,
+// for counters kept elsewhere.
+func NewCounterFunc(name, help string, labels []string, collect func(set SetFunc)) *Func {
+	f := &Func{name: name, help: help, kind: "counter", labels: labels, collect: collect}
+	register(name, f)
+	return f
+}
+
+func (f *Func) write(w *bufio.Writer) {
+	writeHeader(w, f.name, f.help, f.kind)
+	f.collect(func(value float64, labelValues ...string) {
+		checkLabels(f.name, f.labels, labelValues)
+		fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, labelValues), formatValue(value))
+	})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+)
+
+// useTestRegistry replaces the registry with an empty one for the test, so
+// that the output only has the metrics the test registers.
+func useTestRegistry(t *testing.T) {
+	t.Helper()
+	registryMu.Lock()
+	saved := registry
+	registry = make(map[string]metric)
+	registryMu.Unlock()
+	t.Cleanup(func() {
+		registryMu.Lock()
+		registry = saved
+		registryMu.Unlock()
+	})
+}
+
+func writeAll(t *testing.T) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return buf.String()
+}
+
+func TestWrite(t *testing.T) {
+	useTestRegistry(t)
+
+	requests := NewCounter("test_requests_total", "Requests by method\nand status.", "method", "status")
+	requests.Inc("GET", "200")
+	requests.Inc("GET", "200")
+	requests.Add(0.5, "POST", `5"0\0`)
+	NewGaugeFunc("test_pool_connections", `Connections by state, with a \ in the help.`, []string{"state"}, func(set SetFunc) {
+		set(3, "idle")
+		set(math.Inf(1), "busy")
+	})
+	NewCounterFunc("test_acquires_total", "Acquires without labels.", nil, func(set SetFunc) {
+		set(1e21)
+	})
+	NewCounter("test_unused_total", "A counter without samples.")
+
+	const want = `# HELP test_acquires_total Acquires without labels.
+# TYPE test_acquires_total counter
+test_acquires_total 1e+21
+# HELP test_pool_connections Connections by state, with a \\ in the help.
+# TYPE test_pool_connections gauge
+test_pool_connections{state="idle"} 3
+test_pool_connections{state="busy"} +Inf
+# HELP test_requests_total Requests by method\nand status.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",status="200"} 2
+test_requests_total{method="POST",status="5\"0\\0"} 0.5
+# HELP test_unused_total A counter without samples.
+# TYPE test_unused_total counter
+`
+	if got := writeAll(t); got != want {
+		t.Errorf("Write() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	useTestRegistry(t)
+
+	h := NewHistogram("test_duration_seconds", "Durations.", []float64{0.1, 0.5, 1}, "job")
+	// The upper bounds are inclusive, like Prometheus' le.
+	for _, v := range []float64{0.05, 0.1, 0.3, 0.5, 0.7, 2} {
+		h.Observe(v, "sync")
+	}
+	h.Observe(1, "purge")
+
+	const want = `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{job="purge",le="0.1"} 0
+test_duration_seconds_bucket{job="purge",le="0.5"} 0
+test_duration_seconds_bucket{job="purge",le="1"} 1
+test_duration_seconds_bucket{job="purge",le="+Inf"} 1
+test_duration_seconds_sum{job="purge"} 1
+test_duration_seconds_count{job="purge"} 1
+test_duration_seconds_bucket{job="sync",le="0.1"} 2
+test_duration_seconds_bucket{job="sync",le="0.5"} 4
+test_duration_seconds_bucket{job="sync",le="1"} 5
+test_duration_seconds_bucket{job="sync",le="+Inf"} 6
+test_duration_seconds_sum{job="sync"} 3.65
+test_duration_seconds_count{job="sync"} 6
+`
+	if got := writeAll(t); got != want {
+		t.Errorf("Write() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	useTestRegistry(t)
+
+	NewCounter("test_total", "First.")
+	defer func() {
+		if recover() == nil {
+			t.Error("registering test_total again didn't panic")
+		}
+	}()
+	NewGaugeFunc("test_total", "Second.", nil, func(SetFunc) {})
+}
+
+func TestWrongLabelsPanic(t *testing.T) {
+	useTestRegistry(t)
+
+	c := NewCounter("test_total", "Requests.", "method")
+	defer func() {
+		if recover() == nil {
+			t.Error("Inc with two label values for one label didn't panic")
+		}
+	}()
+	c.Inc("GET", "200")
+}
@@ -122,6 +122,7 @@ func (api *StravaAPI) GetAthleteSummaryActivitiesByPage(athleteID int64, page in
 	}
 	ctx := context.WithValue(context.Background(), swagger.ContextAccessToken, accessToken)
 	activities, resp, err := api.apiClient.ActivitiesApi.GetLoggedInAthleteActivities(ctx, opts)
+	observeStravaRequest("list_activities", resp)
 	api.RateLimit.UpdateRateLimit(resp)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
@@ -163,6 +164,7 @@ func (api *StravaAPI) UpdateActivityDescription(activityID int64, athleteID int6
 		Body: optional.NewInterface(swagger.UpdatableActivity{Description: description}),
 	}
 	_, resp, err := api.apiClient.ActivitiesApi.UpdateActivityById(ctx, activityID, opts)
+	observeStravaRequest("update_activity", resp)
 	api.RateLimit.UpdateRateLimit(resp)
 	if err != nil {
 		return fmt.Errorf("failed to update activity description for ID %d: %w", activityID, err)
@@ -193,6 +195,7 @@ func (api *StravaAPI) GetDetailedActivityByID(activityID int64, athleteID int64)
 
 	ctx := context.WithValue(context.Background(), swagger.ContextAccessToken, accessToken)
 	detailedActivity, resp, err := api.apiClient.ActivitiesApi.GetActivityById(ctx, activityID, nil)
+	observeStravaRequest("get_activity", resp)
 	api.RateLimit.UpdateRateLimit(resp)
 	if err != nil {
 		if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
@@ -215,3 +218,36 @@ func (api *StravaAPI) GetDetailedActivityByID(activityID int64, athleteID int64)
 
 	return &detailedActivity, nil
 }
+
+// GetActivityStreams fetches the time, distance, latlng and altitude streams of an activity.
+func (api *StravaAPI) GetActivityStreams(activityID int64, athleteID int64) (*swagger.StreamSet, error) {
+	slog.Info("Fetching activity streams", "activityID", activityID)
+	accessToken, err := api.GetAthleteAccessToken(athleteID)
+	if err != nil {
+		return nil, err
+	}
+
+	limitType := api.RateLimit.IsRateLimitExceeded()
+	if limitType != RateLimitNone {
+		slog.Info("Rate limit exceeded", "limitType", limitType)
+		api.RateLimit.WaitForRateLimitReset(limitType)
+	}
+
+	ctx := context.WithValue(context.Background(), swagger.ContextAccessToken, accessToken)
+	streams, resp, err := api.apiClient.StreamsApi.GetActivityStreams(ctx, activityID, []string{"time", "distance", "latlng", "altitude"}, true)
+	observeStravaRequest("get_activity_streams", resp)
+	api.RateLimit.UpdateRateLimit(resp)
+	if err != nil {
+		slog.Error("Failed to get activity streams", "activityID", activityID, "error", err)
+		return nil, fmt.Errorf("failed to get activity streams for ID %d: %w", activityID, err)
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("no response from Strava for activity streams ID %d", activityID)
+	}
+	if resp.StatusCode != http.StatusOK {
+		slog.Error("Failed to get activity streams", "activityID", activityID, "status", resp.StatusCode)
+		return nil, fmt.Errorf("API request for activity streams failed with status: %d", resp.StatusCode)
+	}
+
+	return &streams, nil
+}
@@ -5,7 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"sync"
+	"time"
 	"wanderwell/backend/config"
 	"wanderwell/backend/db"
 	"wanderwell/backend/models"
@@ -48,7 +50,10 @@ func (cu *CacheUpdater) GetUserIDs() ([]int64, error) {
 // UpdateActivityCache fetches all activities for a user and updates the local cache (database)
 // by checking for new activities. This is meant to do the initial population of the cache.
 // Afterwards, a webhook should be used to get real-time updates.
-func (cu *CacheUpdater) UpdateActivityCache(userID int64) error {
+// Once ctx is cancelled it stops before the next missing activity and returns
+// ctx.Err(); the activities added so far are kept, and the rest are added by
+// the next sync.
+func (cu *CacheUpdater) UpdateActivityCache(ctx context.Context, userID int64) error {
 	slog.Info("Updating activity cache for user", "userID", userID)
 
 	activities, err := cu.GetAllUserActivities(userID, 0)
@@ -56,6 +61,8 @@ func (cu *CacheUpdater) UpdateActivityCache(userID int64) error {
 		return err
 	}
 
+	var missing []swagger.SummaryActivity
+	var latestExisting time.Time
 	for _, activity := range activities {
 
 		// Skip activities with empty polyline
@@ -65,56 +72,164 @@ func (cu *CacheUpdater) UpdateActivityCache(userID int64) error {
 		}
 
 		// Check if activity already exists in the database and add it if not
-		currentName, err := cu.queries.GetRouteName(context.Background(), db.GetRouteNameParams{
+		current, err := cu.queries.GetRouteSummary(context.Background(), db.GetRouteSummaryParams{
 			ID:     activity.Id,
 			UserID: userID,
 		})
 		if err != nil {
 			if err == pgx.ErrNoRows {
-				// Can be a go-routine once rate limiting in concurrent calls is handled
-				cu.AddDetailedActivity(activity.Id, userID)
+				missing = append(missing, activity)
 				continue
 			}
 			slog.Error("Failed to check activity existence", "error", err, "activityID", activity.Id)
 			return err
 		}
-		// Update activity name if it has changed
-		if currentName != activity.Name {
-			slog.Info("Activity name changed, updating", "activityID", activity.Id, "oldName", currentName, "newName", activity.Name)
+		if activity.StartDate.After(latestExisting) {
+			latestExisting = activity.StartDate
+		}
+		// Update the activity if its name or flags changed. This also fills in
+		// the sport type and flags of routes stored before they were synced.
+		summary := db.GetRouteSummaryRow{
+			Name:      activity.Name,
+			SportType: sportTypeText(activity.SportType),
+			Commute:   activity.Commute,
+			Trainer:   activity.Trainer,
+			Private:   activity.Private,
+		}
+		if current != summary {
+			slog.Info("Activity summary changed, updating", "activityID", activity.Id, "oldName", current.Name, "newName", activity.Name)
 			cu.dbMutex.Lock()
-			err = cu.queries.UpdateRouteName(context.Background(), db.UpdateRouteNameParams{
-				Name:   activity.Name,
-				ID:     activity.Id,
-				UserID: userID,
+			err = cu.queries.UpdateRouteSummary(context.Background(), db.UpdateRouteSummaryParams{
+				Name:      summary.Name,
+				SportType: summary.SportType,
+				Commute:   summary.Commute,
+				Trainer:   summary.Trainer,
+				Private:   summary.Private,
+				ID:        activity.Id,
+				UserID:    userID,
 			})
 			cu.dbMutex.Unlock()
 			if err != nil {
-				slog.Error("Failed to update activity name", "error", err)
+				slog.Error("Failed to update activity summary", "error", err)
 				return err
 			}
 		}
 	}
 
+	// Add missing activities oldest first, so that the new ground each one
+	// computes for itself already covers the ones added before it. Only
+	// routes that were already stored and start after the oldest added one
+	// need to be recomputed afterwards.
+	slices.SortFunc(missing, func(a, b swagger.SummaryActivity) int {
+		return a.StartDate.Compare(b.StartDate)
+	})
+	for i, activity := range missing {
+		if err := ctx.Err(); err != nil {
+			slog.Info("Stopping activity sync", "userID", userID, "added", i, "missing", len(missing))
+			return err
+		}
+		// Can be a go-routine once rate limiting in concurrent calls is handled
+		if _, err := cu.AddDetailedActivity(activity.Id, userID); err != nil {
+			continue
+		}
+		if err := cu.ComputeNewGround(activity.Id); err != nil {
+			slog.Error("Failed to compute new ground", "activityID", activity.Id, "error", err)
+		}
+	}
+	// Every stored route now has the private flag of its summary, which share
+	// links rely on.
+	if err := cu.queries.MarkActivitiesSynced(context.Background(), userID); err != nil {
+		return err
+	}
+	if len(missing) > 0 && missing[0].StartDate.Before(latestExisting) {
+		return cu.RecomputeNewGroundSince(userID, pgtype.Timestamptz{Time: missing[0].StartDate, Valid: true})
+	}
+
 	return nil
 }
 
+// ComputeNewGround stores the new ground of a route, so it doesn't need to be
+// recomputed for tiles, route details or the Strava description.
+func (cu *CacheUpdater) ComputeNewGround(activityID int64) error {
+	cu.dbMutex.Lock()
+	defer cu.dbMutex.Unlock()
+	return cu.queries.UpsertRouteNewGround(context.Background(), activityID)
+}
+
+// RecomputeNewGroundSince recomputes the stored new ground of every route of
+// a user that started at or after since, or of all of them if since is NULL.
+func (cu *CacheUpdater) RecomputeNewGroundSince(userID int64, since pgtype.Timestamptz) error {
+	cu.dbMutex.Lock()
+	defer cu.dbMutex.Unlock()
+	return cu.queries.UpsertRouteNewGroundSince(context.Background(), db.UpsertRouteNewGroundSinceParams{
+		UserID: userID,
+		Since:  since,
+	})
+}
+
+// BackfillDescriptions fetches the detailed activity of every route of a user
+// with an empty description and stores its description, so that the route
+// search covers it. Activities whose Strava description is empty are fetched
+// again on every run, and ones that fail to fetch (e.g. deleted on Strava)
+// are skipped. It stops between activities once ctx is cancelled. It returns
+// the number of descriptions filled in.
+func (cu *CacheUpdater) BackfillDescriptions(ctx context.Context, userID int64) (int, error) {
+	ids, err := cu.queries.ListRouteIDsWithoutDescription(context.Background(), userID)
+	if err != nil {
+		return 0, err
+	}
+
+	filled, failed := 0, 0
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return filled, err
+		}
+		detailedActivity, err := cu.stravaAPI.GetDetailedActivityByID(id, userID)
+		if err != nil {
+			failed++
+			continue
+		}
+		if detailedActivity.Description == "" {
+			continue
+		}
+		cu.dbMutex.Lock()
+		err = cu.queries.UpdateRouteDescription(context.Background(), db.UpdateRouteDescriptionParams{
+			Description: detailedActivity.Description,
+			ID:          id,
+			UserID:      userID,
+		})
+		cu.dbMutex.Unlock()
+		if err != nil {
+			return filled, err
+		}
+		filled++
+	}
+	if failed > 0 {
+		return filled, fmt.Errorf("failed to fetch %d of %d activities", failed, len(ids))
+	}
+	return filled, nil
+}
+
 // AddDetailedActivity fetches detailed activity information for a given activity ID and athlete ID,
-// and adds it to the database.
-func (cu *CacheUpdater) AddDetailedActivity(activityID int64, athleteID int64) error {
+// and adds it to the database. Its new ground is left to the caller, with
+// ComputeNewGround: if the route is new or its geometry or start date changed,
+// recomputeSince is the start date from which the new ground of the routes
+// after it must be recomputed with RecomputeNewGroundSince.
+func (cu *CacheUpdater) AddDetailedActivity(activityID int64, athleteID int64) (recomputeSince pgtype.Timestamptz, err error) {
 	detailedActivity, err := cu.stravaAPI.GetDetailedActivityByID(activityID, athleteID)
 	if err != nil {
-		return err
+		return pgtype.Timestamptz{}, err
 	}
 
 	// Skip activities with empty polyline
 	if detailedActivity.Map_ == nil || detailedActivity.Map_.Polyline == "" {
 		slog.Info("Skipping activity with empty polyline", "activityID", activityID, "sportType", detailedActivity.SportType)
-		return nil
+		return pgtype.Timestamptz{}, nil
 	}
 
 	bounds, err := computeBounds([]byte(detailedActivity.Map_.Polyline))
 	if err != nil {
-		return err
+		return pgtype.Timestamptz{}, err
 	}
 
 	// Decode polyline to WKT geometry
@@ -127,11 +242,32 @@ func (cu *CacheUpdater) AddDetailedActivity(activityID int64, athleteID int64) e
 		wkt = &wktValue
 	}
 
+	startDate := pgtype.Timestamptz{Time: detailedActivity.StartDate, Valid: true}
+	var wktText pgtype.Text
+	if wkt != nil {
+		wktText = pgtype.Text{String: *wkt, Valid: true}
+	}
+	change, err := cu.queries.GetRouteGeometryChange(context.Background(), db.GetRouteGeometryChangeParams{
+		Wkt: wktText,
+		ID:  activityID,
+	})
+	switch {
+	case err == pgx.ErrNoRows:
+		recomputeSince = startDate
+	case err != nil:
+		return pgtype.Timestamptz{}, err
+	case change.GeomChanged || !change.StartDate.Time.Equal(startDate.Time):
+		recomputeSince = startDate
+		if change.StartDate.Time.Before(startDate.Time) {
+			recomputeSince = change.StartDate
+		}
+	}
+
 	cu.dbMutex.Lock()
 	err = cu.queries.UpsertRoute(context.Background(), db.UpsertRouteParams{
 		ID:             activityID,
 		UserID:         detailedActivity.Athlete.Id,
-		StartDate:      pgtype.Timestamptz{Time: detailedActivity.StartDate, Valid: true},
+		StartDate:      startDate,
 		Name:           detailedActivity.Name,
 		ElapsedTime:    detailedActivity.ElapsedTime,
 		MovingTime:     detailedActivity.MovingTime,
@@ -139,18 +275,24 @@ func (cu *CacheUpdater) AddDetailedActivity(activityID int64, athleteID int64) e
 		AverageSpeed:   float64(detailedActivity.AverageSpeed) * 3.6,
 		Elevation:      float64(detailedActivity.TotalElevationGain),
 		Bounds:         bounds,
+		SportType:      sportTypeText(detailedActivity.SportType),
+		Commute:        detailedActivity.Commute,
+		Trainer:        detailedActivity.Trainer,
+		StartDateLocal: pgtype.Timestamp{Time: detailedActivity.StartDateLocal, Valid: !detailedActivity.StartDateLocal.IsZero()},
+		Description:    detailedActivity.Description,
+		Private:        detailedActivity.Private,
 		StGeomfromtext: wkt,
 	})
 	cu.dbMutex.Unlock()
 	if err != nil {
-		return err
+		return pgtype.Timestamptz{}, err
 	}
 	slog.Info("Upserted activity in cache", "activityID", activityID, "userID", athleteID)
 
-	return nil
+	return recomputeSince, nil
 }
 
-// WriteUniqueDistanceDescription computes the unique distance for the activity and
+// WriteUniqueDistanceDescription reads the unique distance stored for the activity and
 // writes it back to the Strava activity description if the user has enabled the preference to do so.
 // Errors are logged but do not affect the sync result.
 func (cu *CacheUpdater) WriteUniqueDistanceDescription(activityID int64, athleteID int64) {
@@ -176,9 +318,9 @@ func (cu *CacheUpdater) WriteUniqueDistanceDescription(activityID int64, athlete
 		return
 	}
 
-	metres, err := cu.queries.GetRouteUniqueDistanceMeters(context.Background(), activityID)
+	metres, err := cu.queries.GetRouteNewGroundDistance(context.Background(), activityID)
 	if err != nil {
-		slog.Error("Failed to compute unique distance", "activityID", activityID, "error", err)
+		slog.Error("Failed to get unique distance", "activityID", activityID, "error", err)
 		return
 	}
 
@@ -188,6 +330,81 @@ func (cu *CacheUpdater) WriteUniqueDistanceDescription(activityID int64, athlete
 	}
 }
 
+// GetRouteStream returns the stored streams of a route, fetching and storing
+// them from Strava first if that hasn't happened yet. Fetching is skipped when
+// the rate limit is exhausted so callers never wait for it to reset; ok is
+// false if no streams are available.
+func (cu *CacheUpdater) GetRouteStream(ctx context.Context, routeID int64, athleteID int64) (stream db.RouteStream, ok bool, err error) {
+	stream, err = cu.queries.GetRouteStream(ctx, routeID)
+	if err == nil {
+		return stream, true, nil
+	}
+	if err != pgx.ErrNoRows {
+		return db.RouteStream{}, false, err
+	}
+
+	if cu.stravaAPI.RateLimit.IsRateLimitExceeded() != RateLimitNone {
+		return db.RouteStream{}, false, nil
+	}
+	streams, err := cu.stravaAPI.GetActivityStreams(routeID, athleteID)
+	if err != nil {
+		return db.RouteStream{}, false, err
+	}
+	if streams.Latlng == nil || streams.Time == nil || streams.Distance == nil {
+		return db.RouteStream{}, false, nil
+	}
+
+	n := len(streams.Latlng.Data)
+	if len(streams.Time.Data) != n || len(streams.Distance.Data) != n {
+		return db.RouteStream{}, false, fmt.Errorf("streams of route %d have different lengths", routeID)
+	}
+	stream = db.RouteStream{
+		RouteID:   routeID,
+		UserID:    athleteID,
+		TimeS:     streams.Time.Data,
+		DistanceM: make([]float64, n),
+		AltitudeM: []float64{},
+		Lat:       make([]float64, n),
+		Lng:       make([]float64, n),
+	}
+	for i, latlng := range streams.Latlng.Data {
+		stream.DistanceM[i] = float64(streams.Distance.Data[i])
+		stream.Lat[i] = float64(latlng.Lat)
+		stream.Lng[i] = float64(latlng.Lng)
+	}
+	if streams.Altitude != nil && len(streams.Altitude.Data) == n {
+		stream.AltitudeM = make([]float64, n)
+		for i, altitude := range streams.Altitude.Data {
+			stream.AltitudeM[i] = float64(altitude)
+		}
+	}
+
+	cu.dbMutex.Lock()
+	err = cu.queries.UpsertRouteStream(ctx, db.UpsertRouteStreamParams{
+		RouteID:   stream.RouteID,
+		UserID:    stream.UserID,
+		TimeS:     stream.TimeS,
+		DistanceM: stream.DistanceM,
+		AltitudeM: stream.AltitudeM,
+		Lat:       stream.Lat,
+		Lng:       stream.Lng,
+	})
+	cu.dbMutex.Unlock()
+	if err != nil {
+		return db.RouteStream{}, false, err
+	}
+	return stream, true, nil
+}
+
+// sportTypeText converts the sport type of an activity to the route's
+// sport_type, which is NULL if it is missing.
+func sportTypeText(sportType *swagger.SportType) pgtype.Text {
+	if sportType == nil {
+		return pgtype.Text{}
+	}
+	return pgtype.Text{String: string(*sportType), Valid: true}
+}
+
 func computeBounds(buf []byte) (string, error) {
 	coords, _, _ := polyline.DecodeCoords(buf)
 	if len(coords) == 0 {
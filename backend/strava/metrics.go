@@ -0,0 +1,45 @@
+package strava
+
+import (
+	"net/http"
+	"strconv"
+	"wanderwell/backend/metrics"
+)
+
+var stravaRequests = metrics.NewCounter("wanderwell_strava_requests_total",
+	"Strava API requests by endpoint and HTTP status (error if there was no response).", "endpoint", "status")
+
+// observeStravaRequest counts a request to a Strava API endpoint.
+func observeStravaRequest(endpoint string, resp *http.Response) {
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	stravaRequests.Inc(endpoint, status)
+}
+
+// registerMetrics exposes the quota usage of the last Strava response, for the
+// read and the overall quota, per 15 minute and daily window.
+func (rl *RateLimit) registerMetrics() {
+	collect := func(limits bool) func(set metrics.SetFunc) {
+		return func(set metrics.SetFunc) {
+			rl.mu.Lock()
+			defer rl.mu.Unlock()
+			if limits {
+				set(float64(rl.minuteReadRateLimit), "read", "15m")
+				set(float64(rl.dailyReadRateLimit), "read", "daily")
+				set(float64(rl.minuteRateLimit), "overall", "15m")
+				set(float64(rl.dailyRateLimit), "overall", "daily")
+			} else {
+				set(float64(rl.minuteReadRateLimitUsage), "read", "15m")
+				set(float64(rl.dailyReadRateLimitUsage), "read", "daily")
+				set(float64(rl.minuteRateLimitUsage), "overall", "15m")
+				set(float64(rl.dailyRateLimitUsage), "overall", "daily")
+			}
+		}
+	}
+	metrics.NewGaugeFunc("wanderwell_strava_rate_limit_usage",
+		"Strava API requests used of the quota, as of the last response.", []string{"quota", "window"}, collect(false))
+	metrics.NewGaugeFunc("wanderwell_strava_rate_limit",
+		"Strava API quota, as of the last response.", []string{"quota", "window"}, collect(true))
+}
@@ -24,15 +24,22 @@ type RateLimit struct {
 	minuteReadRateLimitUsage int
 	minuteResetTime          time.Time
 	dailyResetTime           time.Time
+	// Overall (read and write) quota, only tracked for the metrics
+	dailyRateLimit       int
+	dailyRateLimitUsage  int
+	minuteRateLimit      int
+	minuteRateLimitUsage int
 }
 
 func NewRateLimit() *RateLimit {
-	return &RateLimit{
+	rl := &RateLimit{
 		dailyReadRateLimit:       3000,
 		dailyReadRateLimitUsage:  0,
 		minuteReadRateLimit:      300,
 		minuteReadRateLimitUsage: 0,
 	}
+	rl.registerMetrics()
+	return rl
 }
 
 func (rl *RateLimit) UpdateRateLimit(resp *http.Response) {
@@ -47,6 +54,8 @@ func (rl *RateLimit) UpdateRateLimit(resp *http.Response) {
 
 	// fmt.Sscanf(readRateLimit, "%d,%d", &rl.minuteReadRateLimit, &rl.dailyReadRateLimit)
 	fmt.Sscanf(readRateLimitUsage, "%d,%d", &rl.minuteReadRateLimitUsage, &rl.dailyReadRateLimitUsage)
+	fmt.Sscanf(resp.Header.Get("X-RateLimit-Limit"), "%d,%d", &rl.minuteRateLimit, &rl.dailyRateLimit)
+	fmt.Sscanf(resp.Header.Get("X-RateLimit-Usage"), "%d,%d", &rl.minuteRateLimitUsage, &rl.dailyRateLimitUsage)
 
 	now := time.Now()
 	minute := now.Minute()
@@ -1,6 +1,7 @@
 package strava
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,6 +9,8 @@ import (
 	"strings"
 )
 
+const tokenURL = "https://www.strava.com/api/v3/oauth/token"
+
 type TokenResponse struct {
 	TokenType    string `json:"token_type"`
 	ExpiresAt    int64  `json:"expires_at"`
@@ -18,14 +21,12 @@ type TokenResponse struct {
 
 // RefreshToken updates the access credentials from the Strava API using a refresh token
 func refreshToken(refreshToken, clientID, clientSecret string) (*TokenResponse, error) {
-	url := "https://www.strava.com/api/v3/oauth/token"
-
 	payload := strings.NewReader(fmt.Sprintf(
 		"client_id=%s&client_secret=%s&refresh_token=%s&grant_type=refresh_token",
 		clientID, clientSecret, refreshToken,
 	))
 
-	req, err := http.NewRequest("POST", url, payload)
+	req, err := http.NewRequest("POST", tokenURL, payload)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -34,6 +35,7 @@ func refreshToken(refreshToken, clientID, clientSecret string) (*TokenResponse,
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
+	observeStravaRequest("oauth_token", resp)
 	if err != nil {
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
@@ -55,3 +57,18 @@ func refreshToken(refreshToken, clientID, clientSecret string) (*TokenResponse,
 
 	return &tokenResp, nil
 }
+
+// TokenEndpointReachable returns whether the Strava token endpoint answers at
+// all, which is needed to refresh access tokens. Any HTTP response counts.
+func TokenEndpointReachable(ctx context.Context) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, tokenURL, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return true
+}
@@ -0,0 +1,96 @@
+package tiles
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache is an in-memory LRU cache of rendered tiles, bounded by their total
+// size. Tiles are cached per user, so that all tiles of a user can be dropped
+// when their routes change, like the BAN requests of the Varnish tile cache.
+// It is safe for concurrent use.
+type Cache struct {
+	mu       sync.Mutex
+	maxBytes int
+	bytes    int
+	// Most recently used first
+	lru   *list.List
+	users map[int64]map[string]*list.Element
+}
+
+type cacheEntry struct {
+	userID int64
+	key    string
+	tile   []byte
+}
+
+func (e *cacheEntry) size() int {
+	return len(e.key) + len(e.tile)
+}
+
+// NewCache returns a cache that holds up to maxBytes of tiles.
+func NewCache(maxBytes int) *Cache {
+	return &Cache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		users:    make(map[int64]map[string]*list.Element),
+	}
+}
+
+// Get returns the cached tile of a user by its key, e.g. its path and query.
+func (c *Cache) Get(userID int64, key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.users[userID][key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry).tile, true
+}
+
+// Add caches a tile of a user, evicting the least recently used tiles of any
+// user as needed. Tiles larger than the whole cache are not cached.
+func (c *Cache) Add(userID int64, key string, tile []byte) {
+	entry := &cacheEntry{userID: userID, key: key, tile: tile}
+	if entry.size() > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.users[userID][key]; ok {
+		c.remove(element)
+	}
+	if c.users[userID] == nil {
+		c.users[userID] = make(map[string]*list.Element)
+	}
+	c.users[userID][key] = c.lru.PushFront(entry)
+	c.bytes += entry.size()
+
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// InvalidateUser drops all cached tiles of a user.
+func (c *Cache) InvalidateUser(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, element := range c.users[userID] {
+		c.remove(element)
+	}
+}
+
+// remove drops a tile; c.mu must be held.
+func (c *Cache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	c.bytes -= entry.size()
+	delete(c.users[entry.userID], entry.key)
+	if len(c.users[entry.userID]) == 0 {
+		delete(c.users, entry.userID)
+	}
+}
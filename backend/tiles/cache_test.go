@@ -0,0 +1,152 @@
+package tiles
+
+import (
+	"bytes"
+	"testing"
+)
+
+// checkBytes compares the accounted size of the cache with the size of the
+// tiles it holds and checks that the LRU list and the users index agree.
+func checkBytes(t *testing.T, c *Cache, want int) {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total, indexed := 0, 0
+	for element := c.lru.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*cacheEntry)
+		total += entry.size()
+		if c.users[entry.userID][entry.key] != element {
+			t.Errorf("tile %d %q is not indexed", entry.userID, entry.key)
+		}
+	}
+	for _, keys := range c.users {
+		indexed += len(keys)
+	}
+	if indexed != c.lru.Len() {
+		t.Errorf("%d tiles indexed, %d in the LRU list", indexed, c.lru.Len())
+	}
+	if c.bytes != total {
+		t.Errorf("bytes = %d, but the tiles take %d", c.bytes, total)
+	}
+	if c.bytes != want {
+		t.Errorf("bytes = %d, want %d", c.bytes, want)
+	}
+	if c.bytes > c.maxBytes {
+		t.Errorf("bytes = %d, more than maxBytes %d", c.bytes, c.maxBytes)
+	}
+}
+
+func checkCached(t *testing.T, c *Cache, userID int64, key string, want []byte) {
+	t.Helper()
+	tile, ok := c.Get(userID, key)
+	switch {
+	case want == nil && ok:
+		t.Errorf("Get(%d, %q) = %q, want no tile", userID, key, tile)
+	case want != nil && !ok:
+		t.Errorf("Get(%d, %q) = no tile, want %q", userID, key, want)
+	case !bytes.Equal(tile, want):
+		t.Errorf("Get(%d, %q) = %q, want %q", userID, key, tile, want)
+	}
+}
+
+func TestCacheByteAccounting(t *testing.T) {
+	c := NewCache(100)
+
+	c.Add(1, "a", []byte("0123456789"))
+	c.Add(2, "a", []byte("01234"))
+	checkBytes(t, c, 11+6)
+	checkCached(t, c, 1, "a", []byte("0123456789"))
+	checkCached(t, c, 2, "a", []byte("01234"))
+
+	// Replacing a tile accounts for its new size only.
+	c.Add(1, "a", []byte("012"))
+	checkBytes(t, c, 4+6)
+	checkCached(t, c, 1, "a", []byte("012"))
+
+	// The key counts, empty tiles are cached too.
+	c.Add(1, "long key", nil)
+	checkBytes(t, c, 4+6+8)
+	checkCached(t, c, 1, "long key", []byte{})
+
+	// Tiles larger than the cache are not cached and evict nothing.
+	c.Add(3, "a", make([]byte, 100))
+	checkBytes(t, c, 4+6+8)
+	checkCached(t, c, 3, "a", nil)
+
+	// A tile exactly as large as the cache evicts all others.
+	c.Add(3, "b", make([]byte, 99))
+	checkBytes(t, c, 100)
+	checkCached(t, c, 1, "a", nil)
+	checkCached(t, c, 2, "a", nil)
+	checkCached(t, c, 3, "b", make([]byte, 99))
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	// Room for three tiles of 10 bytes with their 2-byte keys.
+	c := NewCache(36)
+	c.Add(1, "t1", make([]byte, 10))
+	c.Add(2, "t2", make([]byte, 10))
+	c.Add(1, "t3", make([]byte, 10))
+	checkBytes(t, c, 36)
+
+	// Reading t1 makes t2 the least recently used.
+	checkCached(t, c, 1, "t1", make([]byte, 10))
+	c.Add(2, "t4", make([]byte, 10))
+	checkBytes(t, c, 36)
+	checkCached(t, c, 2, "t2", nil)
+
+	// Replacing t3 makes t1 the least recently used, and a larger tile
+	// evicts as many as needed.
+	c.Add(1, "t3", make([]byte, 10))
+	c.Add(3, "t5", make([]byte, 22))
+	checkBytes(t, c, 24+12)
+	checkCached(t, c, 1, "t1", nil)
+	checkCached(t, c, 2, "t4", nil)
+	checkCached(t, c, 1, "t3", make([]byte, 10))
+	checkCached(t, c, 3, "t5", make([]byte, 22))
+
+	// Users without tiles left are dropped from the index.
+	c.mu.Lock()
+	if _, ok := c.users[2]; ok {
+		t.Error("user 2 is still indexed without tiles")
+	}
+	c.mu.Unlock()
+}
+
+func TestCacheInvalidateUser(t *testing.T) {
+	c := NewCache(1000)
+	c.Add(1, "a", []byte("tile 1a"))
+	c.Add(1, "b", []byte("tile 1b"))
+	c.Add(2, "a", []byte("tile 2a"))
+	c.Add(2, "b", []byte("tile 2b"))
+
+	c.InvalidateUser(1)
+	checkBytes(t, c, 2*8)
+	checkCached(t, c, 1, "a", nil)
+	checkCached(t, c, 1, "b", nil)
+	checkCached(t, c, 2, "a", []byte("tile 2a"))
+	checkCached(t, c, 2, "b", []byte("tile 2b"))
+
+	// Invalidating a user without tiles is a no-op, and the user's tiles can
+	// be cached again.
+	c.InvalidateUser(1)
+	c.InvalidateUser(3)
+	c.Add(1, "a", []byte("new 1a"))
+	checkBytes(t, c, 2*8+7)
+	checkCached(t, c, 1, "a", []byte("new 1a"))
+
+	c.InvalidateUser(2)
+	c.InvalidateUser(1)
+	checkBytes(t, c, 0)
+	if c.lru.Len() != 0 || len(c.users) != 0 {
+		t.Errorf("cache holds %d tiles of %d users after invalidating all", c.lru.Len(), len(c.users))
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	c := NewCache(0)
+	c.Add(1, "a", []byte("tile"))
+	checkBytes(t, c, 0)
+	checkCached(t, c, 1, "a", nil)
+}
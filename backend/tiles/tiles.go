@@ -0,0 +1,52 @@
+package tiles
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"wanderwell/backend/db"
+)
+
+// Layers are the MVT functions of db/schema.sql that serve the tile layers,
+// by the name Martin serves them under as well.
+var Layers = []string{"user_routes", "user_explorer_tiles", "user_heatmap", "user_new_ground", "user_endpoints"}
+
+// MaxZoom is the highest zoom tiles are served for.
+const MaxZoom = 22
+
+// ValidTile returns whether z/x/y is a tile of the web mercator tile grid up to
+// MaxZoom.
+func ValidTile(z, x, y int) bool {
+	return z >= 0 && z <= MaxZoom && x >= 0 && y >= 0 && x < 1<<z && y < 1<<z
+}
+
+// Render calls the MVT function of a layer for tile z/x/y with the tile's query
+// params, like Martin does. It returns an empty tile where the function
+// returns NULL.
+func Render(ctx context.Context, queries *db.Queries, layer string, z, x, y int, params map[string]string) ([]byte, error) {
+	if !ValidTile(z, x, y) {
+		return nil, fmt.Errorf("invalid tile: %d/%d/%d", z, x, y)
+	}
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// The params of all the tile queries are alike.
+	z32, x32, y32 := int32(z), int32(x), int32(y)
+	switch layer {
+	case "user_routes":
+		return queries.GetUserRoutesTile(ctx, db.GetUserRoutesTileParams{Z: z32, X: x32, Y: y32, QueryParams: paramsJSON})
+	case "user_explorer_tiles":
+		return queries.GetUserExplorerTile(ctx, db.GetUserExplorerTileParams{Z: z32, X: x32, Y: y32, QueryParams: paramsJSON})
+	case "user_heatmap":
+		return queries.GetUserHeatmapTile(ctx, db.GetUserHeatmapTileParams{Z: z32, X: x32, Y: y32, QueryParams: paramsJSON})
+	case "user_new_ground":
+		return queries.GetUserNewGroundTile(ctx, db.GetUserNewGroundTileParams{Z: z32, X: x32, Y: y32, QueryParams: paramsJSON})
+	case "user_endpoints":
+		return queries.GetUserEndpointsTile(ctx, db.GetUserEndpointsTileParams{Z: z32, X: x32, Y: y32, QueryParams: paramsJSON})
+	default:
+		return nil, fmt.Errorf("unknown layer: %q", layer)
+	}
+}